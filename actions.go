@@ -6,12 +6,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/urfave/cli/v2"
+	"golang.org/x/text/language"
 )
 
 // errorFromSlice converts the slice of strings into a single multi-line string
@@ -43,79 +49,1952 @@ func checkMultiArgs(c *cli.Context) error {
 	return nil
 }
 
+// checkTrackType returns an error if ttype is not one of the allowed track
+// types.
+func checkTrackType(ttype string, allowed ...string) error {
+	for _, a := range allowed {
+		if ttype == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid track type %q (valid: %s)", ttype, strings.Join(allowed, ", "))
+}
+
+// inputFiles returns the files in the command line, sorted according to the
+// --sort-files global flag. Files already processed according to the state
+// file (--state-file) are removed.
+func inputFiles(c *cli.Context) ([]string, error) {
+	fnames, err := sortFiles(c.Args().Slice(), c.String("sort-files"))
+	if err != nil {
+		return nil, err
+	}
+	return state.pending(fnames), nil
+}
+
+// confirmBatch asks for confirmation (see confirm) before an in-place
+// operation on more than --confirm-threshold files.
+func confirmBatch(c *cli.Context, verb string, nfiles int) error {
+	if nfiles <= c.Int("confirm-threshold") {
+		return nil
+	}
+	return confirm(verb, nfiles, c.Bool("assume-yes") || c.Bool("dry-run"))
+}
+
+// requireTools returns a function that checks if the given 3rd party tools
+// are installed. Used as the "Before" function in commands, so each command
+// only requires the tools it actually uses.
+func requireTools(tools ...string) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		if noExternalTools && len(tools) != 0 {
+			return fmt.Errorf("this command requires %s (not allowed with --no-external-tools)", strings.Join(tools, ", "))
+		}
+		if err := requirements(tools...); err != nil {
+			return fmt.Errorf("requirements check: %v", err)
+		}
+		return nil
+	}
+}
+
+// requireParser works like requireTools, for commands that only need mkvmerge
+// to parse files. mkvmerge is not required with the native parse backend.
+func requireParser(tools ...string) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		required := tools
+		if parseBackend == backendMkvmerge {
+			required = append([]string{"mkvmerge"}, tools...)
+		}
+		return requireTools(required...)(c)
+	}
+}
+
+// requireToolsIf works like requireTools, also requiring the tools in extra
+// when the boolean flag is set (for flags that use other tools).
+func requireToolsIf(flag string, extra []string, tools ...string) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		required := tools
+		if c.Bool(flag) {
+			required = append(append([]string{}, tools...), extra...)
+		}
+		return requireTools(required...)(c)
+	}
+}
+
+// hookCmdline returns the command line for the post-processing hook. The
+// string "{}" in the hook is replaced by the filename. If not present, the
+// filename is appended to the command. Returns nil for blank hooks.
+func hookCmdline(hook, fname string) []string {
+	fields := strings.Fields(hook)
+	if len(fields) == 0 {
+		return nil
+	}
+	var ret []string
+	found := false
+	for _, f := range fields {
+		if strings.Contains(f, "{}") {
+			found = true
+			f = strings.ReplaceAll(f, "{}", fname)
+		}
+		ret = append(ret, f)
+	}
+	if !found {
+		ret = append(ret, fname)
+	}
+	return ret
+}
+
+// checkPlan returns an error when exporting a plan (--export-plan) for a
+// command with steps that don't run external commands (like renaming files),
+// as running the plan would not reproduce them.
+func checkPlan(c *cli.Context, what string) error {
+	if c.String("export-plan") == "" {
+		return nil
+	}
+	return fmt.Errorf("%w for %s: files are renamed directly, not by external commands", errPlanUnsupported, what)
+}
+
+// postHook runs the post-processing hook command (--post-hook) for fname, if
+// set. Should only be called after a successful operation on the file.
+func postHook(c *cli.Context, fname string) error {
+	hook := c.String("post-hook")
+	if hook == "" {
+		return nil
+	}
+	run := *runnerFromContext(c.Context)
+	cmdline := hookCmdline(hook, fname)
+	if len(cmdline) == 0 {
+		return errors.New("post-hook: blank command")
+	}
+	if err := run.run(cmdline[0], cmdline[1:]...); err != nil {
+		return fmt.Errorf("post-hook: %v", err)
+	}
+	return nil
+}
+
+// showResult re-identifies fname after an in-place edit and prints the given
+// fields of the affected tracks (see editResult), when --show-result is set.
+// This shows the values as stored in the file, confirming that the edit
+// reached the intended tracks. Nothing is shown in dry-run mode, as the file
+// has not been changed.
+func showResult(c *cli.Context, fname, ttype string, ids []int, fields ...string) error {
+	if !c.Bool("show-result") || c.Bool("dry-run") {
+		return nil
+	}
+	cacheInvalidate(fname)
+	mkv, err := parseFile(fname)
+	if err != nil {
+		return fmt.Errorf("show-result: %v", err)
+	}
+	for _, line := range editResult(mkv, ttype, ids, fields...) {
+		fmt.Printf("%s: %s\n", fname, line)
+	}
+	return nil
+}
+
+// jsonLine writes v to w as a single line of JSON (JSON Lines format).
+func jsonLine(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// errString returns the error message, or an empty string if err is nil.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
 func runnerFromContext(ctx context.Context) *runner {
 	ret, ok := ctx.Value(runnerKey).(*runner)
 	if !ok {
 		panic("internal error: Unable to retrieve runner from context.")
 	}
-	return ret
+	return ret
+}
+
+// titleFromContext returns the container title to be used for fname. The
+// title is only generated (by parsing the filename with the default title
+// mask) when --title-from-filename is set. Otherwise, an empty string is
+// returned.
+func titleFromContext(c *cli.Context, fname string) (string, error) {
+	if !c.Bool("title-from-filename") {
+		return "", nil
+	}
+	fopts, err := formatOptionsFromContext(c)
+	if err != nil {
+		return "", err
+	}
+	title, err := format(defaultTitleMask, fname, fopts)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate title from %q: %v", fname, err)
+	}
+	return title, nil
+}
+
+// remuxOptionsFromContext returns the remux options from the command line
+// flags common to merge and remux. The tags and image subtitle tracks
+// dropped from each input file are reported.
+func remuxOptionsFromContext(c *cli.Context, infiles []string, title string) (remuxOptions, error) {
+	opts := remuxOptions{
+		title:                title,
+		subs:                 true,
+		noTrackTags:          c.Bool("no-track-tags"),
+		noGlobalTags:         c.Bool("no-global-tags"),
+		excludeAudio:         map[string][]int{},
+		excludeSubs:          map[string][]int{},
+		subCharsets:          map[string]string{},
+		chaptersNameTemplate: c.String("generate-chapters-name-template"),
+	}
+	if s := c.String("generate-chapters"); s != "" {
+		interval, err := parseChapterInterval(s)
+		if err != nil {
+			return remuxOptions{}, err
+		}
+		opts.chapterInterval = interval
+	}
+	if opts.chaptersNameTemplate != "" && opts.chapterInterval == 0 {
+		return remuxOptions{}, errors.New("--generate-chapters-name-template requires --generate-chapters")
+	}
+	textSubsOnly := c.Bool("text-subs-only")
+	maxAudioChannels := c.Int("max-audio-channels")
+	if maxAudioChannels < 0 {
+		return remuxOptions{}, fmt.Errorf("invalid maximum number of audio channels: %d", maxAudioChannels)
+	}
+	if !opts.noTrackTags && !opts.noGlobalTags && !textSubsOnly && maxAudioChannels == 0 {
+		return opts, nil
+	}
+	// Audio tracks in all inputs, and how many of them are dropped.
+	naudio, ndropped := 0, 0
+	for _, fname := range infiles {
+		mkv := mustParseFile(fname)
+		global, track := tagEntries(mkv)
+		if opts.noGlobalTags {
+			fmt.Printf("%s: Dropping %d global tag entries.\n", fname, global)
+		}
+		if opts.noTrackTags {
+			fmt.Printf("%s: Dropping %d track tag entries.\n", fname, track)
+		}
+		if textSubsOnly {
+			opts.excludeSubs[fname] = imageSubTracks(mkv)
+			for _, id := range opts.excludeSubs[fname] {
+				fmt.Printf("%s: Dropping image subtitle track %d.\n", fname, id)
+			}
+		}
+		if maxAudioChannels > 0 {
+			for _, track := range mkv.Tracks {
+				if track.Type != typeAudio {
+					continue
+				}
+				naudio++
+				if track.Properties.AudioChannels > maxAudioChannels {
+					ndropped++
+					opts.excludeAudio[fname] = append(opts.excludeAudio[fname], track.ID)
+					fmt.Printf("%s: Dropping audio track %d (%d channels).\n", fname, track.ID, track.Properties.AudioChannels)
+				}
+			}
+		}
+	}
+	// Inputs without audio after the filter are fine, as long as the output
+	// keeps some audio track from another input.
+	if naudio != 0 && ndropped == naudio {
+		return remuxOptions{}, fmt.Errorf("all audio tracks have more than %d channels", maxAudioChannels)
+	}
+	return opts, nil
+}
+
+// chaptersFromContext handles --chapters-from, setting the remux options to
+// replace the chapters of the input files with the chapters of the reference
+// file. Returns the name of the temporary chapters file (to be removed by the
+// caller), or an empty string if the flag is not set.
+func chaptersFromContext(c *cli.Context, opts *remuxOptions, run runner) (string, error) {
+	src := c.String("chapters-from")
+	if src == "" {
+		return "", nil
+	}
+	if opts.chapters != "" || opts.chapterInterval != 0 {
+		return "", errors.New("--chapters-from cannot be used with --chapters or --generate-chapters")
+	}
+	if len(readable([]string{src})) == 0 {
+		return "", fmt.Errorf("unable to read chapters source file %q", src)
+	}
+	if err := requirements("mkvextract"); err != nil {
+		return "", err
+	}
+	fname, err := chaptersFrom(src, run)
+	if err != nil {
+		return "", err
+	}
+	infof("Using the chapters from %s", src)
+	opts.chapters = fname
+	opts.noChapters = true
+	return fname, nil
+}
+
+func actionDefaultsReport(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+	opts := showOptions{
+		preferredAudio: c.StringSlice("preferred-audio"),
+		preferredSubs:  c.StringSlice("preferred-subs"),
+	}
+	if len(opts.preferredAudio) == 0 && len(opts.preferredSubs) == 0 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("use --preferred-audio and/or --preferred-subs to set the policy")
+	}
+
+	fnames, errmsgs := walkFiles(c.Args().Slice(), c.Int("max-depth"))
+	fnames, err := sortFiles(fnames, c.String("sort-files"))
+	if err != nil {
+		return err
+	}
+
+	var report defaultsReport
+	for _, fname := range fnames {
+		mkv, err := parseFile(fname)
+		if err != nil {
+			report.add(defaultsFile{File: fname, Error: err.Error()})
+			continue
+		}
+		report.add(fileDefaults(mkv, opts))
+	}
+
+	if c.Bool("json") {
+		if err := report.writeJSON(os.Stdout); err != nil {
+			return err
+		}
+	} else {
+		report.writeTable(os.Stdout)
+	}
+	if report.Summary.Errors != 0 {
+		errmsgs = append(errmsgs, fmt.Sprintf("%d of %d file(s) failed to parse", report.Summary.Errors, report.Summary.Files))
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionFindDefaultMismatch(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+
+	ttype := c.String("type")
+	if err := checkTrackType(ttype, typeSubtitle, typeAudio); err != nil {
+		return err
+	}
+
+	fnames, errmsgs := walkFiles(c.Args().Slice(), c.Int("max-depth"))
+	fnames, err := sortFiles(fnames, c.String("sort-files"))
+	if err != nil {
+		return err
+	}
+
+	mismatches := 0
+
+	for _, fname := range fnames {
+		mkv, err := parseFile(fname)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if current, ok := defaultMismatch(mkv, ttype, c.StringSlice("lang")); ok {
+			fmt.Printf("MISMATCH: %s (%s)\n", fname, current)
+			mismatches++
+		}
+	}
+	if mismatches != 0 {
+		errmsgs = append(errmsgs, fmt.Sprintf("%d of %d file(s) have a default %s track in a non-preferred language", mismatches, len(fnames), ttype))
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionFindUnsupportedCodecs(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+
+	fnames, errmsgs := walkFiles(c.Args().Slice(), c.Int("max-depth"))
+	fnames, err := sortFiles(fnames, c.String("sort-files"))
+	if err != nil {
+		return err
+	}
+
+	found := 0
+
+	for _, fname := range fnames {
+		mkv, err := parseFile(fname)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		tracks := unsupportedTracks(mkv, c.StringSlice("codec"))
+		if len(tracks) == 0 {
+			continue
+		}
+		found++
+		if c.Bool("json-lines") {
+			r := struct {
+				File   string             `json:"file"`
+				Tracks []unsupportedTrack `json:"tracks"`
+			}{fname, tracks}
+			if err := jsonLine(os.Stdout, r); err != nil {
+				return err
+			}
+			continue
+		}
+		var s []string
+		for _, t := range tracks {
+			s = append(s, fmt.Sprintf("track %d (%s, %s)", t.ID, t.Type, t.CodecID))
+		}
+		fmt.Printf("UNSUPPORTED: %s: %s\n", fname, strings.Join(s, ", "))
+	}
+	if found != 0 {
+		errmsgs = append(errmsgs, fmt.Sprintf("%d of %d file(s) have tracks with unsupported codecs", found, len(fnames)))
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionGet(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("need exactly one input file")
+	}
+	mkv, err := parseFile(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	v, err := getField(mkv, c.String("field"))
+	if err != nil {
+		return err
+	}
+	fmt.Println(v)
+	return nil
+}
+
+func actionHarmonize(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, errmsgs := walkFiles(c.Args().Slice(), c.Int("max-depth"))
+	fnames, err := sortFiles(readable(fnames), c.String("sort-files"))
+	if err != nil {
+		return err
+	}
+
+	var mkvs []matroska
+	for _, fname := range fnames {
+		mkvs = append(mkvs, mustParseFile(fname))
+	}
+	majority, changes, err := harmonizeDefaults(mkvs)
+	if majority == "" {
+		if err != nil {
+			errmsgs = append(errmsgs, err.Error())
+		}
+		return errorFromSlice(errmsgs)
+	}
+	if err != nil {
+		errmsgs = append(errmsgs, err.Error())
+	}
+	fmt.Printf("Majority default subtitle language: %s (%d of %d files need changes)\n", majority, len(changes), len(mkvs))
+	if len(changes) != 0 {
+		if err := confirmBatch(c, "change the default subtitle track of", len(changes)); err != nil {
+			return err
+		}
+	}
+
+	for _, ch := range changes {
+		fname := ch.mkv.FileName
+		fmt.Printf("%s: default subtitle %s => %s (track %d)\n", fname, ch.from, majority, ch.track)
+		if err := setdefault(ch.mkv, ch.track, run); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := showResult(c, fname, typeSubtitle, nil, "default"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionInfo(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	errmsgs := processFiles(os.Stdout, readable(fnames), c.Int("jobs"), func(w io.Writer, fname string) error {
+		mkv, err := parseFile(fname)
+		if err != nil {
+			return err
+		}
+		info := newFileInfo(mkv)
+		if !c.Bool("json") {
+			fmt.Fprintln(w, info)
+			return nil
+		}
+		s, err := info.JSON()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, s)
+		return nil
+	})
+	return errorFromSlice(errmsgs)
+}
+
+func actionKeepAudio(c *cli.Context) error {
+	if err := checkTwoArgs(c); err != nil {
+		return err
+	}
+
+	if len(c.StringSlice("lang")) == 0 && c.Int("max-channels") <= 0 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("use --lang and/or --max-channels to select the audio tracks to keep")
+	}
+
+	infile := c.Args().Get(0)
+	outfile := c.Args().Get(1)
+	run := *runnerFromContext(c.Context)
+
+	mkv := mustParseFile(infile)
+	if err := keepAudioByLanguage(mkv, outfile, c.StringSlice("lang"), c.Int("max-channels"), c.Bool("force"), run); err != nil {
+		return err
+	}
+	return postHook(c, outfile)
+}
+
+func actionChapterNames(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+
+	opts := chapterNamesOptions{
+		template: c.String("template"),
+		all:      c.Bool("all"),
+		dryrun:   c.Bool("dry-run"),
+	}
+	if c.String("names-file") != "" {
+		names, err := readChapterNames(c.String("names-file"))
+		if err != nil {
+			return err
+		}
+		opts.names = names
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "rename the chapters of", len(fnames)); err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	for _, fname := range fnames {
+		mkv := mustParseFile(fname)
+		renamed, err := chapterNames(mkv, opts, run)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		fmt.Printf("%s: Renamed %d chapter(s).\n", fname, renamed)
+		if renamed == 0 {
+			state.markDone(fname)
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionDisableByLang(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+	ttype := c.String("type")
+	if ttype != "" {
+		if err := checkTrackType(ttype, typeAudio, typeSubtitle); err != nil {
+			return err
+		}
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "disable tracks in", len(fnames)); err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	for _, fname := range fnames {
+		mkv := mustParseFile(fname)
+		disabled, err := disableByLanguage(mkv, c.StringSlice("lang"), ttype, c.Bool("force"), run)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		for _, id := range disabled {
+			fmt.Printf("%s: Track %d disabled.\n", fname, id)
+		}
+		if len(disabled) == 0 {
+			state.markDone(fname)
+			continue
+		}
+		if err := showResult(c, fname, "", disabled, "language", "enabled"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
+	}
+	return errorFromSlice(errmsgs)
+}
+
+// actionExtractTrack returns the action for extract-audio and extract-video,
+// extracting a track of type ttype.
+func actionExtractTrack(ttype string) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		if c.Args().Len() < 1 || c.Args().Len() > 2 {
+			cli.ShowCommandHelp(c, c.Command.Name)
+			return errors.New("need an input file (and optional output file)")
+		}
+		infile := c.Args().Get(0)
+		run := *runnerFromContext(c.Context)
+
+		tracknum := -1
+		if c.IsSet("track") {
+			tracknum = c.Int("track")
+		}
+		mkv := mustParseFile(infile)
+		outfile, err := extractTrack(mkv, ttype, tracknum, c.Args().Get(1), run)
+		if err != nil {
+			return fmt.Errorf("%s: %v", infile, err)
+		}
+		fmt.Printf("%s => %s\n", infile, outfile)
+		return postHook(c, outfile)
+	}
+}
+
+func actionExtractSubs(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+
+	opts := extractSubsOptions{
+		format:      strings.ToLower(c.String("format")),
+		outdir:      c.String("output-dir"),
+		sidecar:     c.Bool("sidecar"),
+		ocrCommand:  c.String("ocr-command"),
+		strictCodec: c.Bool("strict-codec"),
+		dryrun:      c.Bool("dry-run"),
+	}
+	if opts.format != subFormatSRT && opts.format != subFormatASS && opts.format != subFormatNative {
+		return fmt.Errorf("invalid output format %q (valid: %s, %s, %s)", c.String("format"), subFormatSRT, subFormatASS, subFormatNative)
+	}
+	if c.IsSet("ocr-command") && strings.TrimSpace(opts.ocrCommand) == "" {
+		return errors.New("--ocr-command cannot be blank")
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	for _, fname := range readable(fnames) {
+		mkv := mustParseFile(fname)
+		created, err := extractSubs(mkv, opts, run)
+		failed := err != nil
+		for _, f := range created {
+			fmt.Printf("%s => %s\n", fname, f)
+			if err := postHook(c, f); err != nil {
+				errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", f, err))
+				failed = true
+			}
+		}
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+		}
+		if !failed {
+			state.markDone(fname)
+		}
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionLabelTracks(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+	template := c.String("name-template")
+	if err := checkLabelTemplate(template); err != nil {
+		return err
+	}
+	ttype := c.String("type")
+	if ttype != "" {
+		if err := checkTrackType(ttype, typeVideo, typeAudio, typeSubtitle); err != nil {
+			return err
+		}
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "rename tracks in", len(fnames)); err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	for _, fname := range fnames {
+		mkv := mustParseFile(fname)
+		changes, err := labelTracks(mkv, template, ttype, run)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		for _, change := range changes {
+			fmt.Printf("%s: %s\n", fname, change)
+		}
+		if len(changes) == 0 {
+			state.markDone(fname)
+			continue
+		}
+		if err := showResult(c, fname, ttype, nil, "name"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionLanguages(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+
+	fnames, errmsgs := walkFiles(c.Args().Slice(), c.Int("max-depth"))
+	fnames, err := sortFiles(fnames, c.String("sort-files"))
+	if err != nil {
+		return err
+	}
+
+	inv := newLanguageInventory()
+	for _, fname := range fnames {
+		mkv, err := parseFile(fname)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		inv.add(mkv)
+	}
+	for _, line := range inv.lines(c.Bool("counts"), c.Bool("missing")) {
+		fmt.Println(line)
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionListCodecs(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+	ttype := c.String("type")
+	if ttype != "" {
+		if err := checkTrackType(ttype, typeVideo, typeAudio, typeSubtitle); err != nil {
+			return err
+		}
+	}
+
+	fnames, errmsgs := walkFiles(c.Args().Slice(), c.Int("max-depth"))
+	fnames, err := sortFiles(fnames, c.String("sort-files"))
+	if err != nil {
+		return err
+	}
+
+	h := newCodecHistogram(ttype)
+	for _, fname := range fnames {
+		mkv, err := parseFile(fname)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		h.add(mkv)
+	}
+	h.writeTable(os.Stdout)
+	return errorFromSlice(errmsgs)
+}
+
+func actionMerge(c *cli.Context) error {
+	run := *runnerFromContext(c.Context)
+
+	if c.String("plan") != "" {
+		if c.String("copy-attachments-from") != "" {
+			return errors.New("--copy-attachments-from cannot be used with --plan")
+		}
+		if c.Bool("merge-report") {
+			return errors.New("--merge-report cannot be used with --plan")
+		}
+		output, err := mergePlan(c.String("plan"), c.String("output"), run)
+		if err != nil {
+			return err
+		}
+		return postHook(c, output)
+	}
+	if c.String("output") == "" {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("need an output file (or a mux plan)")
+	}
+	title, err := titleFromContext(c, c.String("output"))
+	if err != nil {
+		return err
+	}
+	opts, err := remuxOptionsFromContext(c, c.Args().Slice(), title)
+	if err != nil {
+		return err
+	}
+	opts.subs = c.Bool("subs")
+	opts.chapters = c.String("chapters")
+	opts.chapterLanguage = c.String("chapter-language")
+	if opts.chapters != "" && len(readable([]string{opts.chapters})) == 0 {
+		return fmt.Errorf("unable to read chapters file %q", opts.chapters)
+	}
+	if opts.chapters != "" && opts.chapterInterval != 0 {
+		return errors.New("--chapters and --generate-chapters cannot be used together")
+	}
+	tmpChapters, err := chaptersFromContext(c, &opts, run)
+	if err != nil {
+		return err
+	}
+	if tmpChapters != "" {
+		defer removeTemp(tmpChapters)
+	}
+	// Character set of external text subtitles: --sub-charset overrides the
+	// detection (from the BOM). Files without a BOM are left to mkvmerge.
+	for _, fname := range c.Args().Slice() {
+		if !isTextSubFile(fname) {
+			continue
+		}
+		cs := c.String("sub-charset")
+		if cs == "" {
+			if cs, err = subCharset(fname); err != nil {
+				return err
+			}
+		}
+		if cs != "" {
+			debugf("%s: using subtitle charset %s", fname, cs)
+			opts.subCharsets[fname] = cs
+		}
+	}
+	if c.Bool("dedupe-attachments") {
+		var mkvs []matroska
+		for _, fname := range c.Args().Slice() {
+			mkvs = append(mkvs, mustParseFile(fname))
+		}
+		if opts.excludeAttachments, err = duplicateAttachments(mkvs, extractionRunner(run)); err != nil {
+			return fmt.Errorf("error finding duplicate attachments: %v", err)
+		}
+		for _, fname := range c.Args().Slice() {
+			if n := len(opts.excludeAttachments[fname]); n != 0 {
+				fmt.Printf("%s: Dropping %d duplicate attachments.\n", fname, n)
+			}
+		}
+	}
+	if src := c.String("copy-attachments-from"); src != "" {
+		if len(readable([]string{src})) == 0 {
+			return fmt.Errorf("unable to read attachments file %q", src)
+		}
+		mkv, err := parseFile(src)
+		if err != nil {
+			return err
+		}
+		if len(mkv.Attachments) == 0 {
+			return fmt.Errorf("%s: file has no attachments", src)
+		}
+		opts.attachmentsFrom = src
+		for _, a := range mkv.Attachments {
+			opts.attachments = append(opts.attachments, a.ID)
+			infof("Copying attachment %q (%s) from %s", a.FileName, a.ContentType, src)
+		}
+	}
+	// Parse the inputs before muxing, so the report reflects the tracks
+	// selected above.
+	var sources []mergeSource
+	if c.Bool("merge-report") {
+		var mkvs []matroska
+		for _, fname := range c.Args().Slice() {
+			mkv, err := parseFile(fname)
+			if err != nil {
+				return fmt.Errorf("%s: %v", fname, err)
+			}
+			mkvs = append(mkvs, mkv)
+		}
+		sources = mergeSources(mkvs, opts)
+	}
+	if err := remux(c.Args().Slice(), c.String("output"), opts, run); err != nil {
+		return err
+	}
+	if c.Bool("merge-report") {
+		writeMergeReport(os.Stdout, sources)
+	}
+	return postHook(c, c.String("output"))
+}
+
+func actionNormalizeLanguages(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "normalize the track languages of", len(fnames)); err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	for _, fname := range fnames {
+		mkv := mustParseFile(fname)
+		changes, err := normalizeLanguages(mkv, run)
+		for _, change := range changes {
+			fmt.Printf("%s: %s\n", fname, change)
+		}
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+		}
+		if len(changes) == 0 {
+			state.markDone(fname)
+			continue
+		}
+		if err := showResult(c, fname, "", nil, "language"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionOnly(c *cli.Context) error {
+	if err := checkTwoArgs(c); err != nil {
+		return err
+	}
+
+	infile := c.Args().Get(0)
+	outfile := c.Args().Get(1)
+
+	run := *runnerFromContext(c.Context)
+
+	// No confirmation needed: the input file is not changed.
+	mkv := mustParseFile(infile)
+
+	if c.Bool("interactive") {
+		tracks, err := selectTracks(mkv)
+		if err != nil {
+			return err
+		}
+		if err := keepTracks(mkv, outfile, tracks, c.Bool("force"), run); err != nil {
+			return err
+		}
+		return postHook(c, outfile)
+	}
+
+	if !c.IsSet("track") {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("need a track number (or --interactive)")
+	}
+	tfi, err := extract(mkv, c.Int("track"), run)
+	defer removeTemp(tfi.fname)
+	if err != nil {
+		return fmt.Errorf("%s: %v", infile, err)
+	}
+	tfi.name = c.String("track-name")
+	if err := submux(infile, outfile, true, run, tfi); err != nil {
+		return err
+	}
+	return postHook(c, outfile)
+}
+
+// formatOptionsFromContext returns the formatting options from the command
+// line flags.
+func formatOptionsFromContext(c *cli.Context) (formatOptions, error) {
+	tag, err := language.Parse(c.String("title-locale"))
+	if err != nil {
+		return formatOptions{}, fmt.Errorf("invalid title locale %q: %v", c.String("title-locale"), err)
+	}
+	return formatOptions{
+		titleLocale: tag,
+		smallWords:  c.Bool("small-words"),
+		normalize:   c.Bool("normalize"),
+		provider:    metadataSource,
+	}, nil
+}
+
+// maskList holds the formatting masks given with print --format. Unlike
+// cli.StringSliceFlag, values are not split on commas, as masks may contain
+// them. The default masks are replaced by the first value set.
+type maskList struct {
+	masks []string
+	set   bool
+}
+
+// maskListSerialized prefixes the serialized form of a maskList. The NUL
+// character can't appear in command line arguments.
+const maskListSerialized = "\x00masks:"
+
+// Set adds a mask to the list, or replaces the list with a serialized list
+// (used by the cli package to copy the value to the flag aliases).
+func (m *maskList) Set(value string) error {
+	if strings.HasPrefix(value, maskListSerialized) {
+		m.set = true
+		return json.Unmarshal([]byte(strings.TrimPrefix(value, maskListSerialized)), &m.masks)
+	}
+	if !m.set {
+		m.masks = nil
+		m.set = true
+	}
+	m.masks = append(m.masks, value)
+	return nil
+}
+
+// Serialize returns the list in a form accepted by Set.
+func (m *maskList) Serialize() string {
+	data, _ := json.Marshal(m.masks)
+	return maskListSerialized + string(data)
+}
+
+// String returns the masks, for the help output.
+func (m *maskList) String() string {
+	if m == nil {
+		return ""
+	}
+	return strings.Join(m.masks, " ")
+}
+
+// reportUnresolved prints the report of unresolved mask tokens (if not empty)
+// and returns a summary error message.
+func reportUnresolved(report unresolvedReport) []string {
+	if len(report) == 0 {
+		return nil
+	}
+	report.print()
+	return []string{fmt.Sprintf("%d file(s) with unresolved tokens", report.files())}
+}
+
+func actionPrint(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+
+	fopts, err := formatOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	report := unresolvedReport{}
+
+	// Multiple masks produce tab separated columns. When reporting unresolved
+	// tokens, each column is handled separately: columns with unresolved
+	// tokens are left empty, and the file is only skipped if no column could
+	// be resolved.
+	masks := c.Generic("format").(*maskList).masks
+
+	errmsgs := processFiles(os.Stdout, fnames, c.Int("jobs"), func(w io.Writer, fname string) error {
+		columns := make([]string, len(masks))
+		var ferrs []error
+		for i, mask := range masks {
+			output, err := format(mask, fname, fopts)
+			if err != nil {
+				if !c.Bool("report-unresolved") {
+					return err
+				}
+				ferrs = append(ferrs, err)
+				continue
+			}
+			columns[i] = output
+		}
+		// Errors for the same file are added together, so the report
+		// lists the file once per token (see unresolvedReport.add).
+		var failed error
+		mu.Lock()
+		for _, err := range ferrs {
+			if !report.add(fname, err) {
+				failed = err
+				break
+			}
+		}
+		mu.Unlock()
+		if failed != nil {
+			return failed
+		}
+		if len(ferrs) == len(masks) {
+			return nil
+		}
+		fmt.Fprintln(w, strings.Join(columns, "\t"))
+		return nil
+	})
+	return errorFromSlice(append(errmsgs, reportUnresolved(report)...))
+}
+
+func actionProbe(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+
+	fnames, errmsgs := walkFiles(c.Args().Slice(), c.Int("max-depth"))
+	fnames, err := sortFiles(fnames, c.String("sort-files"))
+	if err != nil {
+		return err
+	}
+
+	// In JSON Lines mode, results are emitted as each file is processed and
+	// errors are only counted, so memory use does not grow with the number
+	// of files.
+	if c.Bool("json-lines") {
+		failures := 0
+		for _, fname := range fnames {
+			mkv, err := parseFile(fname)
+			if err != nil {
+				failures++
+			}
+			r := struct {
+				File   string `json:"file"`
+				Tracks int    `json:"tracks"`
+				Error  string `json:"error,omitempty"`
+			}{fname, len(mkv.Tracks), errString(err)}
+			if err := jsonLine(os.Stdout, r); err != nil {
+				return err
+			}
+		}
+		if failures != 0 {
+			errmsgs = append(errmsgs, fmt.Sprintf("%d of %d file(s) failed to parse", failures, len(fnames)))
+		}
+		return errorFromSlice(errmsgs)
+	}
+
+	for _, fname := range fnames {
+		if _, err := parseFile(fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+		}
+	}
+	fmt.Printf("Processed %d file(s), %d failure(s).\n", len(fnames), len(errmsgs))
+	return errorFromSlice(errmsgs)
+}
+
+func actionRemux(c *cli.Context) error {
+	if err := checkTwoArgs(c); err != nil {
+		return err
+	}
+
+	infile := c.Args().Get(0)
+	outfile := c.Args().Get(1)
+	run := *runnerFromContext(c.Context)
+
+	if state.isDone(infile) {
+		infof("%s: Already processed according to the state file, skipping.", infile)
+		return nil
+	}
+
+	title, err := titleFromContext(c, outfile)
+	if err != nil {
+		return err
+	}
+	opts, err := remuxOptionsFromContext(c, []string{infile}, title)
+	if err != nil {
+		return err
+	}
+	tmpChapters, err := chaptersFromContext(c, &opts, run)
+	if err != nil {
+		return err
+	}
+	if tmpChapters != "" {
+		defer removeTemp(tmpChapters)
+	}
+	opts.ignoreErrors = c.Bool("ignore-errors")
+	if specs := c.StringSlice("sync-track"); len(specs) != 0 {
+		if opts.syncTracks, err = parseSyncTracks(mustParseFile(infile), specs); err != nil {
+			return err
+		}
+	}
+	// Check that the input can be verified before the (possibly long) remux.
+	if c.Bool("verify-streams") {
+		if err := checkVerifiable(mustParseFile(infile)); err != nil {
+			return err
+		}
+	}
+	if err := remux([]string{infile}, outfile, opts, run); err != nil {
+		return err
+	}
+	if c.Bool("verify-streams") {
+		if c.Bool("dry-run") {
+			log.Printf("Verify the streams in %s against %s", outfile, infile)
+		} else {
+			if err := verifyStreams(infile, outfile, run); err != nil {
+				return err
+			}
+			fmt.Printf("%s: All streams identical to the source.\n", outfile)
+		}
+	}
+	if err := postHook(c, outfile); err != nil {
+		return err
+	}
+	state.markDone(infile)
+	return nil
+}
+
+func actionRename(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+	if err := checkPlan(c, "rename"); err != nil {
+		return err
+	}
+
+	fopts, err := formatOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+
+	opts := renameOptions{
+		mask:         c.String("format"),
+		seriesLayout: c.Bool("series-layout"),
+		outdir:       c.String("output-dir"),
+		resetTimes:   c.Bool("reset-timestamps"),
+		dryrun:       c.Bool("dry-run"),
+	}
+	if opts.seriesLayout && c.IsSet("format") {
+		return errors.New("--series-layout and --format cannot be used together")
+	}
+
+	fnames = readable(fnames)
+	if err := confirm("rename", len(fnames), c.Bool("assume-yes") || c.Bool("dry-run")); err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	report := unresolvedReport{}
+	targets := map[string]string{}
+
+	for _, fname := range fnames {
+		newfile, renamed, err := rename(fname, fopts, opts, targets)
+		if err != nil {
+			if !c.Bool("report-unresolved") || !report.add(fname, err) {
+				errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			}
+			continue
+		}
+		if !renamed {
+			state.markDone(fname)
+			continue
+		}
+		if err := postHook(c, newfile); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", newfile, err))
+			continue
+		}
+		// Record the new name, in case the command runs again on the
+		// renamed files.
+		state.markDone(newfile)
+	}
+	return errorFromSlice(append(errmsgs, reportUnresolved(report)...))
+}
+
+func actionStripAttachments(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+	opts := stripAttachmentsOptions{
+		mimes:    c.StringSlice("mime"),
+		names:    c.StringSlice("name"),
+		keepUsed: c.Bool("keep-used"),
+	}
+	if len(opts.mimes) == 0 && len(opts.names) == 0 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("use --mime and/or --name to select the attachments to remove")
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "remove attachments from", len(fnames)); err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	for _, fname := range fnames {
+		mkv := mustParseFile(fname)
+		removed, err := stripAttachments(mkv, opts, run)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		fmt.Printf("%s: Removed %d attachment(s).\n", fname, len(removed))
+		for _, name := range removed {
+			fmt.Printf("  %s\n", name)
+		}
+		if len(removed) == 0 {
+			state.markDone(fname)
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionStripTags(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+	if !c.Bool("global") && !c.Bool("all") && len(c.IntSlice("track")) == 0 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("use --global, --track, or --all to select the tags to remove")
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "remove tags from", len(fnames)); err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	for _, fname := range fnames {
+		mkv := mustParseFile(fname)
+		count, err := striptags(mkv, c.Bool("global"), c.IntSlice("track"), c.Bool("all"), run)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		fmt.Printf("%s: Removed %d tag entries.\n", fname, count)
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionSubConvert(c *cli.Context) error {
+	run := *runnerFromContext(c.Context)
+
+	to := strings.ToLower(c.String("to"))
+	if to != subFormatSRT && to != subFormatASS {
+		return fmt.Errorf("invalid output format %q (valid: %s, %s)", c.String("to"), subFormatSRT, subFormatASS)
+	}
+
+	if c.Bool("in-place") {
+		if !c.Bool("mux") {
+			return errors.New("--in-place requires --mux")
+		}
+		if err := checkPlan(c, "subconvert --in-place"); err != nil {
+			return err
+		}
+		if c.Args().Len() != 1 {
+			cli.ShowCommandHelp(c, c.Command.Name)
+			return errors.New("need exactly one input file with --in-place")
+		}
+		infile := c.Args().Get(0)
+		mkv := mustParseFile(infile)
+		err := replaceInPlace(infile, c.Bool("dry-run"), func(tmp string) error {
+			return subconvert(mkv, c.Int("track"), to, tmp, true, c.Bool("dry-run"), c.Bool("normalize-nfc"), run)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %v", infile, err)
+		}
+		return postHook(c, infile)
+	}
+
+	if err := checkTwoArgs(c); err != nil {
+		return err
+	}
+	infile := c.Args().Get(0)
+	outfile := c.Args().Get(1)
+
+	mkv := mustParseFile(infile)
+	if err := subconvert(mkv, c.Int("track"), to, outfile, c.Bool("mux"), c.Bool("dry-run"), c.Bool("normalize-nfc"), run); err != nil {
+		return fmt.Errorf("%s: %v", infile, err)
+	}
+	return postHook(c, outfile)
+}
+
+func actionTouchDefault(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+	opts := touchDefaultOptions{
+		audioLangs: c.StringSlice("audio-lang"),
+		subLangs:   c.StringSlice("sub-lang"),
+		ignore:     c.StringSlice("ignore"),
+	}
+	if len(opts.audioLangs) == 0 && len(opts.subLangs) == 0 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("use --audio-lang and/or --sub-lang to set the default track policy")
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, errmsgs := walkFiles(c.Args().Slice(), c.Int("max-depth"))
+	fnames, err := sortFiles(fnames, c.String("sort-files"))
+	if err != nil {
+		return err
+	}
+	fnames = state.pending(readable(fnames))
+	if err := confirmBatch(c, "check (and fix) the default tracks of", len(fnames)); err != nil {
+		return err
+	}
+
+	modified := 0
+
+	for _, fname := range fnames {
+		mkv, err := parseFile(fname)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		changes, err := touchDefault(mkv, opts, run)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		for _, change := range changes {
+			fmt.Printf("%s: %s\n", fname, change)
+		}
+		if len(changes) == 0 {
+			debugf("%s: default tracks already correct", fname)
+			state.markDone(fname)
+			continue
+		}
+		modified++
+		if err := showResult(c, fname, "", nil, "default"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
+	}
+	fmt.Printf("%d of %d file(s) modified.\n", modified, len(fnames))
+	return errorFromSlice(errmsgs)
+}
+
+func actionValidateNames(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+
+	fopts, err := formatOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+
+	var errmsgs []string
+	mismatches := 0
+	failures := 0
+
+	for _, fname := range fnames {
+		want, ok, err := validateName(c.String("format"), fname, fopts)
+		if c.Bool("json-lines") {
+			// Emit one result per file, counting (not buffering) errors.
+			r := struct {
+				File  string `json:"file"`
+				OK    bool   `json:"ok"`
+				Want  string `json:"want,omitempty"`
+				Error string `json:"error,omitempty"`
+			}{fname, ok, want, errString(err)}
+			if err := jsonLine(os.Stdout, r); err != nil {
+				return err
+			}
+			if err != nil {
+				failures++
+			} else if !ok {
+				mismatches++
+			}
+			continue
+		}
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if !ok {
+			fmt.Printf("MISMATCH: %s (want %q)\n", fname, want)
+			mismatches++
+		}
+	}
+	if failures != 0 {
+		errmsgs = append(errmsgs, fmt.Sprintf("unable to format %d file(s)", failures))
+	}
+	if mismatches != 0 {
+		errmsgs = append(errmsgs, fmt.Sprintf("%d of %d file(s) do not match the naming format", mismatches, len(fnames)))
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionReplaceTrack(c *cli.Context) error {
+	if err := checkTwoArgs(c); err != nil {
+		return err
+	}
+
+	infile := c.Args().Get(0)
+	outfile := c.Args().Get(1)
+	run := *runnerFromContext(c.Context)
+
+	mkv := mustParseFile(infile)
+	if err := replaceTrack(mkv, c.Int("track"), c.String("with"), outfile, run); err != nil {
+		return err
+	}
+	return postHook(c, outfile)
+}
+
+func actionSample(c *cli.Context) error {
+	if err := checkTwoArgs(c); err != nil {
+		return err
+	}
+
+	infile := c.Args().Get(0)
+	outfile := c.Args().Get(1)
+	run := *runnerFromContext(c.Context)
+
+	if err := sample(infile, outfile, c.Duration("start"), c.Duration("duration"), c.StringSlice("type"), run); err != nil {
+		return err
+	}
+	return postHook(c, outfile)
+}
+
+func actionSplit(c *cli.Context) error {
+	if err := checkPlan(c, "split"); err != nil {
+		return err
+	}
+	if c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("need exactly one input file")
+	}
+	fname := c.Args().Get(0)
+
+	fopts, err := formatOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	opts := splitOptions{
+		duration: c.Duration("duration"),
+		chapters: c.Bool("chapters"),
+		mask:     c.String("output"),
+		fopts:    fopts,
+		outdir:   c.String("output-dir"),
+		dryrun:   c.Bool("dry-run"),
+	}
+	if opts.duration != 0 && opts.chapters {
+		return errors.New("--duration and --chapters cannot be used together")
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	parts, err := splitFile(fname, opts, run)
+	var errmsgs []string
+	if err != nil {
+		errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+	}
+	for _, part := range parts {
+		fmt.Printf("%s => %s\n", fname, part)
+		if err := postHook(c, part); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", part, err))
+		}
+	}
+	return errorFromSlice(errmsgs)
 }
 
-func actionMerge(c *cli.Context) error {
-	return remux(c.Args().Slice(), c.String("output"), *runnerFromContext(c.Context), c.Bool("subs"))
+func actionSetDate(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+
+	date, err := parseDate(c.String("date"))
+	if err != nil {
+		return err
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "change the date of", len(fnames)); err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	for _, fname := range fnames {
+		if err := setdate(fname, date, run); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
+	}
+	return errorFromSlice(errmsgs)
 }
 
-func actionOnly(c *cli.Context) error {
-	if err := checkTwoArgs(c); err != nil {
+func actionSetFPS(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
 		return err
 	}
 
-	infile := c.Args().Get(0)
-	outfile := c.Args().Get(1)
+	frame, err := parseFPS(c.String("fps"))
+	if err != nil {
+		return err
+	}
 
 	run := *runnerFromContext(c.Context)
 
-	mkv := mustParseFile(infile)
-	tfi, err := extract(mkv, c.Int("track"), run)
-	defer os.Remove(tfi.fname)
+	fnames, err := inputFiles(c)
 	if err != nil {
-		return fmt.Errorf("%s: %v", infile, err)
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "change the frame rate of", len(fnames)); err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	for _, fname := range fnames {
+		mkv := mustParseFile(fname)
+		if err := setfps(mkv, c.Int("track"), frame, run); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := showResult(c, fname, "", []int{c.Int("track")}, "fps"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionSetSubs(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+	opts := setsubsOptions{
+		setDefault:   c.IsSet("default"),
+		defaultTrack: c.Int("default"),
+		setForced:    c.IsSet("forced"),
+		forcedTrack:  c.Int("forced"),
+	}
+	if !opts.setDefault && !opts.setForced {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("use --default and/or --forced to select the tracks")
+	}
+	if opts.defaultTrack < -1 || opts.forcedTrack < -1 {
+		return errors.New("invalid track number (use -1 to clear the flag on all subtitle tracks)")
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "change the subtitle flags of", len(fnames)); err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	for _, fname := range fnames {
+		mkv := mustParseFile(fname)
+		if err := setsubs(mkv, opts, run); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := showResult(c, fname, typeSubtitle, nil, "default", "forced"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
 	}
-	return submux(infile, outfile, true, run)
+	return errorFromSlice(errmsgs)
 }
 
-func actionPrint(c *cli.Context) error {
+func actionSetTracks(c *cli.Context) error {
 	if err := checkMultiArgs(c); err != nil {
 		return err
 	}
+	opts := settracksOptions{
+		where:      c.String("where"),
+		setName:    c.IsSet("name"),
+		name:       c.String("name"),
+		setLang:    c.IsSet("lang"),
+		lang:       c.String("lang"),
+		setDefault: c.IsSet("default"),
+		isDefault:  c.Bool("default"),
+		setForced:  c.IsSet("forced"),
+		isForced:   c.Bool("forced"),
+	}
+	if !opts.setName && !opts.setLang && !opts.setDefault && !opts.setForced {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("use --name, --lang, --default, and/or --forced to select the properties to change")
+	}
+	// Catch syntax errors before processing any files.
+	if _, err := parseSelect(opts.where); err != nil {
+		return fmt.Errorf("invalid expression %q: %v", opts.where, err)
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "change the matching tracks of", len(fnames)); err != nil {
+		return err
+	}
 
 	var errmsgs []string
 
-	for _, fname := range c.Args().Slice() {
-		output, err := format(c.String("format"), fname)
+	for _, fname := range fnames {
+		mkv := mustParseFile(fname)
+		ids, err := settracks(mkv, opts, run)
 		if err != nil {
 			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
 			continue
 		}
-		fmt.Println(output)
+		if len(ids) == 0 {
+			infof("%s: no matching tracks", fname)
+			state.markDone(fname)
+			continue
+		}
+		if err := showResult(c, fname, "", ids, "name", "language", "default", "forced"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
 	}
 	return errorFromSlice(errmsgs)
 }
 
-func actionRemux(c *cli.Context) error {
-	if err := checkTwoArgs(c); err != nil {
+func actionSetTrackUID(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("need exactly one input file")
+	}
+	fname := c.Args().Get(0)
+
+	uid, err := parseUID(c.String("uid"))
+	if err != nil {
 		return err
 	}
 
-	infile := c.Args().Get(0)
-	outfile := c.Args().Get(1)
 	run := *runnerFromContext(c.Context)
 
-	return remux([]string{infile}, outfile, run, true)
+	mkv := mustParseFile(fname)
+	warnf("Changing track UIDs breaks references to the track (E.g. in tags, chapters, and linked segments).")
+	if err := confirm(fmt.Sprintf("change the UID of track %d in", c.Int("track")), 1, c.Bool("assume-yes") || c.Bool("dry-run")); err != nil {
+		return err
+	}
+	if err := settrackuid(mkv, c.Int("track"), uid, run); err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+	if err := showResult(c, fname, "", []int{c.Int("track")}, "uid"); err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+	return postHook(c, fname)
+}
+
+func actionRenameTracks(c *cli.Context) error {
+	if err := checkMultiArgs(c); err != nil {
+		return err
+	}
+	re, err := regexp.Compile(c.String("match"))
+	if err != nil {
+		return fmt.Errorf("invalid --match expression: %v", err)
+	}
+	ttype := c.String("type")
+	if ttype != "" {
+		if err := checkTrackType(ttype, typeVideo, typeAudio, typeSubtitle); err != nil {
+			return err
+		}
+	}
+
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "rename tracks in", len(fnames)); err != nil {
+		return err
+	}
+
+	var errmsgs []string
+
+	for _, fname := range fnames {
+		mkv := mustParseFile(fname)
+		changes, err := renameTracks(mkv, re, c.String("replace"), ttype, run)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		for _, change := range changes {
+			fmt.Printf("%s: %s\n", fname, change)
+		}
+		if len(changes) == 0 {
+			state.markDone(fname)
+			continue
+		}
+		if err := showResult(c, fname, ttype, nil, "name"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		state.markDone(fname)
+	}
+	return errorFromSlice(errmsgs)
 }
 
-func actionRename(c *cli.Context) error {
+func actionSetForcedByName(c *cli.Context) error {
 	if err := checkMultiArgs(c); err != nil {
 		return err
 	}
 
+	run := *runnerFromContext(c.Context)
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "change the forced flags of", len(fnames)); err != nil {
+		return err
+	}
+
 	var errmsgs []string
 
-	for _, fname := range readable(c.Args().Slice()) {
-		err := rename(c.String("format"), fname, c.Bool("dry-run"))
+	for _, fname := range fnames {
+		mkv := mustParseFile(fname)
+		flagged, err := setForcedByName(mkv, c.StringSlice("match"), run)
 		if err != nil {
 			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		for _, id := range flagged {
+			fmt.Printf("%s: Track %d flagged as forced.\n", fname, id)
+		}
+		if len(flagged) == 0 {
+			state.markDone(fname)
+			continue
+		}
+		if err := showResult(c, fname, typeSubtitle, nil, "name", "forced"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
 		}
+		state.markDone(fname)
 	}
 	return errorFromSlice(errmsgs)
 }
@@ -127,14 +2006,33 @@ func actionSetDefault(c *cli.Context) error {
 
 	run := *runnerFromContext(c.Context)
 
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "change the default subtitle track of", len(fnames)); err != nil {
+		return err
+	}
+
 	var errmsgs []string
 
-	for _, fname := range readable(c.Args().Slice()) {
+	for _, fname := range fnames {
 		mkv := mustParseFile(fname)
 		err := setdefault(mkv, c.Int("track"), run)
 		if err != nil {
 			errmsgs = append(errmsgs, fmt.Sprintf("%s: %s", fname, err))
+			continue
+		}
+		if err := showResult(c, fname, typeSubtitle, nil, "default"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
 		}
+		state.markDone(fname)
 	}
 	return errorFromSlice(errmsgs)
 }
@@ -146,19 +2044,48 @@ func actionSetDefaultByLang(c *cli.Context) error {
 
 	run := *runnerFromContext(c.Context)
 
+	fallback := c.String("fallback")
+	if fallback != fallbackError && fallback != fallbackFirst && fallback != fallbackNone {
+		return fmt.Errorf("invalid fallback %q (valid: %s, %s, %s)", fallback, fallbackFirst, fallbackNone, fallbackError)
+	}
+
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+	if err := confirmBatch(c, "change the default subtitle track of", len(fnames)); err != nil {
+		return err
+	}
+
 	var errmsgs []string
 
-	for _, fname := range readable(c.Args().Slice()) {
+	for _, fname := range fnames {
 		mkv := mustParseFile(fname)
-		track, err := trackByLanguage(mkv, c.StringSlice("lang"), c.StringSlice("ignore"))
+		track, err := defaultSubByLanguage(mkv, c.StringSlice("lang"), c.StringSlice("ignore"), c.Bool("strict-single"), fallback)
 		if err != nil {
 			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
 			continue
 		}
+		if track < 0 {
+			infof("%s: no track with language(s) %s, leaving file unchanged", fname, strings.Join(c.StringSlice("lang"), ","))
+			state.markDone(fname)
+			continue
+		}
 		err = setdefault(mkv, track, run)
 		if err != nil {
 			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := showResult(c, fname, typeSubtitle, nil, "default"); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
+		}
+		if err := postHook(c, fname); err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fname, err))
+			continue
 		}
+		state.markDone(fname)
 	}
 	return errorFromSlice(errmsgs)
 }
@@ -167,9 +2094,125 @@ func actionShow(c *cli.Context) error {
 	if err := checkMultiArgs(c); err != nil {
 		return err
 	}
-	for _, fname := range readable(c.Args().Slice()) {
-		mkv := mustParseFile(fname)
-		show(mkv, c.Bool("uid"))
+	if c.Bool("props") && !c.IsSet("track") {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("--props requires a track number (--track)")
+	}
+	opts := showOptions{
+		uid:            c.Bool("uid"),
+		codecName:      c.Bool("codec-name"),
+		preferredAudio: c.StringSlice("preferred-audio"),
+		preferredSubs:  c.StringSlice("preferred-subs"),
+		attachments:    c.Bool("attachments"),
+		summaryRow:     c.Bool("summary-row"),
+	}
+	if c.String("locale") != "" {
+		tag, err := language.Parse(c.String("locale"))
+		if err != nil {
+			return fmt.Errorf("invalid locale %q: %v", c.String("locale"), err)
+		}
+		opts.locale = &tag
+	}
+	// Chapters and tags are extracted with mkvextract.
+	xrun := extractionRunner(*runnerFromContext(c.Context))
+	// The native parser doesn't read tags, so files would seem to have none.
+	if c.Bool("tags") && parseBackend == backendNative {
+		return errors.New("--tags requires --parse-backend=mkvmerge (the native parser does not read tags)")
+	}
+	if c.Bool("chapters") || c.Bool("tags") {
+		if err := requirements("mkvextract"); err != nil {
+			return fmt.Errorf("requirements check: %v", err)
+		}
+	}
+	fnames, err := inputFiles(c)
+	if err != nil {
+		return err
+	}
+	fnames = readable(fnames)
+
+	// Track counts across all files shown, for the grand total (files are
+	// processed in parallel).
+	var (
+		mu     sync.Mutex
+		totals = map[string]int{}
+		nshown int
+	)
+	errmsgs := processFiles(os.Stdout, fnames, c.Int("jobs"), func(w io.Writer, fname string) error {
+		mkv, err := parseFile(fname)
+		if err != nil {
+			return err
+		}
+		if c.IsSet("program") {
+			if mkv, err = selectProgram(mkv, c.Int("program")); err != nil {
+				return err
+			}
+		}
+		if c.Bool("summary") {
+			fmt.Fprintln(w, summary(mkv))
+			return nil
+		}
+		if c.Bool("tree") {
+			showTree(w, mkv, opts)
+			return nil
+		}
+		if c.Bool("props") {
+			return showTrackProps(w, mkv, c.Int("track"), opts)
+		}
+		show(w, mkv, opts)
+		if opts.summaryRow {
+			mu.Lock()
+			for _, track := range mkv.Tracks {
+				totals[track.Type]++
+			}
+			nshown++
+			mu.Unlock()
+		}
+
+		nchapters := 0
+		for _, ch := range mkv.Chapters {
+			nchapters += ch.NumEntries
+		}
+		if c.Bool("chapters") && nchapters != 0 {
+			chapters, err := readChapters(mkv, xrun)
+			if err != nil {
+				return fmt.Errorf("reading chapters: %v", err)
+			}
+			showChapters(w, chapters)
+		}
+		if global, track := tagEntries(mkv); c.Bool("tags") && global+track != 0 {
+			tags, err := readTags(mkv, xrun)
+			if err != nil {
+				return fmt.Errorf("reading tags: %v", err)
+			}
+			showTags(w, tags)
+		}
+		return nil
+	})
+	if opts.summaryRow && nshown > 1 {
+		fmt.Printf("Grand total (%d files): %s\n", nshown, trackTotals(totals))
+	}
+	return errorFromSlice(errmsgs)
+}
+
+func actionWhichTracks(c *cli.Context) error {
+	if c.Args().Len() != 2 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("need an expression and an input file")
+	}
+
+	expr := c.Args().Get(0)
+	fname := c.Args().Get(1)
+
+	mkv, err := parseFile(fname)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+	tracks, err := selectTracksByExpr(mkv, expr)
+	if err != nil {
+		return err
+	}
+	for _, id := range tracks {
+		fmt.Println(id)
 	}
 	return nil
 }
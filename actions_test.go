@@ -0,0 +1,258 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+// runTestCommand runs a single command (with the global flags used by the
+// actions) through the cli package, using r as the runner.
+func runTestCommand(cmd *cli.Command, r runner, args ...string) error {
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.BoolFlag{Name: "dry-run"},
+			&cli.BoolFlag{Name: "assume-yes"},
+			&cli.StringFlag{Name: "post-hook"},
+			&cli.IntFlag{Name: "confirm-threshold"},
+		},
+		Commands: []*cli.Command{cmd},
+	}
+	ctx := context.WithValue(context.Background(), runnerKey, &r)
+	return app.RunContext(ctx, append([]string{"mkvtool", cmd.Name}, args...))
+}
+
+func TestActionOnly(t *testing.T) {
+	fname := setupCache(t)
+	data := `{"identification_format_version": 14, "tracks": [
+		{"id": 0, "type": "video", "properties": {}},
+		{"id": 1, "type": "subtitles", "properties": {"language": "eng"}},
+		{"id": 2, "type": "subtitles", "properties": {"language": "por"}}]}`
+	if err := cacheStore(fname, []byte(data)); err != nil {
+		t.Fatalf("cacheStore: %v", err)
+	}
+
+	cmd := &cli.Command{
+		Name: "only",
+		Flags: []cli.Flag{
+			&cli.IntFlag{Name: "track"},
+			&cli.StringFlag{Name: "track-name"},
+			&cli.BoolFlag{Name: "interactive"},
+			&cli.BoolFlag{Name: "force"},
+		},
+		Action: actionOnly,
+	}
+	r := &recordRunner{}
+	if err := runTestCommand(cmd, r, "--track", "2", fname, "out.mkv"); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	if len(r.cmds) != 2 {
+		t.Fatalf("Got commands %q, want mkvextract and mkvmerge", r.cmds)
+	}
+	tmp := r.cmds[0][3][2:]
+	want := [][]string{
+		{"mkvextract", fname, "tracks", "2:" + tmp},
+		{"mkvmerge", "-o", "out.mkv", "-S", fname, "--language", "0:por", "--track-name", "0:Portuguese", tmp},
+	}
+	if !reflect.DeepEqual(r.cmds, want) {
+		t.Errorf("Got commands %q, want %q", r.cmds, want)
+	}
+}
+
+func TestActionExtractSubsBlankOCR(t *testing.T) {
+	cmd := &cli.Command{
+		Name: "extract-subs",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "format", Value: subFormatSRT},
+			&cli.StringFlag{Name: "ocr-command"},
+		},
+		Action: actionExtractSubs,
+	}
+	r := &recordRunner{}
+	err := runTestCommand(cmd, r, "--ocr-command", "  ", "a.mkv")
+	if err == nil || !strings.Contains(err.Error(), "--ocr-command") {
+		t.Errorf("Got error %v, want error about --ocr-command", err)
+	}
+	if len(r.cmds) != 0 {
+		t.Errorf("Got commands %q, want none", r.cmds)
+	}
+}
+
+func TestHookCmdline(t *testing.T) {
+	casetests := []struct {
+		hook string
+		want []string
+	}{
+		// Filename appended.
+		{hook: "notify --done", want: []string{"notify", "--done", "a b.mkv"}},
+		// Filename replaced.
+		{hook: "cp {} /backup/", want: []string{"cp", "a b.mkv", "/backup/"}},
+		{hook: "echo file={}", want: []string{"echo", "file=a b.mkv"}},
+		// Blank hooks.
+		{hook: ""},
+		{hook: " \t "},
+	}
+
+	for _, tt := range casetests {
+		if got := hookCmdline(tt.hook, "a b.mkv"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("hookCmdline(%q): got %q, want %q", tt.hook, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTrackType(t *testing.T) {
+	casetests := []struct {
+		ttype     string
+		allowed   []string
+		wantError string
+	}{
+		{ttype: typeAudio, allowed: []string{typeAudio, typeSubtitle}},
+		{ttype: typeSubtitle, allowed: []string{typeVideo, typeAudio, typeSubtitle}},
+		{ttype: typeVideo, allowed: []string{typeAudio, typeSubtitle}, wantError: `invalid track type "video" (valid: audio, subtitles)`},
+		{ttype: "", allowed: []string{typeSubtitle, typeAudio}, wantError: `invalid track type "" (valid: subtitles, audio)`},
+	}
+
+	for _, tt := range casetests {
+		err := checkTrackType(tt.ttype, tt.allowed...)
+		if tt.wantError == "" {
+			if err != nil {
+				t.Errorf("checkTrackType(%q, %q): got error %v", tt.ttype, tt.allowed, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.wantError {
+			t.Errorf("checkTrackType(%q, %q): got error %v, want %q", tt.ttype, tt.allowed, err, tt.wantError)
+		}
+	}
+}
+
+func TestRequireToolsIf(t *testing.T) {
+	casetests := []struct {
+		args      []string
+		wantError bool
+	}{
+		{},
+		{args: []string{"--extra"}, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		cmd := &cli.Command{
+			Name:   "test",
+			Flags:  []cli.Flag{&cli.BoolFlag{Name: "extra"}},
+			Before: requireToolsIf("extra", []string{"mkvtool-no-such-tool"}),
+			Action: func(*cli.Context) error { return nil },
+		}
+		err := runTestCommand(cmd, &recordRunner{}, tt.args...)
+		if tt.wantError {
+			if err == nil || !strings.Contains(err.Error(), "mkvtool-no-such-tool") {
+				t.Errorf("args %q: got error %v, want missing tool error", tt.args, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("args %q: got error %q, want no error", tt.args, err)
+		}
+	}
+}
+
+func TestActionRemuxVerifyNonMatroska(t *testing.T) {
+	fname := setupCache(t)
+	data := `{"identification_format_version": 14, "container": {"type": "MP4/QuickTime"},
+		"tracks": [{"id": 0, "type": "video", "properties": {}}]}`
+	if err := cacheStore(fname, []byte(data)); err != nil {
+		t.Fatalf("cacheStore: %v", err)
+	}
+
+	cmd := &cli.Command{
+		Name:   "remux",
+		Flags:  []cli.Flag{&cli.BoolFlag{Name: "verify-streams"}},
+		Action: actionRemux,
+	}
+	r := &recordRunner{}
+	if err := runTestCommand(cmd, r, "--verify-streams", fname, "out.mkv"); err == nil {
+		t.Errorf("Got no error, want error")
+	}
+	// The input must be rejected before remuxing.
+	if len(r.cmds) != 0 {
+		t.Errorf("Got commands %q, want none", r.cmds)
+	}
+}
+
+func TestActionShowTagsNative(t *testing.T) {
+	saved := parseBackend
+	parseBackend = backendNative
+	defer func() { parseBackend = saved }()
+
+	cmd := &cli.Command{
+		Name:   "show",
+		Flags:  []cli.Flag{&cli.BoolFlag{Name: "tags"}},
+		Action: actionShow,
+	}
+	err := runTestCommand(cmd, &recordRunner{}, "--tags", "a.mkv")
+	if err == nil || !strings.Contains(err.Error(), "--tags") {
+		t.Errorf("Got error %v, want error about --tags", err)
+	}
+}
+
+func TestRemuxOptionsMaxAudioChannels(t *testing.T) {
+	video := setupCache(t)
+	audio := filepath.Join(filepath.Dir(video), "b.mka")
+	if err := ioutil.WriteFile(audio, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacheStore(video, []byte(`{"identification_format_version": 14, "tracks": [
+		{"id": 0, "type": "video", "properties": {}},
+		{"id": 1, "type": "audio", "properties": {"audio_channels": 6}}]}`)); err != nil {
+		t.Fatalf("cacheStore: %v", err)
+	}
+	if err := cacheStore(audio, []byte(`{"identification_format_version": 14, "tracks": [
+		{"id": 0, "type": "audio", "properties": {"audio_channels": 2}}]}`)); err != nil {
+		t.Fatalf("cacheStore: %v", err)
+	}
+
+	casetests := []struct {
+		args        []string
+		wantExclude map[string][]int
+		wantError   bool
+	}{
+		// The stereo track in the second input is kept.
+		{args: []string{"--max-audio-channels=2", video, audio}, wantExclude: map[string][]int{video: {1}}},
+		{args: []string{"--max-audio-channels=1", video, audio}, wantError: true},
+		{args: []string{"--max-audio-channels=2", video}, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		var opts remuxOptions
+		cmd := &cli.Command{
+			Name:  "merge",
+			Flags: []cli.Flag{&cli.IntFlag{Name: "max-audio-channels"}},
+			Action: func(c *cli.Context) error {
+				var err error
+				opts, err = remuxOptionsFromContext(c, c.Args().Slice(), "")
+				return err
+			},
+		}
+		err := runTestCommand(cmd, &recordRunner{}, tt.args...)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%q: Got no error, want error", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: Got error %q want no error", tt.args, err)
+		}
+		if !reflect.DeepEqual(opts.excludeAudio, tt.wantExclude) {
+			t.Errorf("%q: Got excluded audio %v, want %v", tt.args, opts.excludeAudio, tt.wantExclude)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+// stripAttachmentsOptions holds the options for stripAttachments.
+type stripAttachmentsOptions struct {
+	// Remove attachments with a MIME type matching one of these globs.
+	mimes []string
+	// Remove attachments with a name matching one of these globs.
+	names []string
+	// Keep fonts used by the ASS subtitle tracks in the file.
+	keepUsed bool
+}
+
+// reASSFontOverride matches font name overrides in ASS events, like
+// {\fnArial}.
+var reASSFontOverride = regexp.MustCompile(`\\fn([^\\}]*)`)
+
+// globMatch returns true if s matches one of the globs (case insensitive).
+func globMatch(s string, globs []string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(strings.ToLower(g), strings.ToLower(s)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isFont returns true if the attachment looks like a font, by MIME type or
+// file extension.
+func isFont(name, mime string) bool {
+	mime = strings.ToLower(mime)
+	if strings.Contains(mime, "font") || strings.Contains(mime, "opentype") {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".ttf", ".otf", ".ttc", ".otc":
+		return true
+	}
+	return false
+}
+
+// assFonts returns the (lowercase) names of the fonts used by an ASS
+// subtitle file, in styles and font overrides in the events.
+func assFonts(r io.Reader) (map[string]bool, error) {
+	fonts := map[string]bool{}
+	add := func(name string) {
+		// "@" selects the vertical variant of the font.
+		name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+		if name != "" {
+			fonts[strings.ToLower(name)] = true
+		}
+	}
+
+	var section string
+	fontField := -1
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(line)
+			fontField = -1
+			continue
+		}
+		switch section {
+		case "[v4+ styles]", "[v4 styles]":
+			if strings.HasPrefix(line, "Format:") {
+				for i, f := range strings.Split(strings.TrimPrefix(line, "Format:"), ",") {
+					if strings.EqualFold(strings.TrimSpace(f), "fontname") {
+						fontField = i
+					}
+				}
+				continue
+			}
+			if strings.HasPrefix(line, "Style:") && fontField >= 0 {
+				values := strings.Split(strings.TrimPrefix(line, "Style:"), ",")
+				if fontField < len(values) {
+					add(values[fontField])
+				}
+			}
+		case "[events]":
+			for _, m := range reASSFontOverride.FindAllStringSubmatch(line, -1) {
+				add(m[1])
+			}
+		}
+	}
+	return fonts, scanner.Err()
+}
+
+// fontNames returns the family and full names in a TrueType or OpenType font
+// (or font collection), read from the "name" table.
+func fontNames(data []byte) ([]string, error) {
+	if len(data) < 12 {
+		return nil, errors.New("font too short")
+	}
+	// Font collections contain the offsets of each font.
+	if string(data[0:4]) == "ttcf" {
+		n := int(binary.BigEndian.Uint32(data[8:12]))
+		if len(data) < 12+4*n {
+			return nil, errors.New("invalid font collection")
+		}
+		var ret []string
+		for i := 0; i < n; i++ {
+			offset := int(binary.BigEndian.Uint32(data[12+4*i:]))
+			names, err := sfntNames(data, offset)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, names...)
+		}
+		return ret, nil
+	}
+	return sfntNames(data, 0)
+}
+
+// sfntNames returns the family and full names of the font starting at
+// offset.
+func sfntNames(data []byte, offset int) ([]string, error) {
+	invalid := errors.New("invalid font data")
+	if offset+12 > len(data) {
+		return nil, invalid
+	}
+	numTables := int(binary.BigEndian.Uint16(data[offset+4:]))
+
+	// Find the name table.
+	var table []byte
+	for i := 0; i < numTables; i++ {
+		rec := offset + 12 + 16*i
+		if rec+16 > len(data) {
+			return nil, invalid
+		}
+		if string(data[rec:rec+4]) != "name" {
+			continue
+		}
+		start := int(binary.BigEndian.Uint32(data[rec+8:]))
+		length := int(binary.BigEndian.Uint32(data[rec+12:]))
+		if start+length > len(data) {
+			return nil, invalid
+		}
+		table = data[start : start+length]
+	}
+	if len(table) < 6 {
+		return nil, errors.New("font has no name table")
+	}
+
+	count := int(binary.BigEndian.Uint16(table[2:]))
+	strOffset := int(binary.BigEndian.Uint16(table[4:]))
+	seen := map[string]bool{}
+	var ret []string
+
+	for i := 0; i < count; i++ {
+		rec := 6 + 12*i
+		if rec+12 > len(table) {
+			return nil, invalid
+		}
+		platform := binary.BigEndian.Uint16(table[rec:])
+		nameID := binary.BigEndian.Uint16(table[rec+6:])
+		length := int(binary.BigEndian.Uint16(table[rec+8:]))
+		start := strOffset + int(binary.BigEndian.Uint16(table[rec+10:]))
+		if start+length > len(table) {
+			return nil, invalid
+		}
+		// Family (1), full name (4), and typographic family (16).
+		if nameID != 1 && nameID != 4 && nameID != 16 {
+			continue
+		}
+		raw := table[start : start+length]
+		var name string
+		switch platform {
+		case 0, 3:
+			// Unicode and Windows names use UTF-16BE.
+			u := make([]uint16, len(raw)/2)
+			for j := range u {
+				u[j] = binary.BigEndian.Uint16(raw[2*j:])
+			}
+			name = string(utf16.Decode(u))
+		case 1:
+			name = string(raw)
+		default:
+			continue
+		}
+		if name != "" && !seen[name] {
+			seen[name] = true
+			ret = append(ret, name)
+		}
+	}
+	return ret, nil
+}
+
+// usedFonts returns the UIDs of the font attachments used by the ASS
+// subtitle tracks in the file. The subtitle tracks and fonts are extracted
+// into a temporary directory. Fonts that can't be read are considered used.
+func usedFonts(mkv matroska, cmd runner) (map[uint64]bool, error) {
+	dir, err := createTempDir()
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(dir)
+
+	// Extract ASS tracks and fonts.
+	var subs []string
+	tracks := []string{mkv.FileName, "tracks"}
+	for _, track := range mkv.Tracks {
+		if track.Type == typeSubtitle && subFormatFromCodecID(track.Properties.CodecID) == subFormatASS {
+			fname := filepath.Join(dir, fmt.Sprintf("track%d.ass", track.ID))
+			tracks = append(tracks, fmt.Sprintf("%d:%s", track.ID, fname))
+			subs = append(subs, fname)
+		}
+	}
+	attachments := []string{mkv.FileName, "attachments"}
+	for _, a := range mkv.Attachments {
+		if isFont(a.FileName, a.ContentType) {
+			attachments = append(attachments, fmt.Sprintf("%d:%s", a.ID, filepath.Join(dir, fmt.Sprintf("font%d", a.ID))))
+		}
+	}
+	if len(subs) != 0 {
+		if err := cmd.run("mkvextract", tracks...); err != nil {
+			return nil, err
+		}
+	}
+	if len(attachments) > 2 {
+		if err := cmd.run("mkvextract", attachments...); err != nil {
+			return nil, err
+		}
+	}
+
+	fonts := map[string]bool{}
+	for _, fname := range subs {
+		r, err := os.Open(fname)
+		if err != nil {
+			return nil, err
+		}
+		f, err := assFonts(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading ASS fonts: %v", err)
+		}
+		for name := range f {
+			fonts[name] = true
+		}
+	}
+
+	ret := map[uint64]bool{}
+	for _, a := range mkv.Attachments {
+		if !isFont(a.FileName, a.ContentType) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("font%d", a.ID)))
+		if err == nil {
+			var names []string
+			names, err = fontNames(data)
+			for _, name := range names {
+				if fonts[strings.ToLower(name)] {
+					ret[a.Properties.UID] = true
+				}
+			}
+		}
+		if err != nil {
+			warnf("%s: unable to read font %q (keeping it): %v", mkv.FileName, a.FileName, err)
+			ret[a.Properties.UID] = true
+		}
+	}
+	return ret, nil
+}
+
+// stripAttachments removes the attachments matching the MIME type or name
+// globs in opts from the file, in place. With keepUsed, fonts used by the ASS
+// subtitle tracks in the file are kept. Returns the names of the removed
+// attachments.
+func stripAttachments(mkv matroska, opts stripAttachmentsOptions, cmd runner) ([]string, error) {
+	var used map[uint64]bool
+	if opts.keepUsed {
+		var err error
+		if used, err = usedFonts(mkv, extractionRunner(cmd)); err != nil {
+			return nil, err
+		}
+	}
+
+	command := []string{"mkvpropedit", mkv.FileName}
+	var removed []string
+
+	for _, a := range mkv.Attachments {
+		if !globMatch(a.ContentType, opts.mimes) && !globMatch(a.FileName, opts.names) {
+			continue
+		}
+		if opts.keepUsed && used[a.Properties.UID] {
+			continue
+		}
+		command = append(command, "--delete-attachment", fmt.Sprintf("=%d", a.Properties.UID))
+		removed = append(removed, a.FileName)
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	if err := cmd.run(command[0], command[1:]...); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// attachmentKey identifies attachments that may have the same contents.
+type attachmentKey struct {
+	name string
+	size int
+}
+
+// duplicateAttachments returns the IDs of the attachments in each file (by
+// file name) with the same contents as an attachment seen before (in a
+// previous file, or earlier in the same file), so only the first copy is kept.
+// Only attachments with the same name and size as others are extracted (into
+// a temporary directory) and hashed.
+func duplicateAttachments(mkvs []matroska, cmd runner) (map[string][]int, error) {
+	groups := map[attachmentKey]int{}
+	for _, mkv := range mkvs {
+		for _, a := range mkv.Attachments {
+			groups[attachmentKey{strings.ToLower(a.FileName), a.Size}]++
+		}
+	}
+	candidate := func(name string, size int) bool {
+		return groups[attachmentKey{strings.ToLower(name), size}] > 1
+	}
+
+	ret := map[string][]int{}
+	dir, err := createTempDir()
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(dir)
+
+	tempName := func(file, id int) string {
+		return filepath.Join(dir, fmt.Sprintf("file%d-attachment%d", file, id))
+	}
+	// Extract the candidates with a single mkvextract call per file.
+	for i, mkv := range mkvs {
+		args := []string{mkv.FileName, "attachments"}
+		for _, a := range mkv.Attachments {
+			if candidate(a.FileName, a.Size) {
+				args = append(args, fmt.Sprintf("%d:%s", a.ID, tempName(i, a.ID)))
+			}
+		}
+		if len(args) == 2 {
+			continue
+		}
+		if err := cmd.run("mkvextract", args...); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, mkv := range mkvs {
+		for _, a := range mkv.Attachments {
+			if !candidate(a.FileName, a.Size) {
+				continue
+			}
+			f, err := os.Open(tempName(i, a.ID))
+			if err != nil {
+				return nil, err
+			}
+			h := sha256.New()
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			sum := fmt.Sprintf("%x", h.Sum(nil))
+			if seen[sum] {
+				ret[mkv.FileName] = append(ret[mkv.FileName], a.ID)
+				continue
+			}
+			seen[sum] = true
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,211 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestASSFonts(t *testing.T) {
+	ass := strings.Join([]string{
+		"\ufeff[Script Info]",
+		"Title: Test",
+		"",
+		"[V4+ Styles]",
+		"Format: Name, Fontname, Fontsize, PrimaryColour",
+		"Style: Default,Open Sans Semibold,20,&H00FFFFFF",
+		"Style: Signs,@Arial Black,20,&H00FFFFFF",
+		"",
+		"[Events]",
+		"Format: Layer, Start, End, Style, Text",
+		`Dialogue: 0,0:00:01.00,0:00:02.00,Default,{\fnGandhi Sans\b1}Hello{\fn}`,
+		`Dialogue: 0,0:00:03.00,0:00:04.00,Default,{\b1\fnComic Sans MS}World`,
+	}, "\n")
+
+	got, err := assFonts(strings.NewReader(ass))
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	want := map[string]bool{
+		"open sans semibold": true,
+		"arial black":        true,
+		"gandhi sans":        true,
+		"comic sans ms":      true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
+
+// fakeFont returns a minimal TrueType font with a name table containing the
+// given Windows (UTF-16) names, by name ID.
+func fakeFont(names map[uint16]string) []byte {
+	var records, strs []byte
+	for _, id := range []uint16{1, 2, 4} {
+		name, ok := names[id]
+		if !ok {
+			continue
+		}
+		var s []byte
+		for _, u := range utf16.Encode([]rune(name)) {
+			s = append(s, byte(u>>8), byte(u))
+		}
+		rec := make([]byte, 12)
+		binary.BigEndian.PutUint16(rec[0:], 3) // Platform: Windows.
+		binary.BigEndian.PutUint16(rec[2:], 1) // Encoding: Unicode BMP.
+		binary.BigEndian.PutUint16(rec[4:], 0x409)
+		binary.BigEndian.PutUint16(rec[6:], id)
+		binary.BigEndian.PutUint16(rec[8:], uint16(len(s)))
+		binary.BigEndian.PutUint16(rec[10:], uint16(len(strs)))
+		records = append(records, rec...)
+		strs = append(strs, s...)
+	}
+	count := len(records) / 12
+	table := make([]byte, 6)
+	binary.BigEndian.PutUint16(table[2:], uint16(count))
+	binary.BigEndian.PutUint16(table[4:], uint16(6+len(records)))
+	table = append(append(table, records...), strs...)
+
+	// Offset table with a single table record.
+	font := make([]byte, 12+16)
+	binary.BigEndian.PutUint32(font[0:], 0x00010000)
+	binary.BigEndian.PutUint16(font[4:], 1)
+	copy(font[12:], "name")
+	binary.BigEndian.PutUint32(font[20:], uint32(len(font)))
+	binary.BigEndian.PutUint32(font[24:], uint32(len(table)))
+	return append(font, table...)
+}
+
+func TestFontNames(t *testing.T) {
+	casetests := []struct {
+		data      []byte
+		want      []string
+		wantError bool
+	}{
+		{
+			data: fakeFont(map[uint16]string{1: "Open Sans", 2: "Semibold", 4: "Open Sans Semibold"}),
+			want: []string{"Open Sans", "Open Sans Semibold"},
+		},
+		// Duplicate names.
+		{
+			data: fakeFont(map[uint16]string{1: "Arial", 4: "Arial"}),
+			want: []string{"Arial"},
+		},
+		{
+			data:      []byte("not a font"),
+			wantError: true,
+		},
+		{
+			data:      append([]byte{0, 1, 0, 0, 0, 0}, make([]byte, 10)...),
+			wantError: true,
+		},
+	}
+
+	for _, tt := range casetests {
+		got, err := fontNames(tt.data)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Got %q, want %q", got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
+
+func TestStripAttachments(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "attachments": [
+		{"id": 1, "file_name": "arial.ttf", "content_type": "font/ttf", "properties": {"uid": 100}},
+		{"id": 2, "file_name": "Gandhi.OTF", "content_type": "application/vnd.ms-opentype", "properties": {"uid": 200}},
+		{"id": 3, "file_name": "cover.jpg", "content_type": "image/jpeg", "properties": {"uid": 300}}]}`)
+
+	casetests := []struct {
+		opts     stripAttachmentsOptions
+		want     []string
+		wantCmds [][]string
+	}{
+		{
+			opts:     stripAttachmentsOptions{mimes: []string{"font/*"}},
+			want:     []string{"arial.ttf"},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--delete-attachment", "=100"}},
+		},
+		{
+			opts:     stripAttachmentsOptions{mimes: []string{"image/*"}, names: []string{"*.otf"}},
+			want:     []string{"Gandhi.OTF", "cover.jpg"},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--delete-attachment", "=200", "--delete-attachment", "=300"}},
+		},
+		// Nothing to remove.
+		{
+			opts: stripAttachmentsOptions{names: []string{"*.woff"}},
+		},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		got, err := stripAttachments(mkv, tt.opts, r)
+		if err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("removed: got %q, want %q", got, tt.want)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("commands: got %q, want %q", r.cmds, tt.wantCmds)
+		}
+	}
+}
+
+// extractRunner is a runner that writes the contents of attachments (by
+// "file:id") when asked to extract them with mkvextract.
+type extractRunner map[string]string
+
+func (r extractRunner) run(name string, args ...string) error {
+	for _, arg := range args[2:] {
+		id, fname, _ := cutString(arg, ":")
+		if err := ioutil.WriteFile(fname, []byte(r[args[0]+":"+id]), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestDuplicateAttachments(t *testing.T) {
+	a := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "attachments": [
+		{"id": 1, "file_name": "font.ttf", "size": 3},
+		{"id": 2, "file_name": "other.ttf", "size": 3},
+		{"id": 3, "file_name": "cover.jpg", "size": 10}]}`)
+	b := mustUnmarshalMKV(t, `{"file_name": "b.mkv", "attachments": [
+		{"id": 1, "file_name": "FONT.ttf", "size": 3},
+		{"id": 2, "file_name": "other.ttf", "size": 3},
+		{"id": 3, "file_name": "cover.jpg", "size": 11}]}`)
+	c := mustUnmarshalMKV(t, `{"file_name": "c.mkv", "attachments": [
+		{"id": 1, "file_name": "font.ttf", "size": 3}]}`)
+
+	r := extractRunner{
+		"a.mkv:1": "abc", "a.mkv:2": "xyz",
+		// Same name and size, different contents.
+		"b.mkv:1": "abc", "b.mkv:2": "XYZ",
+		"c.mkv:1": "abc",
+	}
+	got, err := duplicateAttachments([]matroska{a, b, c}, r)
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	want := map[string][]int{"b.mkv": {1}, "c.mkv": {1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// useParseCache controls the use of the parse cache (set by --no-cache).
+var useParseCache = true
+
+// The parse cache stores the JSON output of mkvmerge --identify for each
+// file, keyed by the absolute path, size, and modification time of the file.
+// Modifying the file invalidates the entry automatically.
+
+// cacheFile returns the name of the cache file for the media file fname.
+func cacheFile(fname string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(fname)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s\x00%d\x00%d", abs, fi.Size(), fi.ModTime().UnixNano())
+	return filepath.Join(dir, "mkvtool", fmt.Sprintf("%x.json", sha256.Sum256([]byte(key)))), nil
+}
+
+// cacheLoad returns the cached identification data for fname, if available.
+func cacheLoad(fname string) ([]byte, bool) {
+	if !useParseCache {
+		return nil, false
+	}
+	cfile, err := cacheFile(fname)
+	if err != nil {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(cfile)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// cacheInvalidate removes the cached identification data for fname, if any.
+// Useful after editing a file in place, as the modification time may not
+// change when the edit is fast enough (or on filesystems with coarse
+// timestamps).
+func cacheInvalidate(fname string) {
+	cfile, err := cacheFile(fname)
+	if err != nil {
+		return
+	}
+	os.Remove(cfile)
+}
+
+// cacheStore saves the identification data for fname in the cache.
+func cacheStore(fname string, data []byte) error {
+	if !useParseCache {
+		return nil
+	}
+	cfile, err := cacheFile(fname)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cfile), 0o755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfile, data, 0o644)
+}
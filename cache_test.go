@@ -0,0 +1,125 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// identifyJSON is a minimal valid identification, as saved in the cache.
+const identifyJSON = `{"identification_format_version": 14, "file_name": "first-run.mkv",
+	"tracks": [{"id": 0, "type": "video", "properties": {}}]}`
+
+// setupCache points the user cache directory to a temporary directory and
+// returns the name of a media file in another temporary directory.
+func setupCache(t *testing.T) string {
+	t.Helper()
+	old, ok := os.LookupEnv("XDG_CACHE_HOME")
+	os.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv("XDG_CACHE_HOME", old)
+			return
+		}
+		os.Unsetenv("XDG_CACHE_HOME")
+	})
+	saved := useParseCache
+	useParseCache = true
+	t.Cleanup(func() { useParseCache = saved })
+
+	fname := filepath.Join(t.TempDir(), "a.mkv")
+	if err := ioutil.WriteFile(fname, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestCacheHitDifferentPath(t *testing.T) {
+	fname := setupCache(t)
+	if err := cacheStore(fname, []byte(identifyJSON)); err != nil {
+		t.Fatalf("cacheStore: %v", err)
+	}
+
+	// Another spelling of the same path must hit the cache (mkvmerge is not
+	// needed) and the parsed file name must be the one requested.
+	other := filepath.Dir(fname) + string(filepath.Separator) + "." + string(filepath.Separator) + "a.mkv"
+	mkv, err := parseFile(other)
+	if err != nil {
+		t.Fatalf("parseFile(%q): %v", other, err)
+	}
+	if mkv.FileName != other {
+		t.Errorf("FileName: got %q, want %q", mkv.FileName, other)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	casetests := []struct {
+		name   string
+		modify func(fname string) error
+	}{
+		{
+			name: "mtime",
+			modify: func(fname string) error {
+				mtime := time.Now().Add(-time.Hour)
+				return os.Chtimes(fname, mtime, mtime)
+			},
+		},
+		{
+			name: "size",
+			modify: func(fname string) error {
+				fi, err := os.Stat(fname)
+				if err != nil {
+					return err
+				}
+				if err := ioutil.WriteFile(fname, []byte("more data"), 0o644); err != nil {
+					return err
+				}
+				// Keep the original modification time.
+				return os.Chtimes(fname, fi.ModTime(), fi.ModTime())
+			},
+		},
+	}
+
+	for _, tt := range casetests {
+		fname := setupCache(t)
+		if err := cacheStore(fname, []byte(identifyJSON)); err != nil {
+			t.Fatalf("%s: cacheStore: %v", tt.name, err)
+		}
+		if _, ok := cacheLoad(fname); !ok {
+			t.Fatalf("%s: cache miss before modifying the file", tt.name)
+		}
+		if err := tt.modify(fname); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, ok := cacheLoad(fname); ok {
+			t.Errorf("%s: got cache hit after modifying the file, want miss", tt.name)
+		}
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	fname := setupCache(t)
+	if err := cacheStore(fname, []byte(identifyJSON)); err != nil {
+		t.Fatalf("cacheStore: %v", err)
+	}
+
+	// With --no-cache, existing entries are ignored and nothing is stored.
+	useParseCache = false
+	if _, ok := cacheLoad(fname); ok {
+		t.Errorf("got cache hit with the cache disabled, want miss")
+	}
+	cacheInvalidate(fname)
+	if err := cacheStore(fname, []byte(identifyJSON)); err != nil {
+		t.Fatalf("cacheStore: %v", err)
+	}
+	useParseCache = true
+	if _, ok := cacheLoad(fname); ok {
+		t.Errorf("cacheStore wrote the cache with the cache disabled")
+	}
+}
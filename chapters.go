@@ -0,0 +1,338 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// reGenericChapter matches chapter names that carry no information, like
+// "Chapter 01" or "3".
+var reGenericChapter = regexp.MustCompile(`(?i)^\s*(chapter\s*)?\d*\s*$`)
+
+// reChapterTemplate matches valid chapter name templates: exactly one integer
+// verb (E.g. "%02d") and no other verbs, except for literal percent signs.
+var reChapterTemplate = regexp.MustCompile(`^([^%]|%%)*%0?\d*d([^%]|%%)*$`)
+
+// chapterNamesOptions holds the options for chapterNames.
+type chapterNamesOptions struct {
+	// Template for the generated names, with a printf style integer verb
+	// for the chapter number (E.g. "Chapter %02d").
+	template string
+	// Use these names (in order) instead of the template.
+	names []string
+	// Rename all chapters, not only the ones with empty or generic names.
+	all bool
+	// Only show the commands (the chapters cannot be read in dry-run mode).
+	dryrun bool
+}
+
+// chapterNamer returns the new name for chapter n (base 1) given its current
+// name, and true if the chapter should be renamed. Chapters that already have
+// the new name are not renamed.
+type chapterNamer func(n int, current string) (string, bool)
+
+// newChapterNamer returns a chapterNamer for the given options.
+func newChapterNamer(opts chapterNamesOptions) (chapterNamer, error) {
+	if len(opts.names) == 0 && !reChapterTemplate.MatchString(opts.template) {
+		return nil, fmt.Errorf("invalid chapter name template %q (need exactly one integer verb, like %%02d)", opts.template)
+	}
+	return func(n int, current string) (string, bool) {
+		if !opts.all && !reGenericChapter.MatchString(current) {
+			return "", false
+		}
+		var name string
+		if len(opts.names) != 0 {
+			if n > len(opts.names) {
+				return "", false
+			}
+			name = opts.names[n-1]
+		} else {
+			name = fmt.Sprintf(opts.template, n)
+		}
+		return name, name != current
+	}, nil
+}
+
+// readChapterNames reads chapter names (one per line) from a file. Empty
+// lines are ignored.
+func readChapterNames(fname string) ([]string, error) {
+	r, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			names = append(names, line)
+		}
+	}
+	return names, scanner.Err()
+}
+
+// renameChapters copies the Matroska chapters XML in r to w, renaming the
+// chapters according to namer. Chapters are numbered in order, starting at
+// one for each edition and for the nested chapters of each chapter. Only the first ChapterString of each chapter is
+// changed, and a ChapterDisplay is added to chapters without one. All other
+// elements are copied unchanged. Returns the number of chapters renamed.
+func renameChapters(r io.Reader, w io.Writer, namer chapterNamer) (int, error) {
+	dec := xml.NewDecoder(r)
+	enc := xml.NewEncoder(w)
+
+	type atom struct {
+		n        int
+		children int  // Number of nested chapters seen.
+		display  bool // Seen a ChapterString.
+	}
+	var (
+		atoms   []*atom // Stack of (nested) chapter atoms.
+		path    []string
+		n       int
+		renamed int
+	)
+
+	// nameString returns true if the current element is the ChapterString of
+	// the innermost chapter and the chapter has no name yet.
+	nameString := func() bool {
+		l := len(path)
+		return l >= 3 && len(atoms) != 0 && !atoms[len(atoms)-1].display &&
+			path[l-1] == "ChapterString" && path[l-2] == "ChapterDisplay" && path[l-3] == "ChapterAtom"
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		tok = xml.CopyToken(tok)
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			switch t.Name.Local {
+			case "EditionEntry":
+				n = 0
+			case "ChapterAtom":
+				if len(atoms) == 0 {
+					n++
+					atoms = append(atoms, &atom{n: n})
+				} else {
+					parent := atoms[len(atoms)-1]
+					parent.children++
+					atoms = append(atoms, &atom{n: parent.children})
+				}
+			}
+			if nameString() {
+				// Read the current name and replace the whole element.
+				var current string
+				if err := dec.DecodeElement(&current, &t); err != nil {
+					return 0, err
+				}
+				path = path[:len(path)-1]
+				a := atoms[len(atoms)-1]
+				a.display = true
+				if name, ok := namer(a.n, current); ok {
+					current = name
+					renamed++
+				}
+				if err := enc.EncodeElement(current, t); err != nil {
+					return 0, err
+				}
+				continue
+			}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+			if t.Name.Local == "ChapterAtom" {
+				a := atoms[len(atoms)-1]
+				atoms = atoms[:len(atoms)-1]
+				if !a.display {
+					if name, ok := namer(a.n, ""); ok {
+						display := struct {
+							XMLName xml.Name `xml:"ChapterDisplay"`
+							String  string   `xml:"ChapterString"`
+						}{String: name}
+						if err := enc.Encode(display); err != nil {
+							return 0, err
+						}
+						renamed++
+					}
+				}
+			}
+		}
+		if err := enc.EncodeToken(tok); err != nil {
+			return 0, err
+		}
+	}
+	return renamed, enc.Flush()
+}
+
+// chaptersFrom extracts the chapters of the file fname into a new temporary
+// file, to be used as the chapters of another file. Returns the name of the
+// temporary file, which should be removed by the caller (with removeTemp).
+func chaptersFrom(fname string, cmd runner) (string, error) {
+	mkv, err := parseFile(fname)
+	if err != nil {
+		return "", err
+	}
+	nchapters := 0
+	for _, c := range mkv.Chapters {
+		nchapters += c.NumEntries
+	}
+	if nchapters == 0 {
+		return "", fmt.Errorf("%s: file has no chapters", fname)
+	}
+	return extractTemp(mkv, "chapters", cmd)
+}
+
+// chapterNames (re)generates the names of the chapters in the file, in place.
+// Returns the number of chapters renamed.
+func chapterNames(mkv matroska, opts chapterNamesOptions, cmd runner) (int, error) {
+	nchapters := 0
+	for _, c := range mkv.Chapters {
+		nchapters += c.NumEntries
+	}
+	if nchapters == 0 {
+		return 0, errors.New("file has no chapters")
+	}
+	namer, err := newChapterNamer(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	in, err := extractTemp(mkv, "chapters", cmd)
+	if err != nil {
+		return 0, err
+	}
+	defer removeTemp(in)
+
+	if opts.dryrun {
+		log.Printf("Rename chapters in %s", mkv.FileName)
+		return 0, cmd.run("mkvpropedit", mkv.FileName, "--chapters", in)
+	}
+
+	r, err := os.Open(in)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	out, err := createTemp()
+	if err != nil {
+		return 0, err
+	}
+	defer removeTemp(out.Name())
+
+	renamed, err := renameChapters(r, out, namer)
+	if err != nil {
+		out.Close()
+		return 0, fmt.Errorf("error processing chapters: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	if renamed == 0 {
+		return 0, nil
+	}
+	return renamed, cmd.run("mkvpropedit", mkv.FileName, "--chapters", out.Name())
+}
+
+// chapterEntry describes a chapter, for display.
+type chapterEntry struct {
+	edition int
+	// Chapter number in the edition ("2", or "2.1" for nested chapters).
+	number   string
+	start    string
+	end      string
+	name     string
+	language string
+}
+
+// xmlChapterAtom holds a chapter atom in the Matroska chapters XML.
+type xmlChapterAtom struct {
+	TimeStart string `xml:"ChapterTimeStart"`
+	TimeEnd   string `xml:"ChapterTimeEnd"`
+	Display   []struct {
+		String   string `xml:"ChapterString"`
+		Language string `xml:"ChapterLanguage"`
+	} `xml:"ChapterDisplay"`
+	Atoms []xmlChapterAtom `xml:"ChapterAtom"`
+}
+
+// chapterTime shortens chapter timestamps to milliseconds
+// (E.g. "00:05:00.000000000" to "00:05:00.000").
+func chapterTime(s string) string {
+	if i := strings.Index(s, "."); i >= 0 && len(s) > i+4 {
+		return s[:i+4]
+	}
+	return s
+}
+
+// parseChapters returns the chapters in the Matroska chapters XML in r, in
+// order. Editions are numbered starting at one, and only the first name of
+// each chapter is returned.
+func parseChapters(r io.Reader) ([]chapterEntry, error) {
+	var doc struct {
+		Editions []struct {
+			Atoms []xmlChapterAtom `xml:"ChapterAtom"`
+		} `xml:"EditionEntry"`
+	}
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var ret []chapterEntry
+	var walk func(edition int, prefix string, atoms []xmlChapterAtom)
+	walk = func(edition int, prefix string, atoms []xmlChapterAtom) {
+		for i, a := range atoms {
+			number := fmt.Sprintf("%s%d", prefix, i+1)
+			e := chapterEntry{
+				edition: edition,
+				number:  number,
+				start:   chapterTime(a.TimeStart),
+				end:     chapterTime(a.TimeEnd),
+			}
+			if len(a.Display) != 0 {
+				e.name = a.Display[0].String
+				e.language = a.Display[0].Language
+			}
+			ret = append(ret, e)
+			walk(edition, number+".", a.Atoms)
+		}
+	}
+	for i, ed := range doc.Editions {
+		walk(i+1, "", ed.Atoms)
+	}
+	return ret, nil
+}
+
+// readChapters extracts and returns the chapters in the file.
+func readChapters(mkv matroska, cmd runner) ([]chapterEntry, error) {
+	fname, err := extractTemp(mkv, "chapters", cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(fname)
+
+	r, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return parseChapters(r)
+}
@@ -0,0 +1,232 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenameChapters(t *testing.T) {
+	input := `<?xml version="1.0"?>
+<!DOCTYPE Chapters SYSTEM "matroskachapters.dtd">
+<Chapters>
+  <EditionEntry>
+    <ChapterAtom>
+      <ChapterTimeStart>00:00:00.000000000</ChapterTimeStart>
+      <ChapterDisplay>
+        <ChapterString>Chapter 01</ChapterString>
+        <ChapterLanguage>eng</ChapterLanguage>
+      </ChapterDisplay>
+    </ChapterAtom>
+    <ChapterAtom>
+      <ChapterTimeStart>00:05:00.000000000</ChapterTimeStart>
+      <ChapterDisplay>
+        <ChapterString>Opening</ChapterString>
+      </ChapterDisplay>
+    </ChapterAtom>
+    <ChapterAtom>
+      <ChapterTimeStart>00:10:00.000000000</ChapterTimeStart>
+    </ChapterAtom>
+  </EditionEntry>
+</Chapters>
+`
+	casetests := []struct {
+		opts        chapterNamesOptions
+		want        []string
+		wantRenamed int
+		wantError   bool
+	}{
+		// Only generic and empty names.
+		{
+			opts:        chapterNamesOptions{template: "Part %d"},
+			want:        []string{"<ChapterString>Part 1</ChapterString>", "<ChapterString>Opening</ChapterString>", "<ChapterString>Part 3</ChapterString>"},
+			wantRenamed: 2,
+		},
+		// All chapters.
+		{
+			opts:        chapterNamesOptions{template: "Chapter %02d", all: true},
+			want:        []string{"<ChapterString>Chapter 01</ChapterString>", "<ChapterString>Chapter 02</ChapterString>", "<ChapterString>Chapter 03</ChapterString>"},
+			wantRenamed: 2,
+		},
+		// Names from a list.
+		{
+			opts:        chapterNamesOptions{names: []string{"Intro", "Middle", "End"}, all: true},
+			want:        []string{"<ChapterString>Intro</ChapterString>", "<ChapterString>Middle</ChapterString>", "<ChapterString>End</ChapterString>"},
+			wantRenamed: 3,
+		},
+		// Invalid templates.
+		{opts: chapterNamesOptions{template: "Chapter"}, wantError: true},
+		{opts: chapterNamesOptions{template: "%s %d"}, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		namer, err := newChapterNamer(tt.opts)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("Got no error, want error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		var out bytes.Buffer
+		renamed, err := renameChapters(strings.NewReader(input), &out, namer)
+		if err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		if renamed != tt.wantRenamed {
+			t.Errorf("Got %d chapters renamed, want %d", renamed, tt.wantRenamed)
+		}
+		got := out.String()
+		for _, w := range tt.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("Output does not contain %q:\n%s", w, got)
+			}
+		}
+		// Other elements are preserved.
+		for _, w := range []string{"<!DOCTYPE Chapters", "<ChapterLanguage>eng</ChapterLanguage>", "<ChapterTimeStart>00:10:00.000000000</ChapterTimeStart>"} {
+			if !strings.Contains(got, w) {
+				t.Errorf("Output does not contain %q:\n%s", w, got)
+			}
+		}
+	}
+}
+
+func TestRenameChaptersTwice(t *testing.T) {
+	input := `<?xml version="1.0"?>
+<Chapters>
+  <EditionEntry>
+    <ChapterAtom>
+      <ChapterTimeStart>00:00:00.000000000</ChapterTimeStart>
+    </ChapterAtom>
+    <ChapterAtom>
+      <ChapterTimeStart>00:05:00.000000000</ChapterTimeStart>
+      <ChapterDisplay>
+        <ChapterString>2</ChapterString>
+      </ChapterDisplay>
+    </ChapterAtom>
+  </EditionEntry>
+</Chapters>
+`
+	namer, err := newChapterNamer(chapterNamesOptions{template: "Chapter %02d"})
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	var first bytes.Buffer
+	renamed, err := renameChapters(strings.NewReader(input), &first, namer)
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	if renamed != 2 {
+		t.Errorf("First run: got %d chapters renamed, want 2", renamed)
+	}
+	// The generated names are generic, but should not be renamed again.
+	var second bytes.Buffer
+	renamed, err = renameChapters(strings.NewReader(first.String()), &second, namer)
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	if renamed != 0 {
+		t.Errorf("Second run: got %d chapters renamed, want 0:\n%s", renamed, second.String())
+	}
+}
+
+func TestRenameChaptersNested(t *testing.T) {
+	input := `<?xml version="1.0"?>
+<Chapters>
+  <EditionEntry>
+    <ChapterAtom>
+      <ChapterTimeStart>00:00:00.000000000</ChapterTimeStart>
+      <ChapterAtom>
+        <ChapterTimeStart>00:01:00.000000000</ChapterTimeStart>
+      </ChapterAtom>
+      <ChapterAtom>
+        <ChapterTimeStart>00:02:00.000000000</ChapterTimeStart>
+      </ChapterAtom>
+    </ChapterAtom>
+    <ChapterAtom>
+      <ChapterTimeStart>00:05:00.000000000</ChapterTimeStart>
+      <ChapterAtom>
+        <ChapterTimeStart>00:06:00.000000000</ChapterTimeStart>
+      </ChapterAtom>
+    </ChapterAtom>
+  </EditionEntry>
+</Chapters>
+`
+	namer, err := newChapterNamer(chapterNamesOptions{template: "Part %d"})
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	var out bytes.Buffer
+	if _, err := renameChapters(strings.NewReader(input), &out, namer); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	entries, err := parseChapters(strings.NewReader(out.String()))
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.number+" "+e.name)
+	}
+	want := []string{"1 Part 1", "1.1 Part 1", "1.2 Part 2", "2 Part 2", "2.1 Part 1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestParseChapters(t *testing.T) {
+	input := `<?xml version="1.0"?>
+<!DOCTYPE Chapters SYSTEM "matroskachapters.dtd">
+<Chapters>
+  <EditionEntry>
+    <ChapterAtom>
+      <ChapterTimeStart>00:00:00.000000000</ChapterTimeStart>
+      <ChapterTimeEnd>00:05:00.000000000</ChapterTimeEnd>
+      <ChapterDisplay>
+        <ChapterString>Opening</ChapterString>
+        <ChapterLanguage>eng</ChapterLanguage>
+      </ChapterDisplay>
+      <ChapterDisplay>
+        <ChapterString>Abertura</ChapterString>
+        <ChapterLanguage>por</ChapterLanguage>
+      </ChapterDisplay>
+      <ChapterAtom>
+        <ChapterTimeStart>00:01:00.500000000</ChapterTimeStart>
+      </ChapterAtom>
+    </ChapterAtom>
+    <ChapterAtom>
+      <ChapterTimeStart>00:05:00.000000000</ChapterTimeStart>
+    </ChapterAtom>
+  </EditionEntry>
+  <EditionEntry>
+    <ChapterAtom>
+      <ChapterTimeStart>00:00:00</ChapterTimeStart>
+    </ChapterAtom>
+  </EditionEntry>
+</Chapters>
+`
+	want := []chapterEntry{
+		{edition: 1, number: "1", start: "00:00:00.000", end: "00:05:00.000", name: "Opening", language: "eng"},
+		{edition: 1, number: "1.1", start: "00:01:00.500"},
+		{edition: 1, number: "2", start: "00:05:00.000"},
+		{edition: 2, number: "1", start: "00:00:00"},
+	}
+	got, err := parseChapters(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+
+	if _, err := parseChapters(strings.NewReader("<Chapters>")); err == nil {
+		t.Errorf("Got no error, want error")
+	}
+}
@@ -0,0 +1,555 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// Parse backends (set by --parse-backend).
+const (
+	backendMkvmerge = "mkvmerge"
+	backendNative   = "native"
+)
+
+// parseBackend selects how files are parsed: using the JSON output of
+// mkvmerge --identify (default), or reading the EBML structure directly.
+var parseBackend = backendMkvmerge
+
+// parseParseBackend validates a parse backend name.
+func parseParseBackend(name string) (string, error) {
+	switch name {
+	case backendMkvmerge, backendNative:
+		return name, nil
+	}
+	return "", fmt.Errorf("invalid parse backend %q (valid: %s, %s)", name, backendMkvmerge, backendNative)
+}
+
+// EBML/Matroska element IDs used by the native parser.
+const (
+	ebmlHeader     = 0x1A45DFA3
+	ebmlDocType    = 0x4282
+	mkvSegment     = 0x18538067
+	mkvInfo        = 0x1549A966
+	mkvTimecode    = 0x2AD7B1
+	mkvDuration    = 0x4489
+	mkvTitle       = 0x7BA9
+	mkvMuxingApp   = 0x4D80
+	mkvWritingApp  = 0x5741
+	mkvTracks      = 0x1654AE6B
+	mkvTrackEntry  = 0xAE
+	mkvTrackNumber = 0xD7
+	mkvTrackUID    = 0x73C5
+	mkvTrackType   = 0x83
+	mkvCodecID     = 0x86
+	mkvTrackName   = 0x536E
+	mkvLanguage    = 0x22B59C
+	mkvLangIETF    = 0x22B59D
+	mkvFlagDefault = 0x88
+	mkvFlagEnabled = 0xB9
+	mkvFlagForced  = 0x55AA
+	mkvVideo       = 0xE0
+	mkvPixelWidth  = 0xB0
+	mkvPixelHeight = 0xBA
+	mkvAudio       = 0xE1
+	mkvSampling    = 0xB5
+	mkvChannels    = 0x9F
+	mkvAttachments = 0x1941A469
+	mkvAttached    = 0x61A7
+	mkvFileName    = 0x466E
+	mkvFileMime    = 0x4660
+	mkvFileData    = 0x465C
+	mkvFileUID     = 0x46AE
+	mkvFileDesc    = 0x467E
+	mkvChapters    = 0x1043A770
+	mkvEdition     = 0x45B9
+	mkvChapterAtom = 0xB6
+)
+
+// trackTypes maps Matroska track types to the names used by mkvmerge.
+// Other track types are ignored.
+var trackTypes = map[uint64]string{
+	1:    typeVideo,
+	2:    typeAudio,
+	0x11: typeSubtitle,
+	0x12: "buttons",
+}
+
+// errUnknownSize is returned when an element with an unknown size can't be
+// skipped.
+var errUnknownSize = errors.New("element with unknown size")
+
+// ebmlReader reads EBML elements from a file.
+type ebmlReader struct {
+	r io.ReadSeeker
+}
+
+// vint reads an EBML variable size integer. Element IDs keep the length
+// marker, sizes don't. Returns -1 for sizes with all bits set (unknown size).
+func (e ebmlReader) vint(id bool) (int64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(e.r, b[:1]); err != nil {
+		return 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && b[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, errors.New("invalid variable size integer")
+	}
+	if _, err := io.ReadFull(e.r, b[1:length]); err != nil {
+		return 0, err
+	}
+	if !id {
+		b[0] &= 0xFF >> length
+	}
+	var v uint64
+	for i := 0; i < length; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	if !id && v == 1<<(7*uint(length))-1 {
+		return -1, nil
+	}
+	return int64(v), nil
+}
+
+// walk reads the elements from the current position up to end (-1 = end of
+// file), calling fn for each element, with the element ID and size (-1 if
+// unknown). After fn returns, the reader skips to the next element, so fn
+// only needs to read what it needs.
+func (e ebmlReader) walk(end int64, fn func(id, size int64) error) error {
+	for {
+		pos, err := e.r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if end >= 0 && pos >= end {
+			return nil
+		}
+		id, err := e.vint(true)
+		if err == io.EOF && end < 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size, err := e.vint(false)
+		if err != nil {
+			return err
+		}
+		start, err := e.r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if err := fn(id, size); err != nil {
+			return err
+		}
+		if size < 0 {
+			return errUnknownSize
+		}
+		if _, err := e.r.Seek(start+size, io.SeekStart); err != nil {
+			return err
+		}
+	}
+}
+
+// children walks the children of a master element of the given size.
+func (e ebmlReader) children(size int64, fn func(id, size int64) error) error {
+	pos, err := e.r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return e.walk(pos+size, fn)
+}
+
+// data reads the contents of a (small) element.
+func (e ebmlReader) data(size int64) ([]byte, error) {
+	if size < 0 || size > 1<<20 {
+		return nil, fmt.Errorf("invalid element size: %d", size)
+	}
+	buf := make([]byte, size)
+	_, err := io.ReadFull(e.r, buf)
+	return buf, err
+}
+
+// uint reads an unsigned integer element.
+func (e ebmlReader) uint(size int64) (uint64, error) {
+	if size > 8 {
+		return 0, fmt.Errorf("invalid integer size: %d", size)
+	}
+	buf, err := e.data(size)
+	var v uint64
+	for _, b := range buf {
+		v = v<<8 | uint64(b)
+	}
+	return v, err
+}
+
+// float reads a floating point element.
+func (e ebmlReader) float(size int64) (float64, error) {
+	buf, err := e.data(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 0:
+		return 0, nil
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(buf))), nil
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(buf)), nil
+	}
+	return 0, fmt.Errorf("invalid float size: %d", size)
+}
+
+// str reads a string element. Strings may be padded with zeroes.
+func (e ebmlReader) str(size int64) (string, error) {
+	buf, err := e.data(size)
+	return strings.TrimRight(string(buf), "\x00"), err
+}
+
+// nativeInfo holds the information read by the native parser, using the
+// field names of the mkvmerge JSON output, so it can be decoded into a
+// matroska struct.
+type nativeInfo struct {
+	FileName  string `json:"file_name"`
+	Container struct {
+		Recognized bool   `json:"recognized"`
+		Supported  bool   `json:"supported"`
+		Type       string `json:"type"`
+		Properties struct {
+			Duration           int64  `json:"duration,omitempty"`
+			Title              string `json:"title,omitempty"`
+			MuxingApplication  string `json:"muxing_application,omitempty"`
+			WritingApplication string `json:"writing_application,omitempty"`
+		} `json:"properties"`
+	} `json:"container"`
+	Tracks      []nativeTrack      `json:"tracks"`
+	Attachments []nativeAttachment `json:"attachments"`
+	Chapters    []nativeChapters   `json:"chapters"`
+}
+
+type nativeTrack struct {
+	Codec      string `json:"codec"`
+	ID         int    `json:"id"`
+	Type       string `json:"type"`
+	Properties struct {
+		Number                 uint64 `json:"number"`
+		UID                    uint64 `json:"uid"`
+		CodecID                string `json:"codec_id"`
+		TrackName              string `json:"track_name,omitempty"`
+		Language               string `json:"language"`
+		LanguageIetf           string `json:"language_ietf,omitempty"`
+		DefaultTrack           bool   `json:"default_track"`
+		EnabledTrack           bool   `json:"enabled_track"`
+		ForcedTrack            bool   `json:"forced_track"`
+		TextSubtitles          bool   `json:"text_subtitles"`
+		PixelDimensions        string `json:"pixel_dimensions,omitempty"`
+		AudioChannels          uint64 `json:"audio_channels,omitempty"`
+		AudioSamplingFrequency int    `json:"audio_sampling_frequency,omitempty"`
+	} `json:"properties"`
+}
+
+type nativeAttachment struct {
+	ID          int    `json:"id"`
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	Description string `json:"description,omitempty"`
+	Size        int64  `json:"size"`
+	Properties  struct {
+		UID uint64 `json:"uid"`
+	} `json:"properties"`
+}
+
+type nativeChapters struct {
+	NumEntries int `json:"num_entries"`
+}
+
+// parseNative parses a Matroska (or WebM) file by reading its EBML structure
+// directly, without running mkvmerge. Only the most common fields are filled:
+// container title and duration, tracks, attachments, and chapters. Tags are
+// not read and codec names are the Matroska codec IDs.
+func parseNative(fname string) (matroska, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return matroska{}, err
+	}
+	defer f.Close()
+
+	info, err := readNative(f)
+	if err != nil {
+		return matroska{}, fmt.Errorf("native parser: %v", err)
+	}
+	info.FileName = fname
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return matroska{}, err
+	}
+	var mkv matroska
+	if err := json.Unmarshal(data, &mkv); err != nil {
+		return matroska{}, err
+	}
+	return mkv, nil
+}
+
+// readNative reads the EBML header and the top level elements of the segment.
+func readNative(r io.ReadSeeker) (nativeInfo, error) {
+	var info nativeInfo
+	e := ebmlReader{r: r}
+
+	// EBML header.
+	id, err := e.vint(true)
+	if err != nil || id != ebmlHeader {
+		return info, errors.New("not a Matroska file")
+	}
+	size, err := e.vint(false)
+	if err != nil || size < 0 {
+		return info, errors.New("invalid EBML header")
+	}
+	doctype := ""
+	err = e.children(size, func(id, size int64) error {
+		if id == ebmlDocType {
+			doctype, err = e.str(size)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return info, err
+	}
+	if doctype != "matroska" && doctype != "webm" {
+		return info, fmt.Errorf("unsupported document type %q", doctype)
+	}
+	info.Container.Recognized = true
+	info.Container.Supported = true
+	info.Container.Type = "Matroska"
+
+	// Segment. Elements with unknown sizes (usually clusters in live streams)
+	// end the parsing, since they can't be skipped.
+	err = e.walk(-1, func(id, size int64) error {
+		if id != mkvSegment {
+			return nil
+		}
+		end := int64(-1)
+		if size >= 0 {
+			pos, err := r.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			end = pos + size
+		}
+		err := e.walk(end, func(id, size int64) error {
+			switch id {
+			case mkvInfo:
+				return readNativeInfo(e, size, &info)
+			case mkvTracks:
+				return readNativeTracks(e, size, &info)
+			case mkvAttachments:
+				return readNativeAttachments(e, size, &info)
+			case mkvChapters:
+				return readNativeChapters(e, size, &info)
+			}
+			return nil
+		})
+		if err != nil && err != errUnknownSize {
+			return err
+		}
+		// Only one segment is read.
+		return io.EOF
+	})
+	if err == io.EOF || err == errUnknownSize {
+		err = nil
+	}
+	return info, err
+}
+
+// readNativeInfo reads the segment information.
+func readNativeInfo(e ebmlReader, size int64, info *nativeInfo) error {
+	scale := uint64(1000000)
+	var duration float64
+
+	err := e.children(size, func(id, size int64) error {
+		var err error
+		switch id {
+		case mkvTimecode:
+			scale, err = e.uint(size)
+		case mkvDuration:
+			duration, err = e.float(size)
+		case mkvTitle:
+			info.Container.Properties.Title, err = e.str(size)
+		case mkvMuxingApp:
+			info.Container.Properties.MuxingApplication, err = e.str(size)
+		case mkvWritingApp:
+			info.Container.Properties.WritingApplication, err = e.str(size)
+		}
+		return err
+	})
+	// Duration is in timecode scale units. mkvmerge reports nanoseconds.
+	info.Container.Properties.Duration = int64(duration * float64(scale))
+	return err
+}
+
+// readNativeTracks reads the track entries. Tracks are numbered in order,
+// starting at zero, like mkvmerge does.
+func readNativeTracks(e ebmlReader, size int64, info *nativeInfo) error {
+	return e.children(size, func(id, size int64) error {
+		if id != mkvTrackEntry {
+			return nil
+		}
+		var (
+			t      nativeTrack
+			ttype  uint64
+			width  uint64
+			height uint64
+		)
+		// Matroska defaults.
+		t.Properties.Language = "eng"
+		t.Properties.DefaultTrack = true
+		t.Properties.EnabledTrack = true
+
+		err := e.children(size, func(id, size int64) error {
+			var (
+				v   uint64
+				err error
+			)
+			switch id {
+			case mkvTrackNumber:
+				t.Properties.Number, err = e.uint(size)
+			case mkvTrackUID:
+				t.Properties.UID, err = e.uint(size)
+			case mkvTrackType:
+				ttype, err = e.uint(size)
+			case mkvCodecID:
+				t.Properties.CodecID, err = e.str(size)
+			case mkvTrackName:
+				t.Properties.TrackName, err = e.str(size)
+			case mkvLanguage:
+				t.Properties.Language, err = e.str(size)
+			case mkvLangIETF:
+				t.Properties.LanguageIetf, err = e.str(size)
+			case mkvFlagDefault:
+				v, err = e.uint(size)
+				t.Properties.DefaultTrack = v != 0
+			case mkvFlagEnabled:
+				v, err = e.uint(size)
+				t.Properties.EnabledTrack = v != 0
+			case mkvFlagForced:
+				v, err = e.uint(size)
+				t.Properties.ForcedTrack = v != 0
+			case mkvVideo:
+				err = e.children(size, func(id, size int64) error {
+					var err error
+					switch id {
+					case mkvPixelWidth:
+						width, err = e.uint(size)
+					case mkvPixelHeight:
+						height, err = e.uint(size)
+					}
+					return err
+				})
+			case mkvAudio:
+				err = e.children(size, func(id, size int64) error {
+					var (
+						freq float64
+						err  error
+					)
+					switch id {
+					case mkvSampling:
+						freq, err = e.float(size)
+						t.Properties.AudioSamplingFrequency = int(freq)
+					case mkvChannels:
+						t.Properties.AudioChannels, err = e.uint(size)
+					}
+					return err
+				})
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		t.Type = trackTypes[ttype]
+		if t.Type == "" {
+			return nil
+		}
+		t.ID = len(info.Tracks)
+		t.Codec = t.Properties.CodecID
+		t.Properties.TextSubtitles = t.Type == typeSubtitle && (strings.HasPrefix(t.Properties.CodecID, "S_TEXT/") ||
+			t.Properties.CodecID == "S_SSA" || t.Properties.CodecID == "S_ASS")
+		if width != 0 && height != 0 {
+			t.Properties.PixelDimensions = fmt.Sprintf("%dx%d", width, height)
+		}
+		info.Tracks = append(info.Tracks, t)
+		return nil
+	})
+}
+
+// readNativeAttachments reads the attached files (without their contents).
+// Attachments are numbered in order, starting at one, like mkvmerge does.
+func readNativeAttachments(e ebmlReader, size int64, info *nativeInfo) error {
+	return e.children(size, func(id, size int64) error {
+		if id != mkvAttached {
+			return nil
+		}
+		a := nativeAttachment{ID: len(info.Attachments) + 1}
+		err := e.children(size, func(id, size int64) error {
+			var err error
+			switch id {
+			case mkvFileName:
+				a.FileName, err = e.str(size)
+			case mkvFileMime:
+				a.ContentType, err = e.str(size)
+			case mkvFileDesc:
+				a.Description, err = e.str(size)
+			case mkvFileUID:
+				a.Properties.UID, err = e.uint(size)
+			case mkvFileData:
+				a.Size = size
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		info.Attachments = append(info.Attachments, a)
+		return nil
+	})
+}
+
+// readNativeChapters counts the chapters (including nested chapters) in each
+// edition.
+func readNativeChapters(e ebmlReader, size int64, info *nativeInfo) error {
+	var count func(size int64) (int, error)
+	count = func(size int64) (int, error) {
+		n := 0
+		err := e.children(size, func(id, size int64) error {
+			if id != mkvChapterAtom {
+				return nil
+			}
+			nested, err := count(size)
+			n += 1 + nested
+			return err
+		})
+		return n, err
+	}
+
+	return e.children(size, func(id, size int64) error {
+		if id != mkvEdition {
+			return nil
+		}
+		n, err := count(size)
+		info.Chapters = append(info.Chapters, nativeChapters{NumEntries: n})
+		return err
+	})
+}
@@ -0,0 +1,206 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// ebmlID encodes an element ID (which already contains the length marker).
+func ebmlID(id int64) []byte {
+	var ret []byte
+	for ; id != 0; id >>= 8 {
+		ret = append([]byte{byte(id)}, ret...)
+	}
+	return ret
+}
+
+// ebmlElement encodes an element with a 8-byte size (-1 = unknown size).
+func ebmlElement(id int64, size int, data ...[]byte) []byte {
+	body := bytes.Join(data, nil)
+	if size == 0 {
+		size = len(body)
+	}
+	buf := make([]byte, 8)
+	if size < 0 {
+		binary.BigEndian.PutUint64(buf, 1<<56-1)
+	} else {
+		binary.BigEndian.PutUint64(buf, uint64(size))
+	}
+	buf[0] |= 0x01
+	return bytes.Join([][]byte{ebmlID(id), buf, body}, nil)
+}
+
+func ebmlMaster(id int64, data ...[]byte) []byte { return ebmlElement(id, 0, data...) }
+func ebmlString(id int64, s string) []byte       { return ebmlElement(id, 0, []byte(s)) }
+func ebmlUint(id int64, v uint64) []byte         { return ebmlElement(id, 0, []byte{byte(v >> 8), byte(v)}) }
+
+func ebmlFloat(id int64, f float64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(f))
+	return ebmlElement(id, 0, buf)
+}
+
+func TestReadNative(t *testing.T) {
+	header := ebmlMaster(ebmlHeader, ebmlString(ebmlDocType, "matroska"))
+	info := ebmlMaster(mkvInfo, ebmlString(mkvTitle, "Title"), ebmlFloat(mkvDuration, 1500))
+	tracks := ebmlMaster(mkvTracks,
+		ebmlMaster(mkvTrackEntry,
+			ebmlUint(mkvTrackNumber, 1), ebmlUint(mkvTrackType, 1), ebmlString(mkvCodecID, "V_MPEG4/ISO/AVC"),
+			ebmlString(mkvLanguage, "und"),
+			ebmlMaster(mkvVideo, ebmlUint(mkvPixelWidth, 1920), ebmlUint(mkvPixelHeight, 1080))),
+		// Logo track (ignored).
+		ebmlMaster(mkvTrackEntry, ebmlUint(mkvTrackNumber, 2), ebmlUint(mkvTrackType, 0x10)),
+		ebmlMaster(mkvTrackEntry,
+			ebmlUint(mkvTrackNumber, 3), ebmlUint(mkvTrackType, 2), ebmlString(mkvCodecID, "A_AAC"),
+			ebmlMaster(mkvAudio, ebmlFloat(mkvSampling, 48000), ebmlUint(mkvChannels, 2))),
+		ebmlMaster(mkvTrackEntry,
+			ebmlUint(mkvTrackNumber, 4), ebmlUint(mkvTrackType, 0x11), ebmlString(mkvCodecID, "S_TEXT/UTF8"),
+			ebmlString(mkvLanguage, "por\x00"), ebmlString(mkvLangIETF, "pt-BR"), ebmlString(mkvTrackName, "Forced"),
+			ebmlUint(mkvFlagDefault, 0), ebmlUint(mkvFlagForced, 1)))
+	attachments := ebmlMaster(mkvAttachments,
+		ebmlMaster(mkvAttached,
+			ebmlString(mkvFileName, "font.ttf"), ebmlString(mkvFileMime, "font/ttf"),
+			ebmlElement(mkvFileData, 0, make([]byte, 100))))
+	chapters := ebmlMaster(mkvChapters,
+		ebmlMaster(mkvEdition, ebmlMaster(mkvChapterAtom, ebmlMaster(mkvChapterAtom)), ebmlMaster(mkvChapterAtom)))
+	// Unknown size clusters stop the parsing.
+	cluster := ebmlElement(0x1F43B675, -1, []byte{0xEC, 0x80})
+
+	casetests := []struct {
+		data      []byte
+		want      nativeInfo
+		wantError bool
+	}{
+		{
+			data: bytes.Join([][]byte{header, ebmlMaster(mkvSegment, info, tracks, attachments, chapters)}, nil),
+			want: func() nativeInfo {
+				var n nativeInfo
+				n.Container.Recognized = true
+				n.Container.Supported = true
+				n.Container.Type = "Matroska"
+				n.Container.Properties.Title = "Title"
+				n.Container.Properties.Duration = 1500000000
+
+				var v, a, s nativeTrack
+				v.ID, v.Type, v.Codec = 0, typeVideo, "V_MPEG4/ISO/AVC"
+				v.Properties.Number, v.Properties.CodecID, v.Properties.Language = 1, "V_MPEG4/ISO/AVC", "und"
+				v.Properties.DefaultTrack, v.Properties.EnabledTrack = true, true
+				v.Properties.PixelDimensions = "1920x1080"
+
+				a.ID, a.Type, a.Codec = 1, typeAudio, "A_AAC"
+				a.Properties.Number, a.Properties.CodecID, a.Properties.Language = 3, "A_AAC", "eng"
+				a.Properties.DefaultTrack, a.Properties.EnabledTrack = true, true
+				a.Properties.AudioSamplingFrequency, a.Properties.AudioChannels = 48000, 2
+
+				s.ID, s.Type, s.Codec = 2, typeSubtitle, "S_TEXT/UTF8"
+				s.Properties.Number, s.Properties.CodecID, s.Properties.Language = 4, "S_TEXT/UTF8", "por"
+				s.Properties.LanguageIetf, s.Properties.TrackName = "pt-BR", "Forced"
+				s.Properties.EnabledTrack, s.Properties.ForcedTrack, s.Properties.TextSubtitles = true, true, true
+
+				n.Tracks = []nativeTrack{v, a, s}
+				n.Attachments = []nativeAttachment{{ID: 1, FileName: "font.ttf", ContentType: "font/ttf", Size: 100}}
+				n.Chapters = []nativeChapters{{NumEntries: 3}}
+				return n
+			}(),
+		},
+		// Unknown size segment and cluster.
+		{
+			data: bytes.Join([][]byte{header, ebmlElement(mkvSegment, -1, info, cluster, tracks)}, nil),
+			want: func() nativeInfo {
+				var n nativeInfo
+				n.Container.Recognized = true
+				n.Container.Supported = true
+				n.Container.Type = "Matroska"
+				n.Container.Properties.Title = "Title"
+				n.Container.Properties.Duration = 1500000000
+				return n
+			}(),
+		},
+		// Not a Matroska file.
+		{
+			data:      []byte("RIFF....AVI LIST"),
+			wantError: true,
+		},
+		// Unsupported document type.
+		{
+			data:      ebmlMaster(ebmlHeader, ebmlString(ebmlDocType, "foobar")),
+			wantError: true,
+		},
+	}
+
+	for _, tt := range casetests {
+		got, err := readNative(bytes.NewReader(tt.data))
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("diff:\ngot:  %+v\nwant: %+v", got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
+
+// Track and attachment UIDs are unsigned 64-bit integers, and must survive
+// the conversion to the mkvmerge JSON format with the high bit set.
+func TestReadNativeLargeUID(t *testing.T) {
+	const uid = uint64(0xFEDCBA9876543210)
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uid)
+
+	data := bytes.Join([][]byte{
+		ebmlMaster(ebmlHeader, ebmlString(ebmlDocType, "matroska")),
+		ebmlMaster(mkvSegment,
+			ebmlMaster(mkvTracks, ebmlMaster(mkvTrackEntry,
+				ebmlUint(mkvTrackNumber, 1), ebmlUint(mkvTrackType, 1), ebmlElement(mkvTrackUID, 0, buf))),
+			ebmlMaster(mkvAttachments, ebmlMaster(mkvAttached,
+				ebmlString(mkvFileName, "font.ttf"), ebmlElement(mkvFileUID, 0, buf)))),
+	}, nil)
+
+	info, err := readNative(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	js, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mkv matroska
+	if err := json.Unmarshal(js, &mkv); err != nil {
+		t.Fatalf("Got error %q decoding JSON, want no error", err)
+	}
+	if len(mkv.Tracks) != 1 || mkv.Tracks[0].Properties.UID != uid {
+		t.Errorf("Track UID: got %+v, want %d", mkv.Tracks, uid)
+	}
+	if len(mkv.Attachments) != 1 || mkv.Attachments[0].Properties.UID != uid {
+		t.Errorf("Attachment UID: got %+v, want %d", mkv.Attachments, uid)
+	}
+	// Integers larger than 8 bytes are invalid.
+	if _, err := (ebmlReader{r: bytes.NewReader(make([]byte, 9))}).uint(9); err == nil {
+		t.Errorf("uint(9): Got no error, want error")
+	}
+}
+
+func TestParseParseBackend(t *testing.T) {
+	for _, name := range []string{backendMkvmerge, backendNative} {
+		if got, err := parseParseBackend(name); err != nil || got != name {
+			t.Errorf("parseParseBackend(%q): got %q, %v", name, got, err)
+		}
+	}
+	if _, err := parseParseBackend("ffprobe"); err == nil {
+		t.Errorf("parseParseBackend(\"ffprobe\"): Got no error, want error")
+	}
+}
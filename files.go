@@ -0,0 +1,302 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Valid sort modes for the list of input files.
+const (
+	sortNone    = ""
+	sortName    = "name"
+	sortMtime   = "mtime"
+	sortSize    = "size"
+	sortNatural = "natural"
+)
+
+// mediaExtensions contains the extensions of files considered when walking
+// directories.
+var mediaExtensions = map[string]bool{
+	".mkv":  true,
+	".mka":  true,
+	".mks":  true,
+	".mk3d": true,
+	".webm": true,
+}
+
+// walkFiles returns the media files (by extension) under each of the root
+// directories. Roots that are not directories are returned unchanged. A
+// maxDepth greater than zero limits how deep the walk descends: 1 means only
+// files directly inside the root, 2 includes its immediate subdirectories,
+// and so on. Paths that cannot be read (E.g. directories without permission)
+// are skipped, and the walk continues with the next path. Returns the files
+// found and one error message per skipped path.
+func walkFiles(roots []string, maxDepth int) ([]string, []string) {
+	var (
+		ret     []string
+		errmsgs []string
+	)
+
+	for _, root := range roots {
+		_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// The error includes the path.
+				errmsgs = append(errmsgs, err.Error())
+				return nil
+			}
+			if path == root {
+				if !d.IsDir() {
+					ret = append(ret, path)
+				}
+				return nil
+			}
+			if d.IsDir() {
+				rel, err := filepath.Rel(root, path)
+				if err != nil {
+					errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", path, err))
+					return filepath.SkipDir
+				}
+				if maxDepth > 0 && len(strings.Split(rel, string(filepath.Separator))) >= maxDepth {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if mediaExtensions[strings.ToLower(filepath.Ext(path))] {
+				ret = append(ret, path)
+			}
+			return nil
+		})
+	}
+	return ret, errmsgs
+}
+
+// sortFiles returns a sorted copy of the list of files, according to mode.
+// Sorting is stable, so files comparing equal retain their original order.
+// Files that cannot be stat'ed sort as if they had a zero size and mtime.
+func sortFiles(fnames []string, mode string) ([]string, error) {
+	ret := append([]string{}, fnames...)
+
+	switch mode {
+	case sortNone:
+	case sortName:
+		sort.SliceStable(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	case sortNatural:
+		sort.SliceStable(ret, func(i, j int) bool { return naturalLess(ret[i], ret[j]) })
+	case sortMtime, sortSize:
+		info := map[string]os.FileInfo{}
+		for _, f := range ret {
+			if fi, err := os.Stat(f); err == nil {
+				info[f] = fi
+			}
+		}
+		sort.SliceStable(ret, func(i, j int) bool {
+			fi, fj := info[ret[i]], info[ret[j]]
+			switch {
+			case fi == nil:
+				return fj != nil
+			case fj == nil:
+				return false
+			case mode == sortSize:
+				return fi.Size() < fj.Size()
+			}
+			return fi.ModTime().Before(fj.ModTime())
+		})
+	default:
+		return nil, fmt.Errorf("invalid sort mode %q (valid: %s, %s, %s, %s)", mode, sortName, sortMtime, sortSize, sortNatural)
+	}
+	return ret, nil
+}
+
+// isDigit returns true if the byte is an ASCII digit.
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// naturalLess compares two strings using "natural" ordering, where sequences
+// of digits are compared by their numeric value. This causes "Episode 2" to
+// sort before "Episode 10". Non-numeric parts are compared case-insensitively.
+func naturalLess(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			// Extract the numeric chunks and compare them. Leading zeroes are
+			// ignored, so longer chunks mean larger numbers.
+			i, j := 0, 0
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			na, nb := strings.TrimLeft(a[:i], "0"), strings.TrimLeft(b[:j], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[i:], b[j:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// processFiles calls fn for each file, using up to jobs concurrent workers.
+// The output of each call is buffered and written to out atomically, in the
+// same order as the input files, so output from concurrent workers is never
+// interleaved. Returns the list of errors (prefixed by the filename).
+func processFiles(out io.Writer, fnames []string, jobs int, fn func(w io.Writer, fname string) error) []string {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	type result struct {
+		buf  bytes.Buffer
+		err  error
+		done chan struct{}
+	}
+
+	results := make([]*result, len(fnames))
+	for i := range results {
+		results[i] = &result{done: make(chan struct{})}
+	}
+
+	go func() {
+		sem := make(chan struct{}, jobs)
+		for i, fname := range fnames {
+			sem <- struct{}{}
+			go func(r *result, fname string) {
+				defer func() { <-sem }()
+				r.err = fn(&r.buf, fname)
+				close(r.done)
+			}(results[i], fname)
+		}
+	}()
+
+	var errmsgs []string
+	for i, r := range results {
+		<-r.done
+		_, _ = out.Write(r.buf.Bytes())
+		if r.err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", fnames[i], r.err))
+		}
+	}
+	return errmsgs
+}
+
+// sameFile returns true if a and b are the same existing file, even if the
+// paths are different (E.g. relative and absolute paths, or paths through
+// symbolic links).
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
+
+// moveFile moves src to dst. If the files are in different filesystems, src
+// is copied to dst and removed. The access and modification times of the
+// original file are preserved (see accessTime), unless resetTimes is set, in
+// which case both are set to the current time.
+func moveFile(src, dst string, resetTimes bool) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+		if err := copyFile(src, dst, fi.Mode()); err != nil {
+			return err
+		}
+		if err := os.Remove(src); err != nil {
+			return err
+		}
+	}
+	if resetTimes {
+		now := time.Now()
+		return os.Chtimes(dst, now, now)
+	}
+	return os.Chtimes(dst, accessTime(fi), fi.ModTime())
+}
+
+// replaceInPlace calls fn with the name of a new temporary file in the same
+// directory as fname, and renames the temporary file over fname if fn
+// succeeds. The temporary file is removed if fn fails, leaving fname
+// untouched. The temporary file is in the same directory as fname, so the
+// rename is atomic.
+func replaceInPlace(fname string, dryrun bool, fn func(tmp string) error) error {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return err
+	}
+	// Keep the extension, as some tools use it to determine the output format.
+	f, err := ioutil.TempFile(filepath.Dir(fname), "."+filepath.Base(fname)+".*"+filepath.Ext(fname))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	registerTemp(tmp)
+	// No-op after a successful rename.
+	defer removeTemp(tmp)
+
+	if err := fn(tmp); err != nil {
+		return err
+	}
+	if dryrun {
+		log.Printf("Replace %s with %s", fname, tmp)
+		return nil
+	}
+	if err := os.Chmod(tmp, fi.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// copyFile copies src into a new file dst, with the given permissions.
+func copyFile(src, dst string, perm fs.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		os.Remove(dst)
+		return err
+	}
+	return w.Close()
+}
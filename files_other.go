@@ -0,0 +1,19 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the modification time of the file, as the access time
+// is not available in this platform.
+func accessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
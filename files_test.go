@@ -0,0 +1,310 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSortFiles(t *testing.T) {
+	casetests := []struct {
+		fnames    []string
+		mode      string
+		want      []string
+		wantError bool
+	}{
+		// No sorting.
+		{
+			fnames: []string{"b", "a", "c"},
+			mode:   sortNone,
+			want:   []string{"b", "a", "c"},
+		},
+		// Lexical sorting.
+		{
+			fnames: []string{"Episode 10.mkv", "Episode 2.mkv", "Episode 1.mkv"},
+			mode:   sortName,
+			want:   []string{"Episode 1.mkv", "Episode 10.mkv", "Episode 2.mkv"},
+		},
+		// Natural sorting.
+		{
+			fnames: []string{"Episode 10.mkv", "Episode 2.mkv", "episode 1.mkv", "Episode 02b.mkv"},
+			mode:   sortNatural,
+			want:   []string{"episode 1.mkv", "Episode 2.mkv", "Episode 02b.mkv", "Episode 10.mkv"},
+		},
+		{
+			fnames: []string{"Show S01E10", "Show S01E09", "Show S02E01", "Show"},
+			mode:   sortNatural,
+			want:   []string{"Show", "Show S01E09", "Show S01E10", "Show S02E01"},
+		},
+		// Invalid mode.
+		{
+			fnames:    []string{"a"},
+			mode:      "foobar",
+			wantError: true,
+		},
+	}
+
+	for _, tt := range casetests {
+		got, err := sortFiles(tt.fnames, tt.mode)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("sort diff: Got %v, want %v", got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
+
+func TestWalkFiles(t *testing.T) {
+	root := t.TempDir()
+	for _, f := range []string{
+		"a.mkv",
+		"notes.txt",
+		"Season 1/s01e01.mkv",
+		"Season 1/extras/deleted.mkv",
+	} {
+		path := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	casetests := []struct {
+		maxDepth int
+		want     []string
+	}{
+		{
+			maxDepth: 0,
+			want:     []string{"Season 1/extras/deleted.mkv", "Season 1/s01e01.mkv", "a.mkv"},
+		},
+		{
+			maxDepth: 1,
+			want:     []string{"a.mkv"},
+		},
+		{
+			maxDepth: 2,
+			want:     []string{"Season 1/s01e01.mkv", "a.mkv"},
+		},
+	}
+
+	for _, tt := range casetests {
+		got, errmsgs := walkFiles([]string{root}, tt.maxDepth)
+		if len(errmsgs) != 0 {
+			t.Fatalf("Got errors %q want no errors", errmsgs)
+		}
+		var want []string
+		for _, f := range tt.want {
+			want = append(want, filepath.Join(root, f))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("maxDepth %d: Got %v, want %v", tt.maxDepth, got, want)
+		}
+	}
+}
+
+func TestWalkFilesErrors(t *testing.T) {
+	root := t.TempDir()
+	for _, f := range []string{"a/1.mkv", "b/2.mkv", "c/3.mkv"} {
+		path := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	missing := filepath.Join(root, "missing")
+	want := []string{filepath.Join(root, "a/1.mkv"), filepath.Join(root, "c/3.mkv")}
+	wantErrors := 2
+
+	// Unreadable directory (permissions don't apply to root).
+	unreadable := filepath.Join(root, "b")
+	if os.Geteuid() == 0 {
+		want = []string{filepath.Join(root, "a/1.mkv"), filepath.Join(root, "b/2.mkv"), filepath.Join(root, "c/3.mkv")}
+		wantErrors = 1
+	} else {
+		if err := os.Chmod(unreadable, 0); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(unreadable, 0o755)
+	}
+
+	// Errors don't stop the walk.
+	got, errmsgs := walkFiles([]string{missing, root}, 0)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	if len(errmsgs) != wantErrors {
+		t.Errorf("Got errors %q, want %d error(s)", errmsgs, wantErrors)
+	}
+}
+
+func TestProcessFiles(t *testing.T) {
+	fnames := []string{"a", "b", "c", "d", "e"}
+	delays := map[string]time.Duration{"a": 30, "b": 0, "c": 20, "d": 10, "e": 0}
+
+	var out bytes.Buffer
+	errmsgs := processFiles(&out, fnames, 4, func(w io.Writer, fname string) error {
+		// Files finish in a different order than the input.
+		time.Sleep(delays[fname] * time.Millisecond)
+		if fname == "c" {
+			return errors.New("failed")
+		}
+		fmt.Fprintf(w, "%s1\n", fname)
+		fmt.Fprintf(w, "%s2\n", fname)
+		return nil
+	})
+
+	want := "a1\na2\nb1\nb2\nd1\nd2\ne1\ne2\n"
+	if out.String() != want {
+		t.Errorf("output diff: Got %q, want %q", out.String(), want)
+	}
+	wantErrs := []string{"c: failed"}
+	if !reflect.DeepEqual(errmsgs, wantErrs) {
+		t.Errorf("errors diff: Got %v, want %v", errmsgs, wantErrs)
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	atime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+
+	for _, resetTimes := range []bool{false, true} {
+		src := filepath.Join(dir, "src.mkv")
+		dst := filepath.Join(dir, fmt.Sprintf("dst-%v.mkv", resetTimes))
+		if err := ioutil.WriteFile(src, []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(src, atime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		srcfi, err := os.Stat(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := moveFile(src, dst, resetTimes); err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		if _, err := os.Stat(src); !os.IsNotExist(err) {
+			t.Errorf("Source file %q still exists after move", src)
+		}
+		fi, err := os.Stat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.ModTime().Equal(mtime); got == resetTimes {
+			t.Errorf("resetTimes=%v: Got mtime %v, original mtime %v", resetTimes, fi.ModTime(), mtime)
+		}
+		// The access time is only available in some platforms.
+		if got := accessTime(fi).Equal(accessTime(srcfi)); got == resetTimes {
+			t.Errorf("resetTimes=%v: Got atime %v, original atime %v", resetTimes, accessTime(fi), accessTime(srcfi))
+		}
+	}
+}
+
+func TestSameFile(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.mkv")
+	b := filepath.Join(dir, "b.mkv")
+	for _, f := range []string{a, b} {
+		if err := ioutil.WriteFile(f, []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+
+	casetests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: a, b: a, want: true},
+		{a: a, b: filepath.Join(link, "a.mkv"), want: true},
+		{a: a, b: filepath.Join(dir, ".", "a.mkv"), want: true},
+		{a: a, b: b},
+		{a: a, b: filepath.Join(dir, "missing.mkv")},
+	}
+
+	for _, tt := range casetests {
+		if got := sameFile(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameFile(%q, %q): got %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestReplaceInPlace(t *testing.T) {
+	casetests := []struct {
+		fnErr bool
+		want  string
+	}{
+		{want: "new"},
+		{fnErr: true, want: "old"},
+	}
+
+	for _, tt := range casetests {
+		dir := t.TempDir()
+		fname := filepath.Join(dir, "file.mkv")
+		if err := ioutil.WriteFile(fname, []byte("old"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		err := replaceInPlace(fname, false, func(tmp string) error {
+			if filepath.Dir(tmp) != dir {
+				t.Errorf("Got temporary file %q, want it in %q", tmp, dir)
+			}
+			if tt.fnErr {
+				return errors.New("failed")
+			}
+			return ioutil.WriteFile(tmp, []byte("new"), 0o644)
+		})
+		if tt.fnErr != (err != nil) {
+			t.Errorf("Got error %v, want error: %v", err, tt.fnErr)
+		}
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("Got contents %q, want %q", data, tt.want)
+		}
+		// The original permissions are kept.
+		fi, err := os.Stat(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0o600 {
+			t.Errorf("Got mode %v, want %v", fi.Mode().Perm(), os.FileMode(0o600))
+		}
+		// No temporary files left behind.
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Errorf("Got %d files in %q, want 1", len(files), dir)
+		}
+	}
+}
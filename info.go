@@ -0,0 +1,209 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shortCodecs maps the (long) codec names used by mkvmerge to the short names
+// used in the file summary.
+var shortCodecs = map[string]string{
+	"AVC/H.264/MPEG-4p10": "H.264",
+	"HEVC/H.265/MPEG-H":   "H.265",
+	"MPEG-1/2":            "MPEG-2",
+	"MPEG-4p2":            "MPEG-4",
+}
+
+// fileInfo holds a short summary of a file. The JSON form is meant to be
+// consumed by other programs, so fields should not be renamed or removed.
+type fileInfo struct {
+	File string `json:"file"`
+	// Duration in seconds (0 if unknown).
+	Duration int64 `json:"duration"`
+	// Codec and resolution of the first video track (E.g. "H.264 1080p").
+	Video string `json:"video,omitempty"`
+	// Languages of the audio and subtitle tracks, in file order.
+	Audio     []string `json:"audio"`
+	Subtitles []string `json:"subtitles"`
+	// Languages of the default audio and subtitle tracks (empty if none).
+	DefaultAudio    string `json:"default_audio,omitempty"`
+	DefaultSubtitle string `json:"default_subtitle,omitempty"`
+}
+
+// newFileInfo returns the summary of a parsed file.
+func newFileInfo(mkv matroska) fileInfo {
+	ret := fileInfo{
+		File:      mkv.FileName,
+		Duration:  int64(time.Duration(mkv.Container.Properties.Duration) / time.Second),
+		Audio:     []string{},
+		Subtitles: []string{},
+	}
+	for _, track := range mkv.Tracks {
+		lang := trackLanguage(track.Properties.Language, track.Properties.LanguageIetf)
+		if lang == "" {
+			lang = "und"
+		}
+		switch track.Type {
+		case typeVideo:
+			if ret.Video != "" {
+				continue
+			}
+			ret.Video = track.Codec
+			if s, ok := shortCodecs[track.Codec]; ok {
+				ret.Video = s
+			}
+			if _, height, ok := cutString(track.Properties.PixelDimensions, "x"); ok {
+				ret.Video += " " + height + "p"
+			}
+		case typeAudio:
+			ret.Audio = append(ret.Audio, lang)
+			if track.Properties.DefaultTrack && ret.DefaultAudio == "" {
+				ret.DefaultAudio = lang
+			}
+		case typeSubtitle:
+			ret.Subtitles = append(ret.Subtitles, lang)
+			if track.Properties.DefaultTrack && ret.DefaultSubtitle == "" {
+				ret.DefaultSubtitle = lang
+			}
+		}
+	}
+	return ret
+}
+
+// String returns the summary as a single line (E.g. "file.mkv: 1h42m, H.264
+// 1080p, audio[jpn,eng], subs[eng,fre], default-sub=eng").
+func (f fileInfo) String() string {
+	var parts []string
+	if f.Duration != 0 {
+		d := time.Duration(f.Duration) * time.Second
+		s := fmt.Sprintf("%dm", int(d.Minutes())%60)
+		if d >= time.Hour {
+			s = fmt.Sprintf("%dh%s", int(d.Hours()), s)
+		}
+		parts = append(parts, s)
+	}
+	if f.Video != "" {
+		parts = append(parts, f.Video)
+	}
+	parts = append(parts, fmt.Sprintf("audio[%s]", strings.Join(f.Audio, ",")))
+	parts = append(parts, fmt.Sprintf("subs[%s]", strings.Join(f.Subtitles, ",")))
+	if f.DefaultAudio != "" {
+		parts = append(parts, "default-audio="+f.DefaultAudio)
+	}
+	if f.DefaultSubtitle != "" {
+		parts = append(parts, "default-sub="+f.DefaultSubtitle)
+	}
+	return fmt.Sprintf("%s: %s", f.File, strings.Join(parts, ", "))
+}
+
+// JSON returns the summary as a compact (single line) JSON object.
+func (f fileInfo) JSON() (string, error) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// defaultLanguage returns the language of the default track of type ttype
+// ("und" if not set), and false if no track of that type is the default.
+func defaultLanguage(mkv matroska, ttype string) (string, bool) {
+	for _, track := range mkv.Tracks {
+		if track.Type == ttype && track.Properties.DefaultTrack {
+			if lang := trackLanguage(track.Properties.Language, track.Properties.LanguageIetf); lang != "" {
+				return lang, true
+			}
+			return "und", true
+		}
+	}
+	return "", false
+}
+
+// firstVideo returns a property of the first video track, and false if the
+// file has no video tracks or the property is empty.
+func firstVideo(mkv matroska, prop func(codec, dimensions string) string) (string, bool) {
+	for _, track := range mkv.Tracks {
+		if track.Type == typeVideo {
+			v := prop(track.Codec, track.Properties.PixelDimensions)
+			return v, v != ""
+		}
+	}
+	return "", false
+}
+
+// countTracks returns the number of tracks of type ttype (all tracks, if
+// empty).
+func countTracks(mkv matroska, ttype string) (string, bool) {
+	n := 0
+	for _, track := range mkv.Tracks {
+		if ttype == "" || track.Type == ttype {
+			n++
+		}
+	}
+	return strconv.Itoa(n), true
+}
+
+// getFields maps the fields accepted by get to functions returning the value
+// of the field, and false if the file doesn't have it.
+var getFields = map[string]func(mkv matroska) (string, bool){
+	"title": func(mkv matroska) (string, bool) {
+		return mkv.Container.Properties.Title, mkv.Container.Properties.Title != ""
+	},
+	"container": func(mkv matroska) (string, bool) {
+		return mkv.Container.Type, mkv.Container.Type != ""
+	},
+	// Duration in seconds.
+	"duration": func(mkv matroska) (string, bool) {
+		d := time.Duration(mkv.Container.Properties.Duration)
+		return strconv.FormatInt(int64(d/time.Second), 10), d != 0
+	},
+	"default-audio-lang": func(mkv matroska) (string, bool) { return defaultLanguage(mkv, typeAudio) },
+	"default-sub-lang":   func(mkv matroska) (string, bool) { return defaultLanguage(mkv, typeSubtitle) },
+	"video-codec": func(mkv matroska) (string, bool) {
+		return firstVideo(mkv, func(codec, _ string) string { return codec })
+	},
+	"resolution": func(mkv matroska) (string, bool) {
+		return firstVideo(mkv, func(_, dimensions string) string { return dimensions })
+	},
+	"tracks":          func(mkv matroska) (string, bool) { return countTracks(mkv, "") },
+	"video-tracks":    func(mkv matroska) (string, bool) { return countTracks(mkv, typeVideo) },
+	"audio-tracks":    func(mkv matroska) (string, bool) { return countTracks(mkv, typeAudio) },
+	"subtitle-tracks": func(mkv matroska) (string, bool) { return countTracks(mkv, typeSubtitle) },
+	"attachments": func(mkv matroska) (string, bool) {
+		return strconv.Itoa(len(mkv.Attachments)), true
+	},
+	"chapters": func(mkv matroska) (string, bool) {
+		n := 0
+		for _, c := range mkv.Chapters {
+			n += c.NumEntries
+		}
+		return strconv.Itoa(n), true
+	},
+}
+
+// getField returns the value of a single field of the file (see getFields).
+// An error is returned if the field is unknown or not present in the file.
+func getField(mkv matroska, field string) (string, error) {
+	fn, ok := getFields[field]
+	if !ok {
+		var valid []string
+		for f := range getFields {
+			valid = append(valid, f)
+		}
+		sort.Strings(valid)
+		return "", fmt.Errorf("unknown field %q (valid: %s)", field, strings.Join(valid, ", "))
+	}
+	v, ok := fn(mkv)
+	if !ok {
+		return "", fmt.Errorf("%s: no %s", mkv.FileName, field)
+	}
+	return v, nil
+}
@@ -0,0 +1,96 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"testing"
+)
+
+func TestFileInfo(t *testing.T) {
+	casetests := []struct {
+		json     string
+		want     string
+		wantJSON string
+	}{
+		{
+			json: `{"file_name": "file.mkv", "container": {"properties": {"duration": 6120000000000}}, "tracks": [
+				{"id": 0, "type": "video", "codec": "AVC/H.264/MPEG-4p10", "properties": {"pixel_dimensions": "1920x1080"}},
+				{"id": 1, "type": "audio", "codec": "AAC", "properties": {"language": "jpn", "default_track": true}},
+				{"id": 2, "type": "audio", "codec": "AAC", "properties": {"language": "eng"}},
+				{"id": 3, "type": "subtitles", "codec": "SubRip/SRT", "properties": {"language": "eng", "default_track": true}},
+				{"id": 4, "type": "subtitles", "codec": "SubRip/SRT", "properties": {"language": "fre"}}]}`,
+			want:     "file.mkv: 1h42m, H.264 1080p, audio[jpn,eng], subs[eng,fre], default-audio=jpn, default-sub=eng",
+			wantJSON: `{"file":"file.mkv","duration":6120,"video":"H.264 1080p","audio":["jpn","eng"],"subtitles":["eng","fre"],"default_audio":"jpn","default_subtitle":"eng"}`,
+		},
+		// No duration, no subtitles, unknown codec and language.
+		{
+			json: `{"file_name": "short.mkv", "tracks": [
+				{"id": 0, "type": "video", "codec": "VP9", "properties": {"pixel_dimensions": "1280x720"}},
+				{"id": 1, "type": "audio", "codec": "Opus", "properties": {}}]}`,
+			want:     "short.mkv: VP9 720p, audio[und], subs[]",
+			wantJSON: `{"file":"short.mkv","duration":0,"video":"VP9 720p","audio":["und"],"subtitles":[]}`,
+		},
+	}
+
+	for _, tt := range casetests {
+		info := newFileInfo(mustUnmarshalMKV(t, tt.json))
+		if got := info.String(); got != tt.want {
+			t.Errorf("String: got %q, want %q", got, tt.want)
+		}
+		got, err := info.JSON()
+		if err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		if got != tt.wantJSON {
+			t.Errorf("JSON: got %s, want %s", got, tt.wantJSON)
+		}
+	}
+}
+
+func TestGetField(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "container": {"type": "Matroska", "properties": {"duration": 6120000000000}},
+		"tracks": [
+			{"id": 0, "type": "video", "codec": "AVC/H.264/MPEG-4p10", "properties": {"pixel_dimensions": "1920x1080"}},
+			{"id": 1, "type": "audio", "properties": {"language": "jpn", "default_track": true}},
+			{"id": 2, "type": "subtitles", "properties": {"language": "eng"}}],
+		"chapters": [{"num_entries": 8}]}`)
+
+	casetests := []struct {
+		field     string
+		want      string
+		wantError bool
+	}{
+		{field: "duration", want: "6120"},
+		{field: "container", want: "Matroska"},
+		{field: "default-audio-lang", want: "jpn"},
+		{field: "resolution", want: "1920x1080"},
+		{field: "video-codec", want: "AVC/H.264/MPEG-4p10"},
+		{field: "tracks", want: "3"},
+		{field: "subtitle-tracks", want: "1"},
+		{field: "attachments", want: "0"},
+		{field: "chapters", want: "8"},
+		// Not present.
+		{field: "default-sub-lang", wantError: true},
+		{field: "title", wantError: true},
+		// Unknown field.
+		{field: "foobar", wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, err := getField(mkv, tt.field)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%s: Got no error, want error", tt.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Got error %q want no error", tt.field, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// bibliographic maps the ISO 639-2/B (bibliographic) language codes to their
+// ISO 639-2/T (terminology) equivalents. Matroska files frequently use the
+// bibliographic codes (E.g. "ger" instead of "deu").
+var bibliographic = map[string]string{
+	"alb": "sqi",
+	"arm": "hye",
+	"baq": "eus",
+	"bur": "mya",
+	"chi": "zho",
+	"cze": "ces",
+	"dut": "nld",
+	"fre": "fra",
+	"geo": "kat",
+	"ger": "deu",
+	"gre": "ell",
+	"ice": "isl",
+	"mac": "mkd",
+	"mao": "mri",
+	"may": "msa",
+	"per": "fas",
+	"rum": "ron",
+	"slo": "slk",
+	"tib": "bod",
+	"wel": "cym",
+}
+
+// preferIETF makes the IETF (BCP-47) language of the tracks authoritative
+// for language matching and display, instead of the legacy (ISO 639-2)
+// language (set by --prefer-ietf).
+var preferIETF bool
+
+// trackLanguage returns the language of a track, given its legacy and IETF
+// languages. The legacy language is used unless preferIETF is set, in which
+// case the IETF language is used (falling back to the legacy language in files
+// without IETF languages).
+func trackLanguage(legacy, ietf string) string {
+	if preferIETF && ietf != "" && ietf != "und" {
+		return ietf
+	}
+	return legacy
+}
+
+var (
+	// languagesByName maps lowercase English language names (E.g. "english")
+	// to their tags. Initialized once, on demand.
+	languagesByName     map[string]language.Tag
+	languagesByNameOnce sync.Once
+)
+
+// languageByName returns the tag for an English language name (E.g.
+// "Portuguese"), case insensitive.
+func languageByName(name string) (language.Tag, bool) {
+	languagesByNameOnce.Do(func() {
+		languagesByName = map[string]language.Tag{}
+		for _, tag := range display.Supported.Tags() {
+			languagesByName[strings.ToLower(display.English.Tags().Name(tag))] = tag
+		}
+	})
+	tag, ok := languagesByName[strings.ToLower(name)]
+	return tag, ok
+}
+
+// normalizeLanguage converts a language code ("en", "eng", "en-US") or English
+// language name ("English") into the canonical ISO 639-2 code and BCP-47 tag.
+func normalizeLanguage(s string) (string, string, error) {
+	code := strings.TrimSpace(s)
+	if t, ok := bibliographic[strings.ToLower(code)]; ok {
+		code = t
+	}
+	tag, err := language.Parse(code)
+	if err != nil {
+		var ok bool
+		if tag, ok = languageByName(code); !ok {
+			return "", "", fmt.Errorf("unknown language %q", s)
+		}
+	}
+	base, _ := tag.Base()
+	return base.ISO3(), tag.String(), nil
+}
+
+// normalizeLanguages rewrites the language of all tracks in the file to the
+// canonical ISO 639-2 code, and the IETF language to a normalized BCP-47 tag.
+// Only tracks with a different normalized form are changed. Tracks without a
+// language are left untouched. Returns a description of the changes.
+func normalizeLanguages(mkv matroska, cmd runner) ([]string, error) {
+	command := []string{"mkvpropedit", mkv.FileName}
+	var changes, errmsgs []string
+
+	for _, track := range mkv.Tracks {
+		lang := track.Properties.Language
+		if lang == "" || lang == "und" {
+			continue
+		}
+		iso, ietf, err := normalizeLanguage(lang)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("track %d: %v", track.ID, err))
+			continue
+		}
+		// Bibliographic codes are valid ISO 639-2 codes.
+		if lang == iso || bibliographic[lang] == iso {
+			iso = lang
+		}
+		if iso == lang && ietf == track.Properties.LanguageIetf {
+			continue
+		}
+		// mkvpropedit uses base 1 for track (not zero).
+		command = append(command, "--edit", fmt.Sprintf("track:%d", track.ID+1), "--set", "language="+iso, "--set", "language-ietf="+ietf)
+		changes = append(changes, fmt.Sprintf("Track %d: %s (%s) => %s (%s)", track.ID, lang, track.Properties.LanguageIetf, iso, ietf))
+	}
+	if len(changes) != 0 {
+		if err := cmd.run(command[0], command[1:]...); err != nil {
+			return nil, err
+		}
+	}
+	return changes, errorFromSlice(errmsgs)
+}
@@ -0,0 +1,69 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeLanguage(t *testing.T) {
+	casetests := []struct {
+		lang      string
+		wantISO   string
+		wantIETF  string
+		wantError bool
+	}{
+		{lang: "en", wantISO: "eng", wantIETF: "en"},
+		{lang: "eng", wantISO: "eng", wantIETF: "en"},
+		{lang: "en-US", wantISO: "eng", wantIETF: "en-US"},
+		{lang: "pt-BR", wantISO: "por", wantIETF: "pt-BR"},
+		{lang: "ger", wantISO: "deu", wantIETF: "de"},
+		{lang: "English", wantISO: "eng", wantIETF: "en"},
+		{lang: "not a language", wantError: true},
+	}
+
+	for _, tt := range casetests {
+		iso, ietf, err := normalizeLanguage(tt.lang)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			if iso != tt.wantISO || ietf != tt.wantIETF {
+				t.Fatalf("normalizeLanguage(%q): Got %q/%q, want %q/%q", tt.lang, iso, ietf, tt.wantISO, tt.wantIETF)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
+
+func TestTrackLanguage(t *testing.T) {
+	defer func() { preferIETF = false }()
+
+	casetests := []struct {
+		legacy     string
+		ietf       string
+		preferIETF bool
+		want       string
+	}{
+		{legacy: "eng", ietf: "en-US", want: "eng"},
+		{legacy: "eng", ietf: "en-US", preferIETF: true, want: "en-US"},
+		{legacy: "und", ietf: "pt-BR", want: "und"},
+		{legacy: "und", ietf: "pt-BR", preferIETF: true, want: "pt-BR"},
+		// Fall back to the legacy language.
+		{legacy: "por", preferIETF: true, want: "por"},
+		{legacy: "por", ietf: "und", preferIETF: true, want: "por"},
+	}
+
+	for _, tt := range casetests {
+		preferIETF = tt.preferIETF
+		if got := trackLanguage(tt.legacy, tt.ietf); got != tt.want {
+			t.Errorf("trackLanguage(%q, %q) preferIETF=%v: Got %q, want %q", tt.legacy, tt.ietf, tt.preferIETF, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Log levels, in increasing order of verbosity. Diagnostic messages are
+// written to stderr (using the standard logger) when their level is less than
+// or equal to the current log level. Regular program output goes to stdout.
+const (
+	levelError = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+// logLevelNames maps the names accepted by --log-level to log levels.
+var logLevelNames = map[string]int{
+	"error": levelError,
+	"warn":  levelWarn,
+	"info":  levelInfo,
+	"debug": levelDebug,
+}
+
+// logLevel holds the current log level (set by --log-level).
+var logLevel = levelInfo
+
+// parseLogLevel returns the log level for the given name.
+func parseLogLevel(name string) (int, error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("invalid log level %q (valid: error, warn, info, debug)", name)
+	}
+	return level, nil
+}
+
+// logf logs a message if level is enabled.
+func logf(level int, format string, args ...interface{}) {
+	if level <= logLevel {
+		log.Printf(format, args...)
+	}
+}
+
+// warnf logs a warning message.
+func warnf(format string, args ...interface{}) {
+	logf(levelWarn, "Warning: "+format, args...)
+}
+
+// infof logs an informational message.
+func infof(format string, args ...interface{}) {
+	logf(levelInfo, "Note: "+format, args...)
+}
+
+// debugf logs a debugging message.
+func debugf(format string, args ...interface{}) {
+	logf(levelDebug, "Debug: "+format, args...)
+}
@@ -6,9 +6,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
 )
@@ -26,7 +30,7 @@ func readable(fnames []string) []string {
 		if _, err := os.Stat(f); err == nil {
 			ret = append(ret, f)
 		} else {
-			log.Printf("Note: File %q is not readable. Skipping.", f)
+			infof("File %q is not readable. Skipping.", f)
 		}
 	}
 	return ret
@@ -44,15 +48,17 @@ func main() {
 		run runner = runCmd
 
 		dryrun bool
-	)
 
-	if err := requirements(); err != nil {
-		log.Fatalf("Requirements check: %v", err)
-	}
+		// Script with the commands (--export-plan).
+		plan *planRunner
+	)
 
 	// Plain logs.
 	log.SetFlags(0)
 
+	// Remove temporary files if interrupted.
+	handleSignals()
+
 	app := &cli.App{
 		Name: "mkvtool",
 		Authors: []*cli.Author{
@@ -73,127 +79,297 @@ func main() {
 				Usage:       "Dry-run mode (only show commands)",
 				Destination: &dryrun,
 			},
+			&cli.BoolFlag{
+				Name:    "assume-yes",
+				Aliases: []string{"y"},
+				Usage:   "Do not ask for confirmation before modifying files",
+			},
+			&cli.IntFlag{
+				Name:  "confirm-threshold",
+				Value: 1,
+				Usage: "Ask for confirmation before modifying more than this number of files in place (0=always ask)",
+			},
+			&cli.IntFlag{
+				Name:    "jobs",
+				Aliases: []string{"j"},
+				Value:   1,
+				Usage:   "Number of files processed in parallel (show and print)",
+			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Value: "info",
+				Usage: "Diagnostic messages shown on stderr (error, warn, info, debug)",
+			},
+			&cli.IntFlag{
+				Name:  "max-parallel-identify",
+				Value: runtime.NumCPU(),
+				Usage: "Maximum number of files identified (parsed by mkvmerge) in parallel",
+			},
+			&cli.StringFlag{
+				Name:  "parse-backend",
+				Value: backendMkvmerge,
+				Usage: "How to parse files: mkvmerge (richer) or native (faster, no mkvmerge needed)",
+			},
+			&cli.BoolFlag{
+				Name:  "no-external-tools",
+				Usage: "Never run external programs (implies --parse-backend=native). Commands needing them fail",
+			},
+			&cli.BoolFlag{
+				Name:  "no-cache",
+				Usage: "Do not use the parse cache",
+			},
+			&cli.BoolFlag{
+				Name:  "prefer-ietf",
+				Usage: "Use the IETF (BCP-47) track language instead of the legacy language for matching and display",
+			},
+			&cli.StringFlag{
+				Name:  "export-plan",
+				Usage: "Write the commands to this shell script instead of running them (implies --dry-run)",
+			},
+			&cli.StringFlag{
+				Name:  "post-hook",
+				Usage: "Run this command after each successful file operation (\"{}\" is replaced by the filename)",
+			},
+			&cli.BoolFlag{
+				Name:  "show-result",
+				Usage: "Re-identify files after in-place track edits and show the new values",
+			},
+			&cli.StringFlag{
+				Name:  "state-file",
+				Usage: "Record the files processed successfully in this file, and skip them when the command is run again",
+			},
+			&cli.BoolFlag{
+				Name:  "timings",
+				Usage: "Print the time spent parsing files and running external commands (on stderr)",
+			},
+			&cli.StringFlag{
+				Name:  "sort-files",
+				Usage: "Sort input files before processing (name, mtime, size, natural)",
+			},
 		},
 		Action: func(c *cli.Context) error {
 			cli.ShowCommandHelp(c, "")
 			return nil
 		},
 		Before: func(c *cli.Context) error {
+			useParseCache = !c.Bool("no-cache")
+			preferIETF = c.Bool("prefer-ietf")
+			level, err := parseLogLevel(c.String("log-level"))
+			if err != nil {
+				return err
+			}
+			logLevel = level
+			if parseBackend, err = parseParseBackend(c.String("parse-backend")); err != nil {
+				return err
+			}
+			if c.IsSet("post-hook") && strings.TrimSpace(c.String("post-hook")) == "" {
+				return errors.New("--post-hook cannot be blank")
+			}
+			if c.Bool("no-external-tools") {
+				if c.IsSet("parse-backend") && parseBackend != backendNative {
+					return errors.New("--no-external-tools requires --parse-backend=native")
+				}
+				if c.String("post-hook") != "" {
+					return errors.New("--post-hook cannot be used with --no-external-tools")
+				}
+				noExternalTools = true
+				parseBackend = backendNative
+			}
+			n := c.Int("max-parallel-identify")
+			if n < 1 {
+				return fmt.Errorf("invalid --max-parallel-identify: %d", n)
+			}
+			identifySem = make(chan struct{}, n)
+			if _, err := sortFiles(nil, c.String("sort-files")); err != nil {
+				return err
+			}
+			// Exporting a plan implies dry-run mode, as nothing is executed.
+			if fname := c.String("export-plan"); fname != "" {
+				if plan, err = newPlanRunner(fname, os.Args[1:]); err != nil {
+					return fmt.Errorf("unable to create plan: %v", err)
+				}
+				if err := c.Set("dry-run", "true"); err != nil {
+					return err
+				}
+			}
 			// Run will resolve to a print-only version when dry-run is chosen.
 			if dryrun {
 				fmt.Println("Dry-run mode: Will not modify any files.")
 				run = fakeRunCmd
+				if plan != nil {
+					fmt.Printf("Writing commands to %s.\n", c.String("export-plan"))
+					run = plan
+				}
 				c.Context = context.WithValue(c.Context, runnerKey, &run)
 			}
+			if c.String("state-file") != "" {
+				// Entries are recorded by (canonical) command name.
+				command := c.Args().First()
+				if cmd := c.App.Command(command); cmd != nil {
+					command = cmd.Name
+				}
+				if state, err = loadStateFile(c.String("state-file"), command, dryrun); err != nil {
+					return fmt.Errorf("unable to read state file: %v", err)
+				}
+			}
+			if c.Bool("timings") {
+				timings = newTimingRecorder()
+				run = timedRunner{r: run}
+			}
 			return nil
 		},
 	}
 
 	// Commands.
 	app.Commands = []*cli.Command{
-		// merge
+		// chapter-names
 		{
-			Name:      "merge",
-			Usage:     "Merge input tracks and files (A/V/S) into an output file",
+			Name:      "chapter-names",
+			Usage:     "Generate names for unnamed chapters (in place)",
 			ArgsUsage: "FILE(s)...",
 			Flags: []cli.Flag{
 				&cli.StringFlag{
-					Name:     "output",
-					Aliases:  []string{"o"},
-					Usage:    "Output file",
-					Required: true,
+					Name:  "template",
+					Value: "Chapter %02d",
+					Usage: "Template for the chapter names (printf style, with the chapter number)",
+				},
+				&cli.StringFlag{
+					Name:  "names-file",
+					Usage: "Read the chapter names from this file (one per line) instead of using the template",
 				},
 				&cli.BoolFlag{
-					Name:  "subs",
-					Usage: "Copy subtitles from original video file",
-					Value: true,
+					Name:    "all",
+					Aliases: []string{"a"},
+					Usage:   "Rename all chapters, not only the ones with empty or generic names",
 				},
 			},
-			Action: actionMerge,
+			Before: requireTools("mkvextract", "mkvmerge", "mkvpropedit"),
+			Action: actionChapterNames,
 		},
 
-		// only
+		// defaults-report
 		{
-			Name:      "only",
-			Usage:     "Remove all subtitle tracks, except one",
-			ArgsUsage: "input_file output_file",
+			Name:      "defaults-report",
+			Usage:     "Report the default audio and subtitle tracks and their compliance with the preferred languages",
+			ArgsUsage: "DIR(s)/FILE(s)...",
 			Flags: []cli.Flag{
-				&cli.IntFlag{
-					Name:     "track",
-					Aliases:  []string{"t"},
-					Usage:    "Track number to keep",
-					Required: true,
+				&cli.StringSliceFlag{
+					Name:  "preferred-audio",
+					Usage: "Preferred audio languages (can be used multiple times)",
+				},
+				&cli.StringSliceFlag{
+					Name:  "preferred-subs",
+					Usage: "Preferred subtitle languages (can be used multiple times)",
 				},
 				&cli.BoolFlag{
-					Name:  "subs",
-					Usage: "Copy subtitles from original video file",
-					Value: true,
+					Name:  "json",
+					Usage: "Output the report in JSON format",
+				},
+				&cli.IntFlag{
+					Name:  "max-depth",
+					Usage: "Maximum directory depth (1=only the named directories, 0=unlimited)",
 				},
 			},
-			Action: actionOnly,
+			Before: requireParser(),
+			Action: actionDefaultsReport,
 		},
 
-		// print
+		// disable-by-lang
 		{
-			Name:      "print",
-			Usage:     "Parse input filename and print scene information using a printf style mask.",
+			Name:      "disable-by-lang",
+			Usage:     "Disable (in place) audio and subtitle tracks in unwanted languages, so players skip them",
 			ArgsUsage: "FILE(s)...",
 			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:     "lang",
+					Aliases:  []string{"l"},
+					Usage:    "Language to disable (Use multiple times. Use 'default' for tracks with no language set.)",
+					Required: true,
+				},
 				&cli.StringFlag{
-					Name:    "format",
-					Aliases: []string{"f"},
-					Value:   "%{title}.mkv",
-					Usage:   "Formating mask",
+					Name:  "type",
+					Usage: "Only disable tracks of this type (audio or subtitles)",
+				},
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Proceed even if no enabled audio track would remain",
 				},
 			},
-			Action: actionPrint,
+			Before: requireParser("mkvpropedit"),
+			Action: actionDisableByLang,
 		},
 
-		// remux
+		// extract-audio
 		{
-			Name:      "remux",
-			Usage:     "Remux input file into an output file",
-			ArgsUsage: "input_file output_file",
-			Action:    actionRemux,
+			Name:      "extract-audio",
+			Usage:     "Extract an audio track (default: the default audio track), using an extension based on the codec",
+			ArgsUsage: "input_file [output_file]",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:    "track",
+					Aliases: []string{"t"},
+					Usage:   "Audio track number to extract",
+				},
+			},
+			Before: requireTools("mkvextract", "mkvmerge"),
+			Action: actionExtractTrack(typeAudio),
 		},
 
-		// rename
+		// extract-subs
 		{
-			Name:      "rename",
-			Usage:     "Rename file based on scene information in filename.",
+			Name:      "extract-subs",
+			Usage:     "Extract all subtitle tracks into separate files (with optional OCR for image subtitles)",
 			ArgsUsage: "FILE(s)...",
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:    "format",
 					Aliases: []string{"f"},
-					Value:   "%{title}.%{container}",
-					Usage:   "Formating mask",
+					Value:   subFormatSRT,
+					Usage:   "Output format for text subtitles (srt, ass, or native to keep the format of each track)",
+				},
+				&cli.StringFlag{
+					Name:    "output-dir",
+					Aliases: []string{"d"},
+					Usage:   "Output directory (default: same directory as the input file)",
+				},
+				&cli.BoolFlag{
+					Name:  "sidecar",
+					Usage: "Name files <input>.<language>.<format>, as expected by players for sidecar subtitles",
+				},
+				&cli.StringFlag{
+					Name:  "ocr-command",
+					Usage: "Command used to OCR image subtitles ({input}, {output}, and {lang} are replaced)",
+				},
+				&cli.BoolFlag{
+					Name:  "strict-codec",
+					Usage: "Fail on subtitle tracks that cannot be extracted (unsupported codec or image without OCR) instead of skipping them",
 				},
 			},
-			Action: actionRename,
+			Before: requireTools("mkvextract", "mkvmerge"),
+			Action: actionExtractSubs,
 		},
 
-		// setdefault
+		// extract-video
 		{
-			Name:      "setdefault",
-			Usage:     "Set the default subtitle tag on a track.",
-			ArgsUsage: "FILE(s)...",
+			Name:      "extract-video",
+			Usage:     "Extract a video track (default: the default video track), using an extension based on the codec",
+			ArgsUsage: "input_file [output_file]",
 			Flags: []cli.Flag{
 				&cli.IntFlag{
-					Name:     "track",
-					Aliases:  []string{"t"},
-					Usage:    "Track Number",
-					Required: true,
+					Name:    "track",
+					Aliases: []string{"t"},
+					Usage:   "Video track number to extract",
 				},
 			},
-			Action: actionSetDefault,
+			Before: requireTools("mkvextract", "mkvmerge"),
+			Action: actionExtractTrack(typeVideo),
 		},
 
-		// setdefaultbylang
+		// find-default-mismatch
 		{
-			Name:      "setdefaultbylang",
-			Usage:     "Set default subtitle track by language.",
-			ArgsUsage: "FILE(s)...",
+			Name:      "find-default-mismatch",
+			Usage:     "List files where the default track is not in one of the preferred languages",
+			ArgsUsage: "DIR(s)/FILE(s)...",
 			Flags: []cli.Flag{
 				&cli.StringSliceFlag{
 					Name:     "lang",
@@ -201,36 +377,1013 @@ func main() {
 					Usage:    "Preferred languages (Use multiple times. Use 'default' for tracks with no language set.)",
 					Required: true,
 				},
+				&cli.StringFlag{
+					Name:  "type",
+					Value: typeSubtitle,
+					Usage: "Track type to check (subtitles or audio)",
+				},
+				&cli.IntFlag{
+					Name:  "max-depth",
+					Usage: "Maximum directory depth (1=only the named directories, 0=unlimited)",
+				},
+			},
+			Before: requireParser(),
+			Action: actionFindDefaultMismatch,
+		},
+
+		// find-unsupported-codecs
+		{
+			Name:      "find-unsupported-codecs",
+			Usage:     "List files with tracks using unsupported codecs",
+			ArgsUsage: "DIR(s)/FILE(s)...",
+			Flags: []cli.Flag{
 				&cli.StringSliceFlag{
-					Name:    "ignore",
-					Aliases: []string{"i"},
-					Usage:   "Ignore tracks with this string in the name (can be used multiple times.)",
+					Name:     "codec",
+					Aliases:  []string{"c"},
+					Usage:    "Unsupported codec ID, like A_TRUEHD or S_HDMV/PGS (Use multiple times. \"*\" matches any string.)",
+					Required: true,
+				},
+				&cli.IntFlag{
+					Name:  "max-depth",
+					Usage: "Maximum directory depth (1=only the named directories, 0=unlimited)",
+				},
+				&cli.BoolFlag{
+					Name:  "json-lines",
+					Usage: "Emit one JSON object per file with unsupported tracks (JSON Lines)",
 				},
 			},
-			Action: actionSetDefaultByLang,
+			Before: requireParser(),
+			Action: actionFindUnsupportedCodecs,
 		},
 
-		// show
+		// get
 		{
-			Name:      "show",
-			Usage:     "Show information about files",
+			Name:      "get",
+			Usage:     "Print the value of a single field (E.g. default-sub-lang or duration)",
+			ArgsUsage: "FILE",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "field",
+					Aliases:  []string{"f"},
+					Usage:    "Field to print",
+					Required: true,
+				},
+			},
+			Before: requireParser(),
+			Action: actionGet,
+		},
+
+		// harmonize
+		{
+			Name:      "harmonize",
+			Usage:     "Set the most common default subtitle language on the files that differ (E.g. a season)",
+			ArgsUsage: "DIRS-OR-FILES...",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "max-depth",
+					Usage: "Maximum directory depth (1=only the named directories, 0=unlimited)",
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionHarmonize,
+		},
+
+		// info
+		{
+			Name:      "info",
+			Usage:     "Show a one line summary of each file",
 			ArgsUsage: "FILE(s)...",
 			Flags: []cli.Flag{
 				&cli.BoolFlag{
-					Name:    "uid",
-					Aliases: []string{"u"},
-					Usage:   "Include track UIDs in the output",
+					Name:  "json",
+					Usage: "Output a compact JSON object per file",
 				},
 			},
-			Action: actionShow,
+			Before: requireParser(),
+			Action: actionInfo,
 		},
-	}
 
-	ctx := context.Background()
-	ctx = context.WithValue(ctx, runnerKey, &run)
-	err := app.RunContext(ctx, os.Args)
+		// keepaudio
+		{
+			Name:      "keepaudio",
+			Usage:     "Remove all audio tracks, except the ones in the chosen languages",
+			ArgsUsage: "input_file output_file",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:    "lang",
+					Aliases: []string{"l"},
+					Usage:   "Language of the audio tracks to keep (can be used multiple times.)",
+				},
+				&cli.IntFlag{
+					Name:  "max-channels",
+					Usage: "Only keep audio tracks with at most this many channels (E.g. 2 for stereo)",
+				},
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Proceed even if the output would have no video or audio tracks",
+				},
+			},
+			Before: requireTools("mkvmerge"),
+			Action: actionKeepAudio,
+		},
+
+		// label-tracks
+		{
+			Name:      "label-tracks",
+			Usage:     "Set track names from a template using the track information (in place)",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name-template",
+					Aliases:  []string{"n"},
+					Usage:    "Track name template (tokens: {langname}, {lang}, {channels}, {codec}, {forced})",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "type",
+					Usage: "Only label tracks of this type (video, audio, subtitles)",
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionLabelTracks,
+		},
+
+		// languages
+		{
+			Name:      "languages",
+			Usage:     "List the audio and subtitle languages present in the files",
+			ArgsUsage: "DIRS-OR-FILES...",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "counts",
+					Aliases: []string{"c"},
+					Usage:   "Show the number of files with each language",
+				},
+				&cli.BoolFlag{
+					Name:  "missing",
+					Usage: "List the files without each language",
+				},
+				&cli.IntFlag{
+					Name:  "max-depth",
+					Usage: "Maximum directory depth (1=only the named directories, 0=unlimited)",
+				},
+			},
+			Before: requireParser(),
+			Action: actionLanguages,
+		},
+
+		// list-codecs
+		{
+			Name:      "list-codecs",
+			Usage:     "Show the number of tracks and files using each codec",
+			ArgsUsage: "DIRS-OR-FILES...",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "type",
+					Usage: "Only count tracks of this type (video, audio, or subtitles)",
+				},
+				&cli.IntFlag{
+					Name:  "max-depth",
+					Usage: "Maximum directory depth (1=only the named directories, 0=unlimited)",
+				},
+			},
+			Before: requireParser(),
+			Action: actionListCodecs,
+		},
+
+		// merge
+		{
+			Name:      "merge",
+			Usage:     "Merge input tracks and files (A/V/S) into an output file",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "Output file (overrides the output in the mux plan)",
+				},
+				&cli.BoolFlag{
+					Name:  "subs",
+					Usage: "Copy subtitles from original video file",
+					Value: true,
+				},
+				&cli.StringFlag{
+					Name:  "plan",
+					Usage: "Read the full mux plan from a JSON file (ignores other input files)",
+				},
+				&cli.StringFlag{
+					Name:  "chapters",
+					Usage: "Add chapters from this file (XML or simple chapter format)",
+				},
+				&cli.StringFlag{
+					Name:  "chapter-language",
+					Usage: "Default language for the chapters (used with --chapters)",
+				},
+				&cli.StringFlag{
+					Name:  "chapters-from",
+					Usage: "Replace the chapters with the chapters from this (Matroska) file",
+				},
+				&cli.StringFlag{
+					Name:  "generate-chapters",
+					Usage: "Generate chapters at this interval (E.g. 10m)",
+				},
+				&cli.StringFlag{
+					Name:  "generate-chapters-name-template",
+					Usage: "Name template for generated chapters (see mkvmerge; default: \"Chapter <NUM:2>\")",
+				},
+				&cli.BoolFlag{
+					Name:  "no-track-tags",
+					Usage: "Do not copy track tags from the input file(s)",
+				},
+				&cli.BoolFlag{
+					Name:  "no-global-tags",
+					Usage: "Do not copy global tags from the input file(s)",
+				},
+				&cli.BoolFlag{
+					Name:  "text-subs-only",
+					Usage: "Drop image based subtitles (PGS, VobSub, DVB), keeping text subtitles",
+				},
+				&cli.IntFlag{
+					Name:  "max-audio-channels",
+					Usage: "Drop audio tracks with more than this number of channels (E.g. 6 to drop 7.1 tracks)",
+				},
+				&cli.StringFlag{
+					Name:  "sub-charset",
+					Usage: "Character set of external text subtitle files (E.g. WINDOWS-1251; default: detect from BOM)",
+				},
+				&cli.BoolFlag{
+					Name:  "dedupe-attachments",
+					Usage: "Keep only one copy of attachments with the same contents (E.g. fonts)",
+				},
+				&cli.StringFlag{
+					Name:  "copy-attachments-from",
+					Usage: "Copy all attachments (E.g. fonts) from this MKV file",
+				},
+				&cli.BoolFlag{
+					Name:  "merge-report",
+					Usage: "After merging, show the source file, type, and language of each output track",
+				},
+				&cli.BoolFlag{
+					Name:  "title-from-filename",
+					Usage: "Set the container title from the (parsed) output filename",
+				},
+				&cli.StringFlag{
+					Name:  "title-locale",
+					Value: "en",
+					Usage: "Locale (BCP-47) used to capitalize titles",
+				},
+				&cli.BoolFlag{
+					Name:  "small-words",
+					Usage: "Do not capitalize small (English) words in titles, like \"of\" and \"the\"",
+				},
+			},
+			Before: requireToolsIf("dedupe-attachments", []string{"mkvextract"}, "mkvmerge"),
+			Action: actionMerge,
+		},
+
+		// normalize-languages
+		{
+			Name:      "normalize-languages",
+			Usage:     "Convert track languages to canonical ISO 639-2 codes and BCP-47 tags (in place)",
+			ArgsUsage: "FILE(s)...",
+			Before:    requireParser("mkvpropedit"),
+			Action:    actionNormalizeLanguages,
+		},
+
+		// only
+		{
+			Name:      "only",
+			Usage:     "Remove all subtitle tracks, except one",
+			ArgsUsage: "input_file output_file",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:    "track",
+					Aliases: []string{"t"},
+					Usage:   "Track number to keep",
+				},
+				&cli.BoolFlag{
+					Name:  "subs",
+					Usage: "Copy subtitles from original video file",
+					Value: true,
+				},
+				&cli.StringFlag{
+					Name:  "track-name",
+					Usage: "Name of the subtitle track in the output (default: language name)",
+				},
+				&cli.BoolFlag{
+					Name:    "interactive",
+					Aliases: []string{"i"},
+					Usage:   "Show the tracks and ask which audio and subtitle tracks to keep",
+				},
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Proceed even if the output would have no video or audio tracks",
+				},
+			},
+			Before: requireTools("mkvextract", "mkvmerge"),
+			Action: actionOnly,
+		},
+
+		// print
+		{
+			Name:      "print",
+			Usage:     "Parse input filename and print scene information using a printf style mask.",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.GenericFlag{
+					Name:    "format",
+					Aliases: []string{"f"},
+					Value:   &maskList{masks: []string{"%{title}.mkv"}},
+					Usage:   "Formating mask (can be used multiple times, for tab separated columns)",
+				},
+				&cli.BoolFlag{
+					Name:  "report-unresolved",
+					Usage: "Report, per unresolved mask token, the files that could not provide it",
+				},
+				&cli.StringFlag{
+					Name:  "title-locale",
+					Value: "en",
+					Usage: "Locale (BCP-47) used to capitalize titles",
+				},
+				&cli.BoolFlag{
+					Name:  "small-words",
+					Usage: "Do not capitalize small (English) words in titles, like \"of\" and \"the\"",
+				},
+				&cli.BoolFlag{
+					Name:  "normalize",
+					Usage: "Convert dots and underscores in titles to spaces",
+				},
+			},
+			Action: actionPrint,
+		},
+
+		// probe
+		{
+			Name:      "probe",
+			Aliases:   []string{"index"},
+			Usage:     "Parse all media files in directories and store the results in the parse cache",
+			ArgsUsage: "DIR(s)/FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "max-depth",
+					Usage: "Maximum directory depth (1=only the named directories, 0=unlimited)",
+				},
+				&cli.BoolFlag{
+					Name:  "json-lines",
+					Usage: "Emit one JSON object per file as it is processed (JSON Lines)",
+				},
+			},
+			Before: requireParser(),
+			Action: actionProbe,
+		},
+
+		// remux
+		{
+			Name:      "remux",
+			Usage:     "Remux input file into an output file",
+			ArgsUsage: "input_file output_file",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "title-from-filename",
+					Usage: "Set the container title from the (parsed) output filename",
+				},
+				&cli.StringFlag{
+					Name:  "title-locale",
+					Value: "en",
+					Usage: "Locale (BCP-47) used to capitalize titles",
+				},
+				&cli.BoolFlag{
+					Name:  "small-words",
+					Usage: "Do not capitalize small (English) words in titles, like \"of\" and \"the\"",
+				},
+				&cli.BoolFlag{
+					Name:  "no-track-tags",
+					Usage: "Do not copy track tags from the input file(s)",
+				},
+				&cli.BoolFlag{
+					Name:  "no-global-tags",
+					Usage: "Do not copy global tags from the input file(s)",
+				},
+				&cli.BoolFlag{
+					Name:  "text-subs-only",
+					Usage: "Drop image based subtitles (PGS, VobSub, DVB), keeping text subtitles",
+				},
+				&cli.IntFlag{
+					Name:  "max-audio-channels",
+					Usage: "Drop audio tracks with more than this number of channels (E.g. 6 to drop 7.1 tracks)",
+				},
+				&cli.StringFlag{
+					Name:  "chapters-from",
+					Usage: "Replace the chapters with the chapters from this (Matroska) file",
+				},
+				&cli.StringFlag{
+					Name:  "generate-chapters",
+					Usage: "Generate chapters at this interval (E.g. 10m)",
+				},
+				&cli.StringFlag{
+					Name:  "generate-chapters-name-template",
+					Usage: "Name template for generated chapters (see mkvmerge; default: \"Chapter <NUM:2>\")",
+				},
+				&cli.StringSliceFlag{
+					Name:  "sync-track",
+					Usage: "Delay a track by this many milliseconds, as track:ms (E.g. 0:200 or 1:-150; can be used multiple times)",
+				},
+				&cli.BoolFlag{
+					Name:  "ignore-errors",
+					Usage: "Salvage problematic inputs: accept mkvmerge warnings as success and use --flush-on-close",
+				},
+				&cli.BoolFlag{
+					Name:  "verify-streams",
+					Usage: "Verify that the data of all tracks is identical to the source after remuxing",
+				},
+			},
+			Before: requireToolsIf("verify-streams", []string{"mkvextract"}, "mkvmerge"),
+			Action: actionRemux,
+		},
+
+		// rename
+		{
+			Name:      "rename",
+			Usage:     "Rename file based on scene information in filename.",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "format",
+					Aliases: []string{"f"},
+					Value:   "%{title}.%{container}",
+					Usage:   "Formating mask",
+				},
+				&cli.BoolFlag{
+					Name:  "report-unresolved",
+					Usage: "Report, per unresolved mask token, the files that could not provide it",
+				},
+				&cli.StringFlag{
+					Name:  "title-locale",
+					Value: "en",
+					Usage: "Locale (BCP-47) used to capitalize titles",
+				},
+				&cli.BoolFlag{
+					Name:  "small-words",
+					Usage: "Do not capitalize small (English) words in titles, like \"of\" and \"the\"",
+				},
+				&cli.BoolFlag{
+					Name:  "normalize",
+					Usage: "Convert dots and underscores in titles to spaces",
+				},
+				&cli.BoolFlag{
+					Name:  "reset-timestamps",
+					Usage: "Set the access and modification times of renamed files to the current time",
+				},
+				&cli.StringFlag{
+					Name:    "output-dir",
+					Aliases: []string{"d"},
+					Usage:   "Move the renamed files into this directory (default: same as the file)",
+				},
+				&cli.BoolFlag{
+					Name:  "series-layout",
+					Usage: "Organize TV series as \"Show/Season NN/Show - SNNENN - Episode.ext\" (media server layout)",
+				},
+			},
+			Before: requireParser(),
+			Action: actionRename,
+		},
+
+		// rename-tracks
+		{
+			Name:      "rename-tracks",
+			Usage:     "Replace track names matching a regular expression (in place)",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "match",
+					Aliases:  []string{"m"},
+					Usage:    "Regular expression matching the track names to replace",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "replace",
+					Aliases:  []string{"r"},
+					Usage:    "Replacement for the matched text (\"$1\" expands to the first submatch)",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "type",
+					Usage: "Only rename tracks of this type (video, audio, subtitles)",
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionRenameTracks,
+		},
+
+		// replace-track
+		{
+			Name:      "replace-track",
+			Usage:     "Replace a track with the track in an external file",
+			ArgsUsage: "input_file output_file",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:     "track",
+					Aliases:  []string{"t"},
+					Usage:    "Track number to replace",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "with",
+					Usage:    "File containing the replacement track",
+					Required: true,
+				},
+			},
+			Before: requireTools("mkvmerge"),
+			Action: actionReplaceTrack,
+		},
+
+		// sample
+		{
+			Name:      "sample",
+			Usage:     "Create a short preview clip from the input file",
+			ArgsUsage: "input_file output_file",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:    "duration",
+					Aliases: []string{"d"},
+					Usage:   "Duration of the sample",
+					Value:   30 * time.Second,
+				},
+				&cli.DurationFlag{
+					Name:    "start",
+					Aliases: []string{"s"},
+					Usage:   "Start offset of the sample",
+				},
+				&cli.StringSliceFlag{
+					Name:    "type",
+					Aliases: []string{"t"},
+					Usage:   "Only copy tracks of this type: video, audio, subtitles (can be used multiple times.)",
+				},
+			},
+			Before: requireTools("mkvmerge"),
+			Action: actionSample,
+		},
+
+		// setdate
+		{
+			Name:      "setdate",
+			Usage:     "Set or clear the muxing date in files.",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "date",
+					Aliases:  []string{"d"},
+					Usage:    "Date in RFC3339 format (E.g. 2022-01-02T15:04:05Z), \"now\", or \"clear\"",
+					Required: true,
+				},
+			},
+			Before: requireTools("mkvpropedit"),
+			Action: actionSetDate,
+		},
+
+		// setfps
+		{
+			Name:      "setfps",
+			Usage:     "Set the frame rate (default duration) of a video track (in place).",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:     "track",
+					Aliases:  []string{"t"},
+					Usage:    "Video track number",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "fps",
+					Usage:    "Frame rate (E.g. 23.976 or 24000/1001)",
+					Required: true,
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionSetFPS,
+		},
+
+		// set-forced-by-name
+		{
+			Name:      "set-forced-by-name",
+			Usage:     "Set the forced flag on subtitle tracks by name (E.g. \"Signs & Songs\").",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:     "match",
+					Aliases:  []string{"m"},
+					Usage:    "Flag tracks with this string in the name (can be used multiple times.)",
+					Required: true,
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionSetForcedByName,
+		},
+
+		// setdefault
+		{
+			Name:      "setdefault",
+			Usage:     "Set the default subtitle tag on a track.",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:     "track",
+					Aliases:  []string{"t"},
+					Usage:    "Track Number",
+					Required: true,
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionSetDefault,
+		},
+
+		// setdefaultbylang
+		{
+			Name:      "setdefaultbylang",
+			Usage:     "Set default subtitle track by language.",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:     "lang",
+					Aliases:  []string{"l"},
+					Usage:    "Preferred languages (Use multiple times. Use 'default' for tracks with no language set.)",
+					Required: true,
+				},
+				&cli.StringSliceFlag{
+					Name:    "ignore",
+					Aliases: []string{"i"},
+					Usage:   "Ignore tracks with this string in the name (can be used multiple times.)",
+				},
+				&cli.BoolFlag{
+					Name:  "strict-single",
+					Usage: "Fail if more than one regular (not forced or SDH) track matches a language",
+				},
+				&cli.StringFlag{
+					Name:  "fallback",
+					Value: fallbackError,
+					Usage: "Action when no track matches the languages: first (first subtitle track), none (no change), or error",
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionSetDefaultByLang,
+		},
+
+		// setsubs
+		{
+			Name:      "setsubs",
+			Usage:     "Set the default and forced subtitle tracks together (in place).",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "default",
+					Usage: "Subtitle track to set as default, clearing the flag on the others (-1 clears all)",
+				},
+				&cli.IntFlag{
+					Name:  "forced",
+					Usage: "Subtitle track to set as forced, clearing the flag on the others (-1 clears all)",
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionSetSubs,
+		},
+
+		// settracks
+		{
+			Name:      "settracks",
+			Usage:     "Set the name, language, or flags of all tracks matching an expression (in place).",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "where",
+					Aliases:  []string{"apply-to-matching"},
+					Usage:    "Track selection expression (E.g. 'type==audio && lang==und')",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "Set the track name",
+				},
+				&cli.StringFlag{
+					Name:  "lang",
+					Usage: "Set the track language (code or English name)",
+				},
+				&cli.BoolFlag{
+					Name:  "default",
+					Usage: "Set (or clear, with --default=false) the default flag",
+				},
+				&cli.BoolFlag{
+					Name:  "forced",
+					Usage: "Set (or clear, with --forced=false) the forced flag",
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionSetTracks,
+		},
+
+		// settrackuid
+		{
+			Name:      "settrackuid",
+			Usage:     "Set the UID of a track (in place). Changing UIDs may break linking.",
+			ArgsUsage: "FILE",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:     "track",
+					Aliases:  []string{"t"},
+					Usage:    "Track number",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "uid",
+					Usage:    "New track UID (non-zero unsigned 64-bit integer, decimal or 0x hex)",
+					Required: true,
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionSetTrackUID,
+		},
+
+		// show
+		{
+			Name:      "show",
+			Usage:     "Show information about files",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "uid",
+					Aliases: []string{"u"},
+					Usage:   "Include track UIDs in the output",
+				},
+				&cli.BoolFlag{
+					Name:  "codec-name",
+					Usage: "Show the friendly codec name, when available",
+				},
+				&cli.BoolFlag{
+					Name:  "summary",
+					Usage: "Show a single line per file with the track counts, attachments, chapters, and default subtitle",
+				},
+				&cli.BoolFlag{
+					Name:  "summary-row",
+					Usage: "Add a footer with the number of tracks by type (and a grand total for multiple files)",
+				},
+				&cli.BoolFlag{
+					Name:  "tree",
+					Usage: "Show file information as a tree",
+				},
+				&cli.IntFlag{
+					Name:    "track",
+					Aliases: []string{"t"},
+					Usage:   "Track number (used with --props)",
+				},
+				&cli.BoolFlag{
+					Name:  "props",
+					Usage: "Show all parsed properties of the track specified with --track",
+				},
+				&cli.StringSliceFlag{
+					Name:  "preferred-audio",
+					Usage: "Preferred audio languages (can be used multiple times). Adds a policy column",
+				},
+				&cli.StringSliceFlag{
+					Name:  "preferred-subs",
+					Usage: "Preferred subtitle languages (can be used multiple times). Adds a policy column",
+				},
+				&cli.IntFlag{
+					Name:  "program",
+					Usage: "Only show tracks in this program number (E.g. MPEG transport streams)",
+				},
+				&cli.StringFlag{
+					Name:  "locale",
+					Usage: "Locale (BCP-47) used to format sizes and other quantities (E.g. de, en-US)",
+				},
+				&cli.BoolFlag{
+					Name:    "attachments",
+					Aliases: []string{"a"},
+					Usage:   "Also list the attachments (ID, name, MIME type, size, and description)",
+				},
+				&cli.BoolFlag{
+					Name:  "chapters",
+					Usage: "Also list the chapters (requires mkvextract)",
+				},
+				&cli.BoolFlag{
+					Name:  "tags",
+					Usage: "Also list the global and track tags (requires mkvextract)",
+				},
+			},
+			Before: requireParser(),
+			Action: actionShow,
+		},
+
+		// split
+		{
+			Name:      "split",
+			Usage:     "Split a file into parts, named using a formatting mask",
+			ArgsUsage: "input_file",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:    "duration",
+					Aliases: []string{"d"},
+					Usage:   "Split every duration (E.g. 30m)",
+				},
+				&cli.BoolFlag{
+					Name:  "chapters",
+					Usage: "Split at every chapter",
+				},
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Value:   "%{title} - Part %{part}.mkv",
+					Usage:   "Formating mask for the parts (%{part} is the part number)",
+				},
+				&cli.StringFlag{
+					Name:  "output-dir",
+					Usage: "Output directory (default: same directory as the input file)",
+				},
+				&cli.StringFlag{
+					Name:  "title-locale",
+					Value: "en",
+					Usage: "Locale (BCP-47) used to capitalize titles",
+				},
+				&cli.BoolFlag{
+					Name:  "small-words",
+					Usage: "Do not capitalize small (English) words in titles, like \"of\" and \"the\"",
+				},
+				&cli.BoolFlag{
+					Name:  "normalize",
+					Usage: "Convert dots and underscores in titles to spaces",
+				},
+			},
+			Before: requireTools("mkvmerge"),
+			Action: actionSplit,
+		},
+
+		// strip-attachments
+		{
+			Name:      "strip-attachments",
+			Usage:     "Remove attachments (E.g. unused fonts) by MIME type or name (in place)",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "mime",
+					Usage: "Remove attachments with a MIME type matching this glob, like \"font/*\" (can be used multiple times)",
+				},
+				&cli.StringSliceFlag{
+					Name:  "name",
+					Usage: "Remove attachments with a name matching this glob, like \"*.otf\" (can be used multiple times)",
+				},
+				&cli.BoolFlag{
+					Name:  "keep-used",
+					Usage: "Keep fonts used by the ASS subtitle tracks in the file",
+				},
+			},
+			Before: requireTools("mkvextract", "mkvmerge", "mkvpropedit"),
+			Action: actionStripAttachments,
+		},
+
+		// striptags
+		{
+			Name:      "striptags",
+			Usage:     "Remove global and/or track tags from files (in place).",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "global",
+					Aliases: []string{"g"},
+					Usage:   "Remove global tags",
+				},
+				&cli.IntSliceFlag{
+					Name:    "track",
+					Aliases: []string{"t"},
+					Usage:   "Remove tags from this track number (can be used multiple times.)",
+				},
+				&cli.BoolFlag{
+					Name:    "all",
+					Aliases: []string{"a"},
+					Usage:   "Remove all tags (global and tracks)",
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionStripTags,
+		},
+
+		// subconvert
+		{
+			Name:      "subconvert",
+			Usage:     "Convert a text subtitle track between the SRT and ASS formats",
+			ArgsUsage: "input_file [output_file]",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:     "track",
+					Aliases:  []string{"t"},
+					Usage:    "Subtitle track number to convert",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "to",
+					Usage:    "Output subtitle format (srt or ass)",
+					Required: true,
+				},
+				&cli.BoolFlag{
+					Name:  "mux",
+					Usage: "Add the converted track to a copy of the input file (output_file is a MKV file)",
+				},
+				&cli.BoolFlag{
+					Name:  "in-place",
+					Usage: "Replace the input file with the muxed output (requires --mux, no output_file)",
+				},
+				&cli.BoolFlag{
+					Name:  "normalize-nfc",
+					Usage: "Normalize the subtitle text to Unicode NFC (fixes accents stored as combining characters)",
+				},
+			},
+			Before: requireTools("mkvextract", "mkvmerge"),
+			Action: actionSubConvert,
+		},
+
+		// touch-default
+		{
+			Name:      "touch-default",
+			Usage:     "Make the default audio and subtitle tracks match the preferred languages, changing only files that differ",
+			ArgsUsage: "DIRS-OR-FILES...",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "audio-lang",
+					Usage: "Preferred audio languages (Use multiple times. Use 'default' for tracks with no language set.)",
+				},
+				&cli.StringSliceFlag{
+					Name:  "sub-lang",
+					Usage: "Preferred subtitle languages (Use multiple times. Use 'default' for tracks with no language set.)",
+				},
+				&cli.StringSliceFlag{
+					Name:    "ignore",
+					Aliases: []string{"i"},
+					Usage:   "Ignore tracks with this string in the name (can be used multiple times.)",
+				},
+				&cli.IntFlag{
+					Name:  "max-depth",
+					Usage: "Maximum directory depth (1=only the named directories, 0=unlimited)",
+				},
+			},
+			Before: requireParser("mkvpropedit"),
+			Action: actionTouchDefault,
+		},
+
+		// validate-names
+		{
+			Name:      "validate-names",
+			Usage:     "Check that filenames match the naming format (fails on mismatches).",
+			ArgsUsage: "FILE(s)...",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "format",
+					Aliases: []string{"f"},
+					Value:   "%{title}.%{container}",
+					Usage:   "Formating mask",
+				},
+				&cli.StringFlag{
+					Name:  "title-locale",
+					Value: "en",
+					Usage: "Locale (BCP-47) used to capitalize titles",
+				},
+				&cli.BoolFlag{
+					Name:  "small-words",
+					Usage: "Do not capitalize small (English) words in titles, like \"of\" and \"the\"",
+				},
+				&cli.BoolFlag{
+					Name:  "normalize",
+					Usage: "Convert dots and underscores in titles to spaces",
+				},
+				&cli.BoolFlag{
+					Name:  "json-lines",
+					Usage: "Emit one JSON object per file as it is processed (JSON Lines)",
+				},
+			},
+			Action: actionValidateNames,
+		},
+
+		// whichtracks
+		{
+			Name:      "whichtracks",
+			Usage:     "Print the IDs of the tracks matching an expression",
+			ArgsUsage: "EXPRESSION FILE",
+			Before:    requireParser(),
+			Action:    actionWhichTracks,
+		},
+	}
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, runnerKey, &run)
+	err := app.RunContext(ctx, os.Args)
+	timings.print(os.Stderr)
+	if plan != nil {
+		// Don't leave an incomplete plan behind.
+		if errors.Is(err, errPlanUnsupported) {
+			_ = plan.discard()
+		} else if cerr := plan.close(); err == nil && cerr != nil {
+			err = fmt.Errorf("writing plan: %v", cerr)
+		}
+	}
 
 	if err != nil {
+		cleanupTemp()
 		log.Fatalln("Execution failed:", err)
 	}
 }
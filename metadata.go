@@ -0,0 +1,62 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"errors"
+)
+
+// metadata holds information about a title fetched from an external source
+// (E.g. an online movie database).
+type metadata struct {
+	// Identifier of the title in the external source (E.g. a TMDB ID).
+	id string
+	// Canonical title.
+	title string
+}
+
+// metadataProvider looks up titles in an external source. Year is zero when
+// not known. Providers return errNoMetadata when the title is not found.
+type metadataProvider interface {
+	lookup(title string, year int) (metadata, error)
+}
+
+// errNoMetadata is returned by metadata providers when a title is not found.
+var errNoMetadata = errors.New("no metadata found")
+
+// noMetadata is the default metadata provider, which never finds anything.
+type noMetadata struct{}
+
+func (noMetadata) lookup(string, int) (metadata, error) {
+	return metadata{}, errNoMetadata
+}
+
+// metadataSource is the provider used to resolve the metadata tokens
+// (%{metaid} and %{metatitle}) in formatting masks.
+var metadataSource metadataProvider = noMetadata{}
+
+// metadataFields looks up the title and year in the provider and returns the
+// metadata tokens found, keyed like the parsed fields used by format. Tokens
+// are absent if the title is not found, so they are reported as unresolved.
+func metadataFields(provider metadataProvider, title string, year int) map[string]interface{} {
+	ret := map[string]interface{}{}
+	if provider == nil || title == "" {
+		return ret
+	}
+	m, err := provider.lookup(title, year)
+	if err != nil {
+		if !errors.Is(err, errNoMetadata) {
+			warnf("Metadata lookup for %q (%d): %v", title, year, err)
+		}
+		return ret
+	}
+	if m.id != "" {
+		ret["Metaid"] = m.id
+	}
+	if m.title != "" {
+		ret["Metatitle"] = m.title
+	}
+	return ret
+}
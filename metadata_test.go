@@ -0,0 +1,82 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+// fakeMetadata is a metadata provider that counts lookups and knows a
+// single title.
+type fakeMetadata struct {
+	lookups int
+}
+
+func (f *fakeMetadata) lookup(title string, year int) (metadata, error) {
+	f.lookups++
+	if strings.EqualFold(title, "Star Wars") && year == 1977 {
+		return metadata{id: "11", title: "Star Wars: A New Hope"}, nil
+	}
+	return metadata{}, errNoMetadata
+}
+
+func TestFormatMetadata(t *testing.T) {
+	casetests := []struct {
+		fname       string
+		mask        string
+		want        string
+		wantLookups int
+		wantError   bool
+	}{
+		{
+			fname:       "star.wars.1977.1080p.mkv",
+			mask:        "%{metatitle} (%{year}) {tmdb-%{metaid}}",
+			want:        "Star Wars: A New Hope (1977) {tmdb-11}",
+			wantLookups: 1,
+		},
+		// No lookups without metadata tokens.
+		{
+			fname: "star.wars.1977.1080p.mkv",
+			mask:  "%{title} (%{year})",
+			want:  "Star Wars (1977)",
+		},
+		// Unknown titles leave the tokens unresolved.
+		{
+			fname:       "Unknown Movie (2020).mkv",
+			mask:        "%{title}%( {tmdb-%{metaid}}%)",
+			want:        "Unknown Movie",
+			wantLookups: 1,
+		},
+		{
+			fname:       "Unknown Movie (2020).mkv",
+			mask:        "%{metatitle}",
+			wantLookups: 1,
+			wantError:   true,
+		},
+	}
+
+	for _, tt := range casetests {
+		provider := &fakeMetadata{}
+		got, err := format(tt.mask, tt.fname, formatOptions{titleLocale: language.English, normalize: true, provider: provider})
+		if provider.lookups != tt.wantLookups {
+			t.Errorf("%q: got %d lookups, want %d", tt.mask, provider.lookups, tt.wantLookups)
+		}
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%q: Got no error, want error", tt.mask)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: Got error %q want no error", tt.mask, err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.mask, got, tt.want)
+		}
+	}
+}
@@ -5,9 +5,24 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 )
 
+// Range of identification format versions (the JSON schema version used by
+// mkvmerge --identify) known to work with the matroska struct below. Versions
+// outside this range may have absent or renamed fields.
+const (
+	minIdentificationVersion = 12
+	maxIdentificationVersion = 20
+)
+
+// versionWarning makes sure we only warn once about untested versions.
+var versionWarning sync.Once
+
 // Source: https://mkvtoolnix.download/doc/mkvmerge-identification-output-schema-v14.json
 // Converted to json with: https://json-schema-faker.js.org/ (enable all optionals!)
 // Converted to Go Struct with: https://mholt.github.io/json-to-go/
@@ -117,3 +132,82 @@ type matroska struct {
 		NumEntries int `json:"num_entries"`
 	} `json:"chapters"`
 }
+
+// checkIdentification verifies that the data decoded from mkvmerge's JSON
+// output is sane. It warns (once) if the identification format version is
+// outside the tested range, and returns an error if important fields are
+// missing, since the JSON decoder would silently zero them.
+func checkIdentification(data []byte, mkv matroska) error {
+	if mkv.IdentificationFormatVersion == 0 {
+		return errors.New("missing identification format version in mkvmerge output")
+	}
+	if v := mkv.IdentificationFormatVersion; v < minIdentificationVersion || v > maxIdentificationVersion {
+		versionWarning.Do(func() {
+			warnf("mkvmerge identification format version %d is outside the tested range (%d-%d). Results may be incorrect.", v, minIdentificationVersion, maxIdentificationVersion)
+		})
+	}
+
+	// Use pointers to detect missing fields.
+	var raw struct {
+		Tracks []struct {
+			ID         *int             `json:"id"`
+			Type       *string          `json:"type"`
+			Properties *json.RawMessage `json:"properties"`
+		} `json:"tracks"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for i, t := range raw.Tracks {
+		if t.ID == nil || t.Type == nil || t.Properties == nil {
+			return fmt.Errorf("track #%d in mkvmerge output lacks id, type, or properties", i)
+		}
+	}
+	return nil
+}
+
+// multiplexWarnings returns warnings about multiplexed tracks and multiple
+// programs (common in MPEG transport streams). In these files, one track may
+// carry more than one stream and track IDs from different programs are
+// listed together, so operations that assume simple track IDs may not do
+// what the user expects.
+func multiplexWarnings(mkv matroska) []string {
+	var ret []string
+	for _, track := range mkv.Tracks {
+		if len(track.Properties.MultiplexedTracks) != 0 {
+			ret = append(ret, fmt.Sprintf("track %d is multiplexed with tracks %v", track.ID, track.Properties.MultiplexedTracks))
+		}
+	}
+	if n := len(mkv.Container.Properties.Programs); n > 1 {
+		ret = append(ret, fmt.Sprintf("file contains %d programs (use --program to select one)", n))
+	}
+	return ret
+}
+
+// jsonSnippet returns a short excerpt of data around the position of a JSON
+// decoding error (or the start of data if the position is unknown), to help
+// diagnose schema mismatches or non-JSON output from mkvmerge.
+func jsonSnippet(data []byte, err error) string {
+	const context = 40
+
+	var offset int64
+	var serr *json.SyntaxError
+	var terr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &serr):
+		offset = serr.Offset
+	case errors.As(err, &terr):
+		offset = terr.Offset
+	}
+	start, end := offset-context, offset+context
+	if start < 0 {
+		start = 0
+	}
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	if start > end {
+		start = end
+	}
+	return string(data[start:end])
+}
@@ -0,0 +1,111 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckIdentification(t *testing.T) {
+	casetests := []struct {
+		data      string
+		wantError bool
+	}{
+		{
+			data: `{"identification_format_version": 14, "tracks": [{"id": 0, "type": "video", "properties": {}}]}`,
+		},
+		// Missing version.
+		{
+			data:      `{"tracks": []}`,
+			wantError: true,
+		},
+		// Missing track type.
+		{
+			data:      `{"identification_format_version": 14, "tracks": [{"id": 0, "properties": {}}]}`,
+			wantError: true,
+		},
+	}
+
+	for _, tt := range casetests {
+		var mkv matroska
+		if err := json.Unmarshal([]byte(tt.data), &mkv); err != nil {
+			t.Fatalf("Error decoding test JSON: %v", err)
+		}
+		err := checkIdentification([]byte(tt.data), mkv)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
+
+func TestMultiplexWarnings(t *testing.T) {
+	casetests := []struct {
+		json string
+		want int
+	}{
+		// Simple file.
+		{
+			json: `{"tracks": [{"id": 0, "type": "video"}, {"id": 1, "type": "audio"}]}`,
+			want: 0,
+		},
+		// Multiplexed tracks.
+		{
+			json: `{"tracks": [
+				{"id": 0, "type": "video", "properties": {"multiplexed_tracks": [0, 1]}},
+				{"id": 1, "type": "audio", "properties": {"multiplexed_tracks": [0, 1]}}]}`,
+			want: 2,
+		},
+		// Multiple programs.
+		{
+			json: `{"container": {"properties": {"programs": [{"program_number": 1}, {"program_number": 2}]}},
+				"tracks": [{"id": 0, "type": "video"}]}`,
+			want: 1,
+		},
+	}
+
+	for _, tt := range casetests {
+		got := multiplexWarnings(mustUnmarshalMKV(t, tt.json))
+		if len(got) != tt.want {
+			t.Errorf("Got %d warnings (%v), want %d", len(got), got, tt.want)
+		}
+	}
+}
+
+func TestJSONSnippet(t *testing.T) {
+	casetests := []struct {
+		data string
+		want string
+	}{
+		// Warning before the JSON.
+		{
+			data: `Warning: the file has issues. {"tracks": []}`,
+			want: `Warning: the file has issues. {"tracks": `,
+		},
+		// Type mismatch deep in the output.
+		{
+			data: `{"container": {"type": "Matroska", "properties": {"title": "A long title for padding"}}, "tracks": [{"id": "zero"}]}`,
+			want: `for padding"}}, "tracks": [{"id": "zero"}]}`,
+		},
+	}
+
+	for _, tt := range casetests {
+		var mkv matroska
+		err := json.Unmarshal([]byte(tt.data), &mkv)
+		if err == nil {
+			t.Fatalf("%q: Got no error, want error", tt.data)
+		}
+		if got := jsonSnippet([]byte(tt.data), err); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
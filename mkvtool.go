@@ -7,20 +7,28 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fatih/structs"
 	"github.com/jedib0t/go-pretty/table"
 	ParseTorrentName "github.com/middelink/go-parse-torrent-name"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+	"golang.org/x/text/message"
 )
 
 // A friendly chat about Matroska metadata track numbers.
@@ -37,173 +45,1808 @@ import (
 //
 // Track Types. See https://www.matroska.org/technical/specs/index.html
 const (
+	typeAudio    = "audio"
 	typeSubtitle = "subtitles"
+	typeVideo    = "video"
 )
 
 // trackFileInfo holds information about an exported track file.
 type trackFileInfo struct {
 	language string
+	name     string
 	fname    string
 }
 
+// defaultTitleMask is the formatting mask used to generate container titles
+// from filenames.
+const defaultTitleMask = "%{title}"
+
 // BuildVersion holds the git build number (set by make).
 var BuildVersion string
 
+// showOptions holds options that change the output of show().
+type showOptions struct {
+	// Include track UIDs.
+	uid bool
+	// Show the friendly codec name (E.g. "Advanced Video Coding") instead of
+	// the codec, when available.
+	codecName bool
+	// Preferred audio and subtitle languages. When set, a "Policy" column
+	// shows if the default tracks match the preferred languages.
+	preferredAudio []string
+	preferredSubs  []string
+	// Also list the attachments (fonts, cover art, etc).
+	attachments bool
+	// Locale used to format quantities (sizes, bitrates, etc). Quantities are
+	// formatted without grouping when not set.
+	locale *language.Tag
+	// Add a footer with the number of tracks by type.
+	summaryRow bool
+}
+
+// number formats a quantity (size, bitrate, etc) according to the locale in
+// the options (E.g. "1,234,567" in English or "1.234.567" in German).
+func (o showOptions) number(n int64) string {
+	if o.locale == nil {
+		return strconv.FormatInt(n, 10)
+	}
+	return message.NewPrinter(*o.locale).Sprintf("%d", n)
+}
+
+// propQuantities lists the track properties formatted as quantities by
+// showTrackProps. Other numbers (like IDs) are shown unchanged.
+var propQuantities = map[string]bool{
+	"AudioSamplingFrequency": true,
+	"CodecDelay":             true,
+	"CodecPrivateLength":     true,
+	"DefaultDuration":        true,
+	"MinimumTimestamp":       true,
+	"TagBitsps":              true,
+	"TagBps":                 true,
+}
+
+// policyMarkers returns the markers for the "Policy" column in show, by track
+// (base 0), comparing the current default tracks with the tracks that should
+// be default according to the preferred languages.
+func policyMarkers(mkv matroska, opts showOptions) map[int]string {
+	ret := map[int]string{}
+	for _, p := range []struct {
+		ttype     string
+		languages []string
+	}{
+		{typeAudio, opts.preferredAudio},
+		{typeSubtitle, opts.preferredSubs},
+	} {
+		if len(p.languages) == 0 {
+			continue
+		}
+		preferred, err := trackByLanguageAndType(mkv, p.ttype, p.languages, nil, false)
+		if err != nil {
+			preferred = -1
+		}
+		for _, track := range mkv.Tracks {
+			if track.Type != p.ttype {
+				continue
+			}
+			switch {
+			case track.ID == preferred && track.Properties.DefaultTrack:
+				ret[track.ID] = "OK"
+			case track.ID == preferred:
+				ret[track.ID] = "should be default"
+			case track.Properties.DefaultTrack:
+				ret[track.ID] = "should not be default"
+			}
+		}
+	}
+	return ret
+}
+
 // show lists all tracks in a file.
-func show(mkv matroska, showUID bool) {
+func show(w io.Writer, mkv matroska, opts showOptions) {
+	tab := table.NewWriter()
+	tab.SetOutputMirror(w)
+
+	policy := len(opts.preferredAudio) != 0 || len(opts.preferredSubs) != 0
+	markers := policyMarkers(mkv, opts)
+
+	header := table.Row{"Number"}
+	if opts.uid {
+		header = append(header, "UID")
+	}
+	header = append(header, "Type", "Name", "Language", "Codec", "Default")
+	if policy {
+		header = append(header, "Policy")
+	}
+	tab.AppendHeader(header)
+
+	for _, track := range mkv.Tracks {
+		// Create a row with the desired columns.
+		// mkvmerge reports tracks starting at zero, so we add one to match the file.
+		row := []interface{}{track.ID}
+		if opts.uid {
+			row = append(row, track.Properties.UID)
+		}
+		codec := track.Codec
+		if opts.codecName && track.Properties.CodecName != "" {
+			codec = track.Properties.CodecName
+		}
+		lang := trackLanguage(track.Properties.Language, track.Properties.LanguageIetf)
+		row = append(row, track.Type, track.Properties.TrackName, lang, codec)
+
+		// Make default flag easier to see.
+		if track.Properties.DefaultTrack {
+			row = append(row, "<=====")
+		} else {
+			row = append(row, "")
+		}
+		if policy {
+			row = append(row, markers[track.ID])
+		}
+		tab.AppendRow(row)
+	}
+	if opts.summaryRow {
+		counts := map[string]int{}
+		for _, track := range mkv.Tracks {
+			counts[track.Type]++
+		}
+		footer := make(table.Row, len(header))
+		footer[0] = "Totals"
+		footer[1] = trackTotals(counts)
+		for i := 2; i < len(footer); i++ {
+			footer[i] = ""
+		}
+		tab.AppendFooter(footer)
+	}
+	tab.Render()
+
+	if opts.attachments && len(mkv.Attachments) != 0 {
+		showAttachments(w, mkv, opts)
+	}
+}
+
+// trackTotals returns the number of tracks by type (E.g. "1 video, 3 audio,
+// 5 subtitles"). Video, audio, and subtitles come first, followed by any
+// other types in alphabetical order.
+func trackTotals(counts map[string]int) string {
+	order := []string{typeVideo, typeAudio, typeSubtitle}
+	var others []string
+	for ttype := range counts {
+		if ttype != typeVideo && ttype != typeAudio && ttype != typeSubtitle {
+			others = append(others, ttype)
+		}
+	}
+	sort.Strings(others)
+
+	var parts []string
+	for _, ttype := range append(order, others...) {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[ttype], ttype))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// summary returns a single line digest of the file, with the number of tracks
+// by type, attachments, presence of chapters, and the language of the default
+// subtitle track (E.g. "file.mkv: V:1 A:2 S:3 att:4 chap:yes
+// default-sub:eng").
+func summary(mkv matroska) string {
+	count := map[string]int{}
+	defaultSub := "none"
+	for _, track := range mkv.Tracks {
+		count[track.Type]++
+		if track.Type == typeSubtitle && track.Properties.DefaultTrack && defaultSub == "none" {
+			defaultSub = trackLanguage(track.Properties.Language, track.Properties.LanguageIetf)
+			if defaultSub == "" {
+				defaultSub = "und"
+			}
+		}
+	}
+	chapters := "no"
+	for _, c := range mkv.Chapters {
+		if c.NumEntries != 0 {
+			chapters = "yes"
+			break
+		}
+	}
+	return fmt.Sprintf("%s: V:%d A:%d S:%d att:%d chap:%s default-sub:%s", mkv.FileName,
+		count[typeVideo], count[typeAudio], count[typeSubtitle], len(mkv.Attachments), chapters, defaultSub)
+}
+
+// showAttachments lists the attachments in a file, with the total size.
+func showAttachments(w io.Writer, mkv matroska, opts showOptions) {
+	tab := table.NewWriter()
+	tab.SetOutputMirror(w)
+	tab.AppendHeader(table.Row{"ID", "Name", "MIME Type", "Size", "Description"})
+
+	total := 0
+	for _, a := range mkv.Attachments {
+		tab.AppendRow(table.Row{a.ID, a.FileName, a.ContentType, opts.number(int64(a.Size)), a.Description})
+		total += a.Size
+	}
+	tab.AppendFooter(table.Row{"", fmt.Sprintf("%d attachment(s)", len(mkv.Attachments)), "Total", opts.number(int64(total)), ""})
+	tab.Render()
+}
+
+// showChapters lists the chapters of a file.
+func showChapters(w io.Writer, chapters []chapterEntry) {
+	tab := table.NewWriter()
+	tab.SetOutputMirror(w)
+	tab.AppendHeader(table.Row{"Edition", "Chapter", "Start", "End", "Name", "Language"})
+	for _, ch := range chapters {
+		tab.AppendRow(table.Row{ch.edition, ch.number, ch.start, ch.end, ch.name, ch.language})
+	}
+	tab.Render()
+}
+
+// showTags lists the tags of a file.
+func showTags(w io.Writer, tags []tagEntry) {
 	tab := table.NewWriter()
-	tab.SetOutputMirror(os.Stdout)
-	if showUID {
-		tab.AppendHeader(table.Row{"Number", "UID", "Type", "Name", "Language", "Codec", "Default"})
+	tab.SetOutputMirror(w)
+	tab.AppendHeader(table.Row{"Target", "Name", "Value"})
+	for _, t := range tags {
+		tab.AppendRow(table.Row{t.target, t.name, t.value})
+	}
+	tab.Render()
+}
+
+// selectProgram returns a copy of mkv containing only the tracks that belong
+// to the given program number (E.g. in MPEG transport streams).
+func selectProgram(mkv matroska, program int) (matroska, error) {
+	found := false
+	for _, p := range mkv.Container.Properties.Programs {
+		if p.ProgramNumber == program {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return matroska{}, fmt.Errorf("program %d not found", program)
+	}
+
+	ret := mkv
+	ret.Tracks = nil
+	for _, track := range mkv.Tracks {
+		if track.Properties.ProgramNumber == program {
+			ret.Tracks = append(ret.Tracks, track)
+		}
+	}
+	return ret, nil
+}
+
+// showTrackProps lists all parsed properties of a track (base 0) as a
+// key/value table.
+func showTrackProps(w io.Writer, mkv matroska, tracknum int, opts showOptions) error {
+	for _, track := range mkv.Tracks {
+		if track.ID != tracknum {
+			continue
+		}
+		tab := table.NewWriter()
+		tab.SetOutputMirror(w)
+		tab.AppendHeader(table.Row{"Property", "Value"})
+		tab.AppendRow(table.Row{"ID", track.ID})
+		tab.AppendRow(table.Row{"Type", track.Type})
+		tab.AppendRow(table.Row{"Codec", track.Codec})
+		for _, f := range structs.Fields(track.Properties) {
+			value := f.Value()
+			if propQuantities[f.Name()] {
+				switch v := value.(type) {
+				case int:
+					value = opts.number(int64(v))
+				case string:
+					// Tags store numbers as strings.
+					if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+						value = opts.number(n)
+					}
+				}
+			}
+			tab.AppendRow(table.Row{f.Name(), value})
+		}
+		tab.Render()
+		return nil
+	}
+	return fmt.Errorf("track %d not found", tracknum)
+}
+
+// treeNode is a node in a textual tree.
+type treeNode struct {
+	label    string
+	children []treeNode
+}
+
+// renderTree returns the textual representation of the tree rooted at node.
+func renderTree(node treeNode) string {
+	var sb strings.Builder
+
+	var walk func(n treeNode, prefix string)
+	walk = func(n treeNode, prefix string) {
+		for i, child := range n.children {
+			branch, indent := "├── ", "│   "
+			if i == len(n.children)-1 {
+				branch, indent = "└── ", "    "
+			}
+			sb.WriteString(prefix + branch + child.label + "\n")
+			walk(child, prefix+indent)
+		}
+	}
+	sb.WriteString(node.label + "\n")
+	walk(node, "")
+	return sb.String()
+}
+
+// fileTree composes the parsed information about a file into a tree: file,
+// container information, tracks (grouped by type), attachments, and chapters.
+func fileTree(mkv matroska, opts showOptions) treeNode {
+	props := mkv.Container.Properties
+
+	container := treeNode{label: "Container: " + mkv.Container.Type}
+	if props.Title != "" {
+		container.children = append(container.children, treeNode{label: fmt.Sprintf("Title: %s", props.Title)})
+	}
+	if props.Duration != 0 {
+		container.children = append(container.children, treeNode{label: fmt.Sprintf("Duration: %v", time.Duration(props.Duration).Round(time.Second))})
+	}
+	if props.MuxingApplication != "" {
+		container.children = append(container.children, treeNode{label: fmt.Sprintf("Muxing application: %s", props.MuxingApplication)})
+	}
+
+	// Group tracks by type, keeping the usual types first.
+	types := []string{typeVideo, typeAudio, typeSubtitle}
+	bytype := map[string][]treeNode{}
+	for _, track := range mkv.Tracks {
+		if _, ok := bytype[track.Type]; !ok && track.Type != typeVideo && track.Type != typeAudio && track.Type != typeSubtitle {
+			types = append(types, track.Type)
+		}
+		label := fmt.Sprintf("%d: %s", track.ID, track.Codec)
+		if lang := trackLanguage(track.Properties.Language, track.Properties.LanguageIetf); lang != "" {
+			label += fmt.Sprintf(" [%s]", lang)
+		}
+		if track.Properties.TrackName != "" {
+			label += fmt.Sprintf(" %q", track.Properties.TrackName)
+		}
+		if track.Properties.DefaultTrack {
+			label += " (default)"
+		}
+		if track.Properties.ForcedTrack {
+			label += " (forced)"
+		}
+		bytype[track.Type] = append(bytype[track.Type], treeNode{label: label})
+	}
+	tracks := treeNode{label: fmt.Sprintf("Tracks (%d)", len(mkv.Tracks))}
+	for _, t := range types {
+		if len(bytype[t]) != 0 {
+			tracks.children = append(tracks.children, treeNode{label: t, children: bytype[t]})
+		}
+	}
+
+	attachments := treeNode{label: fmt.Sprintf("Attachments (%d)", len(mkv.Attachments))}
+	for _, a := range mkv.Attachments {
+		attachments.children = append(attachments.children, treeNode{label: fmt.Sprintf("%d: %s (%s, %s bytes)", a.ID, a.FileName, a.ContentType, opts.number(int64(a.Size)))})
+	}
+
+	nchapters := 0
+	for _, c := range mkv.Chapters {
+		nchapters += c.NumEntries
+	}
+	chapters := treeNode{label: fmt.Sprintf("Chapters (%d)", nchapters)}
+
+	return treeNode{
+		label:    mkv.FileName,
+		children: []treeNode{container, tracks, attachments, chapters},
+	}
+}
+
+// showTree shows information about the file as a tree.
+func showTree(w io.Writer, mkv matroska, opts showOptions) {
+	fmt.Fprint(w, renderTree(fileTree(mkv, opts)))
+}
+
+// setdefault resets flagDefault on all subtitle tracks and sets it on the chosen track UID.
+func setdefault(mkv matroska, tracknum int, cmd runner) error {
+	command := []string{
+		"mkvpropedit",
+		mkv.FileName,
+	}
+
+	for _, track := range mkv.Tracks {
+		if track.Type == typeSubtitle {
+			// mkvpropedit uses base 1 for track (not zero).
+			command = append(command, "--edit", fmt.Sprintf("track:%d", track.ID+1), "--set", "flag-default=0")
+		}
+	}
+
+	if err := cmd.run(command[0], command[1:]...); err != nil {
+		return err
+	}
+	return adddefault(mkv, tracknum, cmd)
+}
+
+// setsubsOptions holds the options for setsubs. A track number of -1 clears
+// the flag on all subtitle tracks.
+type setsubsOptions struct {
+	// Set the default flag only on defaultTrack (base 0).
+	setDefault   bool
+	defaultTrack int
+	// Set the forced flag only on forcedTrack (base 0).
+	setForced   bool
+	forcedTrack int
+}
+
+// setsubs sets the default and forced flags of the subtitle tracks together,
+// in place, with a single mkvpropedit invocation. The chosen tracks get the
+// flag and all other subtitle tracks have it cleared.
+func setsubs(mkv matroska, opts setsubsOptions, cmd runner) error {
+	for _, t := range []struct {
+		set   bool
+		track int
+		flag  string
+	}{
+		{opts.setDefault, opts.defaultTrack, "default"},
+		{opts.setForced, opts.forcedTrack, "forced"},
+	} {
+		if !t.set || t.track == -1 {
+			continue
+		}
+		found := false
+		for _, track := range mkv.Tracks {
+			if track.ID != t.track {
+				continue
+			}
+			if track.Type != typeSubtitle {
+				return fmt.Errorf("%s track %d is not a subtitle track", t.flag, t.track)
+			}
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("%s track %d not found", t.flag, t.track)
+		}
+	}
+
+	command := []string{"mkvpropedit", mkv.FileName}
+	flag := func(b bool) string {
+		if b {
+			return "1"
+		}
+		return "0"
+	}
+	for _, track := range mkv.Tracks {
+		if track.Type != typeSubtitle {
+			continue
+		}
+		// mkvpropedit uses base 1 for track (not zero).
+		command = append(command, "--edit", fmt.Sprintf("track:%d", track.ID+1))
+		if opts.setDefault {
+			command = append(command, "--set", "flag-default="+flag(track.ID == opts.defaultTrack))
+		}
+		if opts.setForced {
+			command = append(command, "--set", "flag-forced="+flag(track.ID == opts.forcedTrack))
+		}
+	}
+	if len(command) == 2 {
+		return errors.New("file has no subtitle tracks")
+	}
+	return cmd.run(command[0], command[1:]...)
+}
+
+// settracksOptions holds the options for settracks. Only the properties with
+// the corresponding set field are changed.
+type settracksOptions struct {
+	// Track selection expression (see selectTracksByExpr).
+	where string
+
+	setName    bool
+	name       string
+	setLang    bool
+	lang       string
+	setDefault bool
+	isDefault  bool
+	setForced  bool
+	isForced   bool
+}
+
+// settracks changes the properties of all tracks matching the selection
+// expression, in place, with a single mkvpropedit invocation. Languages are
+// normalized (see normalizeLanguage). Returns the IDs of the changed tracks.
+// A file without matching tracks is not an error (and is not changed). Setting
+// the default flag on more than one track of the same type is an error, as
+// players would pick one of them arbitrarily.
+func settracks(mkv matroska, opts settracksOptions, cmd runner) ([]int, error) {
+	var props []string
+	if opts.setName {
+		props = append(props, "--set", "name="+opts.name)
+	}
+	if opts.setLang {
+		iso, ietf, err := normalizeLanguage(opts.lang)
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, "--set", "language="+iso, "--set", "language-ietf="+ietf)
+	}
+	flag := func(b bool) string {
+		if b {
+			return "1"
+		}
+		return "0"
+	}
+	if opts.setDefault {
+		props = append(props, "--set", "flag-default="+flag(opts.isDefault))
+	}
+	if opts.setForced {
+		props = append(props, "--set", "flag-forced="+flag(opts.isForced))
+	}
+	if len(props) == 0 {
+		return nil, errors.New("no track properties to change")
+	}
+
+	ids, err := selectTracksByExpr(mkv, opts.where)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	if opts.setDefault && opts.isDefault {
+		ttypes := map[int]string{}
+		for _, track := range mkv.Tracks {
+			ttypes[track.ID] = track.Type
+		}
+		count := map[string]int{}
+		for _, id := range ids {
+			count[ttypes[id]]++
+			if count[ttypes[id]] > 1 {
+				return nil, fmt.Errorf("more than one %s track matches %q (only one track of each type can be the default)", ttypes[id], opts.where)
+			}
+		}
+	}
+	command := []string{"mkvpropedit", mkv.FileName}
+	for _, id := range ids {
+		// mkvpropedit uses base 1 for track (not zero).
+		command = append(command, "--edit", fmt.Sprintf("track:%d", id+1))
+		command = append(command, props...)
+	}
+	return ids, cmd.run(command[0], command[1:]...)
+}
+
+// editResult returns a description of the given fields (name, language,
+// default, forced, enabled, uid, or fps) of the tracks in the file, one track
+// per line.
+// Only tracks of type ttype are included, or all tracks if ttype is empty. If
+// ids is not empty, only those tracks (base 0) are included. Used to show the
+// result of in-place edits.
+func editResult(mkv matroska, ttype string, ids []int, fields ...string) []string {
+	yesno := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	want := map[int]bool{}
+	for _, id := range ids {
+		want[id] = true
+	}
+
+	var ret []string
+	for _, track := range mkv.Tracks {
+		if ttype != "" && track.Type != ttype {
+			continue
+		}
+		if len(want) != 0 && !want[track.ID] {
+			continue
+		}
+		var values []string
+		for _, field := range fields {
+			p := track.Properties
+			v := ""
+			switch field {
+			case "name":
+				v = strconv.Quote(p.TrackName)
+			case "language":
+				v = trackLanguage(p.Language, p.LanguageIetf)
+			case "default":
+				v = yesno(p.DefaultTrack)
+			case "forced":
+				v = yesno(p.ForcedTrack)
+			case "enabled":
+				v = yesno(p.EnabledTrack)
+			case "uid":
+				v = strconv.FormatUint(p.UID, 10)
+			case "fps":
+				v = "unset"
+				if p.DefaultDuration != 0 {
+					v = strconv.FormatFloat(float64(time.Second)/float64(p.DefaultDuration), 'f', 3, 64)
+				}
+			}
+			values = append(values, field+"="+v)
+		}
+		ret = append(ret, fmt.Sprintf("track %d (%s): %s", track.ID, track.Type, strings.Join(values, " ")))
+	}
+	return ret
+}
+
+// striptags removes tags from the file in place. Global tags are removed if
+// global is set and track tags for each track (base 0) in tracks. Setting all
+// removes all tags from the file. Returns the number of tag entries removed.
+func striptags(mkv matroska, global bool, tracks []int, all bool, cmd runner) (int, error) {
+	command := []string{"mkvpropedit", mkv.FileName}
+	count := 0
+
+	if all {
+		command = append(command, "--tags", "all:")
+		for _, t := range mkv.GlobalTags {
+			count += t.NumEntries
+		}
+		for _, t := range mkv.TrackTags {
+			count += t.NumEntries
+		}
 	} else {
-		tab.AppendHeader(table.Row{"Number", "Type", "Name", "Language", "Codec", "Default"})
+		if global {
+			command = append(command, "--tags", "global:")
+			for _, t := range mkv.GlobalTags {
+				count += t.NumEntries
+			}
+		}
+		for _, tracknum := range tracks {
+			found := false
+			for _, track := range mkv.Tracks {
+				if track.ID == tracknum {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return 0, fmt.Errorf("file %s does not contain track %d", mkv.FileName, tracknum)
+			}
+			// mkvpropedit uses base 1 for tracks.
+			command = append(command, "--tags", fmt.Sprintf("track:%d:", tracknum+1))
+			for _, t := range mkv.TrackTags {
+				if t.TrackID == tracknum {
+					count += t.NumEntries
+				}
+			}
+		}
+	}
+	if len(command) == 2 {
+		return 0, errors.New("no tags selected for removal")
+	}
+	if err := cmd.run(command[0], command[1:]...); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// setForcedByName sets the forced flag on all subtitle tracks with a name
+// containing one of the strings in matches (case insensitive). Returns the
+// list of tracks flagged.
+func setForcedByName(mkv matroska, matches []string, cmd runner) ([]int, error) {
+	command := []string{"mkvpropedit", mkv.FileName}
+	var flagged []int
+
+	for _, track := range mkv.Tracks {
+		if track.Type != typeSubtitle || track.Properties.ForcedTrack || !stringInSlice(track.Properties.TrackName, matches) {
+			continue
+		}
+		// mkvpropedit uses base 1 for track (not zero).
+		command = append(command, "--edit", fmt.Sprintf("track:%d", track.ID+1), "--set", "flag-forced=1")
+		flagged = append(flagged, track.ID)
+	}
+	if len(flagged) == 0 {
+		return nil, nil
+	}
+	if err := cmd.run(command[0], command[1:]...); err != nil {
+		return nil, err
+	}
+	return flagged, nil
+}
+
+// disableByLanguage clears the enabled flag of the audio and subtitle tracks
+// in one of the languages ("default" matches tracks without a language), so
+// players skip them. If ttype is not empty, only tracks of that type are
+// changed. Unless force is set, an error is returned if no enabled audio
+// track would remain. Returns the IDs of the disabled tracks.
+func disableByLanguage(mkv matroska, languages []string, ttype string, force bool, cmd runner) ([]int, error) {
+	want := map[string]bool{}
+	for _, lang := range languages {
+		if lang == "default" {
+			lang = ""
+		}
+		want[strings.ToLower(lang)] = true
+	}
+
+	command := []string{"mkvpropedit", mkv.FileName}
+	var disabled []int
+	keep := map[int]bool{}
+
+	for _, track := range mkv.Tracks {
+		if track.Type != typeAudio && track.Type != typeSubtitle {
+			continue
+		}
+		lang := strings.ToLower(trackLanguage(track.Properties.Language, track.Properties.LanguageIetf))
+		if !track.Properties.EnabledTrack || (ttype != "" && track.Type != ttype) || !want[lang] {
+			keep[track.ID] = track.Properties.EnabledTrack
+			continue
+		}
+		// mkvpropedit uses base 1 for track (not zero).
+		command = append(command, "--edit", fmt.Sprintf("track:%d", track.ID+1), "--set", "flag-enabled=0")
+		disabled = append(disabled, track.ID)
+	}
+	if len(disabled) == 0 {
+		return nil, nil
+	}
+	if err := checkLayout(mkv, keep); err != nil {
+		if !force {
+			return nil, fmt.Errorf("%v (use --force to proceed anyway)", err)
+		}
+		warnf("%s: %v", mkv.FileName, err)
+	}
+	if err := cmd.run(command[0], command[1:]...); err != nil {
+		return nil, err
+	}
+	return disabled, nil
+}
+
+// renameTracks replaces the names of all tracks matching re with template
+// (using regexp replacement syntax, E.g. "$1"). If ttype is not empty, only
+// tracks of that type are changed. Tracks without a name are never changed.
+// Tracks with an empty name after the replacement have their name removed.
+// Returns a description of the changes.
+func renameTracks(mkv matroska, re *regexp.Regexp, template, ttype string, cmd runner) ([]string, error) {
+	command := []string{"mkvpropedit", mkv.FileName}
+	var changes []string
+
+	for _, track := range mkv.Tracks {
+		name := track.Properties.TrackName
+		if (ttype != "" && track.Type != ttype) || name == "" || !re.MatchString(name) {
+			continue
+		}
+		newname := re.ReplaceAllString(name, template)
+		if newname == name {
+			continue
+		}
+		// mkvpropedit uses base 1 for track (not zero).
+		command = append(command, "--edit", fmt.Sprintf("track:%d", track.ID+1))
+		if newname == "" {
+			command = append(command, "--delete", "name")
+		} else {
+			command = append(command, "--set", "name="+newname)
+		}
+		changes = append(changes, fmt.Sprintf("Track %d: %q => %q", track.ID, name, newname))
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	if err := cmd.run(command[0], command[1:]...); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// reLabelToken matches the tokens in track name templates (E.g. "{langname}").
+var reLabelToken = regexp.MustCompile(`{([a-z]+)}`)
+
+// labelTokens lists the valid tokens in track name templates.
+var labelTokens = map[string]bool{
+	"langname": true,
+	"lang":     true,
+	"channels": true,
+	"codec":    true,
+	"forced":   true,
+}
+
+// checkLabelTemplate returns an error if the track name template contains
+// unknown tokens.
+func checkLabelTemplate(template string) error {
+	for _, m := range reLabelToken.FindAllStringSubmatch(template, -1) {
+		if !labelTokens[m[1]] {
+			return fmt.Errorf("unknown token %q in name template", m[0])
+		}
+	}
+	return nil
+}
+
+// channelLayout returns the usual description of a number of audio channels
+// (E.g. "5.1" for 6 channels).
+func channelLayout(channels int) string {
+	switch channels {
+	case 0:
+		return ""
+	case 1:
+		return "1.0"
+	case 2:
+		return "2.0"
+	case 6:
+		return "5.1"
+	case 8:
+		return "7.1"
+	}
+	return fmt.Sprintf("%d channels", channels)
+}
+
+// labelTracks sets the names of all tracks (or only tracks of type ttype, if
+// not empty) using template. The tokens {langname} (English language name),
+// {lang} (language code), {channels} (E.g. "5.1"), {codec}, and {forced}
+// ("Forced" for forced tracks) are replaced by the track information. Tokens
+// may resolve to empty strings, so empty brackets and repeated spaces are
+// removed from the result (E.g. "{langname} [{forced}]" produces "English"
+// for tracks that are not forced). Tracks already named correctly are not
+// changed. Returns a description of the changes.
+func labelTracks(mkv matroska, template, ttype string, cmd runner) ([]string, error) {
+	if err := checkLabelTemplate(template); err != nil {
+		return nil, err
+	}
+	command := []string{"mkvpropedit", mkv.FileName}
+	var changes []string
+
+	for _, track := range mkv.Tracks {
+		if ttype != "" && track.Type != ttype {
+			continue
+		}
+		p := track.Properties
+		lang := trackLanguage(p.Language, p.LanguageIetf)
+		name := reLabelToken.ReplaceAllStringFunc(template, func(s string) string {
+			switch s[1 : len(s)-1] {
+			case "langname":
+				if name := languageName(lang); name != "" {
+					return name
+				}
+				return "Unknown"
+			case "lang":
+				return lang
+			case "channels":
+				return channelLayout(p.AudioChannels)
+			case "codec":
+				return track.Codec
+			case "forced":
+				if p.ForcedTrack {
+					return "Forced"
+				}
+			}
+			return ""
+		})
+		name = strings.NewReplacer("()", "", "[]", "").Replace(name)
+		name = strings.Join(strings.Fields(name), " ")
+
+		if name == "" || name == p.TrackName {
+			continue
+		}
+		// mkvpropedit uses base 1 for track (not zero).
+		command = append(command, "--edit", fmt.Sprintf("track:%d", track.ID+1), "--set", "name="+name)
+		changes = append(changes, fmt.Sprintf("Track %d: %q => %q", track.ID, p.TrackName, name))
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	if err := cmd.run(command[0], command[1:]...); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// setdate sets the muxing date in the file to date. A zero date removes the
+// muxing date from the file.
+func setdate(fname string, date time.Time, cmd runner) error {
+	command := []string{"mkvpropedit", fname, "--edit", "info"}
+	if date.IsZero() {
+		command = append(command, "--delete", "date")
+	} else {
+		command = append(command, "--set", "date="+date.Format(time.RFC3339))
+	}
+	return cmd.run(command[0], command[1:]...)
+}
+
+// parseDate parses a date in RFC3339 format (E.g. 2022-01-02T15:04:05Z). The
+// special value "now" returns the current time and "clear" returns the zero
+// time.
+func parseDate(s string) (time.Time, error) {
+	switch strings.ToLower(s) {
+	case "now":
+		return time.Now().Truncate(time.Second), nil
+	case "clear":
+		return time.Time{}, nil
+	}
+	date, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q (use RFC3339, \"now\", or \"clear\")", s)
+	}
+	return date, nil
+}
+
+// parseFPS parses a frame rate, either as a decimal number (E.g. "23.976") or
+// a fraction (E.g. "24000/1001"), and returns the duration of each frame.
+func parseFPS(s string) (time.Duration, error) {
+	var fps float64
+	var err error
+
+	if num, den, ok := cutString(s, "/"); ok {
+		var n, d float64
+		n, err = strconv.ParseFloat(num, 64)
+		if err == nil {
+			d, err = strconv.ParseFloat(den, 64)
+		}
+		if err == nil && d == 0 {
+			err = errors.New("zero denominator")
+		}
+		if err == nil {
+			fps = n / d
+		}
+	} else {
+		fps, err = strconv.ParseFloat(s, 64)
+	}
+	if err != nil || math.IsNaN(fps) || fps <= 0 || fps > 1000 {
+		return 0, fmt.Errorf("invalid frame rate %q (use a number between 0 and 1000, or a fraction like 24000/1001)", s)
+	}
+	return time.Duration(math.Round(float64(time.Second) / fps)), nil
+}
+
+// cutString slices s around the first instance of sep (like strings.Cut, not
+// available in older versions of Go).
+func cutString(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// setfps sets the default duration (frame duration) of a video track (base
+// 0), in place. This fixes players that use the wrong frame rate due to
+// incorrect metadata.
+func setfps(mkv matroska, tracknum int, frame time.Duration, cmd runner) error {
+	for _, track := range mkv.Tracks {
+		if track.ID != tracknum {
+			continue
+		}
+		if track.Type != typeVideo {
+			return fmt.Errorf("track %d is not a video track", tracknum)
+		}
+		// mkvpropedit uses base 1 for track (not zero).
+		return cmd.run("mkvpropedit", mkv.FileName, "--edit", fmt.Sprintf("track:%d", tracknum+1), "--set", fmt.Sprintf("default-duration=%d", frame.Nanoseconds()))
+	}
+	return fmt.Errorf("track %d not found", tracknum)
+}
+
+// parseUID parses a Matroska UID (a non-zero unsigned 64-bit integer), in
+// decimal or hexadecimal (with a "0x" prefix).
+func parseUID(s string) (uint64, error) {
+	uid, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid UID %q: must be an unsigned 64-bit integer", s)
+	}
+	if uid == 0 {
+		return 0, errors.New("invalid UID 0: UIDs must not be zero")
+	}
+	return uid, nil
+}
+
+// settrackuid sets the UID of a track (base 0), in place. The UID must not be
+// in use by another track in the file.
+func settrackuid(mkv matroska, tracknum int, uid uint64, cmd runner) error {
+	found := false
+	for _, track := range mkv.Tracks {
+		if track.ID == tracknum {
+			found = true
+			continue
+		}
+		if track.Properties.UID == uid {
+			return fmt.Errorf("UID %d already used by track %d", uid, track.ID)
+		}
+	}
+	if !found {
+		return fmt.Errorf("track %d not found", tracknum)
+	}
+	// mkvpropedit uses base 1 for track (not zero).
+	return cmd.run("mkvpropedit", mkv.FileName, "--edit", fmt.Sprintf("track:%d", tracknum+1), "--set", fmt.Sprintf("track-uid=%d", uid))
+}
+
+// trackByLanguage returns the track number (base 0) for the first track with
+// one of the specified languages. The list of languages works as a priority,
+// meaning that languages=["eng","fra"] will first attempt to find a track with
+// the English language, and failing that, French. The special language
+// "default" will cause tracks without a language code to be selected (Matroska
+// has the concept of a "default language", which is usually English -- tracks
+// with this language will not have a language code).
+//
+// The ignore slice contains a list of strings for case-insentive search
+// against the track name. If the selected language contains one of the strings
+// in this slice, it will be ignored. This is useful to select tracks by
+// language while ignoring 'Forced' tracks.
+//
+// In strict mode, an error is returned if more than one regular (not forced
+// and not SDH) track matches the language, instead of silently picking the
+// first one.
+func trackByLanguage(mkv matroska, languages []string, ignore []string, strict bool) (int, error) {
+	return trackByLanguageAndType(mkv, typeSubtitle, languages, ignore, strict)
+}
+
+// trackByLanguageAndType works like trackByLanguage, for tracks of the given
+// type.
+func trackByLanguageAndType(mkv matroska, ttype string, languages []string, ignore []string, strict bool) (int, error) {
+	for _, lang := range languages {
+		if lang == "default" {
+			lang = ""
+		}
+		var matches, regular []int
+		for _, track := range mkv.Tracks {
+			// Match subtitle and language.
+			if track.Type != ttype || trackLanguage(track.Properties.Language, track.Properties.LanguageIetf) != lang {
+				continue
+			}
+			// Make sure track should not be ignored.
+			if stringInSlice(track.Properties.TrackName, ignore) {
+				continue
+			}
+			if !strict {
+				return track.ID, nil
+			}
+			matches = append(matches, track.ID)
+			if !track.Properties.ForcedTrack && !track.Properties.FlagHearingImpaired && !stringInSlice(track.Properties.TrackName, []string{"sdh"}) {
+				regular = append(regular, track.ID)
+			}
+		}
+		switch {
+		case len(regular) > 1:
+			var ids []string
+			for _, id := range regular {
+				ids = append(ids, fmt.Sprintf("%d", id))
+			}
+			return 0, fmt.Errorf("ambiguous language %q: tracks %s match", lang, strings.Join(ids, ","))
+		case len(regular) == 1:
+			return regular[0], nil
+		case len(matches) != 0:
+			return matches[0], nil
+		}
+	}
+	return 0, fmt.Errorf("%w with language(s): %s", errNoTrack, strings.Join(languages, ","))
+}
+
+// errNoTrack is returned (wrapped) by trackByLanguageAndType when no track
+// matches the languages.
+var errNoTrack = errors.New("no track")
+
+// Actions taken by setdefaultbylang when no track matches the languages.
+const (
+	fallbackError = "error"
+	fallbackFirst = "first"
+	fallbackNone  = "none"
+)
+
+// touchDefaultOptions holds the default track policy for touchDefault.
+type touchDefaultOptions struct {
+	// Preferred audio and subtitle languages, in priority order (see
+	// trackByLanguage). Types without languages are not checked.
+	audioLangs []string
+	subLangs   []string
+	// Ignore tracks with one of these strings in the name.
+	ignore []string
+}
+
+// touchDefault makes the default flags in the file match the policy in opts:
+// for each track type, the first track in a preferred language becomes the
+// only default track of that type. Types without a matching track are left
+// unchanged. mkvpropedit only runs if a flag needs to change, so running it
+// again over the same file is a no-op. Returns a description of the changes.
+func touchDefault(mkv matroska, opts touchDefaultOptions, cmd runner) ([]string, error) {
+	command := []string{"mkvpropedit", mkv.FileName}
+	var changes []string
+
+	for _, p := range []struct {
+		ttype string
+		langs []string
+	}{
+		{typeAudio, opts.audioLangs},
+		{typeSubtitle, opts.subLangs},
+	} {
+		if len(p.langs) == 0 {
+			continue
+		}
+		want, err := trackByLanguageAndType(mkv, p.ttype, p.langs, opts.ignore, false)
+		if errors.Is(err, errNoTrack) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, track := range mkv.Tracks {
+			isDefault := track.ID == want
+			if track.Type != p.ttype || track.Properties.DefaultTrack == isDefault {
+				continue
+			}
+			flag := "0"
+			if isDefault {
+				flag = "1"
+			}
+			// mkvpropedit uses base 1 for track (not zero).
+			command = append(command, "--edit", fmt.Sprintf("track:%d", track.ID+1), "--set", "flag-default="+flag)
+			changes = append(changes, fmt.Sprintf("track %d (%s): default %v => %v", track.ID, track.Type, track.Properties.DefaultTrack, isDefault))
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	return changes, cmd.run(command[0], command[1:]...)
+}
+
+// defaultSubByLanguage returns the subtitle track (base 0) that should become
+// the default, like trackByLanguage. When no track matches, the fallback
+// decides: fallbackFirst returns the first subtitle track, fallbackNone
+// returns -1 (leave the file unchanged), and fallbackError returns the error.
+func defaultSubByLanguage(mkv matroska, languages []string, ignore []string, strict bool, fallback string) (int, error) {
+	track, err := trackByLanguage(mkv, languages, ignore, strict)
+	if err == nil || !errors.Is(err, errNoTrack) {
+		return track, err
+	}
+	switch fallback {
+	case fallbackFirst:
+		for _, t := range mkv.Tracks {
+			if t.Type == typeSubtitle {
+				return t.ID, nil
+			}
+		}
+	case fallbackNone:
+		return -1, nil
+	}
+	return 0, err
+}
+
+// harmonizeChange describes a file whose default subtitle track must change
+// to match the majority of the files.
+type harmonizeChange struct {
+	mkv matroska
+	// Current default subtitle language ("none" if no default).
+	from string
+	// New default subtitle track (base 0).
+	track int
+}
+
+// harmonizeDefaults finds the most common default subtitle language among the
+// files, and returns it along with the changes needed to make the remaining
+// files use it (with the same rules as setdefaultbylang). Files without a
+// subtitle track in that language are reported as errors. Ties are an error,
+// as there's no way to decide which language is correct.
+func harmonizeDefaults(mkvs []matroska) (string, []harmonizeChange, error) {
+	tally := map[string]int{}
+	for _, mkv := range mkvs {
+		if lang, ok := defaultLanguage(mkv, typeSubtitle); ok {
+			tally[lang]++
+		}
+	}
+	var langs []string
+	for lang := range tally {
+		langs = append(langs, lang)
+	}
+	if len(langs) == 0 {
+		return "", nil, errors.New("no files with a default subtitle track")
+	}
+	sort.Slice(langs, func(i, j int) bool {
+		if tally[langs[i]] != tally[langs[j]] {
+			return tally[langs[i]] > tally[langs[j]]
+		}
+		return langs[i] < langs[j]
+	})
+	majority := langs[0]
+	if len(langs) > 1 && tally[langs[1]] == tally[majority] {
+		return "", nil, fmt.Errorf("no majority default subtitle language (%s and %s tied with %d file(s) each)", majority, langs[1], tally[majority])
+	}
+
+	// defaultLanguage reports tracks without a language as "und".
+	match := []string{majority}
+	if majority == "und" {
+		match = append(match, "default")
+	}
+	var (
+		changes []harmonizeChange
+		errmsgs []string
+	)
+	for _, mkv := range mkvs {
+		from, ok := defaultLanguage(mkv, typeSubtitle)
+		if ok && from == majority {
+			continue
+		}
+		if !ok {
+			from = "none"
+		}
+		track, err := defaultSubByLanguage(mkv, match, nil, false, fallbackNone)
+		if err == nil && track < 0 {
+			err = fmt.Errorf("no subtitle track in %s", majority)
+		}
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("%s: %v", mkv.FileName, err))
+			continue
+		}
+		changes = append(changes, harmonizeChange{mkv: mkv, from: from, track: track})
+	}
+	return majority, changes, errorFromSlice(errmsgs)
+}
+
+// defaultMismatch checks if the language of the default track of the given
+// type is one of the preferred languages ("default" matches tracks with no
+// language set). Returns a description of the current default track and true
+// if it does not match (or there's no default track of that type).
+func defaultMismatch(mkv matroska, ttype string, languages []string) (string, bool) {
+	for _, track := range mkv.Tracks {
+		if track.Type != ttype || !track.Properties.DefaultTrack {
+			continue
+		}
+		lang := trackLanguage(track.Properties.Language, track.Properties.LanguageIetf)
+		for _, want := range languages {
+			if want == "default" {
+				want = ""
+			}
+			if lang == want {
+				return "", false
+			}
+		}
+		if lang == "" {
+			lang = "none"
+		}
+		return fmt.Sprintf("track %d, language %s", track.ID, lang), true
+	}
+	return "no default track", true
+}
+
+// unsupportedTrack describes a track with an unsupported codec.
+type unsupportedTrack struct {
+	ID      int    `json:"id"`
+	Type    string `json:"type"`
+	CodecID string `json:"codec_id"`
+}
+
+// codecMatch returns true if the codec ID matches one of the codecs, case
+// insensitive. A "*" in the codecs matches any string (including slashes, so
+// "A_DTS*" matches "A_DTS/LOSSLESS").
+func codecMatch(codecID string, codecs []string) bool {
+	for _, c := range codecs {
+		expr := "(?i)^" + strings.ReplaceAll(regexp.QuoteMeta(c), `\*`, ".*") + "$"
+		if ok, _ := regexp.MatchString(expr, codecID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// unsupportedTracks returns the tracks with a codec ID matching one of the
+// codecs (see codecMatch).
+func unsupportedTracks(mkv matroska, codecs []string) []unsupportedTrack {
+	var ret []unsupportedTrack
+	for _, track := range mkv.Tracks {
+		if codecMatch(track.Properties.CodecID, codecs) {
+			ret = append(ret, unsupportedTrack{ID: track.ID, Type: track.Type, CodecID: track.Properties.CodecID})
+		}
+	}
+	return ret
+}
+
+// stringInSlice returns true if a string exists inside a slice of strings.
+// Comparison is case insensitive.
+func stringInSlice(s string, slc []string) bool {
+	for _, substr := range slc {
+		if strings.Contains(strings.ToLower(s), strings.ToLower(substr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// extract extracts a given track into a file.
+func extract(mkv matroska, tracknum int, cmd runner) (trackFileInfo, error) {
+	// Fetch language for the track. Fail if track does not exist.
+	ok := false
+	language := ""
+	for _, track := range mkv.Tracks {
+		if track.ID == tracknum {
+			ok = true
+			language = track.Properties.Language
+			break
+		}
+	}
+	if !ok {
+		return trackFileInfo{}, fmt.Errorf("track #%d not found in file %s", tracknum, mkv.FileName)
+	}
+
+	// Extract into a temporary file
+	tmpfile, err := createTemp()
+	if err != nil {
+		return trackFileInfo{}, err
+	}
+	temp := tmpfile.Name()
+	_ = tmpfile.Close()
+
+	command := []string{
+		"mkvextract",
+		mkv.FileName,
+		"tracks",
+		fmt.Sprintf("%d:%s", tracknum, temp),
+	}
+	if err := cmd.run(command[0], command[1:]...); err != nil {
+		return trackFileInfo{}, err
+	}
+	return trackFileInfo{language: language, fname: temp}, nil
+}
+
+// trackExtensions maps audio and video codec IDs to the extensions of the
+// files written by mkvextract. Codec IDs with a suffix (E.g.
+// "A_AAC/MPEG4/LC") use the extension of the prefix.
+var trackExtensions = map[string]string{
+	"A_AAC":            ".aac",
+	"A_AC3":            ".ac3",
+	"A_EAC3":           ".eac3",
+	"A_DTS":            ".dts",
+	"A_TRUEHD":         ".thd",
+	"A_FLAC":           ".flac",
+	"A_OPUS":           ".opus",
+	"A_VORBIS":         ".ogg",
+	"A_MPEG/L2":        ".mp2",
+	"A_MPEG/L3":        ".mp3",
+	"A_PCM/INT/LIT":    ".wav",
+	"V_MPEG4/ISO/AVC":  ".h264",
+	"V_MPEGH/ISO/HEVC": ".h265",
+	"V_MPEG1":          ".m1v",
+	"V_MPEG2":          ".m2v",
+	"V_AV1":            ".ivf",
+	"V_VP8":            ".ivf",
+	"V_VP9":            ".ivf",
+}
+
+// trackExtension returns the file extension for a codec ID, or an empty
+// string if unknown.
+func trackExtension(codecID string) string {
+	for id := codecID; id != ""; {
+		if ext, ok := trackExtensions[id]; ok {
+			return ext
+		}
+		i := strings.LastIndex(id, "/")
+		if i < 0 {
+			break
+		}
+		id = id[:i]
+	}
+	return ""
+}
+
+// extractTrack extracts a track of type ttype into outfile. If tracknum is
+// negative, the default track of that type is used (or the first track, if
+// none is marked as default). If outfile is empty, the output is named after
+// the input file, with the extension for the track codec. Returns the name
+// of the output file.
+func extractTrack(mkv matroska, ttype string, tracknum int, outfile string, cmd runner) (string, error) {
+	id, codecID := -1, ""
+	for _, track := range mkv.Tracks {
+		if tracknum >= 0 {
+			if track.ID != tracknum {
+				continue
+			}
+			if track.Type != ttype {
+				return "", fmt.Errorf("track %d is not of type %s (type: %s)", tracknum, ttype, track.Type)
+			}
+		} else if track.Type != ttype || (id >= 0 && !track.Properties.DefaultTrack) {
+			continue
+		}
+		id, codecID = track.ID, track.Properties.CodecID
+		if tracknum >= 0 || track.Properties.DefaultTrack {
+			break
+		}
+	}
+	if id < 0 {
+		if tracknum >= 0 {
+			return "", fmt.Errorf("track %d not found", tracknum)
+		}
+		return "", fmt.Errorf("file has no %s tracks", ttype)
+	}
+
+	if outfile == "" {
+		ext := trackExtension(codecID)
+		if ext == "" {
+			return "", fmt.Errorf("no known extension for track %d (codec %s): specify the output file", id, codecID)
+		}
+		outfile = strings.TrimSuffix(mkv.FileName, filepath.Ext(mkv.FileName)) + ext
+	}
+	if err := cmd.run("mkvextract", mkv.FileName, "tracks", fmt.Sprintf("%d:%s", id, outfile)); err != nil {
+		return "", err
+	}
+	return outfile, nil
+}
+
+// extractTemp extracts the chapters or tags (kind) of the file, in XML format,
+// into a new temporary file. Returns the name of the temporary file, which
+// should be removed by the caller (with removeTemp).
+func extractTemp(mkv matroska, kind string, cmd runner) (string, error) {
+	f, err := createTemp()
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+
+	if err := cmd.run("mkvextract", mkv.FileName, kind, f.Name()); err != nil {
+		removeTemp(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// languageName returns the English name of a language code (E.g. "eng" or
+// "pt-BR"), or an empty string if the language cannot be identified.
+func languageName(code string) string {
+	if code == "" || code == "und" {
+		return ""
+	}
+	tag, err := language.Parse(code)
+	if err != nil {
+		return ""
+	}
+	return display.English.Tags().Name(tag)
+}
+
+// submux merges an input file (usually an mkv file) and multiple subtitles into a
+// destination, optionally removing all other subtitles from the source.
+func submux(infile, outfile string, nosubs bool, cmd runner, subs ...trackFileInfo) error {
+	cmdline := []string{"mkvmerge", "-o", outfile}
+
+	if nosubs {
+		cmdline = append(cmdline, "-S")
+	}
+	cmdline = append(cmdline, infile)
+
+	for _, sub := range subs {
+		cmdline = append(cmdline, "--language", fmt.Sprintf("0:%s", sub.language))
+		// Players show a generic name (like "Track 3") for tracks
+		// without a name, so we default to the language name.
+		name := sub.name
+		if name == "" {
+			name = languageName(sub.language)
+		}
+		if name != "" {
+			cmdline = append(cmdline, "--track-name", fmt.Sprintf("0:%s", name))
+		}
+		cmdline = append(cmdline, sub.fname)
+	}
+	return cmd.run(cmdline[0], cmdline[1:]...)
+}
+
+// remuxOptions holds the options for remux.
+type remuxOptions struct {
+	// Container title in the output file (empty = don't set).
+	title string
+	// Copy subtitles from the input file(s).
+	subs bool
+	// Chapters file to add to the output (empty = none).
+	chapters string
+	// Default language for the chapters (empty = mkvmerge's default).
+	chapterLanguage string
+	// Generate chapters at this interval (0 = don't generate), named with
+	// chaptersNameTemplate (empty = mkvmerge's default).
+	chapterInterval      time.Duration
+	chaptersNameTemplate string
+	// Don't copy chapters from the input file(s).
+	noChapters bool
+	// Don't copy track and global tags from the input file(s).
+	noTrackTags  bool
+	noGlobalTags bool
+	// Audio and subtitle tracks (base 0) to exclude, by input file.
+	excludeAudio map[string][]int
+	excludeSubs  map[string][]int
+	// Character set of external text subtitle files, by input file.
+	subCharsets map[string]string
+	// Copy these attachments (by ID) from attachmentsFrom (empty = none).
+	attachmentsFrom string
+	attachments     []int
+	// Attachments (by ID) to exclude, by input file.
+	excludeAttachments map[string][]int
+	// Delay in milliseconds (may be negative) of tracks (base 0) in the
+	// first input file.
+	syncTracks map[int]int
+	// Salvage problematic inputs: flush the output on close and accept
+	// mkvmerge warnings (E.g. about invalid timestamps) as success.
+	ignoreErrors bool
+}
+
+// imageSubCodecs contains the codec IDs of image based subtitles.
+var imageSubCodecs = map[string]bool{
+	"S_HDMV/PGS": true,
+	"S_VOBSUB":   true,
+	"S_DVBSUB":   true,
+}
+
+// imageSubTracks returns the image based subtitle tracks (base 0) in the file.
+func imageSubTracks(mkv matroska) []int {
+	var ret []int
+	for _, track := range mkv.Tracks {
+		if track.Type == typeSubtitle && imageSubCodecs[track.Properties.CodecID] {
+			ret = append(ret, track.ID)
+		}
+	}
+	return ret
+}
+
+// tagEntries returns the number of global and track tag entries in the file.
+func tagEntries(mkv matroska) (global, track int) {
+	for _, t := range mkv.GlobalTags {
+		global += t.NumEntries
+	}
+	for _, t := range mkv.TrackTags {
+		track += t.NumEntries
+	}
+	return global, track
+}
+
+// excludeIDs returns the mkvmerge track (or attachment) selection that
+// excludes the given IDs (E.g. "!1,2").
+func excludeIDs(ids []int) string {
+	var s []string
+	for _, id := range ids {
+		s = append(s, strconv.Itoa(id))
+	}
+	return "!" + strings.Join(s, ",")
+}
+
+// maxSyncOffset is the largest track delay accepted by parseSyncTracks.
+const maxSyncOffset = time.Hour
+
+// parseSyncTracks parses track delays in the form "track:ms" (E.g. "0:200"
+// delays track 0 by 200ms, "1:-150" makes track 1 play 150ms earlier), and
+// returns the delays by track (base 0). The tracks must exist in the file.
+func parseSyncTracks(mkv matroska, specs []string) (map[int]int, error) {
+	ret := map[int]int{}
+	for _, spec := range specs {
+		t, ms, ok := cutString(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid sync %q: must be track:ms", spec)
+		}
+		tracknum, err := strconv.Atoi(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sync %q: invalid track number %q", spec, t)
+		}
+		offset, err := strconv.Atoi(ms)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sync %q: invalid offset %q (must be in milliseconds)", spec, ms)
+		}
+		// Compare in milliseconds, as huge offsets overflow time.Duration.
+		if max := maxSyncOffset.Milliseconds(); int64(offset) > max || int64(offset) < -max {
+			return nil, fmt.Errorf("invalid sync %q: offset must be at most %v", spec, maxSyncOffset)
+		}
+		found := false
+		for _, track := range mkv.Tracks {
+			if track.ID == tracknum {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid sync %q: track %d not found in %s", spec, tracknum, mkv.FileName)
+		}
+		if _, ok := ret[tracknum]; ok {
+			return nil, fmt.Errorf("invalid sync %q: track %d already synced", spec, tracknum)
+		}
+		ret[tracknum] = offset
+	}
+	return ret, nil
+}
+
+// remux re-multiplexes the input file(s) into the output file.
+func remux(infiles []string, outfile string, opts remuxOptions, cmd runner) error {
+	cmdline := []string{"mkvmerge"}
+	if !opts.subs {
+		cmdline = append(cmdline, "-S")
+	}
+	if opts.title != "" {
+		cmdline = append(cmdline, "--title", opts.title)
+	}
+	if opts.ignoreErrors {
+		cmdline = append(cmdline, "--flush-on-close")
+	}
+	if opts.chapters != "" {
+		// The chapter language must precede the chapters file.
+		if opts.chapterLanguage != "" {
+			cmdline = append(cmdline, "--chapter-language", opts.chapterLanguage)
+		}
+		cmdline = append(cmdline, "--chapters", opts.chapters)
+	}
+	if opts.chapterInterval != 0 {
+		cmdline = append(cmdline, "--generate-chapters", "interval:"+timestamp(opts.chapterInterval))
+		if opts.chaptersNameTemplate != "" {
+			cmdline = append(cmdline, "--generate-chapters-name-template", opts.chaptersNameTemplate)
+		}
+	}
+	// Tag and track selection options apply to the next input file only.
+	for i, f := range infiles {
+		if opts.noChapters {
+			cmdline = append(cmdline, "--no-chapters")
+		}
+		if opts.noTrackTags {
+			cmdline = append(cmdline, "--no-track-tags")
+		}
+		if opts.noGlobalTags {
+			cmdline = append(cmdline, "--no-global-tags")
+		}
+		if ids := opts.excludeAudio[f]; len(ids) != 0 {
+			cmdline = append(cmdline, "--audio-tracks", excludeIDs(ids))
+		}
+		// -S already excludes all subtitles from the first file.
+		if ids := opts.excludeSubs[f]; len(ids) != 0 && (i != 0 || opts.subs) {
+			cmdline = append(cmdline, "--subtitle-tracks", excludeIDs(ids))
+		}
+		if i == 0 && len(opts.syncTracks) != 0 {
+			var ids []int
+			for id := range opts.syncTracks {
+				ids = append(ids, id)
+			}
+			sort.Ints(ids)
+			for _, id := range ids {
+				cmdline = append(cmdline, "--sync", fmt.Sprintf("%d:%d", id, opts.syncTracks[id]))
+			}
+		}
+		if ids := opts.excludeAttachments[f]; len(ids) != 0 {
+			cmdline = append(cmdline, "--attachments", excludeIDs(ids))
+		}
+		// External subtitle files contain a single track (0).
+		if cs := opts.subCharsets[f]; cs != "" {
+			cmdline = append(cmdline, "--sub-charset", "0:"+cs)
+		}
+		cmdline = append(cmdline, f)
+	}
+	// Add the attachments source as the last input, ignoring everything but
+	// the selected attachments.
+	if opts.attachmentsFrom != "" {
+		var s []string
+		for _, id := range opts.attachments {
+			s = append(s, strconv.Itoa(id))
+		}
+		cmdline = append(cmdline, "-A", "-D", "-S", "-B", "--no-chapters", "--no-track-tags", "--no-global-tags",
+			"--attachments", strings.Join(s, ","), opts.attachmentsFrom)
+	}
+	cmdline = append(cmdline, "-o", outfile)
+
+	err := cmd.run(cmdline[0], cmdline[1:]...)
+	if opts.ignoreErrors && mkvmergeWarnings(err) {
+		warnf("%s: mkvmerge finished with warnings (ignored). Check the output file.", outfile)
+		return nil
 	}
+	return err
+}
 
+// checkLayout verifies that the tracks surviving an operation that keeps all
+// video tracks and the audio and subtitle tracks in keep still contain at
+// least one video and one audio track (if the original file has them).
+func checkLayout(mkv matroska, keep map[int]bool) error {
+	before := map[string]int{}
+	after := map[string]int{}
 	for _, track := range mkv.Tracks {
-		// Create a row with the desired columns.
-		// mkvmerge reports tracks starting at zero, so we add one to match the file.
-		row := []interface{}{track.ID}
-		if showUID {
-			row = append(row, uint64(track.Properties.UID))
+		before[track.Type]++
+		if track.Type == typeVideo || keep[track.ID] {
+			after[track.Type]++
 		}
-		row = append(row, track.Type, track.Properties.TrackName, track.Properties.Language, track.Codec)
-
-		// Make default flag easier to see.
-		if track.Properties.DefaultTrack {
-			row = append(row, "<=====")
-		} else {
-			row = append(row, "")
+	}
+	var errmsgs []string
+	for _, ttype := range []string{typeVideo, typeAudio} {
+		if before[ttype] != 0 && after[ttype] == 0 {
+			errmsgs = append(errmsgs, fmt.Sprintf("operation would remove all %s tracks", ttype))
 		}
-		tab.AppendRow(row)
 	}
-	tab.Render()
+	return errorFromSlice(errmsgs)
 }
 
-// setdefault resets flagDefault on all subtitle tracks and sets it on the chosen track UID.
-func setdefault(mkv matroska, tracknum int, cmd runner) error {
-	command := []string{
-		"mkvpropedit",
-		mkv.FileName,
+// keepTracks copies the input file into outfile, keeping all video tracks and
+// only the audio and subtitle tracks listed in tracks. Unless force is set,
+// an error is returned if the output would have no video or audio tracks.
+func keepTracks(mkv matroska, outfile string, tracks []int, force bool, cmd runner) error {
+	keep := map[int]bool{}
+	for _, t := range tracks {
+		keep[t] = true
+	}
+	if err := checkLayout(mkv, keep); err != nil {
+		if !force {
+			return fmt.Errorf("%s: %v (use --force to proceed anyway)", mkv.FileName, err)
+		}
+		warnf("%s: %v", mkv.FileName, err)
 	}
 
+	var audio, subs []string
 	for _, track := range mkv.Tracks {
-		if track.Type == typeSubtitle {
-			// mkvpropedit uses base 1 for track (not zero).
-			command = append(command, "--edit", fmt.Sprintf("track:%d", track.ID+1), "--set", "flag-default=0")
+		if !keep[track.ID] {
+			continue
+		}
+		switch track.Type {
+		case typeAudio:
+			audio = append(audio, fmt.Sprintf("%d", track.ID))
+		case typeSubtitle:
+			subs = append(subs, fmt.Sprintf("%d", track.ID))
 		}
 	}
 
-	if err := cmd.run(command[0], command[1:]...); err != nil {
-		return err
+	cmdline := []string{"mkvmerge", "-o", outfile}
+	if len(audio) == 0 {
+		cmdline = append(cmdline, "-A")
+	} else {
+		cmdline = append(cmdline, "--audio-tracks", strings.Join(audio, ","))
 	}
-	return adddefault(mkv, tracknum, cmd)
+	if len(subs) == 0 {
+		cmdline = append(cmdline, "-S")
+	} else {
+		cmdline = append(cmdline, "--subtitle-tracks", strings.Join(subs, ","))
+	}
+	cmdline = append(cmdline, mkv.FileName)
+
+	return cmd.run(cmdline[0], cmdline[1:]...)
 }
 
-// trackByLanguage returns the track number (base 0) for the first track with
-// one of the specified languages. The list of languages works as a priority,
-// meaning that languages=["eng","fra"] will first attempt to find a track with
-// the English language, and failing that, French. The special language
-// "default" will cause tracks without a language code to be selected (Matroska
-// has the concept of a "default language", which is usually English -- tracks
-// with this language will not have a language code).
-//
-// The ignore slice contains a list of strings for case-insentive search
-// against the track name. If the selected language contains one of the strings
-// in this slice, it will be ignored. This is useful to select tracks by
-// language while ignoring 'Forced' tracks.
-func trackByLanguage(mkv matroska, languages []string, ignore []string) (int, error) {
-	for _, lang := range languages {
-		if lang == "default" {
-			lang = ""
-		}
-		for _, track := range mkv.Tracks {
-			// Match subtitle and language.
-			if track.Type != typeSubtitle || track.Properties.Language != lang {
+// audioFilter returns the audio and subtitle tracks (base 0) to keep when
+// removing audio tracks. Audio tracks are kept if they're in one of the given
+// languages (or any language, if empty) and have at most maxChannels channels
+// (or any number of channels, if zero). All subtitle tracks are kept.
+func audioFilter(mkv matroska, languages []string, maxChannels int) []int {
+	var tracks []int
+
+	for _, track := range mkv.Tracks {
+		switch track.Type {
+		case typeSubtitle:
+			tracks = append(tracks, track.ID)
+		case typeAudio:
+			if maxChannels > 0 && track.Properties.AudioChannels > maxChannels {
 				continue
 			}
-			// Make sure track should not be ignored.
-			if stringInSlice(track.Properties.TrackName, ignore) {
+			if len(languages) == 0 {
+				tracks = append(tracks, track.ID)
 				continue
 			}
-			return track.ID, nil
+			for _, lang := range languages {
+				if track.Properties.Language == lang || track.Properties.LanguageIetf == lang {
+					tracks = append(tracks, track.ID)
+					break
+				}
+			}
 		}
 	}
-	return 0, fmt.Errorf("no track with language(s): %s", strings.Join(languages, ","))
+	return tracks
 }
 
-// stringInSlice returns true if a string exists inside a slice of strings.
-// Comparison is case insensitive.
-func stringInSlice(s string, slc []string) bool {
-	for _, substr := range slc {
-		if strings.Contains(strings.ToLower(s), strings.ToLower(substr)) {
-			return true
-		}
-	}
-	return false
+// keepAudioByLanguage copies the input file into outfile, keeping only the
+// audio tracks in one of the given languages and with at most maxChannels
+// channels (see audioFilter). All video and subtitle tracks are kept. Unless
+// force is set, an error is returned if no audio tracks match.
+func keepAudioByLanguage(mkv matroska, outfile string, languages []string, maxChannels int, force bool, cmd runner) error {
+	return keepTracks(mkv, outfile, audioFilter(mkv, languages, maxChannels), force, cmd)
 }
 
-// extract extracts a given track into a file.
-func extract(mkv matroska, tracknum int, cmd runner) (trackFileInfo, error) {
-	// Fetch language for the track. Fail if track does not exist.
-	ok := false
-	language := ""
-	for _, track := range mkv.Tracks {
-		if track.ID == tracknum {
-			ok = true
-			language = track.Properties.Language
-			break
-		}
-	}
-	if !ok {
-		return trackFileInfo{}, fmt.Errorf("track #%d not found in file %s", tracknum, mkv.FileName)
-	}
-
-	// Extract into a temporary file
-	tmpfile, err := ioutil.TempFile("", "mkvtool")
+// parseChapterInterval parses the interval between generated chapters, as a
+// duration (E.g. "10m" or "1h30m"). The interval must be at least one second.
+func parseChapterInterval(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
 	if err != nil {
-		return trackFileInfo{}, err
-	}
-	temp := tmpfile.Name()
-	_ = tmpfile.Close()
-
-	command := []string{
-		"mkvextract",
-		mkv.FileName,
-		"tracks",
-		fmt.Sprintf("%d:%s", tracknum, temp),
+		return 0, fmt.Errorf("invalid chapter interval %q (use a duration like 10m or 1h30m)", s)
 	}
-	if err := cmd.run(command[0], command[1:]...); err != nil {
-		return trackFileInfo{}, err
+	if d < time.Second {
+		return 0, fmt.Errorf("invalid chapter interval %q: must be at least 1s", s)
 	}
-	return trackFileInfo{language: language, fname: temp}, nil
+	return d, nil
 }
 
-// submux merges an input file (usually an mkv file) and multiple subtitles into a
-// destination, optionally removing all other subtitles from the source.
-func submux(infile, outfile string, nosubs bool, cmd runner, subs ...trackFileInfo) error {
-	cmdline := []string{"mkvmerge", "-o", outfile}
+// timestamp formats a duration as a mkvmerge timestamp (HH:MM:SS.nnn).
+func timestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
 
-	if nosubs {
-		cmdline = append(cmdline, "-S")
+// sample creates a short clip of the input file, starting at start and
+// lasting for duration. If types is not empty, only tracks of the given types
+// (video, audio, subtitles) are copied into the output.
+func sample(infile, outfile string, start, duration time.Duration, types []string, cmd runner) error {
+	if start < 0 || duration <= 0 {
+		return fmt.Errorf("invalid start (%v) or duration (%v)", start, duration)
 	}
-	cmdline = append(cmdline, infile)
 
-	for _, sub := range subs {
-		cmdline = append(cmdline, "--language", fmt.Sprintf("0:%s", sub.language))
-		cmdline = append(cmdline, sub.fname)
-	}
-	return cmd.run(cmdline[0], cmdline[1:]...)
-}
+	cmdline := []string{"mkvmerge", "-o", outfile}
 
-// remux re-multiplexes the input file(s) into the output file. Setting subs to
-// false will cause subs not to be copied.
-func remux(infiles []string, outfile string, cmd runner, subs bool) error {
-	cmdline := []string{"mkvmerge"}
-	if !subs {
-		cmdline = append(cmdline, "-S")
+	if len(types) != 0 {
+		keep := map[string]bool{}
+		for _, t := range types {
+			if err := checkTrackType(t, typeVideo, typeAudio, typeSubtitle); err != nil {
+				return err
+			}
+			keep[t] = true
+		}
+		if !keep[typeVideo] {
+			cmdline = append(cmdline, "-D")
+		}
+		if !keep[typeAudio] {
+			cmdline = append(cmdline, "-A")
+		}
+		if !keep[typeSubtitle] {
+			cmdline = append(cmdline, "-S")
+		}
 	}
-	cmdline = append(cmdline, infiles...)
-	cmdline = append(cmdline, "-o", outfile)
+	cmdline = append(cmdline, "--split", fmt.Sprintf("parts:%s-%s", timestamp(start), timestamp(start+duration)), infile)
 
 	return cmd.run(cmdline[0], cmdline[1:]...)
 }
@@ -219,20 +1862,221 @@ func adddefault(mkv matroska, tracknum int, cmd runner) error {
 	return fmt.Errorf("file %s does not contain track %d", mkv.FileName, tracknum)
 }
 
+// formatOptions holds options that change the way format() works.
+type formatOptions struct {
+	// Locale used to capitalize titles.
+	titleLocale language.Tag
+	// Don't capitalize small English words (articles, conjunctions, and
+	// short prepositions), unless they're the first or the last word.
+	smallWords bool
+	// Convert dots and underscores in the title to spaces.
+	normalize bool
+	// Provider for the metadata tokens (nil = none).
+	provider metadataProvider
+}
+
+// reAcronym matches acronyms written with dots, like "S.W.A.T.".
+var reAcronym = regexp.MustCompile(`(?:^|[^\pL])((?:\pL\.){2,})`)
+
+// normalizeTitle converts dots and underscores in the title to spaces, and
+// collapses multiple spaces. Dots in acronyms (E.g. "S.W.A.T.") are kept.
+func normalizeTitle(title string) string {
+	// Protect the dots in acronyms.
+	const placeholder = "\x00"
+	b := []byte(title)
+	for _, m := range reAcronym.FindAllStringSubmatchIndex(title, -1) {
+		for i := m[2]; i < m[3]; i++ {
+			if b[i] == '.' {
+				b[i] = placeholder[0]
+			}
+		}
+	}
+	title = strings.NewReplacer(".", " ", "_", " ").Replace(string(b))
+	title = strings.ReplaceAll(title, placeholder, ".")
+	return strings.Join(strings.Fields(title), " ")
+}
+
+// smallWords contains the English words that are not capitalized in titles.
+var smallWords = map[string]bool{
+	"a": true, "an": true, "and": true, "as": true, "at": true, "but": true,
+	"by": true, "for": true, "in": true, "nor": true, "of": true, "on": true,
+	"or": true, "per": true, "the": true, "to": true, "via": true, "vs": true,
+}
+
+// titleCase capitalizes the title according to the formatting options.
+func titleCase(title string, fopts formatOptions) string {
+	title = cases.Title(fopts.titleLocale).String(title)
+	if !fopts.smallWords {
+		return title
+	}
+	words := strings.Split(title, " ")
+	for i := 1; i < len(words)-1; i++ {
+		if smallWords[strings.ToLower(words[i])] {
+			words[i] = strings.ToLower(words[i])
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// renameOptions holds the options for rename.
+type renameOptions struct {
+	// Formatting mask (see format).
+	mask string
+	// Use the series layout (see seriesMask) instead of mask.
+	seriesLayout bool
+	// Base directory for the renamed files (empty = same as the file).
+	outdir string
+	// Set the file times to the current time, instead of preserving them.
+	resetTimes bool
+	// Only show what would be done.
+	dryrun bool
+}
+
+// reSpecial matches season 0 (specials) in filenames. The parsed season
+// number can't be used, since zero means "no season".
+var reSpecial = regexp.MustCompile(`(?i)\bS00E\d+`)
+
+// reEpisodeTitle matches the text following the season and episode numbers
+// (E.g. "Pilot.720p.mkv" in "Show.S01E02.Pilot.720p.mkv").
+var reEpisodeTitle = regexp.MustCompile(`(?i)\bS\d+E\d+[._ -]+(.+)$`)
+
+// reTechnical matches common technical words in filenames, which mark the
+// end of the episode title.
+var reTechnical = regexp.MustCompile(`(?i)^(\d{3,4}[pi]|proper|repack|extended|internal|hdtv|web|web-?dl|webrip|blu-?ray|x26[45]|h26[45]|hevc)$`)
+
+// episodeTitle returns the episode title in the filename, taken from the
+// words between the season and episode numbers and the first technical word
+// (resolution, quality, codec, etc), or an empty string if not present.
+func episodeTitle(file string, parsed *ParseTorrentName.TorrentInfo) string {
+	m := reEpisodeTitle.FindStringSubmatch(strings.TrimSuffix(file, filepath.Ext(file)))
+	if m == nil {
+		return ""
+	}
+	var stop []string
+	for _, v := range []string{parsed.Resolution, parsed.Quality, parsed.Codec, parsed.Audio} {
+		if v != "" {
+			stop = append(stop, strings.ToLower(v))
+		}
+	}
+	if parsed.Year != 0 {
+		stop = append(stop, strconv.Itoa(parsed.Year))
+	}
+
+	var words []string
+	for _, w := range strings.FieldsFunc(m[1], func(r rune) bool { return r == '.' || r == '_' || r == ' ' }) {
+		if reTechnical.MatchString(w) {
+			break
+		}
+		lw := strings.ToLower(w)
+		technical := false
+		for _, s := range stop {
+			if strings.Contains(lw, s) {
+				technical = true
+				break
+			}
+		}
+		if technical {
+			break
+		}
+		words = append(words, w)
+	}
+	return strings.Join(words, " ")
+}
+
+// seriesMask returns the mask used to rename fname into the directory layout
+// used by media servers (E.g. Plex and Jellyfin):
+//
+//	Show Name/Season 01/Show Name - S01E02 - Episode Title.mkv
+//
+// Specials (season 0) are placed in the "Specials" directory. The episode
+// title is omitted when not available. An error is returned if the filename
+// doesn't contain the season and episode numbers.
+func seriesMask(fname string) (string, error) {
+	base := filepath.Base(fname)
+	parsed, err := ParseTorrentName.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	season := "Season %02{season}"
+	number := "S%02{season}"
+	special := reSpecial.MatchString(base)
+	if special {
+		season = "Specials"
+		number = "S00"
+	}
+	if (parsed.Season <= 0 && !special) || parsed.Episode <= 0 {
+		return "", errors.New("no season and episode numbers (E.g. S01E02) in the filename, required by the series layout")
+	}
+	return "%{title}/" + season + "/%{title} - " + number + "E%02{episode}%( - %{episodetitle}%).%{container}", nil
+}
+
 // rename renames a file according to the "Scene" information in the file.
-func rename(mask, fname string, dryrun bool) error {
-	newname, err := format(fname, mask)
+// Targets maps the new names of the files renamed so far to their original
+// names, and is used to detect multiple files renamed to the same name. The
+// same checks are performed in dry-run mode, so the preview matches the real
+// run. The file is parsed only to validate it: the new name comes from the
+// file name alone. Returns the new name of the file and true if the file was
+// (or would be, in dry-run mode) renamed.
+func rename(fname string, fopts formatOptions, opts renameOptions, targets map[string]string) (string, bool, error) {
+	mask := opts.mask
+	if opts.seriesLayout {
+		var err error
+		if mask, err = seriesMask(fname); err != nil {
+			return "", false, err
+		}
+	}
+	newname, err := format(mask, fname, fopts)
 	if err != nil {
-		return err
+		return "", false, err
 	}
 	dir, _ := filepath.Split(fname)
+	if opts.outdir != "" {
+		dir = opts.outdir
+	}
 	newfile := filepath.Join(dir, newname)
 
+	if prev, ok := targets[newfile]; ok {
+		return "", false, fmt.Errorf("%q would also be renamed to %q", prev, newfile)
+	}
+	targets[newfile] = fname
+
+	// Files already named correctly are silently skipped, so running rename
+	// again over renamed files is a no-op. Paths are also compared by file
+	// identity, as the output directory may point to the same directory
+	// using a different path. Names differing only in case are still renamed
+	// (case-insensitive filesystems report them as the same file).
+	if newfile == filepath.Clean(fname) || (filepath.Base(newfile) == filepath.Base(fname) && sameFile(fname, newfile)) {
+		debugf("%s: name unchanged", fname)
+		return newfile, false, nil
+	}
+	// Only validation: the metadata in the file is not used.
+	if _, err := parseFile(fname); err != nil {
+		return "", false, fmt.Errorf("not a valid media file: %v", err)
+	}
+	if _, err := os.Stat(newfile); err == nil {
+		return "", false, fmt.Errorf("destination %q already exists", newfile)
+	}
+
 	fmt.Printf("%s => %s\n", fname, newfile)
-	if dryrun {
-		return nil
+	if opts.dryrun {
+		return newfile, true, nil
+	}
+	// Create any directories in the mask (E.g. series layout).
+	if err := os.MkdirAll(filepath.Dir(newfile), 0755); err != nil {
+		return "", false, err
 	}
-	return os.Rename(fname, newfile)
+	return newfile, true, moveFile(fname, newfile, opts.resetTimes)
+}
+
+// validateName checks if the filename matches the name generated by format()
+// using the given mask. Returns the expected name (without the directory) and
+// true if the names match.
+func validateName(mask, fname string, fopts formatOptions) (string, bool, error) {
+	want, err := format(mask, fname, fopts)
+	if err != nil {
+		return "", false, err
+	}
+	return want, filepath.Base(fname) == want, nil
 }
 
 // format parses "Scene" information in the file and returns a string formatted
@@ -242,8 +2086,9 @@ func rename(mask, fname string, dryrun bool) error {
 // %[format]{codec}
 // %[format]{container} (this matches the original extension)
 // %[format]{episode}
-// %[format]{episodeName}
+// %[format]{episodetitle} (the words after the season and episode, E.g. "S01E02")
 // %[format]{excess}
+// %[format]{ext} (the extension of the file, without the dot)
 // %[format]{extended}
 // %[format]{garbage}
 // %[format]{group}
@@ -260,6 +2105,12 @@ func rename(mask, fname string, dryrun bool) error {
 // %[format]{widescreen}
 // %[format]{year}
 //
+// And the tokens looked up with the metadata provider in fopts (see
+// metadataFields), using the parsed title and year:
+//
+// %[format]{metaid}
+// %[format]{metatitle}
+//
 // Where "format" is a printf style format sizing specification. Complete
 // examples:
 // - %-02.2{season} - Season formatted as two characters, left padded wth zeroes.
@@ -268,8 +2119,14 @@ func rename(mask, fname string, dryrun bool) error {
 // Anything not matching the %[format]{xxxx} construct will be interpreted literally.
 //
 // Formatting will fail if any element present in the mask cannot be resolved
-// (a typical example is asking for episode numbers for movies).
-func format(mask, fname string) (string, error) {
+// (a typical example is asking for episode numbers for movies), unless the
+// element is inside an optional group, delimited by "%(" and "%)". Optional
+// groups are only emitted when all tokens inside them resolve. Example:
+// - %{title}%( [%{resolution}]%) - "Title [1080p]", or "Title" if the
+// resolution is not present in the filename.
+//
+// The title is capitalized according to the options in fopts.
+func format(mask, fname string, fopts formatOptions) (string, error) {
 	// Split the filename so we can work on parts separately.
 	_, file := filepath.Split(fname)
 
@@ -278,6 +2135,10 @@ func format(mask, fname string) (string, error) {
 		return "", err
 	}
 	fields := structs.Map(parsed)
+	if t := episodeTitle(file, parsed); t != "" {
+		fields["Episodetitle"] = t
+	}
+	fields["Ext"] = strings.TrimPrefix(filepath.Ext(file), ".")
 
 	// tags are formatted as %[format]{value}
 	re, err := regexp.Compile(`%((?:-?[\d]+)?(?:\.\d+)?){([a-z]+)}`)
@@ -285,53 +2146,164 @@ func format(mask, fname string) (string, error) {
 		return "", err
 	}
 
-	var errlist []string
+	// Optional groups: %( ... %)
+	groupRe, err := regexp.Compile(`%\((.*?)%\)`)
+	if err != nil {
+		return "", err
+	}
+
+	// Only look up metadata when the mask uses it, as lookups may be slow.
+	for _, m := range re.FindAllStringSubmatch(mask, -1) {
+		if m[2] == "metaid" || m[2] == "metatitle" {
+			title, _ := fields["Title"].(string)
+			if fopts.normalize {
+				title = normalizeTitle(title)
+			}
+			year, _ := fields["Year"].(int)
+			for k, v := range metadataFields(fopts.provider, title, year) {
+				fields[k] = v
+			}
+			break
+		}
+	}
+
+	ferr := &formatError{}
 
-	formatted := re.ReplaceAllStringFunc(mask, func(match string) string {
-		// Split matched tag into size formatting specifier and tag name.
-		// Tag must be capitalized to match the keys in the map.
-		e := re.FindStringSubmatch(match)
-		sizespec := e[1]
-		tag := cases.Title(language.English).String(e[2])
+	// expand replaces all tokens in s, adding errors to ferr.
+	expand := func(s string, ferr *formatError) string {
+		return re.ReplaceAllStringFunc(s, func(match string) string {
+			return expandToken(re, match, fields, fopts, ferr)
+		})
+	}
 
-		if i, ok := fields[tag]; ok {
-			switch t := i.(type) {
-			case string:
-				val := i.(string)
-				if val == "" {
-					break
-				}
-				// Special case for title: Capitalize
-				if tag == "Title" {
-					val = cases.Title(language.English).String(val)
-				}
-				return fmt.Sprintf("%"+sizespec+"s", val)
-			case int:
-				val := i.(int)
-				if val <= 0 {
-					break
+	var sb strings.Builder
+	last := 0
+	for _, idx := range groupRe.FindAllStringSubmatchIndex(mask, -1) {
+		sb.WriteString(expand(mask[last:idx[0]], ferr))
+		last = idx[1]
+
+		gerr := &formatError{}
+		group := expand(mask[idx[2]:idx[3]], gerr)
+		// Drop the group silently if the only problems are unresolved tokens.
+		if len(gerr.msgs) != 0 {
+			if len(gerr.msgs) != len(gerr.unresolved) {
+				ferr.msgs = append(ferr.msgs, gerr.msgs...)
+			}
+			continue
+		}
+		sb.WriteString(group)
+	}
+	sb.WriteString(expand(mask[last:], ferr))
+
+	if len(ferr.msgs) != 0 {
+		return "", ferr
+	}
+	return sb.String(), nil
+}
+
+// expandToken returns the value for a single %[format]{token} match, using the
+// parsed fields. Errors are added to ferr.
+func expandToken(re *regexp.Regexp, match string, fields map[string]interface{}, fopts formatOptions, ferr *formatError) string {
+	// Split matched tag into size formatting specifier and tag name.
+	// Tag must be capitalized to match the keys in the map.
+	e := re.FindStringSubmatch(match)
+	sizespec := e[1]
+	tag := cases.Title(language.English).String(e[2])
+
+	if i, ok := fields[tag]; ok {
+		switch t := i.(type) {
+		case string:
+			val := i.(string)
+			if val == "" {
+				break
+			}
+			// Special case for title: Capitalize
+			if tag == "Title" {
+				if fopts.normalize {
+					val = normalizeTitle(val)
 				}
-				return fmt.Sprintf("%"+sizespec+"d", i.(int))
-			default:
-				errlist = append(errlist, fmt.Sprintf("Internal error: Unknown type %T for %q", match, t))
-				return "*ERROR*"
+				val = titleCase(val, fopts)
+			}
+			return fmt.Sprintf("%"+sizespec+"s", val)
+		case int:
+			val := i.(int)
+			if val <= 0 {
+				break
 			}
+			return fmt.Sprintf("%"+sizespec+"d", i.(int))
+		default:
+			ferr.msgs = append(ferr.msgs, fmt.Sprintf("Internal error: Unknown type %T for %q", match, t))
+			return "*ERROR*"
 		}
-		errlist = append(errlist, fmt.Sprintf("Unable to parse data for %s", match))
-		return "*ERROR*"
-	})
+	}
+	ferr.msgs = append(ferr.msgs, fmt.Sprintf("Unable to parse data for %s", match))
+	ferr.unresolved = append(ferr.unresolved, "%{"+e[2]+"}")
+	return "*ERROR*"
+}
+
+// formatError is returned by format() when the mask cannot be formatted.
+type formatError struct {
+	// All error messages.
+	msgs []string
+	// Tokens in the mask that could not be resolved (E.g. "%{year}").
+	unresolved []string
+}
+
+func (e *formatError) Error() string {
+	return strings.Join(e.msgs, ";")
+}
+
+// unresolvedReport aggregates, per mask token, the files that could not
+// provide a value for the token.
+type unresolvedReport map[string][]string
+
+// add records the unresolved tokens in err (if any) for fname. Files are only
+// recorded once per token, even when added again (E.g. for several masks).
+// Returns true if err only contains unresolved tokens.
+func (r unresolvedReport) add(fname string, err error) bool {
+	var ferr *formatError
+	if !errors.As(err, &ferr) || len(ferr.unresolved) == 0 {
+		return false
+	}
+	for _, token := range ferr.unresolved {
+		if n := len(r[token]); n != 0 && r[token][n-1] == fname {
+			continue
+		}
+		r[token] = append(r[token], fname)
+	}
+	return len(ferr.unresolved) == len(ferr.msgs)
+}
+
+// print shows the report, sorted by token.
+func (r unresolvedReport) print() {
+	var tokens []string
+	for token := range r {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+
+	for _, token := range tokens {
+		fmt.Printf("Unresolved %s (%d file(s)):\n", token, len(r[token]))
+		for _, fname := range r[token] {
+			fmt.Printf("  %s\n", fname)
+		}
+	}
+}
 
-	if len(errlist) != 0 {
-		return "", fmt.Errorf("%s", strings.Join(errlist, ";"))
+// files returns the number of distinct files in the report.
+func (r unresolvedReport) files() int {
+	seen := map[string]bool{}
+	for _, fnames := range r {
+		for _, f := range fnames {
+			seen[f] = true
+		}
 	}
-	return formatted, nil
+	return len(seen)
 }
 
 // requirements returns nil if all required tools are installed and an error indicating
 // the tools missing otherwise.
-func requirements() error {
-	var tools = []string{"mkvextract", "mkvmerge", "mkvpropedit"}
-
+func requirements(tools ...string) error {
 	missing := []string{}
 	for _, t := range tools {
 		_, err := exec.LookPath(t)
@@ -345,24 +2317,88 @@ func requirements() error {
 	return nil
 }
 
-// mustParseFile parses the MKV file using the JSON output from mkmerge --identify.
-// error message in case of problems.
-func mustParseFile(fname string) matroska {
-	var stdout bytes.Buffer
+// identifySem limits the number of concurrent mkvmerge --identify processes,
+// independently of the number of workers (set by --max-parallel-identify).
+var identifySem = make(chan struct{}, runtime.NumCPU())
+
+// identify returns the JSON output of mkvmerge --identify for the file, using
+// the parse cache when possible.
+func identify(fname string) ([]byte, error) {
+	if data, ok := cacheLoad(fname); ok {
+		debugf("%s: Using cached identification data", fname)
+		return data, nil
+	}
+
+	if err := checkExternal("mkvmerge"); err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
 
 	cmd := exec.Command("mkvmerge", "--identify", "-F", "json", fname)
 	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	identifySem <- struct{}{}
+	debugf("%s: Running mkvmerge --identify", fname)
 	err := cmd.Run()
+	<-identifySem
+
 	if err != nil {
-		log.Printf("mkvmerge failed: %v", err)
-		log.Fatalf("--- Output ---\n%s\n", stdout.String())
+		return nil, fmt.Errorf("mkvmerge failed: %v\n--- Output ---\n%s\n--- Errors ---\n%s", err, stdout.String(), stderr.String())
+	}
+	if stderr.Len() != 0 {
+		debugf("%s: mkvmerge --identify messages: %s", fname, strings.TrimSpace(stderr.String()))
+	}
+	// Don't cache output that can't be decoded.
+	if !json.Valid(stdout.Bytes()) {
+		return stdout.Bytes(), nil
+	}
+	if err := cacheStore(fname, stdout.Bytes()); err != nil {
+		infof("Unable to save %q to the parse cache: %v", fname, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// parseFile parses the MKV file using the JSON output from mkmerge --identify,
+// or the native parser (see parseBackend).
+func parseFile(fname string) (matroska, error) {
+	start := time.Now()
+	defer func() { timings.record("parse", []string{fname}, time.Since(start)) }()
+
+	if parseBackend == backendNative {
+		return parseNative(fname)
+	}
+	data, err := identify(fname)
+	if err != nil {
+		return matroska{}, err
 	}
 
 	// Decode JSON.
 	var mkv matroska
-	err = json.Unmarshal(stdout.Bytes(), &mkv)
+	if err := json.Unmarshal(data, &mkv); err != nil {
+		return matroska{}, fmt.Errorf("error decoding JSON output from mkvmerge: %v (near %q)", err, jsonSnippet(data, err))
+	}
+	// Cached data keeps the name used in the first run, which may be a
+	// different spelling of the path (E.g. relative to another directory).
+	mkv.FileName = fname
+	if err := checkIdentification(data, mkv); err != nil {
+		return matroska{}, err
+	}
+	for _, w := range multiplexWarnings(mkv) {
+		warnf("%s: %s", fname, w)
+	}
+	return mkv, nil
+}
+
+// mustParseFile parses the MKV file using the JSON output from mkmerge --identify.
+// Exits with an error message in case of problems.
+func mustParseFile(fname string) matroska {
+	mkv, err := parseFile(fname)
 	if err != nil {
-		log.Fatalf("Error decoding JSON output from mkvmerge: %v", err)
+		// log.Fatalf skips deferred calls.
+		cleanupTemp()
+		log.Fatalf("%s: %v", fname, err)
 	}
 	return mkv
 }
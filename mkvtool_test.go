@@ -5,7 +5,18 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/text/language"
 )
 
 func TestFormat(t *testing.T) {
@@ -45,10 +56,34 @@ func TestFormat(t *testing.T) {
 			mask:      "%{title} S%02.2{season}E%02.2{episode} (%{year}) [%{resolution}]",
 			wantError: true,
 		},
+		// Optional groups: emitted when all tokens resolve.
+		{
+			fname: "Movie Title (2022) [1080p].mkv",
+			mask:  "%{title}%( (%{year})%)%( [%{resolution}]%).%{container}",
+			want:  "Movie Title (2022) [1080p].mkv",
+		},
+		// Optional groups: dropped when any token does not resolve.
+		{
+			fname: "Series Title S01E02 [1080p].mkv",
+			mask:  "%{title}%( (%{year})%)%( S%02.2{season}E%02.2{episode}%)",
+			want:  "Series Title S01E02",
+		},
+		// File extension.
+		{
+			fname: "Movie Title (2022).mp4",
+			mask:  "%{title}.%{ext}",
+			want:  "Movie Title.mp4",
+		},
+		// Optional groups do not hide errors outside the group.
+		{
+			fname:     "Series Title S01E02 [1080p].mkv",
+			mask:      "%{title}%( [%{resolution}]%) %{year}",
+			wantError: true,
+		},
 	}
 
 	for _, tt := range casetests {
-		got, err := format(tt.mask, tt.fname)
+		got, err := format(tt.mask, tt.fname, formatOptions{titleLocale: language.English})
 		if !tt.wantError {
 			if err != nil {
 				t.Fatalf("Got error %q want no error", err)
@@ -64,3 +99,1681 @@ func TestFormat(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateName(t *testing.T) {
+	mask := "%{title} S%02.2{season}E%02.2{episode}.%{ext}"
+
+	casetests := []struct {
+		fname     string
+		want      string
+		wantOK    bool
+		wantError bool
+	}{
+		// Match (the directory is ignored).
+		{fname: "/tv/Show S01E02.mkv", want: "Show S01E02.mkv", wantOK: true},
+		{fname: "Show S01E02.webm", want: "Show S01E02.webm", wantOK: true},
+		// Mismatch.
+		{fname: "show.s01e02.720p.mkv", want: "Show S01E02.mkv"},
+		{fname: "Show.S01E02.mkv", want: "Show S01E02.mkv"},
+		// Unresolved tokens.
+		{fname: "Movie (2022).mkv", wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, ok, err := validateName(mask, tt.fname, formatOptions{titleLocale: language.English})
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%s: Got no error, want error", tt.fname)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Got error %q want no error", tt.fname, err)
+		}
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: Got %q (match=%v), want %q (match=%v)", tt.fname, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestTitleCase(t *testing.T) {
+	casetests := []struct {
+		title      string
+		smallWords bool
+		want       string
+	}{
+		{
+			title: "a tale of two cities",
+			want:  "A Tale Of Two Cities",
+		},
+		{
+			title:      "a tale of two cities",
+			smallWords: true,
+			want:       "A Tale of Two Cities",
+		},
+		// First and last words are always capitalized.
+		{
+			title:      "of mice and men",
+			smallWords: true,
+			want:       "Of Mice and Men",
+		},
+		{
+			title:      "the return of the king",
+			smallWords: true,
+			want:       "The Return of the King",
+		},
+	}
+
+	for _, tt := range casetests {
+		got := titleCase(tt.title, formatOptions{titleLocale: language.English, smallWords: tt.smallWords})
+		if got != tt.want {
+			t.Errorf("titleCase(%q): Got %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestRenderTree(t *testing.T) {
+	tree := treeNode{
+		label: "file.mkv",
+		children: []treeNode{
+			{label: "Tracks", children: []treeNode{
+				{label: "video", children: []treeNode{{label: "0: AVC"}}},
+				{label: "audio", children: []treeNode{{label: "1: AAC"}, {label: "2: AC-3"}}},
+			}},
+			{label: "Chapters (0)"},
+		},
+	}
+	want := `file.mkv
+├── Tracks
+│   ├── video
+│   │   └── 0: AVC
+│   └── audio
+│       ├── 1: AAC
+│       └── 2: AC-3
+└── Chapters (0)
+`
+	if got := renderTree(tree); got != want {
+		t.Errorf("tree diff: Got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	casetests := []struct {
+		title string
+		want  string
+	}{
+		{"The.Movie", "The Movie"},
+		{"the_movie__title", "the movie title"},
+		{"S.W.A.T.", "S.W.A.T."},
+		{"S.W.A.T..Under.Siege", "S.W.A.T. Under Siege"},
+		{"Mr.Robot", "Mr Robot"},
+		{"Marvel's.Agents.of.S.H.I.E.L.D.", "Marvel's Agents of S.H.I.E.L.D."},
+	}
+
+	for _, tt := range casetests {
+		if got := normalizeTitle(tt.title); got != tt.want {
+			t.Errorf("normalizeTitle(%q): Got %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestTrackByLanguage(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video"},
+		{"id": 1, "type": "subtitles", "properties": {"language": "eng", "forced_track": true}},
+		{"id": 2, "type": "subtitles", "properties": {"language": "eng", "track_name": "Full"}},
+		{"id": 3, "type": "subtitles", "properties": {"language": "eng", "track_name": "Signs & Songs"}},
+		{"id": 4, "type": "subtitles", "properties": {"language": "por"}},
+		{"id": 5, "type": "subtitles", "properties": {"language": "por", "track_name": "SDH"}}]}`)
+
+	casetests := []struct {
+		languages []string
+		ignore    []string
+		strict    bool
+		want      int
+		wantError bool
+	}{
+		{languages: []string{"eng"}, want: 1},
+		{languages: []string{"fra", "por"}, want: 4},
+		{languages: []string{"eng"}, strict: true, wantError: true},
+		{languages: []string{"eng"}, ignore: []string{"signs"}, strict: true, want: 2},
+		{languages: []string{"por"}, strict: true, want: 4},
+		{languages: []string{"fra"}, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, err := trackByLanguage(mkv, tt.languages, tt.ignore, tt.strict)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			if got != tt.want {
+				t.Fatalf("track diff: Got %d, want %d", got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
+
+func TestDefaultSubByLanguage(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video"},
+		{"id": 1, "type": "subtitles", "properties": {"language": "eng"}},
+		{"id": 2, "type": "subtitles", "properties": {"language": "eng"}},
+		{"id": 3, "type": "subtitles", "properties": {"language": "por"}}]}`)
+	nosubs := mustUnmarshalMKV(t, `{"tracks": [{"id": 0, "type": "video"}]}`)
+
+	casetests := []struct {
+		mkv       matroska
+		languages []string
+		strict    bool
+		fallback  string
+		want      int
+		wantError bool
+	}{
+		{mkv: mkv, languages: []string{"por"}, fallback: fallbackFirst, want: 3},
+		{mkv: mkv, languages: []string{"fra"}, fallback: fallbackFirst, want: 1},
+		{mkv: mkv, languages: []string{"fra"}, fallback: fallbackNone, want: -1},
+		{mkv: mkv, languages: []string{"fra"}, fallback: fallbackError, wantError: true},
+		{mkv: nosubs, languages: []string{"fra"}, fallback: fallbackFirst, wantError: true},
+		// Ambiguous matches are not affected by the fallback.
+		{mkv: mkv, languages: []string{"eng"}, strict: true, fallback: fallbackNone, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, err := defaultSubByLanguage(tt.mkv, tt.languages, nil, tt.strict, tt.fallback)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			if got != tt.want {
+				t.Errorf("track diff: Got %d, want %d", got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
+
+func TestUnsupportedTracks(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video", "properties": {"codec_id": "V_MPEGH/ISO/HEVC"}},
+		{"id": 1, "type": "audio", "properties": {"codec_id": "A_TRUEHD"}},
+		{"id": 2, "type": "audio", "properties": {"codec_id": "A_DTS/LOSSLESS"}},
+		{"id": 3, "type": "subtitles", "properties": {"codec_id": "S_HDMV/PGS"}}]}`)
+
+	casetests := []struct {
+		codecs []string
+		want   []unsupportedTrack
+	}{
+		{
+			codecs: []string{"a_truehd", "S_HDMV/PGS"},
+			want:   []unsupportedTrack{{1, typeAudio, "A_TRUEHD"}, {3, typeSubtitle, "S_HDMV/PGS"}},
+		},
+		{
+			codecs: []string{"A_DTS*"},
+			want:   []unsupportedTrack{{2, typeAudio, "A_DTS/LOSSLESS"}},
+		},
+		{codecs: []string{"A_AC3"}},
+	}
+
+	for _, tt := range casetests {
+		got := unsupportedTracks(mkv, tt.codecs)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("unsupportedTracks(%q): Got %v, want %v", tt.codecs, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultMismatch(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video", "properties": {"default_track": true}},
+		{"id": 1, "type": "audio", "properties": {"language": "jpn", "default_track": true}},
+		{"id": 2, "type": "subtitles", "properties": {"language": "eng"}},
+		{"id": 3, "type": "subtitles", "properties": {"language": "por", "default_track": true}}]}`)
+	nodefault := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "subtitles", "properties": {"language": "eng"}}]}`)
+
+	casetests := []struct {
+		mkv       matroska
+		ttype     string
+		languages []string
+		want      bool
+	}{
+		{mkv: mkv, ttype: typeSubtitle, languages: []string{"eng"}, want: true},
+		{mkv: mkv, ttype: typeSubtitle, languages: []string{"eng", "por"}, want: false},
+		{mkv: mkv, ttype: typeAudio, languages: []string{"jpn"}, want: false},
+		{mkv: mkv, ttype: typeAudio, languages: []string{"default"}, want: true},
+		{mkv: nodefault, ttype: typeSubtitle, languages: []string{"eng"}, want: true},
+	}
+
+	for _, tt := range casetests {
+		_, got := defaultMismatch(tt.mkv, tt.ttype, tt.languages)
+		if got != tt.want {
+			t.Errorf("defaultMismatch(%s, %v): Got %v, want %v", tt.ttype, tt.languages, got, tt.want)
+		}
+	}
+}
+
+func TestSelectProgram(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{
+		"container": {"properties": {"programs": [{"program_number": 1}, {"program_number": 2}]}},
+		"tracks": [
+			{"id": 0, "type": "video", "properties": {"program_number": 1}},
+			{"id": 1, "type": "audio", "properties": {"program_number": 1}},
+			{"id": 2, "type": "video", "properties": {"program_number": 2}},
+			{"id": 3, "type": "audio", "properties": {"program_number": 2}},
+			{"id": 4, "type": "subtitles", "properties": {"program_number": 2}}]}`)
+
+	casetests := []struct {
+		program   int
+		want      []int
+		wantError bool
+	}{
+		{program: 1, want: []int{0, 1}},
+		{program: 2, want: []int{2, 3, 4}},
+		{program: 3, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, err := selectProgram(mkv, tt.program)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			var ids []int
+			for _, track := range got.Tracks {
+				ids = append(ids, track.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Fatalf("program %d: Got tracks %v, want %v", tt.program, ids, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
+
+func TestCheckLayout(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video"},
+		{"id": 1, "type": "audio"},
+		{"id": 2, "type": "audio"},
+		{"id": 3, "type": "subtitles"}]}`)
+	noaudio := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video"},
+		{"id": 1, "type": "subtitles"}]}`)
+
+	casetests := []struct {
+		mkv       matroska
+		keep      map[int]bool
+		wantError bool
+	}{
+		{mkv: mkv, keep: map[int]bool{1: true}},
+		{mkv: mkv, keep: map[int]bool{2: true, 3: true}},
+		// All audio removed.
+		{mkv: mkv, keep: map[int]bool{3: true}, wantError: true},
+		{mkv: mkv, keep: map[int]bool{}, wantError: true},
+		// No audio in the original file.
+		{mkv: noaudio, keep: map[int]bool{}},
+	}
+
+	for _, tt := range casetests {
+		err := checkLayout(tt.mkv, tt.keep)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
+
+func TestSetSubs(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+		{"id": 0, "type": "video"},
+		{"id": 1, "type": "subtitles"},
+		{"id": 2, "type": "subtitles"}]}`)
+
+	casetests := []struct {
+		opts      setsubsOptions
+		wantCmds  [][]string
+		wantError bool
+	}{
+		{
+			opts: setsubsOptions{setDefault: true, defaultTrack: 1, setForced: true, forcedTrack: 2},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv",
+				"--edit", "track:2", "--set", "flag-default=1", "--set", "flag-forced=0",
+				"--edit", "track:3", "--set", "flag-default=0", "--set", "flag-forced=1"}},
+		},
+		// Clear all forced flags, keeping the default flags.
+		{
+			opts:     setsubsOptions{setForced: true, forcedTrack: -1},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:2", "--set", "flag-forced=0", "--edit", "track:3", "--set", "flag-forced=0"}},
+		},
+		{opts: setsubsOptions{setDefault: true, defaultTrack: 0}, wantError: true},
+		{opts: setsubsOptions{setForced: true, forcedTrack: 5}, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		err := setsubs(mkv, tt.opts, r)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("Got no error, want error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("commands: got %q, want %q", r.cmds, tt.wantCmds)
+		}
+	}
+}
+
+func TestStripTags(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv",
+		"tracks": [{"id": 0, "type": "video"}, {"id": 1, "type": "audio"}, {"id": 2, "type": "audio"}],
+		"global_tags": [{"num_entries": 3}],
+		"track_tags": [{"num_entries": 4, "track_id": 0}, {"num_entries": 2, "track_id": 2}]}`)
+
+	casetests := []struct {
+		global    bool
+		tracks    []int
+		all       bool
+		want      int
+		wantCmds  [][]string
+		wantError bool
+	}{
+		{
+			all:      true,
+			want:     9,
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--tags", "all:"}},
+		},
+		{
+			global:   true,
+			want:     3,
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--tags", "global:"}},
+		},
+		// Tracks without tags are still cleared.
+		{
+			global:   true,
+			tracks:   []int{1, 2},
+			want:     5,
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--tags", "global:", "--tags", "track:2:", "--tags", "track:3:"}},
+		},
+		// Nothing selected.
+		{wantError: true},
+		// Non-existing track.
+		{tracks: []int{0, 3}, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		got, err := striptags(mkv, tt.global, tt.tracks, tt.all, r)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("global=%v tracks=%v all=%v: Got no error, want error", tt.global, tt.tracks, tt.all)
+			}
+			if len(r.cmds) != 0 {
+				t.Errorf("global=%v tracks=%v all=%v: Got commands %q, want none", tt.global, tt.tracks, tt.all, r.cmds)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("global=%v tracks=%v all=%v: Got error %q want no error", tt.global, tt.tracks, tt.all, err)
+		}
+		if got != tt.want {
+			t.Errorf("global=%v tracks=%v all=%v: Got %d entries removed, want %d", tt.global, tt.tracks, tt.all, got, tt.want)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("global=%v tracks=%v all=%v: commands: got %q, want %q", tt.global, tt.tracks, tt.all, r.cmds, tt.wantCmds)
+		}
+	}
+}
+
+func TestSetTracks(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+		{"id": 0, "type": "video"},
+		{"id": 1, "type": "audio", "properties": {"language": "und"}},
+		{"id": 2, "type": "audio", "properties": {"language": "eng"}},
+		{"id": 3, "type": "audio", "properties": {"language": "und"}}]}`)
+
+	casetests := []struct {
+		opts      settracksOptions
+		wantIDs   []int
+		wantCmds  [][]string
+		wantError bool
+	}{
+		{
+			opts:    settracksOptions{where: "type==audio && lang==und", setName: true, name: "Japanese", setDefault: true},
+			wantIDs: []int{1, 3},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv",
+				"--edit", "track:2", "--set", "name=Japanese", "--set", "flag-default=0",
+				"--edit", "track:4", "--set", "name=Japanese", "--set", "flag-default=0"}},
+		},
+		{
+			opts:     settracksOptions{where: "id==2", setForced: true, isForced: true},
+			wantIDs:  []int{2},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:3", "--set", "flag-forced=1"}},
+		},
+		// One default track per type.
+		{
+			opts:      settracksOptions{where: "lang==und", setDefault: true, isDefault: true},
+			wantError: true,
+		},
+		{
+			opts:     settracksOptions{where: "id==0 || id==2", setDefault: true, isDefault: true},
+			wantIDs:  []int{0, 2},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:1", "--set", "flag-default=1", "--edit", "track:3", "--set", "flag-default=1"}},
+		},
+		// No matching tracks: nothing to do.
+		{opts: settracksOptions{where: "type==subtitles", setName: true, name: "x"}},
+		// Nothing to change.
+		{opts: settracksOptions{where: "type==audio"}, wantError: true},
+		{opts: settracksOptions{where: "type==", setName: true}, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		ids, err := settracks(mkv, tt.opts, r)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%q: Got no error, want error", tt.opts.where)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: Got error %q want no error", tt.opts.where, err)
+		}
+		if !reflect.DeepEqual(ids, tt.wantIDs) {
+			t.Errorf("%q: ids: got %v, want %v", tt.opts.where, ids, tt.wantIDs)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("%q: commands: got %q, want %q", tt.opts.where, r.cmds, tt.wantCmds)
+		}
+	}
+}
+
+func TestEditResult(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+		{"id": 0, "type": "video", "properties": {"default_duration": 41708333, "uid": 1234}},
+		{"id": 1, "type": "subtitles", "properties": {"language": "eng", "track_name": "Commentary", "default_track": true}},
+		{"id": 2, "type": "subtitles", "properties": {"language": "por", "language_ietf": "pt-BR", "forced_track": true}}]}`)
+
+	casetests := []struct {
+		ttype  string
+		ids    []int
+		fields []string
+		want   []string
+	}{
+		{
+			ttype:  typeSubtitle,
+			fields: []string{"name", "default", "forced"},
+			want: []string{
+				`track 1 (subtitles): name="Commentary" default=yes forced=no`,
+				`track 2 (subtitles): name="" default=no forced=yes`,
+			},
+		},
+		{
+			ids:    []int{0},
+			fields: []string{"fps", "uid"},
+			want:   []string{"track 0 (video): fps=23.976 uid=1234"},
+		},
+		{
+			ids:    []int{2},
+			fields: []string{"language"},
+			want:   []string{"track 2 (subtitles): language=por"},
+		},
+	}
+
+	for _, tt := range casetests {
+		got := editResult(mkv, tt.ttype, tt.ids, tt.fields...)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestParseUID(t *testing.T) {
+	casetests := []struct {
+		input     string
+		want      uint64
+		wantError bool
+	}{
+		{input: "12345", want: 12345},
+		{input: "0xff", want: 255},
+		{input: "18446744073709551615", want: 18446744073709551615},
+		{input: "18446744073709551616", wantError: true},
+		{input: "0", wantError: true},
+		{input: "-1", wantError: true},
+		{input: "abc", wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, err := parseUID(tt.input)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseUID(%q): Got %d, want %d", tt.input, got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("parseUID(%q): Got no error, want error", tt.input)
+		}
+	}
+}
+
+func TestSetTrackUID(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+		{"id": 0, "type": "video", "properties": {"uid": 100}},
+		{"id": 1, "type": "audio", "properties": {"uid": 200}}]}`)
+
+	casetests := []struct {
+		track     int
+		uid       uint64
+		wantCmds  [][]string
+		wantError bool
+	}{
+		{track: 1, uid: 300, wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:2", "--set", "track-uid=300"}}},
+		// Same UID on the same track is fine.
+		{track: 1, uid: 200, wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:2", "--set", "track-uid=200"}}},
+		// UID in use by another track.
+		{track: 1, uid: 100, wantError: true},
+		{track: 5, uid: 300, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		err := settrackuid(mkv, tt.track, tt.uid, r)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("Got no error, want error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("commands: got %q, want %q", r.cmds, tt.wantCmds)
+		}
+	}
+}
+
+func TestParseFPS(t *testing.T) {
+	casetests := []struct {
+		fps       string
+		want      time.Duration
+		wantError bool
+	}{
+		{fps: "25", want: 40 * time.Millisecond},
+		{fps: "23.976", want: 41708375},
+		{fps: "24000/1001", want: 41708333},
+		{fps: "0", wantError: true},
+		{fps: "-24", wantError: true},
+		{fps: "24/0", wantError: true},
+		{fps: "fast", wantError: true},
+		{fps: "NaN", wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, err := parseFPS(tt.fps)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			if got != tt.want {
+				t.Fatalf("parseFPS(%q): Got %d, want %d", tt.fps, got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("parseFPS(%q): Got no error, want error", tt.fps)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	casetests := []struct {
+		s         string
+		want      time.Time
+		wantZero  bool
+		wantNow   bool
+		wantError bool
+	}{
+		{s: "2022-01-02T15:04:05Z", want: time.Date(2022, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{s: "2022-01-02T15:04:05-03:00", want: time.Date(2022, 1, 2, 18, 4, 5, 0, time.UTC)},
+		{s: "2022-01-02T15:04:05.5Z", want: time.Date(2022, 1, 2, 15, 4, 5, 500000000, time.UTC)},
+		// Special values (case insensitive).
+		{s: "clear", wantZero: true},
+		{s: "CLEAR", wantZero: true},
+		{s: "now", wantNow: true},
+		{s: "Now", wantNow: true},
+		// Errors.
+		{s: "", wantError: true},
+		{s: "2022-01-02", wantError: true},
+		{s: "2022-01-02 15:04:05", wantError: true},
+		{s: "2022-13-02T15:04:05Z", wantError: true},
+		{s: "yesterday", wantError: true},
+	}
+
+	for _, tt := range casetests {
+		before := time.Now().Truncate(time.Second)
+		got, err := parseDate(tt.s)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%q: Got no error, want error", tt.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: Got error %q want no error", tt.s, err)
+		}
+		switch {
+		case tt.wantZero:
+			if !got.IsZero() {
+				t.Errorf("%q: Got %v, want the zero time", tt.s, got)
+			}
+		case tt.wantNow:
+			if got.Before(before) || got.After(time.Now()) || got.Nanosecond() != 0 {
+				t.Errorf("%q: Got %v, want the current time (in seconds)", tt.s, got)
+			}
+		default:
+			if !got.Equal(tt.want) {
+				t.Errorf("%q: Got %v, want %v", tt.s, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestSetdate(t *testing.T) {
+	casetests := []struct {
+		date     time.Time
+		wantCmds [][]string
+	}{
+		{
+			date:     time.Date(2022, 1, 2, 15, 4, 5, 0, time.UTC),
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "info", "--set", "date=2022-01-02T15:04:05Z"}},
+		},
+		// The zero date removes the date.
+		{
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "info", "--delete", "date"}},
+		},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		if err := setdate("a.mkv", tt.date, r); err != nil {
+			t.Fatalf("%v: Got error %q want no error", tt.date, err)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("%v: commands: got %q, want %q", tt.date, r.cmds, tt.wantCmds)
+		}
+	}
+}
+
+func TestImageSubTracks(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video", "properties": {"codec_id": "V_MPEG4/ISO/AVC"}},
+		{"id": 1, "type": "subtitles", "properties": {"codec_id": "S_TEXT/UTF8"}},
+		{"id": 2, "type": "subtitles", "properties": {"codec_id": "S_HDMV/PGS"}},
+		{"id": 3, "type": "subtitles", "properties": {"codec_id": "S_TEXT/ASS"}},
+		{"id": 4, "type": "subtitles", "properties": {"codec_id": "S_VOBSUB"}},
+		{"id": 5, "type": "subtitles", "properties": {"codec_id": "S_DVBSUB"}}]}`)
+
+	want := []int{2, 4, 5}
+	if got := imageSubTracks(mkv); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
+
+func TestPolicyMarkers(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video", "properties": {"default_track": true}},
+		{"id": 1, "type": "audio", "properties": {"language": "jpn", "default_track": true}},
+		{"id": 2, "type": "audio", "properties": {"language": "eng"}},
+		{"id": 3, "type": "subtitles", "properties": {"language": "eng"}},
+		{"id": 4, "type": "subtitles", "properties": {"language": "por", "default_track": true}}]}`)
+
+	casetests := []struct {
+		opts showOptions
+		want map[int]string
+	}{
+		{
+			opts: showOptions{preferredAudio: []string{"jpn"}, preferredSubs: []string{"eng"}},
+			want: map[int]string{1: "OK", 3: "should be default", 4: "should not be default"},
+		},
+		{
+			opts: showOptions{preferredAudio: []string{"eng", "jpn"}},
+			want: map[int]string{1: "should not be default", 2: "should be default"},
+		},
+		// No track in the preferred language.
+		{
+			opts: showOptions{preferredSubs: []string{"fra"}},
+			want: map[int]string{4: "should not be default"},
+		},
+		{
+			opts: showOptions{},
+			want: map[int]string{},
+		},
+	}
+
+	for _, tt := range casetests {
+		if got := policyMarkers(mkv, tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Got %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func TestMaskList(t *testing.T) {
+	casetests := []struct {
+		args []string
+		want []string
+	}{
+		// Default.
+		{
+			want: []string{"%{title}.mkv"},
+		},
+		// Commas are kept (not split like cli.StringSliceFlag values).
+		{
+			args: []string{"-f", "%{title}, %{year}"},
+			want: []string{"%{title}, %{year}"},
+		},
+		{
+			args: []string{"-f", "%{title}", "-f", "%{season},%{episode}"},
+			want: []string{"%{title}", "%{season},%{episode}"},
+		},
+	}
+
+	for _, tt := range casetests {
+		var got []string
+		app := &cli.App{
+			Flags: []cli.Flag{
+				&cli.GenericFlag{
+					Name:    "format",
+					Aliases: []string{"f"},
+					Value:   &maskList{masks: []string{"%{title}.mkv"}},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				got = c.Generic("format").(*maskList).masks
+				return nil
+			},
+		}
+		if err := app.Run(append([]string{"mkvtool"}, tt.args...)); err != nil {
+			t.Fatalf("args %q: %v", tt.args, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("args %q: got %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// The comma is kept in the output.
+	out, err := format("%{title}, %{year}", "The.Movie.2019.1080p.mkv", formatOptions{titleLocale: language.English})
+	if err != nil || out != "The Movie, 2019" {
+		t.Errorf("format with a comma: got %q (error %v), want %q", out, err, "The Movie, 2019")
+	}
+}
+
+func TestSeriesMask(t *testing.T) {
+	casetests := []struct {
+		fname     string
+		want      string
+		wantError bool
+	}{
+		{
+			fname: "/tmp/Show.Name.S01E02.Pilot.720p.mkv",
+			want:  "Show Name/Season 01/Show Name - S01E02 - Pilot.mkv",
+		},
+		{
+			fname: "/tmp/Show.Name.S01E02.The.Big.One.720p.HDTV.x264-GRP.mkv",
+			want:  "Show Name/Season 01/Show Name - S01E02 - The Big One.mkv",
+		},
+		// No episode title.
+		{
+			fname: "/tmp/Show.Name.S01E02.720p.mkv",
+			want:  "Show Name/Season 01/Show Name - S01E02.mkv",
+		},
+		// Specials.
+		{
+			fname: "/tmp/Show.Name.s00e03.720p.mkv",
+			want:  "Show Name/Specials/Show Name - S00E03.mkv",
+		},
+		// S00 in the directory name is ignored.
+		{
+			fname: "/S00E01/Show.Name.S02E01.mkv",
+			want:  "Show Name/Season 02/Show Name - S02E01.mkv",
+		},
+		// No season information.
+		{
+			fname:     "/tmp/Movie.Name.2019.1080p.mkv",
+			wantError: true,
+		},
+	}
+
+	for _, tt := range casetests {
+		mask, err := seriesMask(tt.fname)
+		var got string
+		if err == nil {
+			got, err = format(mask, tt.fname, formatOptions{titleLocale: language.English})
+		}
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("seriesMask(%q): got no error, want error", tt.fname)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("seriesMask(%q): got error %v, want no error", tt.fname, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("seriesMask(%q): got %q, want %q", tt.fname, got, tt.want)
+		}
+	}
+}
+
+func TestAudioFilter(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video", "properties": {}},
+		{"id": 1, "type": "audio", "properties": {"language": "eng", "audio_channels": 6}},
+		{"id": 2, "type": "audio", "properties": {"language": "eng", "audio_channels": 2}},
+		{"id": 3, "type": "audio", "properties": {"language": "jpn", "audio_channels": 2}},
+		{"id": 4, "type": "subtitles", "properties": {"language": "eng"}}]}`)
+
+	casetests := []struct {
+		languages   []string
+		maxChannels int
+		want        []int
+	}{
+		{languages: []string{"eng"}, want: []int{1, 2, 4}},
+		{maxChannels: 2, want: []int{2, 3, 4}},
+		{languages: []string{"eng"}, maxChannels: 2, want: []int{2, 4}},
+		{languages: []string{"jpn"}, maxChannels: 1, want: []int{4}},
+	}
+
+	for _, tt := range casetests {
+		if got := audioFilter(mkv, tt.languages, tt.maxChannels); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("audioFilter(%v, %d): got %v, want %v", tt.languages, tt.maxChannels, got, tt.want)
+		}
+	}
+}
+
+// recordRunner is a runner that records the commands.
+type recordRunner struct {
+	cmds [][]string
+}
+
+func (r *recordRunner) run(name string, args ...string) error {
+	r.cmds = append(r.cmds, append([]string{name}, args...))
+	return nil
+}
+
+func TestLabelTracks(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+		{"id": 0, "type": "video", "codec": "AVC/H.264/MPEG-4p10"},
+		{"id": 1, "type": "audio", "codec": "AAC", "properties": {"language": "jpn", "audio_channels": 6}},
+		{"id": 2, "type": "audio", "codec": "FLAC", "properties": {"language": "eng", "audio_channels": 2, "track_name": "eng 2.0 FLAC"}},
+		{"id": 3, "type": "subtitles", "properties": {"language": "eng"}},
+		{"id": 4, "type": "subtitles", "properties": {"language": "eng", "forced_track": true}}]}`)
+
+	casetests := []struct {
+		template  string
+		ttype     string
+		want      []string
+		wantCmds  [][]string
+		wantError bool
+	}{
+		// Empty tokens leave no empty brackets.
+		{
+			template: "{lang} [{forced}]",
+			ttype:    typeSubtitle,
+			want:     []string{`Track 3: "" => "eng"`, `Track 4: "" => "eng [Forced]"`},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:4", "--set", "name=eng", "--edit", "track:5", "--set", "name=eng [Forced]"}},
+		},
+		// Names already correct are not changed.
+		{
+			template: "{lang} {channels} {codec}",
+			ttype:    typeAudio,
+			want:     []string{`Track 1: "" => "jpn 5.1 AAC"`},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:2", "--set", "name=jpn 5.1 AAC"}},
+		},
+		{
+			template: "{langname} ({channels})",
+			ttype:    typeAudio,
+			want:     []string{`Track 1: "" => "Japanese (5.1)"`, `Track 2: "eng 2.0 FLAC" => "English (2.0)"`},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:2", "--set", "name=Japanese (5.1)", "--edit", "track:3", "--set", "name=English (2.0)"}},
+		},
+		{template: "{language}", wantError: true},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		got, err := labelTracks(mkv, tt.template, tt.ttype, r)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("Got no error, want error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("changes: got %q, want %q", got, tt.want)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("commands: got %q, want %q", r.cmds, tt.wantCmds)
+		}
+	}
+}
+
+func TestUnresolvedReport(t *testing.T) {
+	year := &formatError{msgs: []string{"no year"}, unresolved: []string{"%{year}"}}
+	both := &formatError{msgs: []string{"no year", "no episode"}, unresolved: []string{"%{year}", "%{episode}"}}
+	mixed := &formatError{msgs: []string{"no year", "invalid mask"}, unresolved: []string{"%{year}"}}
+
+	casetests := []struct {
+		fname  string
+		err    error
+		wantOK bool
+	}{
+		{fname: "a.mkv", err: year, wantOK: true},
+		// Same file again (E.g. another mask): not repeated.
+		{fname: "a.mkv", err: both, wantOK: true},
+		{fname: "b.mkv", err: year, wantOK: true},
+		{fname: "c.mkv", err: mixed, wantOK: false},
+		{fname: "d.mkv", err: fmt.Errorf("other error"), wantOK: false},
+	}
+
+	report := unresolvedReport{}
+	for _, tt := range casetests {
+		if got := report.add(tt.fname, tt.err); got != tt.wantOK {
+			t.Errorf("%s: add(%q): Got %v, want %v", tt.fname, tt.err, got, tt.wantOK)
+		}
+	}
+	want := unresolvedReport{
+		"%{year}":    {"a.mkv", "b.mkv", "c.mkv"},
+		"%{episode}": {"a.mkv"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("Got %v, want %v", report, want)
+	}
+	if got := report.files(); got != 3 {
+		t.Errorf("files: Got %d, want 3", got)
+	}
+}
+
+func TestRenameValidation(t *testing.T) {
+	setupCache(t)
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "The.Movie.2020.1080p.mkv")
+	invalid := filepath.Join(dir, "Other.Movie.2021.1080p.mkv")
+	for _, fname := range []string{valid, invalid} {
+		if err := ioutil.WriteFile(fname, []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the valid file has identification data (no mkvmerge needed).
+	if err := cacheStore(valid, []byte(identifyJSON)); err != nil {
+		t.Fatalf("cacheStore: %v", err)
+	}
+
+	casetests := []struct {
+		fname     string
+		want      string
+		wantError bool
+	}{
+		{fname: valid, want: filepath.Join(dir, "The Movie (2020).mkv")},
+		{fname: invalid, wantError: true},
+	}
+
+	fopts := formatOptions{titleLocale: language.English}
+	opts := renameOptions{mask: "%{title}%( (%{year})%).%{container}", dryrun: true}
+	for _, tt := range casetests {
+		got, renamed, err := rename(tt.fname, fopts, opts, map[string]string{})
+		if tt.wantError {
+			if err == nil || !strings.Contains(err.Error(), "not a valid media file") {
+				t.Errorf("%s: Got error %v, want invalid media file error", tt.fname, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Got error %q want no error", tt.fname, err)
+		}
+		if got != tt.want || !renamed {
+			t.Errorf("%s: Got %q (renamed=%v), want %q (renamed=true)", tt.fname, got, renamed, tt.want)
+		}
+	}
+}
+
+func TestRenameTracks(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+		{"id": 0, "type": "video", "properties": {"track_name": "EN"}},
+		{"id": 1, "type": "subtitles", "properties": {"track_name": "Eng"}},
+		{"id": 2, "type": "subtitles", "properties": {"track_name": "English sub"}},
+		{"id": 3, "type": "subtitles", "properties": {"track_name": "English"}},
+		{"id": 4, "type": "subtitles", "properties": {"track_name": "Portuguese"}},
+		{"id": 5, "type": "subtitles", "properties": {}}]}`)
+
+	casetests := []struct {
+		match    string
+		replace  string
+		ttype    string
+		want     []string
+		wantCmds [][]string
+	}{
+		{
+			match:   `(?i)^(eng|english sub|en)$`,
+			replace: "English",
+			ttype:   typeSubtitle,
+			want:    []string{`Track 1: "Eng" => "English"`, `Track 2: "English sub" => "English"`},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv",
+				"--edit", "track:2", "--set", "name=English",
+				"--edit", "track:3", "--set", "name=English"}},
+		},
+		// Submatches, all track types, and empty names.
+		{
+			match:    `^(\w+) sub$`,
+			replace:  "$1",
+			want:     []string{`Track 2: "English sub" => "English"`},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:3", "--set", "name=English"}},
+		},
+		{
+			match:    `^EN$`,
+			replace:  "",
+			want:     []string{`Track 0: "EN" => ""`},
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:1", "--delete", "name"}},
+		},
+		// No changes.
+		{
+			match:   `^French$`,
+			replace: "Francais",
+		},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		got, err := renameTracks(mkv, regexp.MustCompile(tt.match), tt.replace, tt.ttype, r)
+		if err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("changes: got %q, want %q", got, tt.want)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("commands: got %q, want %q", r.cmds, tt.wantCmds)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	casetests := []struct {
+		json string
+		want string
+	}{
+		{
+			json: `{"file_name": "a.mkv", "tracks": [
+				{"id": 0, "type": "video"},
+				{"id": 1, "type": "audio"},
+				{"id": 2, "type": "audio"},
+				{"id": 3, "type": "subtitles", "properties": {"language": "por"}},
+				{"id": 4, "type": "subtitles", "properties": {"language": "eng", "default_track": true}}],
+				"attachments": [{"id": 1}, {"id": 2}],
+				"chapters": [{"num_entries": 12}]}`,
+			want: "a.mkv: V:1 A:2 S:2 att:2 chap:yes default-sub:eng",
+		},
+		{
+			json: `{"file_name": "b.mkv", "tracks": [{"id": 0, "type": "video"}]}`,
+			want: "b.mkv: V:1 A:0 S:0 att:0 chap:no default-sub:none",
+		},
+	}
+
+	for _, tt := range casetests {
+		if got := summary(mustUnmarshalMKV(t, tt.json)); got != tt.want {
+			t.Errorf("Got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestShowAttachments(t *testing.T) {
+	english := language.English
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "attachments": [
+		{"id": 1, "file_name": "font.ttf", "content_type": "font/ttf", "size": 1234567},
+		{"id": 2, "file_name": "cover.jpg", "content_type": "image/jpeg", "size": 2000, "description": "Cover"}]}`)
+
+	casetests := []struct {
+		mkv  matroska
+		opts showOptions
+		want string
+	}{
+		{
+			mkv: mkv,
+			want: `+----+-----------------+------------+---------+-------------+
+| ID | NAME            | MIME TYPE  | SIZE    | DESCRIPTION |
++----+-----------------+------------+---------+-------------+
+|  1 | font.ttf        | font/ttf   | 1234567 |             |
+|  2 | cover.jpg       | image/jpeg | 2000    | Cover       |
++----+-----------------+------------+---------+-------------+
+|    | 2 ATTACHMENT(S) | TOTAL      | 1236567 |             |
++----+-----------------+------------+---------+-------------+
+`,
+		},
+		// Sizes in the locale format.
+		{
+			mkv:  mkv,
+			opts: showOptions{locale: &english},
+			want: `+----+-----------------+------------+-----------+-------------+
+| ID | NAME            | MIME TYPE  | SIZE      | DESCRIPTION |
++----+-----------------+------------+-----------+-------------+
+|  1 | font.ttf        | font/ttf   | 1,234,567 |             |
+|  2 | cover.jpg       | image/jpeg | 2,000     | Cover       |
++----+-----------------+------------+-----------+-------------+
+|    | 2 ATTACHMENT(S) | TOTAL      | 1,236,567 |             |
++----+-----------------+------------+-----------+-------------+
+`,
+		},
+		// No attachments.
+		{
+			mkv: mustUnmarshalMKV(t, `{"file_name": "b.mkv"}`),
+			want: `+----+-----------------+-----------+------+-------------+
+| ID |            NAME | MIME TYPE | SIZE | DESCRIPTION |
++----+-----------------+-----------+------+-------------+
++----+-----------------+-----------+------+-------------+
+|    | 0 ATTACHMENT(S) |     TOTAL |    0 |             |
++----+-----------------+-----------+------+-------------+
+`,
+		},
+	}
+
+	for _, tt := range casetests {
+		var out bytes.Buffer
+		showAttachments(&out, tt.mkv, tt.opts)
+		if got := out.String(); got != tt.want {
+			t.Errorf("%s: Got:\n%s\nWant:\n%s", tt.mkv.FileName, got, tt.want)
+		}
+	}
+}
+
+func TestTrackTotals(t *testing.T) {
+	casetests := []struct {
+		counts map[string]int
+		want   string
+	}{
+		{
+			counts: map[string]int{typeSubtitle: 5, typeAudio: 3, typeVideo: 1},
+			want:   "1 video, 3 audio, 5 subtitles",
+		},
+		{
+			counts: map[string]int{typeVideo: 1},
+			want:   "1 video, 0 audio, 0 subtitles",
+		},
+		{
+			counts: map[string]int{typeVideo: 2, "buttons": 1},
+			want:   "2 video, 0 audio, 0 subtitles, 1 buttons",
+		},
+	}
+
+	for _, tt := range casetests {
+		if got := trackTotals(tt.counts); got != tt.want {
+			t.Errorf("trackTotals(%v): got %q, want %q", tt.counts, got, tt.want)
+		}
+	}
+}
+
+func TestShowOptionsNumber(t *testing.T) {
+	english := language.English
+	german := language.German
+
+	casetests := []struct {
+		locale *language.Tag
+		n      int64
+		want   string
+	}{
+		{n: 1234567, want: "1234567"},
+		{locale: &english, n: 1234567, want: "1,234,567"},
+		{locale: &german, n: 1234567, want: "1.234.567"},
+		{locale: &german, n: 123, want: "123"},
+	}
+
+	for _, tt := range casetests {
+		got := showOptions{locale: tt.locale}.number(tt.n)
+		if got != tt.want {
+			t.Errorf("number(%d): got %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestParseChapterInterval(t *testing.T) {
+	casetests := []struct {
+		input     string
+		want      time.Duration
+		wantError bool
+	}{
+		{input: "10m", want: 10 * time.Minute},
+		{input: "1h30m", want: 90 * time.Minute},
+		{input: "500ms", wantError: true},
+		{input: "-10m", wantError: true},
+		{input: "10", wantError: true},
+		{input: "00:10:00", wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, err := parseChapterInterval(tt.input)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseChapterInterval(%q): Got %v, want %v", tt.input, got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("parseChapterInterval(%q): Got no error, want error", tt.input)
+		}
+	}
+}
+
+func TestRemuxGenerateChapters(t *testing.T) {
+	r := &recordRunner{}
+	opts := remuxOptions{subs: true, chapterInterval: 10 * time.Minute, chaptersNameTemplate: "Part <NUM:2>"}
+	if err := remux([]string{"in.mkv"}, "out.mkv", opts, r); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	want := [][]string{{"mkvmerge", "--generate-chapters", "interval:00:10:00.000", "--generate-chapters-name-template", "Part <NUM:2>", "in.mkv", "-o", "out.mkv"}}
+	if !reflect.DeepEqual(r.cmds, want) {
+		t.Errorf("commands: got %q, want %q", r.cmds, want)
+	}
+}
+
+func TestRemuxChaptersFrom(t *testing.T) {
+	r := &recordRunner{}
+	opts := remuxOptions{subs: true, chapters: "/tmp/chapters.xml", noChapters: true}
+	if err := remux([]string{"video.mkv", "audio.mka"}, "out.mkv", opts, r); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	want := [][]string{{"mkvmerge", "--chapters", "/tmp/chapters.xml", "--no-chapters", "video.mkv", "--no-chapters", "audio.mka", "-o", "out.mkv"}}
+	if !reflect.DeepEqual(r.cmds, want) {
+		t.Errorf("commands: got %q, want %q", r.cmds, want)
+	}
+}
+
+func TestRemuxExcludeTracks(t *testing.T) {
+	r := &recordRunner{}
+	opts := remuxOptions{
+		subs:               true,
+		excludeAudio:       map[string][]int{"in.mkv": {1, 3}},
+		excludeSubs:        map[string][]int{"in.mkv": {5}},
+		excludeAttachments: map[string][]int{"in2.mkv": {2}},
+	}
+	if err := remux([]string{"in.mkv", "in2.mkv"}, "out.mkv", opts, r); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	want := [][]string{{"mkvmerge", "--audio-tracks", "!1,3", "--subtitle-tracks", "!5", "in.mkv", "--attachments", "!2", "in2.mkv", "-o", "out.mkv"}}
+	if !reflect.DeepEqual(r.cmds, want) {
+		t.Errorf("commands: got %q, want %q", r.cmds, want)
+	}
+}
+
+func TestTagEntries(t *testing.T) {
+	casetests := []struct {
+		json       string
+		wantGlobal int
+		wantTrack  int
+	}{
+		{json: `{"file_name": "a.mkv"}`},
+		{
+			json: `{"file_name": "a.mkv", "global_tags": [{"num_entries": 3}, {"num_entries": 2}],
+				"track_tags": [{"num_entries": 4, "track_id": 0}, {"num_entries": 1, "track_id": 1}]}`,
+			wantGlobal: 5,
+			wantTrack:  5,
+		},
+		{json: `{"file_name": "a.mkv", "track_tags": [{"num_entries": 7, "track_id": 2}]}`, wantTrack: 7},
+	}
+
+	for _, tt := range casetests {
+		global, track := tagEntries(mustUnmarshalMKV(t, tt.json))
+		if global != tt.wantGlobal || track != tt.wantTrack {
+			t.Errorf("%s: Got %d global and %d track entries, want %d and %d", tt.json, global, track, tt.wantGlobal, tt.wantTrack)
+		}
+	}
+}
+
+func TestRemuxDropTags(t *testing.T) {
+	casetests := []struct {
+		opts remuxOptions
+		want [][]string
+	}{
+		{
+			opts: remuxOptions{subs: true, noTrackTags: true},
+			want: [][]string{{"mkvmerge", "--no-track-tags", "in.mkv", "--no-track-tags", "in2.mkv", "-o", "out.mkv"}},
+		},
+		{
+			opts: remuxOptions{subs: true, noTrackTags: true, noGlobalTags: true},
+			want: [][]string{{"mkvmerge", "--no-track-tags", "--no-global-tags", "in.mkv", "--no-track-tags", "--no-global-tags", "in2.mkv", "-o", "out.mkv"}},
+		},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		if err := remux([]string{"in.mkv", "in2.mkv"}, "out.mkv", tt.opts, r); err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.want) {
+			t.Errorf("commands: got %q, want %q", r.cmds, tt.want)
+		}
+	}
+}
+
+func TestRemuxCopyAttachments(t *testing.T) {
+	r := &recordRunner{}
+	opts := remuxOptions{
+		subs:            true,
+		attachmentsFrom: "fonts.mkv",
+		attachments:     []int{1, 3},
+	}
+	if err := remux([]string{"in.mkv", "in.srt"}, "out.mkv", opts, r); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	want := [][]string{{"mkvmerge", "in.mkv", "in.srt",
+		"-A", "-D", "-S", "-B", "--no-chapters", "--no-track-tags", "--no-global-tags", "--attachments", "1,3", "fonts.mkv",
+		"-o", "out.mkv"}}
+	if !reflect.DeepEqual(r.cmds, want) {
+		t.Errorf("commands: got %q, want %q", r.cmds, want)
+	}
+}
+
+func TestExtractTrack(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "/videos/movie.mkv", "tracks": [
+		{"id": 0, "type": "video", "properties": {"codec_id": "V_MPEG4/ISO/AVC", "default_track": true}},
+		{"id": 1, "type": "audio", "properties": {"codec_id": "A_AAC/MPEG4/LC"}},
+		{"id": 2, "type": "audio", "properties": {"codec_id": "A_AC3", "default_track": true}},
+		{"id": 3, "type": "audio", "properties": {"codec_id": "A_MS/ACM"}}]}`)
+
+	casetests := []struct {
+		ttype     string
+		tracknum  int
+		outfile   string
+		want      string
+		wantCmds  [][]string
+		wantError bool
+	}{
+		// Default track.
+		{
+			ttype: typeAudio, tracknum: -1,
+			want:     "/videos/movie.ac3",
+			wantCmds: [][]string{{"mkvextract", "/videos/movie.mkv", "tracks", "2:/videos/movie.ac3"}},
+		},
+		{
+			ttype: typeAudio, tracknum: 1,
+			want:     "/videos/movie.aac",
+			wantCmds: [][]string{{"mkvextract", "/videos/movie.mkv", "tracks", "1:/videos/movie.aac"}},
+		},
+		{
+			ttype: typeVideo, tracknum: -1,
+			want:     "/videos/movie.h264",
+			wantCmds: [][]string{{"mkvextract", "/videos/movie.mkv", "tracks", "0:/videos/movie.h264"}},
+		},
+		// Unknown codec, with an explicit output file.
+		{
+			ttype: typeAudio, tracknum: 3, outfile: "out.wav",
+			want:     "out.wav",
+			wantCmds: [][]string{{"mkvextract", "/videos/movie.mkv", "tracks", "3:out.wav"}},
+		},
+		{ttype: typeAudio, tracknum: 3, wantError: true},
+		{ttype: typeAudio, tracknum: 0, wantError: true},
+		{ttype: typeAudio, tracknum: 9, wantError: true},
+		{ttype: typeSubtitle, tracknum: -1, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		got, err := extractTrack(mkv, tt.ttype, tt.tracknum, tt.outfile, r)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%s track %d: Got no error, want error", tt.ttype, tt.tracknum)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		if got != tt.want {
+			t.Errorf("output: got %q, want %q", got, tt.want)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("commands: got %q, want %q", r.cmds, tt.wantCmds)
+		}
+	}
+}
+
+func TestHarmonizeDefaults(t *testing.T) {
+	episode := func(name string, defaultLang string) matroska {
+		tracks := []string{}
+		for i, lang := range []string{"eng", "por"} {
+			tracks = append(tracks, fmt.Sprintf(`{"id": %d, "type": "subtitles", "properties": {"language": %q, "default_track": %v}}`, i+1, lang, lang == defaultLang))
+		}
+		return mustUnmarshalMKV(t, fmt.Sprintf(`{"file_name": %q, "tracks": [{"id": 0, "type": "video"}, %s]}`, name, strings.Join(tracks, ",")))
+	}
+	noPor := mustUnmarshalMKV(t, `{"file_name": "e5.mkv", "tracks": [{"id": 0, "type": "subtitles", "properties": {"language": "eng", "default_track": true}}]}`)
+
+	casetests := []struct {
+		mkvs         []matroska
+		wantMajority string
+		wantChanges  []string
+		wantError    bool
+	}{
+		{
+			mkvs:         []matroska{episode("e1.mkv", "por"), episode("e2.mkv", "eng"), episode("e3.mkv", "por"), episode("e4.mkv", "")},
+			wantMajority: "por",
+			wantChanges:  []string{"e2.mkv: eng => 2", "e4.mkv: none => 2"},
+		},
+		// Nothing to change.
+		{
+			mkvs:         []matroska{episode("e1.mkv", "eng"), episode("e2.mkv", "eng")},
+			wantMajority: "eng",
+		},
+		// Outlier without a track in the majority language.
+		{
+			mkvs:         []matroska{episode("e1.mkv", "por"), episode("e2.mkv", "por"), noPor},
+			wantMajority: "por",
+			wantError:    true,
+		},
+		// Tie.
+		{mkvs: []matroska{episode("e1.mkv", "eng"), episode("e2.mkv", "por")}, wantError: true},
+		// No defaults at all.
+		{mkvs: []matroska{episode("e1.mkv", "")}, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		majority, changes, err := harmonizeDefaults(tt.mkvs)
+		if tt.wantError != (err != nil) {
+			t.Errorf("harmonizeDefaults: got error %v, want error: %v", err, tt.wantError)
+		}
+		if majority != tt.wantMajority {
+			t.Errorf("majority: got %q, want %q", majority, tt.wantMajority)
+		}
+		var got []string
+		for _, ch := range changes {
+			got = append(got, fmt.Sprintf("%s: %s => %d", ch.mkv.FileName, ch.from, ch.track))
+		}
+		if !reflect.DeepEqual(got, tt.wantChanges) {
+			t.Errorf("changes: got %q, want %q", got, tt.wantChanges)
+		}
+	}
+}
+
+func TestTouchDefault(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+		{"id": 0, "type": "video", "properties": {"default_track": true}},
+		{"id": 1, "type": "audio", "properties": {"language": "jpn", "default_track": true}},
+		{"id": 2, "type": "audio", "properties": {"language": "eng"}},
+		{"id": 3, "type": "subtitles", "properties": {"language": "eng", "track_name": "Signs", "default_track": true}},
+		{"id": 4, "type": "subtitles", "properties": {"language": "eng"}}]}`)
+
+	casetests := []struct {
+		opts        touchDefaultOptions
+		wantChanges int
+		wantCmds    [][]string
+	}{
+		// Already correct: no writes.
+		{opts: touchDefaultOptions{audioLangs: []string{"jpn"}, subLangs: []string{"eng"}}},
+		{
+			opts:        touchDefaultOptions{audioLangs: []string{"eng"}, subLangs: []string{"eng"}, ignore: []string{"signs"}},
+			wantChanges: 4,
+			wantCmds: [][]string{{"mkvpropedit", "a.mkv",
+				"--edit", "track:2", "--set", "flag-default=0",
+				"--edit", "track:3", "--set", "flag-default=1",
+				"--edit", "track:4", "--set", "flag-default=0",
+				"--edit", "track:5", "--set", "flag-default=1"}},
+		},
+		// No matching subtitle track: subtitles left unchanged.
+		{opts: touchDefaultOptions{audioLangs: []string{"fre", "jpn"}, subLangs: []string{"por"}}},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		changes, err := touchDefault(mkv, tt.opts, r)
+		if err != nil {
+			t.Fatalf("Got error %q want no error", err)
+		}
+		if len(changes) != tt.wantChanges {
+			t.Errorf("changes: got %q, want %d changes", changes, tt.wantChanges)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("commands: got %q, want %q", r.cmds, tt.wantCmds)
+		}
+	}
+}
+
+func TestParseSyncTracks(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [{"id": 0, "type": "video"}, {"id": 1, "type": "audio"}]}`)
+
+	casetests := []struct {
+		specs     []string
+		want      map[int]int
+		wantError bool
+	}{
+		{specs: []string{"0:200", "1:-150"}, want: map[int]int{0: 200, 1: -150}},
+		{specs: []string{"2:100"}, wantError: true},
+		{specs: []string{"0:1.5"}, wantError: true},
+		{specs: []string{"0"}, wantError: true},
+		{specs: []string{"x:100"}, wantError: true},
+		{specs: []string{"0:3600000", "1:-3600000"}, want: map[int]int{0: 3600000, 1: -3600000}},
+		{specs: []string{"0:3600001"}, wantError: true},
+		{specs: []string{"0:-3600001"}, wantError: true},
+		// Overflows time.Duration (wraps around to about 448ms).
+		{specs: []string{"0:18446744073710"}, wantError: true},
+		{specs: []string{"0:10", "0:20"}, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, err := parseSyncTracks(mkv, tt.specs)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%q: Got no error, want error", tt.specs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: Got error %q want no error", tt.specs, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.specs, got, tt.want)
+		}
+	}
+
+	r := &recordRunner{}
+	if err := remux([]string{"a.mkv"}, "out.mkv", remuxOptions{subs: true, syncTracks: map[int]int{1: -150, 0: 200}}, r); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	want := [][]string{{"mkvmerge", "--sync", "0:200", "--sync", "1:-150", "a.mkv", "-o", "out.mkv"}}
+	if !reflect.DeepEqual(r.cmds, want) {
+		t.Errorf("commands: got %q, want %q", r.cmds, want)
+	}
+}
+
+func TestDisableByLanguage(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+		{"id": 0, "type": "video", "properties": {"enabled_track": true}},
+		{"id": 1, "type": "audio", "properties": {"language": "jpn", "enabled_track": true}},
+		{"id": 2, "type": "audio", "properties": {"language": "ger", "enabled_track": true}},
+		{"id": 3, "type": "subtitles", "properties": {"language": "ger", "enabled_track": true}},
+		{"id": 4, "type": "subtitles", "properties": {"language": "ita"}}]}`)
+
+	casetests := []struct {
+		languages []string
+		ttype     string
+		force     bool
+		want      []int
+		wantCmds  [][]string
+		wantError bool
+	}{
+		{
+			languages: []string{"ger", "ita"},
+			want:      []int{2, 3},
+			wantCmds:  [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:3", "--set", "flag-enabled=0", "--edit", "track:4", "--set", "flag-enabled=0"}},
+		},
+		{
+			languages: []string{"ger"},
+			ttype:     typeSubtitle,
+			want:      []int{3},
+			wantCmds:  [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:4", "--set", "flag-enabled=0"}},
+		},
+		// Already disabled.
+		{languages: []string{"ita"}},
+		// No enabled audio would remain.
+		{languages: []string{"jpn", "ger"}, wantError: true},
+		{
+			languages: []string{"jpn", "ger"},
+			ttype:     typeAudio,
+			force:     true,
+			want:      []int{1, 2},
+			wantCmds:  [][]string{{"mkvpropedit", "a.mkv", "--edit", "track:2", "--set", "flag-enabled=0", "--edit", "track:3", "--set", "flag-enabled=0"}},
+		},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		got, err := disableByLanguage(mkv, tt.languages, tt.ttype, tt.force, r)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%v: Got no error, want error", tt.languages)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: Got error %q want no error", tt.languages, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.languages, got, tt.want)
+		}
+		if !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("%v: commands: got %q, want %q", tt.languages, r.cmds, tt.wantCmds)
+		}
+	}
+}
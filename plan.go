@@ -0,0 +1,284 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// muxPlan describes a complete mux operation, read from a JSON file. It
+// allows advanced users to specify per-track options that would be
+// cumbersome to express using command-line flags. Example:
+//
+//	{
+//	  "output": "out.mkv",
+//	  "title": "My Movie",
+//	  "inputs": [
+//	    {
+//	      "file": "movie.mkv",
+//	      "tracks": [
+//	        {"id": 2, "exclude": true},
+//	        {"id": 1, "language": "eng", "name": "English", "default": true}
+//	      ]
+//	    },
+//	    {
+//	      "file": "movie.por.srt",
+//	      "tracks": [{"id": 0, "language": "por", "delay": -200}]
+//	    }
+//	  ],
+//	  "track_order": [{"input": 0, "track": 0}, {"input": 0, "track": 1}, {"input": 1, "track": 0}]
+//	}
+type muxPlan struct {
+	Output     string            `json:"output"`
+	Title      string            `json:"title"`
+	Inputs     []muxPlanInput    `json:"inputs"`
+	TrackOrder []muxPlanTrackRef `json:"track_order"`
+}
+
+// muxPlanInput holds one input file and the options for its tracks. Tracks
+// not mentioned in Tracks are copied unchanged.
+type muxPlanInput struct {
+	File   string         `json:"file"`
+	Tracks []muxPlanTrack `json:"tracks"`
+}
+
+// muxPlanTrack holds the options for a single track (base 0, as shown by
+// mkvmerge --identify). Pointers are used for flags so we can distinguish
+// "not set" from "false".
+type muxPlanTrack struct {
+	ID       int    `json:"id"`
+	Exclude  bool   `json:"exclude"`
+	Language string `json:"language"`
+	Name     string `json:"name"`
+	Default  *bool  `json:"default"`
+	Forced   *bool  `json:"forced"`
+	Delay    int    `json:"delay"` // Milliseconds.
+}
+
+// muxPlanTrackRef references a track in one of the plan inputs.
+type muxPlanTrackRef struct {
+	Input int `json:"input"`
+	Track int `json:"track"`
+}
+
+// loadPlan reads a mux plan from a JSON file.
+func loadPlan(fname string) (muxPlan, error) {
+	r, err := os.Open(fname)
+	if err != nil {
+		return muxPlan{}, err
+	}
+	defer r.Close()
+
+	var plan muxPlan
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&plan); err != nil {
+		return muxPlan{}, fmt.Errorf("%s: %v", fname, err)
+	}
+	return plan, nil
+}
+
+// boolFlag returns "1" for true and "0" for false, as expected by mkvmerge.
+func boolFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// planCmdline validates the plan against the parsed input files and returns
+// the equivalent mkvmerge command line. The mkvs slice must contain the
+// parsed version of each input in the plan, in the same order.
+func planCmdline(plan muxPlan, mkvs []matroska) ([]string, error) {
+	if plan.Output == "" {
+		return nil, errors.New("plan: no output file specified")
+	}
+	if len(plan.Inputs) == 0 {
+		return nil, errors.New("plan: no input files specified")
+	}
+	if len(plan.Inputs) != len(mkvs) {
+		return nil, fmt.Errorf("internal error: got %d parsed files for %d plan inputs", len(mkvs), len(plan.Inputs))
+	}
+
+	cmdline := []string{"mkvmerge", "-o", plan.Output}
+	if plan.Title != "" {
+		cmdline = append(cmdline, "--title", plan.Title)
+	}
+
+	var errmsgs []string
+
+	// Map track IDs to their types, for each input.
+	ttypes := make([]map[int]string, len(plan.Inputs))
+	for idx, mkv := range mkvs {
+		ttypes[idx] = map[int]string{}
+		for _, track := range mkv.Tracks {
+			ttypes[idx][track.ID] = track.Type
+		}
+	}
+
+	// Excluded track IDs, for each input.
+	excludedIDs := make([]map[int]bool, len(plan.Inputs))
+
+	for idx, input := range plan.Inputs {
+		excludedIDs[idx] = map[int]bool{}
+
+		// Excluded tracks, by type.
+		excluded := map[string][]string{}
+		var opts []string
+
+		for _, pt := range input.Tracks {
+			ttype, ok := ttypes[idx][pt.ID]
+			if !ok {
+				errmsgs = append(errmsgs, fmt.Sprintf("%s: track %d not found", input.File, pt.ID))
+				continue
+			}
+			if pt.Exclude {
+				excludedIDs[idx][pt.ID] = true
+				excluded[ttype] = append(excluded[ttype], fmt.Sprintf("%d", pt.ID))
+				continue
+			}
+			if pt.Language != "" {
+				opts = append(opts, "--language", fmt.Sprintf("%d:%s", pt.ID, pt.Language))
+			}
+			if pt.Name != "" {
+				opts = append(opts, "--track-name", fmt.Sprintf("%d:%s", pt.ID, pt.Name))
+			}
+			if pt.Default != nil {
+				opts = append(opts, "--default-track-flag", fmt.Sprintf("%d:%s", pt.ID, boolFlag(*pt.Default)))
+			}
+			if pt.Forced != nil {
+				opts = append(opts, "--forced-display-flag", fmt.Sprintf("%d:%s", pt.ID, boolFlag(*pt.Forced)))
+			}
+			if pt.Delay != 0 {
+				opts = append(opts, "--sync", fmt.Sprintf("%d:%d", pt.ID, pt.Delay))
+			}
+		}
+
+		// mkvmerge uses "!" to invert the track selection.
+		for _, s := range []struct{ ttype, flag string }{
+			{typeVideo, "--video-tracks"},
+			{typeAudio, "--audio-tracks"},
+			{typeSubtitle, "--subtitle-tracks"},
+		} {
+			if ids, ok := excluded[s.ttype]; ok {
+				cmdline = append(cmdline, s.flag, "!"+strings.Join(ids, ","))
+			}
+		}
+		cmdline = append(cmdline, opts...)
+		cmdline = append(cmdline, input.File)
+	}
+
+	// Track order.
+	var order []string
+	for _, ref := range plan.TrackOrder {
+		if ref.Input < 0 || ref.Input >= len(plan.Inputs) {
+			errmsgs = append(errmsgs, fmt.Sprintf("track_order: invalid input %d", ref.Input))
+			continue
+		}
+		if _, ok := ttypes[ref.Input][ref.Track]; !ok {
+			errmsgs = append(errmsgs, fmt.Sprintf("track_order: track %d not found in %s", ref.Track, plan.Inputs[ref.Input].File))
+			continue
+		}
+		if excludedIDs[ref.Input][ref.Track] {
+			errmsgs = append(errmsgs, fmt.Sprintf("track_order: track %d in %s is excluded", ref.Track, plan.Inputs[ref.Input].File))
+			continue
+		}
+		order = append(order, fmt.Sprintf("%d:%d", ref.Input, ref.Track))
+	}
+	if len(order) != 0 {
+		cmdline = append(cmdline, "--track-order", strings.Join(order, ","))
+	}
+
+	if err := errorFromSlice(errmsgs); err != nil {
+		return nil, err
+	}
+	return cmdline, nil
+}
+
+// mergePlan executes the mux plan in the given file. A non-empty output
+// overrides the output specified in the plan. Returns the name of the output
+// file.
+func mergePlan(fname, output string, cmd runner) (string, error) {
+	plan, err := loadPlan(fname)
+	if err != nil {
+		return "", err
+	}
+	if output != "" {
+		plan.Output = output
+	}
+
+	var mkvs []matroska
+	for _, input := range plan.Inputs {
+		mkvs = append(mkvs, mustParseFile(input.File))
+	}
+	cmdline, err := planCmdline(plan, mkvs)
+	if err != nil {
+		return "", err
+	}
+	return plan.Output, cmd.run(cmdline[0], cmdline[1:]...)
+}
+
+// replaceTrackPlan returns a mux plan that copies mkv into output, replacing
+// track (base 0) with the single track in the replacement file. The new track
+// keeps the position, language, name, and flags of the original track.
+func replaceTrackPlan(mkv, replacement matroska, track int, output string) (muxPlan, error) {
+	if len(replacement.Tracks) != 1 {
+		return muxPlan{}, fmt.Errorf("%s: need exactly one track, found %d", replacement.FileName, len(replacement.Tracks))
+	}
+	newtrack := replacement.Tracks[0]
+
+	plan := muxPlan{Output: output}
+	found := false
+
+	for _, t := range mkv.Tracks {
+		if t.ID != track {
+			plan.TrackOrder = append(plan.TrackOrder, muxPlanTrackRef{Input: 0, Track: t.ID})
+			continue
+		}
+		if t.Type != newtrack.Type {
+			return muxPlan{}, fmt.Errorf("cannot replace %s track %d with a %s track", t.Type, track, newtrack.Type)
+		}
+		found = true
+		deflt := t.Properties.DefaultTrack
+		forced := t.Properties.ForcedTrack
+		plan.Inputs = []muxPlanInput{
+			{File: mkv.FileName, Tracks: []muxPlanTrack{{ID: track, Exclude: true}}},
+			{File: replacement.FileName, Tracks: []muxPlanTrack{{
+				ID:       newtrack.ID,
+				Language: t.Properties.Language,
+				Name:     t.Properties.TrackName,
+				Default:  &deflt,
+				Forced:   &forced,
+			}}},
+		}
+		plan.TrackOrder = append(plan.TrackOrder, muxPlanTrackRef{Input: 1, Track: newtrack.ID})
+	}
+	if !found {
+		return muxPlan{}, fmt.Errorf("%s: track %d not found", mkv.FileName, track)
+	}
+	return plan, nil
+}
+
+// replaceTrack copies mkv into output, replacing track (base 0) with the
+// track in the replacement file.
+func replaceTrack(mkv matroska, track int, replacement, output string, cmd runner) error {
+	rmkv, err := parseFile(replacement)
+	if err != nil {
+		return err
+	}
+	plan, err := replaceTrackPlan(mkv, rmkv, track, output)
+	if err != nil {
+		return err
+	}
+	cmdline, err := planCmdline(plan, []matroska{mkv, rmkv})
+	if err != nil {
+		return err
+	}
+	return cmd.run(cmdline[0], cmdline[1:]...)
+}
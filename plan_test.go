@@ -0,0 +1,172 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// mustUnmarshalMKV creates a matroska struct from a JSON string.
+func mustUnmarshalMKV(t *testing.T, s string) matroska {
+	t.Helper()
+	var mkv matroska
+	if err := json.Unmarshal([]byte(s), &mkv); err != nil {
+		t.Fatalf("Error decoding test JSON: %v", err)
+	}
+	return mkv
+}
+
+func TestPlanCmdline(t *testing.T) {
+	yes := true
+
+	movie := mustUnmarshalMKV(t, `{"file_name": "movie.mkv", "tracks": [
+		{"id": 0, "type": "video"},
+		{"id": 1, "type": "audio"},
+		{"id": 2, "type": "audio"},
+		{"id": 3, "type": "subtitles"}]}`)
+	srt := mustUnmarshalMKV(t, `{"file_name": "movie.srt", "tracks": [{"id": 0, "type": "subtitles"}]}`)
+
+	casetests := []struct {
+		plan      muxPlan
+		want      []string
+		wantError bool
+	}{
+		// Track exclusion and per-track options.
+		{
+			plan: muxPlan{
+				Output: "out.mkv",
+				Title:  "Title",
+				Inputs: []muxPlanInput{
+					{
+						File: "movie.mkv",
+						Tracks: []muxPlanTrack{
+							{ID: 2, Exclude: true},
+							{ID: 3, Exclude: true},
+							{ID: 1, Language: "eng", Name: "English", Default: &yes},
+						},
+					},
+					{
+						File:   "movie.srt",
+						Tracks: []muxPlanTrack{{ID: 0, Language: "por", Delay: -200}},
+					},
+				},
+				TrackOrder: []muxPlanTrackRef{{0, 0}, {0, 1}, {1, 0}},
+			},
+			want: []string{
+				"mkvmerge", "-o", "out.mkv", "--title", "Title",
+				"--audio-tracks", "!2", "--subtitle-tracks", "!3",
+				"--language", "1:eng", "--track-name", "1:English", "--default-track-flag", "1:1",
+				"movie.mkv",
+				"--language", "0:por", "--sync", "0:-200",
+				"movie.srt",
+				"--track-order", "0:0,0:1,1:0",
+			},
+		},
+		// Non-existing track.
+		{
+			plan: muxPlan{
+				Output: "out.mkv",
+				Inputs: []muxPlanInput{
+					{File: "movie.mkv", Tracks: []muxPlanTrack{{ID: 9, Exclude: true}}},
+					{File: "movie.srt"},
+				},
+			},
+			wantError: true,
+		},
+		// Excluded track in the track order.
+		{
+			plan: muxPlan{
+				Output: "out.mkv",
+				Inputs: []muxPlanInput{
+					{File: "movie.mkv", Tracks: []muxPlanTrack{{ID: 2, Exclude: true}}},
+					{File: "movie.srt"},
+				},
+				TrackOrder: []muxPlanTrackRef{{0, 0}, {0, 2}, {1, 0}},
+			},
+			wantError: true,
+		},
+		// No output.
+		{
+			plan: muxPlan{
+				Inputs: []muxPlanInput{{File: "movie.mkv"}, {File: "movie.srt"}},
+			},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range casetests {
+		got, err := planCmdline(tt.plan, []matroska{movie, srt})
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("command diff: Got %v, want %v", got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
+
+func TestReplaceTrackPlan(t *testing.T) {
+	yes, no := true, false
+
+	movie := mustUnmarshalMKV(t, `{"file_name": "movie.mkv", "tracks": [
+		{"id": 0, "type": "video"},
+		{"id": 1, "type": "audio", "properties": {"language": "eng", "track_name": "Stereo", "default_track": true}},
+		{"id": 2, "type": "subtitles"}]}`)
+	ac3 := mustUnmarshalMKV(t, `{"file_name": "better.ac3", "tracks": [{"id": 0, "type": "audio"}]}`)
+	srt := mustUnmarshalMKV(t, `{"file_name": "movie.srt", "tracks": [{"id": 0, "type": "subtitles"}]}`)
+	empty := mustUnmarshalMKV(t, `{"file_name": "empty.mka", "tracks": []}`)
+
+	casetests := []struct {
+		replacement matroska
+		track       int
+		want        muxPlan
+		wantError   bool
+	}{
+		{
+			replacement: ac3,
+			track:       1,
+			want: muxPlan{
+				Output: "out.mkv",
+				Inputs: []muxPlanInput{
+					{File: "movie.mkv", Tracks: []muxPlanTrack{{ID: 1, Exclude: true}}},
+					{File: "better.ac3", Tracks: []muxPlanTrack{{ID: 0, Language: "eng", Name: "Stereo", Default: &yes, Forced: &no}}},
+				},
+				TrackOrder: []muxPlanTrackRef{{0, 0}, {1, 0}, {0, 2}},
+			},
+		},
+		// Type mismatch.
+		{replacement: srt, track: 1, wantError: true},
+		// Track not found.
+		{replacement: ac3, track: 5, wantError: true},
+		// No tracks in replacement.
+		{replacement: empty, track: 1, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, err := replaceTrackPlan(movie, tt.replacement, tt.track, "out.mkv")
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("diff: Got %+v, want %+v", got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// errAborted is returned when the user refuses to continue.
+var errAborted = errors.New("aborted by user")
+
+// isTerminal returns true if the file is a terminal (character device).
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// readAnswer prints a prompt and returns the (trimmed) line typed by the user.
+func readAnswer(prompt string) (string, error) {
+	fmt.Print(prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// confirm asks the user to confirm an operation affecting nfiles files. The
+// question is skipped (and confirm returns nil) when assumeYes is set or
+// standard input is not a terminal. Returns errAborted if the user does not
+// answer yes.
+func confirm(verb string, nfiles int, assumeYes bool) error {
+	if assumeYes || nfiles == 0 || !isTerminal(os.Stdin) {
+		return nil
+	}
+	p := message.NewPrinter(language.English)
+	noun := "files"
+	if nfiles == 1 {
+		noun = "file"
+	}
+	answer, err := readAnswer(p.Sprintf("This will %s %d %s. Continue? [y/N] ", verb, nfiles, noun))
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		return nil
+	}
+	return errAborted
+}
+
+// parseTrackList parses a list of track numbers and ranges separated by
+// commas and/or spaces (E.g. "1, 3 5-7"). Duplicates are removed, keeping the
+// order of the first occurrence. All tracks must be in valid.
+func parseTrackList(s string, valid map[int]bool) ([]int, error) {
+	var (
+		ret     []int
+		invalid []string
+	)
+	seen := map[int]bool{}
+	highest := -1
+	for n := range valid {
+		if n > highest {
+			highest = n
+		}
+	}
+
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		first, last := f, f
+		if a, b, ok := cutString(f, "-"); ok && a != "" {
+			first, last = a, b
+		}
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid track number %q", f)
+		}
+		end, err := strconv.Atoi(last)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid track range %q", f)
+		}
+		// Don't walk huge ranges.
+		if start < 0 || end > highest {
+			invalid = append(invalid, f)
+			continue
+		}
+		for n := start; n <= end; n++ {
+			if !valid[n] {
+				invalid = append(invalid, strconv.Itoa(n))
+				continue
+			}
+			if !seen[n] {
+				seen[n] = true
+				ret = append(ret, n)
+			}
+		}
+	}
+	if len(invalid) != 0 {
+		return nil, fmt.Errorf("not audio or subtitle tracks: %s", strings.Join(invalid, ","))
+	}
+	return ret, nil
+}
+
+// selectTracks shows the tracks in the file and asks the user to choose which
+// audio and subtitle tracks to keep. Returns the list of chosen tracks. Fails
+// if the standard input is not a terminal.
+func selectTracks(mkv matroska) ([]int, error) {
+	if !isTerminal(os.Stdin) {
+		return nil, errors.New("interactive mode requires a terminal")
+	}
+
+	valid := map[int]bool{}
+	for _, track := range mkv.Tracks {
+		if track.Type == typeAudio || track.Type == typeSubtitle {
+			valid[track.ID] = true
+		}
+	}
+
+	fmt.Printf("Tracks in %s:\n", mkv.FileName)
+	show(os.Stdout, mkv, showOptions{})
+
+	for {
+		answer, err := readAnswer("Audio and subtitle track numbers to keep (separated by commas, ranges like 2-4): ")
+		if err != nil {
+			return nil, err
+		}
+		tracks, err := parseTrackList(answer, valid)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		return tracks, nil
+	}
+}
@@ -0,0 +1,62 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTrackList(t *testing.T) {
+	// Tracks 1 to 5 are audio or subtitles (0 is the video track).
+	valid := map[int]bool{1: true, 2: true, 3: true, 4: true, 5: true}
+
+	casetests := []struct {
+		s         string
+		want      []int
+		wantError bool
+	}{
+		{s: "1", want: []int{1}},
+		{s: "1, 3 4", want: []int{1, 3, 4}},
+		{s: "5,1", want: []int{5, 1}},
+		{s: "", want: nil},
+		// Ranges.
+		{s: "2-4", want: []int{2, 3, 4}},
+		{s: "1, 3-5", want: []int{1, 3, 4, 5}},
+		{s: "4-4", want: []int{4}},
+		// Duplicates.
+		{s: "1,1,2", want: []int{1, 2}},
+		{s: "2-4 3", want: []int{2, 3, 4}},
+		// Out of range.
+		{s: "0", wantError: true},
+		{s: "6", wantError: true},
+		{s: "-1", wantError: true},
+		{s: "4-6", wantError: true},
+		{s: "1-9999999999", wantError: true},
+		// Garbage.
+		{s: "a", wantError: true},
+		{s: "1;2", wantError: true},
+		{s: "1.5", wantError: true},
+		{s: "4-2", wantError: true},
+		{s: "1-", wantError: true},
+		{s: "1-2-3", wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, err := parseTrackList(tt.s, valid)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%q: Got no error, want error", tt.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: Got error %q want no error", tt.s, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: Got %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/jedib0t/go-pretty/table"
+)
+
+// defaultsTrack describes a track in the defaults report.
+type defaultsTrack struct {
+	ID       int    `json:"id"`
+	Language string `json:"language"`
+	Name     string `json:"name"`
+}
+
+// defaultsType holds the default and preferred tracks of one type (audio or
+// subtitles) in a file.
+type defaultsType struct {
+	// Current default track (nil if none).
+	Default *defaultsTrack `json:"default"`
+	// Track that should be the default according to the preferred
+	// languages (nil if none, or no preferred languages).
+	Preferred *defaultsTrack `json:"preferred"`
+	// True if the default tracks match the policy (always true without
+	// preferred languages).
+	Compliant bool `json:"compliant"`
+}
+
+// defaultsFile holds the defaults report for one file.
+type defaultsFile struct {
+	File      string       `json:"file"`
+	Audio     defaultsType `json:"audio"`
+	Subtitles defaultsType `json:"subtitles"`
+	Compliant bool         `json:"compliant"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// defaultsReport is the full defaults report. The JSON form is meant to be
+// consumed by other programs, so fields should not be renamed or removed.
+type defaultsReport struct {
+	Summary struct {
+		Files        int `json:"files"`
+		Compliant    int `json:"compliant"`
+		NonCompliant int `json:"non_compliant"`
+		Errors       int `json:"errors"`
+	} `json:"summary"`
+	Files []defaultsFile `json:"files"`
+}
+
+// newDefaultsTrack returns the defaultsTrack for track (base 0).
+func newDefaultsTrack(mkv matroska, id int) *defaultsTrack {
+	for _, track := range mkv.Tracks {
+		if track.ID == id {
+			return &defaultsTrack{
+				ID:       track.ID,
+				Language: trackLanguage(track.Properties.Language, track.Properties.LanguageIetf),
+				Name:     track.Properties.TrackName,
+			}
+		}
+	}
+	return nil
+}
+
+// fileDefaults returns the defaults report for a file, using the preferred
+// audio and subtitle languages in opts. The policy is the same used by the
+// "Policy" column in show.
+func fileDefaults(mkv matroska, opts showOptions) defaultsFile {
+	ret := defaultsFile{File: mkv.FileName}
+	markers := policyMarkers(mkv, opts)
+
+	for _, p := range []struct {
+		ttype     string
+		languages []string
+		dt        *defaultsType
+	}{
+		{typeAudio, opts.preferredAudio, &ret.Audio},
+		{typeSubtitle, opts.preferredSubs, &ret.Subtitles},
+	} {
+		for _, track := range mkv.Tracks {
+			if track.Type == p.ttype && track.Properties.DefaultTrack {
+				p.dt.Default = newDefaultsTrack(mkv, track.ID)
+				break
+			}
+		}
+		p.dt.Compliant = true
+		if len(p.languages) == 0 {
+			continue
+		}
+		if id, err := trackByLanguageAndType(mkv, p.ttype, p.languages, nil, false); err == nil {
+			p.dt.Preferred = newDefaultsTrack(mkv, id)
+		}
+		for _, track := range mkv.Tracks {
+			if m, ok := markers[track.ID]; ok && track.Type == p.ttype && m != "OK" {
+				p.dt.Compliant = false
+			}
+		}
+	}
+	ret.Compliant = ret.Audio.Compliant && ret.Subtitles.Compliant
+	return ret
+}
+
+// add adds a file to the report, updating the summary.
+func (r *defaultsReport) add(f defaultsFile) {
+	r.Files = append(r.Files, f)
+	r.Summary.Files++
+	switch {
+	case f.Error != "":
+		r.Summary.Errors++
+	case f.Compliant:
+		r.Summary.Compliant++
+	default:
+		r.Summary.NonCompliant++
+	}
+}
+
+// writeJSON writes the report in JSON format.
+func (r defaultsReport) writeJSON(w io.Writer) error {
+	// Always emit an array, even without files.
+	if r.Files == nil {
+		r.Files = []defaultsFile{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// writeTable writes the report as a table, followed by the summary.
+func (r defaultsReport) writeTable(w io.Writer) {
+	// describe returns a short description of a track.
+	describe := func(t *defaultsTrack) string {
+		if t == nil {
+			return "none"
+		}
+		return fmt.Sprintf("%d (%s)", t.ID, t.Language)
+	}
+	yesno := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "NO"
+	}
+
+	tab := table.NewWriter()
+	tab.SetOutputMirror(w)
+	tab.AppendHeader(table.Row{"File", "Default Audio", "Default Subtitles", "Compliant"})
+	for _, f := range r.Files {
+		if f.Error != "" {
+			tab.AppendRow(table.Row{f.File, "", "", "ERROR: " + f.Error})
+			continue
+		}
+		tab.AppendRow(table.Row{f.File, describe(f.Audio.Default), describe(f.Subtitles.Default), yesno(f.Compliant)})
+	}
+	tab.Render()
+	fmt.Fprintf(w, "%d file(s): %d compliant, %d non-compliant, %d error(s).\n",
+		r.Summary.Files, r.Summary.Compliant, r.Summary.NonCompliant, r.Summary.Errors)
+}
+
+// languageInventory holds the languages of the audio and subtitle tracks in a
+// set of files.
+type languageInventory struct {
+	files []string
+	// Files with at least one track in each language, by track type.
+	langs map[string]map[string][]string
+}
+
+// newLanguageInventory returns an empty inventory.
+func newLanguageInventory() *languageInventory {
+	return &languageInventory{langs: map[string]map[string][]string{
+		typeAudio:    {},
+		typeSubtitle: {},
+	}}
+}
+
+// add adds the languages in a file to the inventory. Tracks without a
+// language are counted as "und".
+func (inv *languageInventory) add(mkv matroska) {
+	inv.files = append(inv.files, mkv.FileName)
+	for _, track := range mkv.Tracks {
+		files, ok := inv.langs[track.Type]
+		if !ok {
+			continue
+		}
+		lang := trackLanguage(track.Properties.Language, track.Properties.LanguageIetf)
+		if lang == "" {
+			lang = "und"
+		}
+		// Count each file only once per language.
+		if n := len(files[lang]); n == 0 || files[lang][n-1] != mkv.FileName {
+			files[lang] = append(files[lang], mkv.FileName)
+		}
+	}
+}
+
+// lines returns the inventory, one track type and language per line (E.g.
+// "subtitles: por"). With counts, the number of files with each language is
+// included. With missing, the files without each language are listed after
+// it (indented).
+func (inv *languageInventory) lines(counts, missing bool) []string {
+	var ret []string
+	for _, ttype := range []string{typeAudio, typeSubtitle} {
+		var langs []string
+		for lang := range inv.langs[ttype] {
+			langs = append(langs, lang)
+		}
+		sort.Strings(langs)
+		for _, lang := range langs {
+			files := inv.langs[ttype][lang]
+			line := fmt.Sprintf("%s: %s", ttype, lang)
+			if counts {
+				line += fmt.Sprintf(" (%d of %d files)", len(files), len(inv.files))
+			}
+			ret = append(ret, line)
+			if !missing {
+				continue
+			}
+			has := map[string]bool{}
+			for _, f := range files {
+				has[f] = true
+			}
+			for _, f := range inv.files {
+				if !has[f] {
+					ret = append(ret, "  missing: "+f)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// codecCount holds the number of tracks and files using a codec.
+type codecCount struct {
+	ttype   string
+	codecID string
+	tracks  int
+	files   int
+}
+
+// codecHistogram tallies the codecs (by codec ID) of the tracks in a set of
+// files.
+type codecHistogram struct {
+	// Only count tracks of this type (all types if empty).
+	ttype  string
+	counts map[string]*codecCount
+}
+
+// newCodecHistogram returns an empty histogram for tracks of type ttype (all
+// types, if empty).
+func newCodecHistogram(ttype string) *codecHistogram {
+	return &codecHistogram{ttype: ttype, counts: map[string]*codecCount{}}
+}
+
+// add adds the tracks in a file to the histogram.
+func (h *codecHistogram) add(mkv matroska) {
+	seen := map[string]bool{}
+	for _, track := range mkv.Tracks {
+		if h.ttype != "" && track.Type != h.ttype {
+			continue
+		}
+		id := track.Properties.CodecID
+		if id == "" {
+			id = track.Codec
+		}
+		key := track.Type + "/" + id
+		c, ok := h.counts[key]
+		if !ok {
+			c = &codecCount{ttype: track.Type, codecID: id}
+			h.counts[key] = c
+		}
+		c.tracks++
+		if !seen[key] {
+			c.files++
+			seen[key] = true
+		}
+	}
+}
+
+// sorted returns the codecs, most used (by number of tracks) first.
+func (h *codecHistogram) sorted() []codecCount {
+	var ret []codecCount
+	for _, c := range h.counts {
+		ret = append(ret, *c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if a.tracks != b.tracks {
+			return a.tracks > b.tracks
+		}
+		if a.ttype != b.ttype {
+			return a.ttype < b.ttype
+		}
+		return a.codecID < b.codecID
+	})
+	return ret
+}
+
+// writeTable writes the histogram as a table.
+func (h *codecHistogram) writeTable(w io.Writer) {
+	tab := table.NewWriter()
+	tab.SetOutputMirror(w)
+	tab.AppendHeader(table.Row{"Type", "Codec ID", "Tracks", "Files"})
+	for _, c := range h.sorted() {
+		tab.AppendRow(table.Row{c.ttype, c.codecID, c.tracks, c.files})
+	}
+	tab.Render()
+}
+
+// mergeSource describes a track in the output of merge, and where it came
+// from.
+type mergeSource struct {
+	// Track number (base 0) in the output file.
+	track int
+	// Input file and track number (base 0) in the input file.
+	file     string
+	sourceID int
+	ttype    string
+	language string
+}
+
+// mergeSources returns the tracks in the output of a merge of the parsed
+// input files, in the order created by mkvmerge (input file order, then track
+// order in each file), skipping the tracks excluded by opts.
+func mergeSources(mkvs []matroska, opts remuxOptions) []mergeSource {
+	var ret []mergeSource
+	for i, mkv := range mkvs {
+		exclude := map[int]bool{}
+		for _, id := range opts.excludeAudio[mkv.FileName] {
+			exclude[id] = true
+		}
+		for _, id := range opts.excludeSubs[mkv.FileName] {
+			exclude[id] = true
+		}
+		for _, track := range mkv.Tracks {
+			if exclude[track.ID] || (i == 0 && !opts.subs && track.Type == typeSubtitle) {
+				continue
+			}
+			lang := trackLanguage(track.Properties.Language, track.Properties.LanguageIetf)
+			if lang == "" {
+				lang = "und"
+			}
+			ret = append(ret, mergeSource{
+				track:    len(ret),
+				file:     mkv.FileName,
+				sourceID: track.ID,
+				ttype:    track.Type,
+				language: lang,
+			})
+		}
+	}
+	return ret
+}
+
+// writeMergeReport writes the sources of the tracks in the merge output as a
+// table.
+func writeMergeReport(w io.Writer, sources []mergeSource) {
+	tab := table.NewWriter()
+	tab.SetOutputMirror(w)
+	tab.AppendHeader(table.Row{"Output track", "Source file", "Source track", "Type", "Language"})
+	for _, s := range sources {
+		tab.AppendRow(table.Row{s.track, s.file, s.sourceID, s.ttype, s.language})
+	}
+	tab.Render()
+}
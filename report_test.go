@@ -0,0 +1,230 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFileDefaults(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+		{"id": 0, "type": "video", "properties": {"default_track": true}},
+		{"id": 1, "type": "audio", "properties": {"language": "jpn", "default_track": true}},
+		{"id": 2, "type": "audio", "properties": {"language": "eng"}},
+		{"id": 3, "type": "subtitles", "properties": {"language": "eng", "track_name": "English"}},
+		{"id": 4, "type": "subtitles", "properties": {"language": "por"}}]}`)
+
+	jpn := &defaultsTrack{ID: 1, Language: "jpn"}
+	eng := &defaultsTrack{ID: 2, Language: "eng"}
+	engSub := &defaultsTrack{ID: 3, Language: "eng", Name: "English"}
+
+	casetests := []struct {
+		opts showOptions
+		want defaultsFile
+	}{
+		{
+			opts: showOptions{preferredAudio: []string{"jpn"}, preferredSubs: []string{"eng"}},
+			want: defaultsFile{
+				File:      "a.mkv",
+				Audio:     defaultsType{Default: jpn, Preferred: jpn, Compliant: true},
+				Subtitles: defaultsType{Preferred: engSub},
+			},
+		},
+		{
+			opts: showOptions{preferredAudio: []string{"eng"}},
+			want: defaultsFile{
+				File:      "a.mkv",
+				Audio:     defaultsType{Default: jpn, Preferred: eng},
+				Subtitles: defaultsType{Compliant: true},
+			},
+		},
+		// No tracks in the preferred languages.
+		{
+			opts: showOptions{preferredSubs: []string{"fra"}},
+			want: defaultsFile{
+				File:      "a.mkv",
+				Audio:     defaultsType{Default: jpn, Compliant: true},
+				Subtitles: defaultsType{Compliant: true},
+				Compliant: true,
+			},
+		},
+	}
+
+	for _, tt := range casetests {
+		if got := fileDefaults(mkv, tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("fileDefaults(%+v):\ngot:  %+v\nwant: %+v", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultsReportJSON(t *testing.T) {
+	var report defaultsReport
+	report.add(defaultsFile{File: "a.mkv", Compliant: true})
+	report.add(defaultsFile{File: "b.mkv"})
+	report.add(defaultsFile{File: "c.mkv", Error: "parse error"})
+
+	var buf bytes.Buffer
+	if err := report.writeJSON(&buf); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	var got struct {
+		Summary map[string]int `json:"summary"`
+		Files   []struct {
+			File  string `json:"file"`
+			Error string `json:"error"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	wantSummary := map[string]int{"files": 3, "compliant": 1, "non_compliant": 1, "errors": 1}
+	if !reflect.DeepEqual(got.Summary, wantSummary) {
+		t.Errorf("summary: got %v, want %v", got.Summary, wantSummary)
+	}
+	if len(got.Files) != 3 || got.Files[2].Error != "parse error" {
+		t.Errorf("files: got %+v", got.Files)
+	}
+}
+
+func TestLanguageInventory(t *testing.T) {
+	inv := newLanguageInventory()
+	inv.add(mustUnmarshalMKV(t, `{"file_name": "e1.mkv", "tracks": [
+		{"id": 0, "type": "video"},
+		{"id": 1, "type": "audio", "properties": {"language": "jpn"}},
+		{"id": 2, "type": "subtitles", "properties": {"language": "eng"}},
+		{"id": 3, "type": "subtitles", "properties": {"language": "por"}},
+		{"id": 4, "type": "subtitles", "properties": {"language": "por", "forced_track": true}}]}`))
+	inv.add(mustUnmarshalMKV(t, `{"file_name": "e2.mkv", "tracks": [
+		{"id": 0, "type": "audio"},
+		{"id": 1, "type": "subtitles", "properties": {"language": "eng"}}]}`))
+
+	casetests := []struct {
+		counts  bool
+		missing bool
+		want    []string
+	}{
+		{
+			want: []string{"audio: jpn", "audio: und", "subtitles: eng", "subtitles: por"},
+		},
+		{
+			counts:  true,
+			missing: true,
+			want: []string{
+				"audio: jpn (1 of 2 files)",
+				"  missing: e2.mkv",
+				"audio: und (1 of 2 files)",
+				"  missing: e1.mkv",
+				"subtitles: eng (2 of 2 files)",
+				"subtitles: por (1 of 2 files)",
+				"  missing: e2.mkv",
+			},
+		},
+	}
+
+	for _, tt := range casetests {
+		if got := inv.lines(tt.counts, tt.missing); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lines(%v, %v): got %q, want %q", tt.counts, tt.missing, got, tt.want)
+		}
+	}
+}
+
+func TestCodecHistogram(t *testing.T) {
+	mkvs := []matroska{
+		mustUnmarshalMKV(t, `{"file_name": "e1.mkv", "tracks": [
+			{"id": 0, "type": "video", "properties": {"codec_id": "V_MPEG4/ISO/AVC"}},
+			{"id": 1, "type": "audio", "properties": {"codec_id": "A_DTS"}},
+			{"id": 2, "type": "audio", "properties": {"codec_id": "A_DTS"}},
+			{"id": 3, "type": "subtitles", "properties": {"codec_id": "S_TEXT/UTF8"}}]}`),
+		mustUnmarshalMKV(t, `{"file_name": "e2.mkv", "tracks": [
+			{"id": 0, "type": "video", "properties": {"codec_id": "V_MPEGH/ISO/HEVC"}},
+			{"id": 1, "type": "audio", "properties": {"codec_id": "A_DTS"}},
+			{"id": 2, "type": "audio", "properties": {"codec_id": "A_AC3"}}]}`),
+	}
+
+	casetests := []struct {
+		ttype string
+		want  []codecCount
+	}{
+		{
+			want: []codecCount{
+				{ttype: "audio", codecID: "A_DTS", tracks: 3, files: 2},
+				{ttype: "audio", codecID: "A_AC3", tracks: 1, files: 1},
+				{ttype: "subtitles", codecID: "S_TEXT/UTF8", tracks: 1, files: 1},
+				{ttype: "video", codecID: "V_MPEG4/ISO/AVC", tracks: 1, files: 1},
+				{ttype: "video", codecID: "V_MPEGH/ISO/HEVC", tracks: 1, files: 1},
+			},
+		},
+		{
+			ttype: typeVideo,
+			want: []codecCount{
+				{ttype: "video", codecID: "V_MPEG4/ISO/AVC", tracks: 1, files: 1},
+				{ttype: "video", codecID: "V_MPEGH/ISO/HEVC", tracks: 1, files: 1},
+			},
+		},
+	}
+
+	for _, tt := range casetests {
+		h := newCodecHistogram(tt.ttype)
+		for _, mkv := range mkvs {
+			h.add(mkv)
+		}
+		if got := h.sorted(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("type %q: got %+v, want %+v", tt.ttype, got, tt.want)
+		}
+	}
+}
+
+func TestMergeSources(t *testing.T) {
+	mkvs := []matroska{
+		mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+			{"id": 0, "type": "video"},
+			{"id": 1, "type": "audio", "properties": {"language": "jpn"}},
+			{"id": 2, "type": "subtitles", "properties": {"language": "eng"}}]}`),
+		mustUnmarshalMKV(t, `{"file_name": "b.mka", "tracks": [
+			{"id": 0, "type": "audio", "properties": {"language": "eng"}},
+			{"id": 1, "type": "audio", "properties": {"language": "ger"}}]}`),
+		mustUnmarshalMKV(t, `{"file_name": "c.srt", "tracks": [
+			{"id": 0, "type": "subtitles"}]}`),
+	}
+
+	casetests := []struct {
+		name string
+		opts remuxOptions
+		want []mergeSource
+	}{
+		{
+			name: "all tracks",
+			opts: remuxOptions{subs: true},
+			want: []mergeSource{
+				{track: 0, file: "a.mkv", sourceID: 0, ttype: "video", language: "und"},
+				{track: 1, file: "a.mkv", sourceID: 1, ttype: "audio", language: "jpn"},
+				{track: 2, file: "a.mkv", sourceID: 2, ttype: "subtitles", language: "eng"},
+				{track: 3, file: "b.mka", sourceID: 0, ttype: "audio", language: "eng"},
+				{track: 4, file: "b.mka", sourceID: 1, ttype: "audio", language: "ger"},
+				{track: 5, file: "c.srt", sourceID: 0, ttype: "subtitles", language: "und"},
+			},
+		},
+		{
+			name: "no subs and excluded tracks",
+			opts: remuxOptions{
+				excludeAudio: map[string][]int{"a.mkv": {1}, "b.mka": {1}},
+			},
+			want: []mergeSource{
+				{track: 0, file: "a.mkv", sourceID: 0, ttype: "video", language: "und"},
+				{track: 1, file: "b.mka", sourceID: 0, ttype: "audio", language: "eng"},
+				{track: 2, file: "c.srt", sourceID: 0, ttype: "subtitles", language: "und"},
+			},
+		},
+	}
+
+	for _, tt := range casetests {
+		if got := mergeSources(mkvs, tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -5,24 +5,45 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type runner interface {
 	run(string, ...string) error
 }
 
+// noExternalTools disables running any 3rd party programs (set by
+// --no-external-tools).
+var noExternalTools bool
+
+// checkExternal returns an error if running the 3rd party program name is
+// not allowed.
+func checkExternal(name string) error {
+	if noExternalTools {
+		return fmt.Errorf("refusing to run %q: external tools disabled (--no-external-tools)", name)
+	}
+	return nil
+}
+
 // runner provides a simple and mockable interface to exec.Command()
 type runCommand int
 
 // run creates an *exec.Cmd object using exec.Command and runs
 // it using exec.Run. The return is the return of exec.Run.
 func (x runCommand) run(name string, arg ...string) error {
+	if err := checkExternal(name); err != nil {
+		return err
+	}
+	debugf("Running %q %s", name, quoteArgs(arg))
 	cmd := exec.Command(name, arg...)
 
 	stdout, err := cmd.StdoutPipe()
@@ -47,11 +68,102 @@ type fakeRunCommand int
 
 // Fakerunner just logs the commands (dry-run)
 func (x fakeRunCommand) run(name string, args ...string) error {
+	log.Printf("%q %s", name, quoteArgs(args))
+	return nil
+}
+
+// extractionRunner returns the runner to extract chapters, tags, and
+// attachments with. Extraction only writes temporary files, so it also runs in
+// dry-run mode (and with --export-plan), to show exactly what would be done.
+// Other runners, including the --timings wrapper, are kept.
+func extractionRunner(r runner) runner {
+	switch x := r.(type) {
+	case timedRunner:
+		return timedRunner{r: extractionRunner(x.r)}
+	case fakeRunCommand, *planRunner:
+		return runCommand(0)
+	}
+	return r
+}
+
+// planRunner writes the commands to a shell script instead of running them
+// (set by --export-plan), so a batch can be reviewed before running it. It is
+// safe for concurrent use.
+type planRunner struct {
+	mu   sync.Mutex
+	name string
+	f    *os.File
+}
+
+// errPlanUnsupported is returned by commands with steps that don't use the
+// runner (like renaming files), which can't be written to a plan.
+var errPlanUnsupported = errors.New("--export-plan is not supported")
+
+// newPlanRunner creates the (executable) shell script fname, with a header
+// showing the command line (args) used to generate it. Newlines in the
+// arguments are escaped, so the header remains a comment.
+func newPlanRunner(fname string, args []string) (*planRunner, error) {
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	cmdline := strings.NewReplacer("\n", `\n`, "\r", `\r`).Replace(shellQuote(args))
+	if _, err := fmt.Fprintf(f, "#!/bin/sh\n# Generated by: mkvtool %s\nset -e\n", cmdline); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &planRunner{name: fname, f: f}, nil
+}
+
+// run writes the command to the script.
+func (x *planRunner) run(name string, args ...string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	_, err := fmt.Fprintln(x.f, shellQuote(append([]string{name}, args...)))
+	return err
+}
+
+// close closes the script.
+func (x *planRunner) close() error {
+	return x.f.Close()
+}
+
+// discard closes and removes the script.
+func (x *planRunner) discard() error {
+	x.f.Close()
+	return os.Remove(x.name)
+}
+
+// reShellSafe matches strings that don't need quoting in shell scripts.
+var reShellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote returns the arguments quoted for POSIX shells, separated by
+// spaces.
+func shellQuote(args []string) string {
+	var quoted []string
+	for _, a := range args {
+		if !reShellSafe.MatchString(a) {
+			a = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+		quoted = append(quoted, a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// mkvmergeWarnings returns true if err indicates that mkvmerge (or
+// mkvpropedit) finished with warnings (exit status 1). The output is complete
+// in this case, unlike errors (exit status 2).
+func mkvmergeWarnings(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == 1
+}
+
+// quoteArgs returns the quoted command arguments, separated by spaces.
+func quoteArgs(args []string) string {
 	var quoted []string
 
 	for _, a := range args {
 		quoted = append(quoted, strconv.Quote(a))
 	}
-	log.Printf("%q %s", name, strings.Join(quoted, " "))
-	return nil
+	return strings.Join(quoted, " ")
 }
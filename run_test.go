@@ -0,0 +1,149 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMkvmergeWarnings(t *testing.T) {
+	casetests := []struct {
+		err  error
+		want bool
+	}{
+		{err: exec.Command("sh", "-c", "exit 1").Run(), want: true},
+		{err: exec.Command("sh", "-c", "exit 2").Run()},
+		{err: errors.New("exit status 1")},
+		{err: nil},
+	}
+
+	for _, tt := range casetests {
+		if got := mkvmergeWarnings(tt.err); got != tt.want {
+			t.Errorf("mkvmergeWarnings(%v): got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	casetests := []struct {
+		args []string
+		want string
+	}{
+		{
+			args: []string{"mkvpropedit", "/videos/a.mkv", "--edit", "track:2", "--set", "flag-default=1"},
+			want: "mkvpropedit /videos/a.mkv --edit track:2 --set flag-default=1",
+		},
+		{
+			args: []string{"mkvpropedit", "My Movie (2020).mkv", "--set", "name=Director's Cut"},
+			want: `mkvpropedit 'My Movie (2020).mkv' --set 'name=Director'\''s Cut'`,
+		},
+		{
+			args: []string{"echo", "", "$HOME", "a;b"},
+			want: `echo '' '$HOME' 'a;b'`,
+		},
+	}
+
+	for _, tt := range casetests {
+		if got := shellQuote(tt.args); got != tt.want {
+			t.Errorf("shellQuote(%q): got %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestPlanRunner(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "plan.sh")
+	plan, err := newPlanRunner(fname, []string{"setdefaultbylang", "--lang", "eng\nrm -rf /", "a.mkv"})
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	if err := plan.run("mkvpropedit", "a b.mkv", "--edit", "track:1"); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	if err := plan.close(); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := []string{
+		"#!/bin/sh",
+		`# Generated by: mkvtool setdefaultbylang --lang 'eng\nrm -rf /' a.mkv`,
+		"set -e",
+		"mkvpropedit 'a b.mkv' --edit track:1",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Unexpected plan contents:\n%s", data)
+	}
+	fi, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&0o100 == 0 {
+		t.Errorf("Plan is not executable (mode %v)", fi.Mode())
+	}
+}
+
+func TestPlanRunnerDiscard(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "plan.sh")
+	plan, err := newPlanRunner(fname, []string{"rename", "a.mkv"})
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	if err := plan.discard(); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Errorf("Plan %s was not removed (stat error: %v)", fname, err)
+	}
+}
+
+func TestNoExternalTools(t *testing.T) {
+	noExternalTools = true
+	defer func() { noExternalTools = false }()
+
+	if err := (runCommand(0)).run("true"); err == nil {
+		t.Errorf("run: Got no error, want error")
+	}
+	if err := requireTools("mkvmerge")(nil); err == nil {
+		t.Errorf("requireTools: Got no error, want error")
+	}
+	if err := requireTools()(nil); err != nil {
+		t.Errorf("requireTools (no tools): Got error %q, want no error", err)
+	}
+}
+
+func TestExtractionRunner(t *testing.T) {
+	plan := &planRunner{}
+	rec := &recordRunner{}
+
+	casetests := []struct {
+		r    runner
+		want runner
+	}{
+		{r: runCommand(0), want: runCommand(0)},
+		{r: fakeRunCommand(0), want: runCommand(0)},
+		{r: plan, want: runCommand(0)},
+		{r: timedRunner{r: fakeRunCommand(0)}, want: timedRunner{r: runCommand(0)}},
+		{r: timedRunner{r: plan}, want: timedRunner{r: runCommand(0)}},
+		// Other runners (like the ones used in tests) are kept.
+		{r: rec, want: rec},
+		{r: timedRunner{r: rec}, want: timedRunner{r: rec}},
+	}
+	for _, tt := range casetests {
+		if got := extractionRunner(tt.r); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("extractionRunner(%#v): Got %#v, want %#v", tt.r, got, tt.want)
+		}
+	}
+}
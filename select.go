@@ -0,0 +1,278 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Track selection expressions select tracks based on their attributes. The
+// syntax is:
+//
+//	expr    := and ("||" and)*
+//	and     := unary ("&&" unary)*
+//	unary   := "!" unary | "(" expr ")" | field op value
+//	op      := "==" | "!=" | "~=" (contains) | "<" | "<=" | ">" | ">="
+//
+// Values can be bare words or double quoted strings. Comparisons are case
+// insensitive. The ordering operators compare integers and only apply to
+// numeric fields. Example: type==subtitles && (lang==eng || name~="english")
+
+// selectFields lists the valid fields in track selection expressions.
+var selectFields = map[string]bool{
+	"id":       true,
+	"type":     true,
+	"lang":     true,
+	"ietf":     true,
+	"name":     true,
+	"codec":    true,
+	"default":  true,
+	"forced":   true,
+	"channels": true,
+}
+
+// selectNumericFields lists the fields that can be used with the ordering
+// operators.
+var selectNumericFields = map[string]bool{
+	"id":       true,
+	"channels": true,
+}
+
+// trackMatcher returns true if the track attributes match an expression.
+type trackMatcher func(attrs map[string]string) bool
+
+// selectParser holds the state of the parser.
+type selectParser struct {
+	tokens []string
+	pos    int
+}
+
+// tokenizeSelect splits a selection expression into tokens.
+func tokenizeSelect(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(s[i:], "&&"), strings.HasPrefix(s[i:], "||"),
+			strings.HasPrefix(s[i:], "=="), strings.HasPrefix(s[i:], "!="), strings.HasPrefix(s[i:], "~="),
+			strings.HasPrefix(s[i:], "<="), strings.HasPrefix(s[i:], ">="):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case c == '!' || c == '<' || c == '>':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			// Keep the quotes so strings are never taken as operators.
+			tokens = append(tokens, s[i:i+end+2])
+			i += end + 2
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune("()&|!=~<>\"", rune(s[j])) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// parseSelect parses a selection expression and returns a matcher.
+func parseSelect(s string) (trackMatcher, error) {
+	tokens, err := tokenizeSelect(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	p := &selectParser{tokens: tokens}
+	m, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return m, nil
+}
+
+// peek returns the next token, or an empty string at the end of input.
+func (p *selectParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// next consumes and returns the next token.
+func (p *selectParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *selectParser) expr() (trackMatcher, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(attrs map[string]string) bool { return l(attrs) || right(attrs) }
+	}
+	return left, nil
+}
+
+func (p *selectParser) and() (trackMatcher, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(attrs map[string]string) bool { return l(attrs) && right(attrs) }
+	}
+	return left, nil
+}
+
+func (p *selectParser) unary() (trackMatcher, error) {
+	switch p.peek() {
+	case "!":
+		p.pos++
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(attrs map[string]string) bool { return !m(attrs) }, nil
+	case "(":
+		p.pos++
+		m, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return m, nil
+	}
+	return p.comparison()
+}
+
+func (p *selectParser) comparison() (trackMatcher, error) {
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	field = strings.ToLower(field)
+	if !selectFields[field] {
+		return nil, fmt.Errorf("unknown field %q", field)
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(value, "\"") {
+		value = strings.Trim(value, "\"")
+	} else if strings.ContainsAny(value, "()&|!=~<>") {
+		// Operators and parentheses are never valid values.
+		return nil, fmt.Errorf("invalid value %q for %q", value, field)
+	}
+
+	switch op {
+	case "==":
+		return func(attrs map[string]string) bool { return strings.EqualFold(attrs[field], value) }, nil
+	case "!=":
+		return func(attrs map[string]string) bool { return !strings.EqualFold(attrs[field], value) }, nil
+	case "~=":
+		return func(attrs map[string]string) bool {
+			return strings.Contains(strings.ToLower(attrs[field]), strings.ToLower(value))
+		}, nil
+	case "<", "<=", ">", ">=":
+		if !selectNumericFields[field] {
+			return nil, fmt.Errorf("operator %q needs a numeric field, not %q", op, field)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q for %q", value, field)
+		}
+		return func(attrs map[string]string) bool {
+			// Fields without a value (E.g. channels in video tracks) never match.
+			v, err := strconv.Atoi(attrs[field])
+			if err != nil {
+				return false
+			}
+			switch op {
+			case "<":
+				return v < n
+			case "<=":
+				return v <= n
+			case ">":
+				return v > n
+			}
+			return v >= n
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid operator %q after %q", op, field)
+}
+
+// selectTracksByExpr returns the IDs of the tracks matching the selection
+// expression.
+func selectTracksByExpr(mkv matroska, expr string) ([]int, error) {
+	m, err := parseSelect(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", expr, err)
+	}
+	var ret []int
+	for _, track := range mkv.Tracks {
+		attrs := map[string]string{
+			"id":      strconv.Itoa(track.ID),
+			"type":    track.Type,
+			"lang":    trackLanguage(track.Properties.Language, track.Properties.LanguageIetf),
+			"ietf":    track.Properties.LanguageIetf,
+			"name":    track.Properties.TrackName,
+			"codec":   track.Codec,
+			"default": strconv.FormatBool(track.Properties.DefaultTrack),
+			"forced":  strconv.FormatBool(track.Properties.ForcedTrack),
+		}
+		if track.Type == typeAudio {
+			attrs["channels"] = strconv.Itoa(track.Properties.AudioChannels)
+		}
+		if m(attrs) {
+			ret = append(ret, track.ID)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,69 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectTracksByExpr(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video", "codec": "AVC/H.264/MPEG-4p10"},
+		{"id": 1, "type": "audio", "properties": {"language": "jpn", "default_track": true, "audio_channels": 6}},
+		{"id": 2, "type": "audio", "properties": {"language": "eng", "audio_channels": 2}},
+		{"id": 3, "type": "subtitles", "properties": {"language": "eng", "track_name": "Full"}},
+		{"id": 4, "type": "subtitles", "properties": {"language": "eng", "track_name": "Signs & Songs", "forced_track": true}},
+		{"id": 5, "type": "subtitles", "properties": {"language": "por"}}]}`)
+
+	casetests := []struct {
+		expr      string
+		want      []int
+		wantError bool
+	}{
+		{expr: "type==subtitles && lang==eng", want: []int{3, 4}},
+		{expr: "type == audio || lang == por", want: []int{1, 2, 5}},
+		{expr: "type==subtitles && !(forced==true)", want: []int{3, 5}},
+		{expr: `name~="signs &"`, want: []int{4}},
+		{expr: "TYPE==Audio && default==true", want: []int{1}},
+		{expr: "lang!=eng && type!=video", want: []int{1, 5}},
+		{expr: "id==0 || id==5", want: []int{0, 5}},
+		{expr: "lang==fra", want: nil},
+		{expr: "channels<=2", want: []int{2}},
+		{expr: "channels>2 || type==video", want: []int{0, 1}},
+		{expr: "channels==6", want: []int{1}},
+		{expr: "id>=4", want: []int{4, 5}},
+		{expr: "!(channels<6)", want: []int{0, 1, 3, 4, 5}},
+		// Errors.
+		{expr: "", wantError: true},
+		{expr: "bad==1", wantError: true},
+		{expr: "type=subtitles", wantError: true},
+		{expr: "type==", wantError: true},
+		{expr: "type== && lang==eng", wantError: true},
+		{expr: "(type==audio", wantError: true},
+		{expr: "type==audio)", wantError: true},
+		{expr: `name=="unterminated`, wantError: true},
+		{expr: "lang<eng", wantError: true},
+		{expr: "channels<=two", wantError: true},
+		{expr: "channels=<2", wantError: true},
+	}
+
+	for _, tt := range casetests {
+		got, err := selectTracksByExpr(mkv, tt.expr)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("%q: Got error %q want no error", tt.expr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("%q: Got %v, want %v", tt.expr, got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("%q: Got no error, want error", tt.expr)
+		}
+	}
+}
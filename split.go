@@ -0,0 +1,124 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// rePartToken matches the part number token in split output masks, with an
+// optional printf style width (E.g. "%{part}" or "%02{part}").
+var rePartToken = regexp.MustCompile(`%(-?\d*){part}`)
+
+// splitOptions holds the options for splitFile.
+type splitOptions struct {
+	// Split every duration, or at every chapter if chapters is set.
+	duration time.Duration
+	chapters bool
+	// Output name mask, with scene tokens (see format) and %{part}.
+	mask  string
+	fopts formatOptions
+	// Output directory (default: same directory as the input file).
+	outdir string
+	dryrun bool
+}
+
+// expandPart replaces the part number tokens in mask with part.
+func expandPart(mask string, part int) string {
+	return rePartToken.ReplaceAllStringFunc(mask, func(match string) string {
+		spec := rePartToken.FindStringSubmatch(match)[1]
+		return fmt.Sprintf("%"+spec+"d", part)
+	})
+}
+
+// splitFile splits fname into multiple files using mkvmerge, and renames the
+// parts according to the output mask. mkvmerge only numbers the parts
+// sequentially, so the parts are created with temporary names and renamed
+// afterwards. Parts that can't be renamed are removed. Returns the names of
+// the parts.
+func splitFile(fname string, opts splitOptions, cmd runner) ([]string, error) {
+	if !rePartToken.MatchString(opts.mask) {
+		return nil, errors.New("output mask must contain %{part}")
+	}
+	if (opts.duration == 0) == !opts.chapters {
+		return nil, errors.New("need either a duration or chapters to split")
+	}
+	split := "chapters:all"
+	if opts.duration != 0 {
+		if opts.duration < time.Second {
+			return nil, fmt.Errorf("invalid split duration %v: must be at least one second", opts.duration)
+		}
+		split = "duration:" + timestamp(opts.duration)
+	}
+
+	dir, _ := filepath.Split(fname)
+	if opts.outdir != "" {
+		dir = opts.outdir
+	}
+	// Resolve the name of the first part before splitting, so problems with
+	// the mask are reported before the (possibly long) split operation.
+	first, err := format(expandPart(opts.mask, 1), fname, opts.fopts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The parts are created in a temporary directory inside the output
+	// directory (so they can be moved without copying), which is removed when
+	// done, on errors, or when interrupted.
+	tmpdir := filepath.Join(dir, fmt.Sprintf(".mkvtool-split-%d", os.Getpid()))
+	if !opts.dryrun {
+		if err := os.MkdirAll(tmpdir, 0755); err != nil {
+			return nil, err
+		}
+		registerTemp(tmpdir)
+		defer removeTemp(tmpdir)
+	}
+	if err := cmd.run("mkvmerge", "-o", filepath.Join(tmpdir, "%03d.mkv"), "--split", split, fname); err != nil {
+		return nil, err
+	}
+	if opts.dryrun {
+		log.Printf("Rename the parts to %s, etc.", filepath.Join(dir, first))
+		return nil, nil
+	}
+
+	parts, err := filepath.Glob(filepath.Join(tmpdir, "*.mkv"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(parts)
+
+	var (
+		created []string
+		errmsgs []string
+	)
+	for i, part := range parts {
+		name, err := format(expandPart(opts.mask, i+1), fname, opts.fopts)
+		if err == nil {
+			name = filepath.Join(dir, name)
+			if _, serr := os.Stat(name); serr == nil {
+				err = fmt.Errorf("destination %q already exists", name)
+			}
+		}
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(name), 0755)
+		}
+		if err == nil {
+			err = moveFile(part, name, false)
+		}
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("part %d: %v", i+1, err))
+			continue
+		}
+		created = append(created, name)
+	}
+	return created, errorFromSlice(errmsgs)
+}
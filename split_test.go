@@ -0,0 +1,117 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+func TestExpandPart(t *testing.T) {
+	casetests := []struct {
+		mask string
+		part int
+		want string
+	}{
+		{mask: "%{title} - Part %{part}.mkv", part: 1, want: "%{title} - Part 1.mkv"},
+		{mask: "%{title} - S%02{season}E%02{episode} - %02{part}.mkv", part: 3, want: "%{title} - S%02{season}E%02{episode} - 03.mkv"},
+		{mask: "%{title}.mkv", part: 1, want: "%{title}.mkv"},
+	}
+
+	for _, tt := range casetests {
+		if got := expandPart(tt.mask, tt.part); got != tt.want {
+			t.Errorf("expandPart(%q, %d): got %q, want %q", tt.mask, tt.part, got, tt.want)
+		}
+	}
+}
+
+func TestSplitFileOptions(t *testing.T) {
+	casetests := []struct {
+		opts splitOptions
+	}{
+		// No %{part} in the mask.
+		{opts: splitOptions{duration: time.Minute, mask: "%{title}.mkv"}},
+		// Duration or chapters required.
+		{opts: splitOptions{mask: "%{part}.mkv"}},
+		{opts: splitOptions{duration: time.Minute, chapters: true, mask: "%{part}.mkv"}},
+		{opts: splitOptions{duration: time.Millisecond, mask: "%{part}.mkv"}},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		if _, err := splitFile("movie.mkv", tt.opts, r); err == nil {
+			t.Errorf("%+v: Got no error, want error", tt.opts)
+		}
+		if len(r.cmds) != 0 {
+			t.Errorf("%+v: Got commands %q, want none", tt.opts, r.cmds)
+		}
+	}
+}
+
+// splitRunner simulates mkvmerge --split, creating the given number of parts
+// before returning err.
+type splitRunner struct {
+	parts int
+	err   error
+}
+
+func (x splitRunner) run(name string, args ...string) error {
+	for i := 1; i <= x.parts; i++ {
+		if err := ioutil.WriteFile(fmt.Sprintf(args[1], i), []byte("part"), 0o644); err != nil {
+			return err
+		}
+	}
+	return x.err
+}
+
+func TestSplitFileCleanup(t *testing.T) {
+	casetests := []struct {
+		r         splitRunner
+		existing  string
+		want      []string
+		wantError bool
+	}{
+		{r: splitRunner{parts: 2}, want: []string{"Movie - Part 1.mkv", "Movie - Part 2.mkv"}},
+		// mkvmerge failed after creating some parts.
+		{r: splitRunner{parts: 1, err: errors.New("failed")}, wantError: true},
+		// One of the parts can't be renamed.
+		{r: splitRunner{parts: 2}, existing: "Movie - Part 2.mkv", want: []string{"Movie - Part 1.mkv"}, wantError: true},
+	}
+
+	for _, tt := range casetests {
+		dir := t.TempDir()
+		if tt.existing != "" {
+			if err := ioutil.WriteFile(filepath.Join(dir, tt.existing), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		opts := splitOptions{chapters: true, mask: "%{title} - Part %{part}.mkv", fopts: formatOptions{titleLocale: language.English}, outdir: dir}
+		_, err := splitFile("Movie.2020.mkv", opts, tt.r)
+		if tt.wantError != (err != nil) {
+			t.Errorf("%+v: Got error %v, want error: %v", tt.r, err, tt.wantError)
+		}
+		// Only the renamed parts (and existing files) are left.
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			if e.Name() != tt.existing {
+				got = append(got, e.Name())
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: Got files %q, want %q", tt.r, got, tt.want)
+		}
+	}
+}
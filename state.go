@@ -0,0 +1,119 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stateFile records the input files processed successfully by a batch, one
+// "<command>\t<absolute path>" entry per line, so an interrupted batch can be
+// resumed skipping the files already done. Entries are keyed by command, so a
+// file processed by one command is not skipped by other commands using the
+// same state file (including commands that don't change files, and never
+// record anything). It is safe for concurrent use.
+type stateFile struct {
+	mu   sync.Mutex
+	path string
+	// Name of the command being run.
+	command string
+	done    map[string]bool
+	// Don't record anything (dry-run mode).
+	readOnly bool
+}
+
+// state tracks completed files when not nil (set by --state-file).
+var state *stateFile
+
+// loadStateFile reads the state file in path, for the given command. A
+// missing file is not an error (nothing has been processed yet).
+func loadStateFile(path, command string, readOnly bool) (*stateFile, error) {
+	s := &stateFile{path: path, command: command, done: map[string]bool{}, readOnly: readOnly}
+
+	r, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			s.done[line] = true
+		}
+	}
+	return s, scanner.Err()
+}
+
+// key returns the key used for fname in the state file.
+func (s *stateFile) key(fname string) string {
+	if abs, err := filepath.Abs(fname); err == nil {
+		fname = abs
+	}
+	return s.command + "\t" + fname
+}
+
+// isDone returns true if fname has been processed already.
+func (s *stateFile) isDone(fname string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done[s.key(fname)]
+}
+
+// pending returns the files in fnames not processed yet.
+func (s *stateFile) pending(fnames []string) []string {
+	if s == nil {
+		return fnames
+	}
+	var ret []string
+	for _, fname := range fnames {
+		if s.isDone(fname) {
+			debugf("%s: already processed (state file), skipping", fname)
+			continue
+		}
+		ret = append(ret, fname)
+	}
+	if skipped := len(fnames) - len(ret); skipped != 0 {
+		infof("Skipping %d file(s) already processed according to %s.", skipped, s.path)
+	}
+	return ret
+}
+
+// markDone records fname as processed. The state file is updated
+// immediately, so no work is lost if the program is interrupted. Failures to
+// write the state file are only logged, as they don't affect the files.
+func (s *stateFile) markDone(fname string) {
+	if s == nil || s.readOnly {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.key(fname)
+	if s.done[key] {
+		return
+	}
+	w, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err == nil {
+		_, err = w.WriteString(key + "\n")
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		warnf("Unable to update state file %s: %v", s.path, err)
+		return
+	}
+	s.done[key] = true
+}
@@ -0,0 +1,60 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+
+	s, err := loadStateFile(path, "striptags", false)
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	s.markDone("a.mkv")
+	s.markDone("c.mkv")
+	s.markDone("a.mkv")
+
+	// Resume from the saved state.
+	s, err = loadStateFile(path, "striptags", false)
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	got := s.pending([]string{"a.mkv", "b.mkv", "c.mkv", "d.mkv"})
+	want := []string{"b.mkv", "d.mkv"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pending: got %q, want %q", got, want)
+	}
+
+	// Read-only (dry-run) state files are not updated.
+	ro, err := loadStateFile(path, "striptags", true)
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	ro.markDone("b.mkv")
+	if s, _ = loadStateFile(path, "striptags", false); s.isDone("b.mkv") {
+		t.Errorf("read-only state file was updated")
+	}
+
+	// Other commands don't skip the files.
+	other, err := loadStateFile(path, "remux", false)
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	all := []string{"a.mkv", "b.mkv", "c.mkv"}
+	if got := other.pending(all); !reflect.DeepEqual(got, all) {
+		t.Errorf("pending (other command): got %q, want %q", got, all)
+	}
+
+	// A nil state file processes everything.
+	var none *stateFile
+	if got := none.pending(want); !reflect.DeepEqual(got, want) {
+		t.Errorf("nil pending: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,631 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Text subtitle formats.
+const (
+	subFormatSRT = "srt"
+	subFormatASS = "ass"
+	// Keep the format of each track (extract-subs only).
+	subFormatNative = "native"
+)
+
+// subCue holds a single subtitle event. Lines in the text are separated by
+// newlines and styling has already been converted to SRT (HTML-like) tags.
+type subCue struct {
+	start time.Duration
+	end   time.Duration
+	text  string
+}
+
+var (
+	// ASS override blocks, like {\i1} or {\pos(10,10)}.
+	reASSOverride = regexp.MustCompile(`\{[^}]*\}`)
+	// HTML style tags, as used in SRT files.
+	reHTMLTag = regexp.MustCompile(`<[^>]+>`)
+	// Blank lines separating SRT blocks.
+	reBlankLines = regexp.MustCompile(`\n\s*\n`)
+)
+
+// subFormatFromCodecID returns the subtitle format for a Matroska codec ID,
+// or an empty string if the codec is not a supported text subtitle.
+func subFormatFromCodecID(codecID string) string {
+	switch codecID {
+	case "S_TEXT/UTF8":
+		return subFormatSRT
+	case "S_TEXT/ASS", "S_TEXT/SSA":
+		return subFormatASS
+	}
+	return ""
+}
+
+// isTextSubFile returns true if the file extension belongs to an external
+// text subtitle format accepted by mkvmerge.
+func isTextSubFile(fname string) bool {
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".srt", ".ass", ".ssa":
+		return true
+	}
+	return false
+}
+
+// charsetFromBOM returns the character set indicated by the byte order mark
+// at the start of r (as understood by mkvmerge's --sub-charset), or an empty
+// string if there's no BOM.
+func charsetFromBOM(r io.Reader) string {
+	buf := make([]byte, 3)
+	n, _ := io.ReadFull(r, buf)
+	buf = buf[:n]
+
+	switch {
+	case len(buf) >= 3 && buf[0] == 0xef && buf[1] == 0xbb && buf[2] == 0xbf:
+		return "UTF-8"
+	case len(buf) >= 2 && buf[0] == 0xff && buf[1] == 0xfe:
+		return "UTF-16LE"
+	case len(buf) >= 2 && buf[0] == 0xfe && buf[1] == 0xff:
+		return "UTF-16BE"
+	}
+	return ""
+}
+
+// subCharset returns the character set of an external subtitle file,
+// detected from its byte order mark. Returns an empty string if the
+// character set cannot be detected.
+func subCharset(fname string) (string, error) {
+	r, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return charsetFromBOM(r), nil
+}
+
+// parseSubTime parses a subtitle timestamp in the H:MM:SS,mmm (SRT) or
+// H:MM:SS.cc (ASS) formats.
+func parseSubTime(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+
+	hms, frac := s, ""
+	if i := strings.IndexAny(s, ".,"); i >= 0 {
+		hms, frac = s[:i], s[i+1:]
+	}
+	parts := strings.Split(hms, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		d += time.Duration(n) * unit
+	}
+	// The fractional part may have any number of digits (centiseconds in
+	// ASS, milliseconds in SRT).
+	for i, ms := 0, 100; i < len(frac) && ms > 0; i, ms = i+1, ms/10 {
+		if frac[i] < '0' || frac[i] > '9' {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		d += time.Duration(int(frac[i]-'0')*ms) * time.Millisecond
+	}
+	return d, nil
+}
+
+// parseSRT reads a SubRip (SRT) subtitle file.
+func parseSRT(r io.Reader) ([]subCue, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	var cues []subCue
+
+	for _, block := range reBlankLines.Split(strings.TrimSpace(text), -1) {
+		lines := strings.Split(block, "\n")
+		// Skip the (optional) sequence number.
+		if len(lines) > 0 && !strings.Contains(lines[0], "-->") {
+			lines = lines[1:]
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		times := strings.SplitN(lines[0], "-->", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid SRT timing line %q", lines[0])
+		}
+		start, err := parseSubTime(times[0])
+		if err != nil {
+			return nil, err
+		}
+		// Strip optional coordinates after the end time.
+		end, err := parseSubTime(strings.Fields(times[1] + " ")[0])
+		if err != nil {
+			return nil, err
+		}
+		cues = append(cues, subCue{start: start, end: end, text: strings.Join(lines[1:], "\n")})
+	}
+	return cues, nil
+}
+
+// parseASS reads a (Advanced) SubStation Alpha subtitle file. Only the events
+// are read. Override tags are removed, except for italics, bold, and
+// underline, which are converted to the equivalent SRT tags.
+func parseASS(r io.Reader) ([]subCue, error) {
+	var (
+		cues    []subCue
+		section string
+		fields  []string
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(line)
+			continue
+		}
+		if section != "[events]" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "Format:"):
+			fields = nil
+			for _, f := range strings.Split(strings.TrimPrefix(line, "Format:"), ",") {
+				fields = append(fields, strings.ToLower(strings.TrimSpace(f)))
+			}
+		case strings.HasPrefix(line, "Dialogue:"):
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("ASS dialogue line before format line: %q", line)
+			}
+			// The text is always the last field and may contain commas.
+			values := strings.SplitN(strings.TrimPrefix(line, "Dialogue:"), ",", len(fields))
+			if len(values) != len(fields) {
+				return nil, fmt.Errorf("invalid ASS dialogue line %q", line)
+			}
+			var cue subCue
+			for i, f := range fields {
+				var err error
+				v := strings.TrimSpace(values[i])
+				switch f {
+				case "start":
+					cue.start, err = parseSubTime(v)
+				case "end":
+					cue.end, err = parseSubTime(v)
+				case "text":
+					cue.text = assToSRTText(values[i])
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			cues = append(cues, cue)
+		}
+	}
+	return cues, scanner.Err()
+}
+
+// assToSRTText converts an ASS event text into SRT text.
+func assToSRTText(s string) string {
+	for _, r := range []struct{ from, to string }{
+		{`{\i1}`, "<i>"}, {`{\i0}`, "</i>"},
+		{`{\b1}`, "<b>"}, {`{\b0}`, "</b>"},
+		{`{\u1}`, "<u>"}, {`{\u0}`, "</u>"},
+	} {
+		s = strings.ReplaceAll(s, r.from, r.to)
+	}
+	s = reASSOverride.ReplaceAllString(s, "")
+	s = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(s)
+	return strings.TrimSpace(s)
+}
+
+// srtToASSText converts SRT text into ASS event text.
+func srtToASSText(s string) string {
+	for _, r := range []struct{ from, to string }{
+		{"<i>", `{\i1}`}, {"</i>", `{\i0}`},
+		{"<b>", `{\b1}`}, {"</b>", `{\b0}`},
+		{"<u>", `{\u1}`}, {"</u>", `{\u0}`},
+	} {
+		s = strings.ReplaceAll(s, r.from, r.to)
+	}
+	s = reHTMLTag.ReplaceAllString(s, "")
+	return strings.ReplaceAll(s, "\n", `\N`)
+}
+
+// writeSRT writes the cues in SubRip format. Styling tags are removed, since
+// many devices cannot render them.
+func writeSRT(w io.Writer, cues []subCue) error {
+	srtTime := func(d time.Duration) string {
+		return strings.Replace(timestamp(d), ".", ",", 1)
+	}
+	for i, cue := range cues {
+		text := reHTMLTag.ReplaceAllString(cue.text, "")
+		if _, err := fmt.Fprintf(w, "%d\n%s --> %s\n%s\n\n", i+1, srtTime(cue.start), srtTime(cue.end), text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeASS writes the cues in Advanced SubStation Alpha format, using a
+// single default style.
+func writeASS(w io.Writer, cues []subCue) error {
+	assTime := func(d time.Duration) string {
+		cs := d.Milliseconds() / 10
+		return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+	}
+
+	header := `[Script Info]
+ScriptType: v4.00+
+WrapStyle: 0
+ScaledBorderAndShadow: yes
+
+[V4+ Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding
+Style: Default,Arial,20,&H00FFFFFF,&H000000FF,&H00000000,&H00000000,0,0,0,0,100,100,0,0,1,2,2,2,10,10,10,1
+
+[Events]
+Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+`
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	for _, cue := range cues {
+		if _, err := fmt.Fprintf(w, "Dialogue: 0,%s,%s,Default,,0,0,0,,%s\n", assTime(cue.start), assTime(cue.end), srtToASSText(cue.text)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertSubtitles reads subtitles in the "from" format and writes them in
+// the "to" format.
+func convertSubtitles(r io.Reader, from string, w io.Writer, to string) error {
+	var (
+		cues []subCue
+		err  error
+	)
+
+	switch from {
+	case subFormatSRT:
+		cues, err = parseSRT(r)
+	case subFormatASS:
+		cues, err = parseASS(r)
+	default:
+		err = fmt.Errorf("unsupported input subtitle format %q", from)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch to {
+	case subFormatSRT:
+		return writeSRT(w, cues)
+	case subFormatASS:
+		return writeASS(w, cues)
+	}
+	return fmt.Errorf("unsupported output subtitle format %q", to)
+}
+
+// nfcWriteCloser normalizes the text written to it to Unicode NFC. Closing it
+// flushes the normalizer and closes the underlying file.
+type nfcWriteCloser struct {
+	io.WriteCloser
+	f io.Closer
+}
+
+// Close flushes the normalizer and closes the underlying file.
+func (w nfcWriteCloser) Close() error {
+	err := w.WriteCloser.Close()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// subconvert extracts a text subtitle track from the file and converts it to
+// the "to" format, saving the result in outfile. If mux is set, outfile will
+// contain a copy of the input file with the converted subtitle track added.
+// If nfc is set, the text is also normalized to Unicode NFC (composed
+// characters), and the track may be "converted" to its own format, in which
+// case the text is copied without any other changes.
+func subconvert(mkv matroska, tracknum int, to, outfile string, mux, dryrun, nfc bool, cmd runner) error {
+	from := ""
+	name := ""
+	for _, track := range mkv.Tracks {
+		if track.ID == tracknum {
+			if track.Type != typeSubtitle {
+				return fmt.Errorf("track %d is not a subtitle track", tracknum)
+			}
+			from = subFormatFromCodecID(track.Properties.CodecID)
+			if imageSubCodecs[track.Properties.CodecID] {
+				return fmt.Errorf("track %d is an image subtitle (codec: %s) and cannot be converted", tracknum, track.Codec)
+			}
+			if from == "" {
+				return fmt.Errorf("track %d is not a SRT or ASS subtitle (codec: %s)", tracknum, track.Codec)
+			}
+			name = track.Properties.TrackName
+			break
+		}
+	}
+	// extract will complain about a non-existing track.
+	if from == to && !nfc {
+		return fmt.Errorf("track %d is already in %s format", tracknum, to)
+	}
+
+	tfi, err := extract(mkv, tracknum, cmd)
+	defer removeTemp(tfi.fname)
+	if err != nil {
+		return err
+	}
+
+	if dryrun {
+		log.Printf("Convert track %d from %s to %s", tracknum, from, to)
+		if nfc {
+			log.Printf("Normalize track %d to Unicode NFC", tracknum)
+		}
+		if !mux {
+			return nil
+		}
+	}
+
+	in, err := os.Open(tfi.fname)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createTemp()
+	if err != nil {
+		return err
+	}
+	defer removeTemp(out.Name())
+
+	var w io.WriteCloser = out
+	if nfc {
+		// The normalizing writer must be closed to flush the remaining text.
+		w = nfcWriteCloser{norm.NFC.Writer(out), out}
+	}
+	// Same format (normalization only): copy the text unchanged, as
+	// converting would lose anything not supported by the converters (E.g.
+	// ASS styles).
+	if from == to {
+		_, err = io.Copy(w, in)
+	} else {
+		err = convertSubtitles(in, from, w, to)
+	}
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if mux {
+		return submux(mkv.FileName, outfile, false, cmd, trackFileInfo{language: tfi.language, name: name, fname: out.Name()})
+	}
+	data, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outfile, data, 0o644)
+}
+
+// imageSubExtensions maps image based subtitle codec IDs to the file
+// extensions used when extracting them.
+var imageSubExtensions = map[string]string{
+	"S_HDMV/PGS": ".sup",
+	"S_VOBSUB":   ".idx",
+}
+
+// extractSubsOptions holds the options for extractSubs.
+type extractSubsOptions struct {
+	// Output format (srt, ass, or native).
+	format string
+	// Output directory (default: same directory as the input file).
+	outdir string
+	// Name the output files "<input>.<lang>.<format>", as expected by players
+	// for sidecar subtitles.
+	sidecar bool
+	// Command template used to OCR image subtitles. The strings {input},
+	// {output}, and {lang} are replaced by the extracted image subtitle file,
+	// the output SRT file, and the track language.
+	ocrCommand string
+	// Fail on subtitle tracks that cannot be extracted into a usable file
+	// (unsupported codecs, or image subtitles without OCR) instead of
+	// skipping them with a warning.
+	strictCodec bool
+	dryrun      bool
+}
+
+// ocrCmdline returns the OCR command line from the template.
+func ocrCmdline(template, input, output, lang string) []string {
+	r := strings.NewReplacer("{input}", input, "{output}", output, "{lang}", lang)
+	var ret []string
+	for _, f := range strings.Fields(template) {
+		ret = append(ret, r.Replace(f))
+	}
+	return ret
+}
+
+// extractSubs extracts all subtitle tracks in the file into separate files
+// named "<input>.<track>.<lang>.<format>" (or "<input>.<lang>.<format>" in
+// sidecar mode, adding the track number only to repeated names). Text
+// subtitles are converted to the output format as needed, unless the format is
+// native. Image subtitles are converted to SRT using an
+// external OCR command, with ".ocr" added to the output name to indicate that
+// the output needs review. Image subtitles are skipped with a warning if no
+// OCR command is configured. Returns the list of files created.
+func extractSubs(mkv matroska, opts extractSubsOptions, cmd runner) ([]string, error) {
+	dir, base := filepath.Split(mkv.FileName)
+	if opts.outdir != "" {
+		dir = opts.outdir
+	}
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	var (
+		created []string
+		errmsgs []string
+	)
+	// Names already used in sidecar mode.
+	used := map[string]bool{}
+
+	// skip reports a track that cannot be extracted, as an error in strict
+	// mode or a warning otherwise.
+	skip := func(tracknum int, codec, reason string) {
+		if opts.strictCodec {
+			errmsgs = append(errmsgs, fmt.Sprintf("track %d (%s): %s", tracknum, codec, reason))
+			return
+		}
+		warnf("%s: Skipping subtitle track %d (%s): %s.", mkv.FileName, tracknum, codec, reason)
+	}
+
+	for _, track := range mkv.Tracks {
+		if track.Type != typeSubtitle {
+			continue
+		}
+		lang := track.Properties.Language
+		if lang == "" {
+			lang = "und"
+		}
+		codecID := track.Properties.CodecID
+
+		// Determine the format (and extension) of the output first, so
+		// sidecar names are only considered repeated when the whole name
+		// (including the extension) is the same.
+		var from, to, suffix string
+		imageExt, image := imageSubExtensions[codecID]
+		if image {
+			if opts.ocrCommand == "" {
+				skip(track.ID, track.Codec, "image subtitle and no OCR command configured")
+				continue
+			}
+			if opts.format != subFormatSRT && opts.format != subFormatNative {
+				errmsgs = append(errmsgs, fmt.Sprintf("track %d: OCR only produces %s output", track.ID, subFormatSRT))
+				continue
+			}
+			suffix = ".ocr.srt"
+		} else {
+			from = subFormatFromCodecID(codecID)
+			if from == "" {
+				skip(track.ID, track.Codec, "unsupported subtitle codec")
+				continue
+			}
+			to = opts.format
+			if to == subFormatNative {
+				to = from
+			}
+			suffix = "." + to
+		}
+
+		outname := filepath.Join(dir, fmt.Sprintf("%s.%d.%s", base, track.ID, lang)) + suffix
+		if opts.sidecar {
+			outname = filepath.Join(dir, fmt.Sprintf("%s.%s", base, lang)) + suffix
+			if used[outname] {
+				outname = filepath.Join(dir, fmt.Sprintf("%s.%s.%d", base, lang, track.ID)) + suffix
+			}
+			used[outname] = true
+		}
+
+		// Image subtitles.
+		if image {
+			if err := ocrTrack(mkv, track.ID, imageExt, outname, opts, lang, cmd); err != nil {
+				errmsgs = append(errmsgs, fmt.Sprintf("track %d: %v", track.ID, err))
+				continue
+			}
+			infof("%s was created using OCR and needs review.", outname)
+			created = append(created, outname)
+			continue
+		}
+
+		// Same format: extract directly into the output file.
+		if from == to {
+			if err := cmd.run("mkvextract", mkv.FileName, "tracks", fmt.Sprintf("%d:%s", track.ID, outname)); err != nil {
+				errmsgs = append(errmsgs, fmt.Sprintf("track %d: %v", track.ID, err))
+				continue
+			}
+			created = append(created, outname)
+			continue
+		}
+
+		tfi, err := extract(mkv, track.ID, cmd)
+		if err == nil {
+			err = convertSubFile(tfi.fname, from, outname, to, opts.dryrun)
+		}
+		removeTemp(tfi.fname)
+		if err != nil {
+			errmsgs = append(errmsgs, fmt.Sprintf("track %d: %v", track.ID, err))
+			continue
+		}
+		created = append(created, outname)
+	}
+	return created, errorFromSlice(errmsgs)
+}
+
+// convertSubFile converts the subtitle file infile into outfile. In dry-run
+// mode, only logs the operation.
+func convertSubFile(infile, from, outfile, to string, dryrun bool) error {
+	if dryrun {
+		log.Printf("Convert %s subtitles to %s: %s", from, to, outfile)
+		return nil
+	}
+	in, err := os.Open(infile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+	if err := convertSubtitles(in, from, out, to); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// ocrTrack extracts an image subtitle track into a temporary file (with the
+// given extension) and runs the OCR command to produce outfile.
+func ocrTrack(mkv matroska, tracknum int, ext, outfile string, opts extractSubsOptions, lang string, cmd runner) error {
+	tmpdir, err := createTempDir()
+	if err != nil {
+		return err
+	}
+	defer removeTemp(tmpdir)
+
+	image := filepath.Join(tmpdir, fmt.Sprintf("track%d%s", tracknum, ext))
+	if err := cmd.run("mkvextract", mkv.FileName, "tracks", fmt.Sprintf("%d:%s", tracknum, image)); err != nil {
+		return err
+	}
+	ocr := ocrCmdline(opts.ocrCommand, image, outfile, lang)
+	if len(ocr) == 0 {
+		return errors.New("empty OCR command")
+	}
+	return cmd.run(ocr[0], ocr[1:]...)
+}
@@ -0,0 +1,262 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestConvertSubtitles(t *testing.T) {
+	casetests := []struct {
+		input     string
+		from      string
+		to        string
+		want      string
+		wantError bool
+	}{
+		// SRT to ASS, with styling.
+		{
+			input: "1\r\n00:00:01,500 --> 00:00:03,000\r\n<i>Hello</i>\r\nthere\r\n\r\n" +
+				"2\r\n00:01:02,010 --> 01:00:03,000\r\n<font color=\"red\">World</font>\r\n",
+			from: subFormatSRT,
+			to:   subFormatASS,
+			want: "Dialogue: 0,0:00:01.50,0:00:03.00,Default,,0,0,0,,{\\i1}Hello{\\i0}\\Nthere\n" +
+				"Dialogue: 0,0:01:02.01,1:00:03.00,Default,,0,0,0,,World\n",
+		},
+		// ASS to SRT strips override tags.
+		{
+			input: "[Script Info]\nTitle: Test\n\n[Events]\n" +
+				"Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+				"Dialogue: 0,0:00:01.50,0:00:03.00,Default,,0,0,0,,{\\pos(10,10)}{\\i1}Hello,{\\i0}\\Nthere\n",
+			from: subFormatASS,
+			to:   subFormatSRT,
+			want: "1\n00:00:01,500 --> 00:00:03,000\nHello,\nthere\n\n",
+		},
+		// Invalid timestamp.
+		{
+			input:     "1\n00:00:xx,500 --> 00:00:03,000\nHello\n",
+			from:      subFormatSRT,
+			to:        subFormatASS,
+			wantError: true,
+		},
+	}
+
+	for _, tt := range casetests {
+		var out bytes.Buffer
+		err := convertSubtitles(strings.NewReader(tt.input), tt.from, &out, tt.to)
+		if !tt.wantError {
+			if err != nil {
+				t.Fatalf("Got error %q want no error", err)
+			}
+			got := out.String()
+			// Ignore the ASS header.
+			if i := strings.Index(got, "Dialogue:"); tt.to == subFormatASS && i >= 0 {
+				got = got[i:]
+			}
+			if got != tt.want {
+				t.Fatalf("conversion diff: Got %q, want %q", got, tt.want)
+			}
+			continue
+		}
+		// Here, we want to see an error.
+		if err == nil {
+			t.Errorf("Got no error, want error")
+		}
+	}
+}
+
+func TestCharsetFromBOM(t *testing.T) {
+	casetests := []struct {
+		input string
+		want  string
+	}{
+		{input: "\xef\xbb\xbf1\n00:00:01,000", want: "UTF-8"},
+		{input: "\xff\xfe1\x00", want: "UTF-16LE"},
+		{input: "\xfe\xff\x001", want: "UTF-16BE"},
+		// No BOM.
+		{input: "1\n00:00:01,000", want: ""},
+		{input: "\xef", want: ""},
+		{input: "", want: ""},
+	}
+
+	for _, tt := range casetests {
+		got := charsetFromBOM(strings.NewReader(tt.input))
+		if got != tt.want {
+			t.Errorf("charsetFromBOM(%q): got %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestExtractSubs(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "/videos/movie.mkv", "tracks": [
+		{"id": 0, "type": "video"},
+		{"id": 1, "type": "subtitles", "codec": "SubRip/SRT", "properties": {"codec_id": "S_TEXT/UTF8", "language": "eng"}},
+		{"id": 2, "type": "subtitles", "codec": "SubStationAlpha", "properties": {"codec_id": "S_TEXT/ASS", "language": "eng"}},
+		{"id": 3, "type": "subtitles", "codec": "SubRip/SRT", "properties": {"codec_id": "S_TEXT/UTF8"}},
+		{"id": 4, "type": "subtitles", "codec": "HDMV PGS", "properties": {"codec_id": "S_HDMV/PGS", "language": "eng"}}]}`)
+
+	casetests := []struct {
+		opts      extractSubsOptions
+		want      []string
+		wantCmds  [][]string
+		wantError bool
+	}{
+		{
+			opts: extractSubsOptions{format: subFormatNative, sidecar: true},
+			want: []string{"/videos/movie.eng.srt", "/videos/movie.eng.ass", "/videos/movie.und.srt"},
+			wantCmds: [][]string{
+				{"mkvextract", "/videos/movie.mkv", "tracks", "1:/videos/movie.eng.srt"},
+				{"mkvextract", "/videos/movie.mkv", "tracks", "2:/videos/movie.eng.ass"},
+				{"mkvextract", "/videos/movie.mkv", "tracks", "3:/videos/movie.und.srt"},
+			},
+		},
+		// Same name (including the extension): the track number is added.
+		// Commands are not checked, as converted tracks are extracted into
+		// temporary files.
+		{
+			opts: extractSubsOptions{format: subFormatSRT, sidecar: true, dryrun: true},
+			want: []string{"/videos/movie.eng.srt", "/videos/movie.eng.2.srt", "/videos/movie.und.srt"},
+		},
+		{
+			opts: extractSubsOptions{format: subFormatNative, outdir: "/out"},
+			want: []string{"/out/movie.1.eng.srt", "/out/movie.2.eng.ass", "/out/movie.3.und.srt"},
+			wantCmds: [][]string{
+				{"mkvextract", "/videos/movie.mkv", "tracks", "1:/out/movie.1.eng.srt"},
+				{"mkvextract", "/videos/movie.mkv", "tracks", "2:/out/movie.2.eng.ass"},
+				{"mkvextract", "/videos/movie.mkv", "tracks", "3:/out/movie.3.und.srt"},
+			},
+		},
+		// Image subtitles without OCR are an error in strict mode. The other
+		// tracks are still extracted.
+		{
+			opts: extractSubsOptions{format: subFormatNative, strictCodec: true},
+			want: []string{"/videos/movie.1.eng.srt", "/videos/movie.2.eng.ass", "/videos/movie.3.und.srt"},
+			wantCmds: [][]string{
+				{"mkvextract", "/videos/movie.mkv", "tracks", "1:/videos/movie.1.eng.srt"},
+				{"mkvextract", "/videos/movie.mkv", "tracks", "2:/videos/movie.2.eng.ass"},
+				{"mkvextract", "/videos/movie.mkv", "tracks", "3:/videos/movie.3.und.srt"},
+			},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		got, err := extractSubs(mkv, tt.opts, r)
+		if tt.wantError != (err != nil) {
+			t.Fatalf("Got error %v, want error: %v", err, tt.wantError)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("files: got %q, want %q", got, tt.want)
+		}
+		if tt.wantCmds != nil && !reflect.DeepEqual(r.cmds, tt.wantCmds) {
+			t.Errorf("commands: got %q, want %q", r.cmds, tt.wantCmds)
+		}
+	}
+}
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestNFCWriteCloser(t *testing.T) {
+	var out bytes.Buffer
+	f := &closeRecorder{}
+	w := nfcWriteCloser{norm.NFC.Writer(&out), f}
+
+	// Accents as combining characters.
+	input := "1\n00:00:01,000 --> 00:00:02,000\nNa\u0303o e\u0301\n\n"
+	if err := convertSubtitles(strings.NewReader(input), subFormatSRT, w, subFormatSRT); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	want := "1\n00:00:01,000 --> 00:00:02,000\nN\u00e3o \u00e9\n\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !f.closed {
+		t.Errorf("underlying file not closed")
+	}
+}
+
+func TestSubconvertNFCSameFormat(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+		{"id": 0, "type": "video", "properties": {}},
+		{"id": 1, "type": "subtitles", "codec": "SubStationAlpha", "properties": {"codec_id": "S_TEXT/ASS"}}]}`)
+
+	// Styles and other sections must be kept.
+	input := "[Script Info]\nTitle: Test\nScriptType: v4.00+\n\n" +
+		"[V4+ Styles]\nFormat: Name, Fontname, Fontsize\nStyle: Sign,Georgia,30\n\n" +
+		"[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+		"Dialogue: 0,0:00:01.00,0:00:02.00,Sign,,0,0,0,,{\\pos(10,10)}Na\u0303o\n"
+	want := strings.ReplaceAll(input, "Na\u0303o", "N\u00e3o")
+
+	outfile := filepath.Join(t.TempDir(), "out.ass")
+	r := extractRunner{"a.mkv:1": input}
+	if err := subconvert(mkv, 1, subFormatASS, outfile, false, false, true, r); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	data, err := ioutil.ReadFile(outfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOCRTrack(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"file_name": "a.mkv", "tracks": [
+		{"id": 0, "type": "subtitles", "properties": {"codec_id": "S_HDMV/PGS"}}]}`)
+
+	casetests := []struct {
+		template  string
+		want      []string
+		wantError bool
+	}{
+		{
+			template: "ocr -l {lang} {input} {output}",
+			want:     []string{"ocr", "-l", "eng", "", "out.srt"},
+		},
+		// Blank templates.
+		{template: "", wantError: true},
+		{template: " \t ", wantError: true},
+	}
+
+	for _, tt := range casetests {
+		r := &recordRunner{}
+		err := ocrTrack(mkv, 0, ".sup", "out.srt", extractSubsOptions{ocrCommand: tt.template}, "eng", r)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("template %q: got no error, want error", tt.template)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("template %q: got error %q, want no error", tt.template, err)
+		}
+		// The input is a temporary file (the mkvextract output).
+		got := r.cmds[len(r.cmds)-1]
+		tt.want[3] = got[3]
+		if !reflect.DeepEqual(got, tt.want) || !strings.HasSuffix(got[3], "track0.sup") {
+			t.Errorf("template %q: got %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
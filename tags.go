@@ -0,0 +1,104 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+)
+
+// tagEntry describes a tag, for display.
+type tagEntry struct {
+	// What the tag applies to (E.g. "Global" or "Track 1").
+	target string
+	// Tag name. Nested tags are shown as "PARENT/CHILD".
+	name  string
+	value string
+}
+
+// xmlSimpleTag holds a (possibly nested) simple tag in the Matroska tags XML.
+type xmlSimpleTag struct {
+	Name   string         `xml:"Name"`
+	String string         `xml:"String"`
+	Binary string         `xml:"Binary"`
+	Simple []xmlSimpleTag `xml:"Simple"`
+}
+
+// tagTarget returns the description of a tag target. Track UIDs are
+// converted to track numbers (base 0) when the track exists in the file.
+func tagTarget(mkv matroska, targetType string, trackUIDs []uint64) string {
+	if len(trackUIDs) == 0 {
+		if targetType != "" {
+			return fmt.Sprintf("Global (%s)", targetType)
+		}
+		return "Global"
+	}
+	ret := ""
+	for i, uid := range trackUIDs {
+		if i != 0 {
+			ret += ", "
+		}
+		s := fmt.Sprintf("Track UID %d", uid)
+		for _, track := range mkv.Tracks {
+			if track.Properties.UID == uid {
+				s = fmt.Sprintf("Track %d", track.ID)
+				break
+			}
+		}
+		ret += s
+	}
+	return ret
+}
+
+// parseTags returns the tags in the Matroska tags XML in r, in order.
+func parseTags(r io.Reader, mkv matroska) ([]tagEntry, error) {
+	var doc struct {
+		Tags []struct {
+			Targets struct {
+				TargetType string   `xml:"TargetType"`
+				TrackUIDs  []uint64 `xml:"TrackUID"`
+			} `xml:"Targets"`
+			Simple []xmlSimpleTag `xml:"Simple"`
+		} `xml:"Tag"`
+	}
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var ret []tagEntry
+	var walk func(target, prefix string, tags []xmlSimpleTag)
+	walk = func(target, prefix string, tags []xmlSimpleTag) {
+		for _, t := range tags {
+			value := t.String
+			if value == "" && t.Binary != "" {
+				value = "(binary)"
+			}
+			ret = append(ret, tagEntry{target: target, name: prefix + t.Name, value: value})
+			walk(target, prefix+t.Name+"/", t.Simple)
+		}
+	}
+	for _, tag := range doc.Tags {
+		walk(tagTarget(mkv, tag.Targets.TargetType, tag.Targets.TrackUIDs), "", tag.Simple)
+	}
+	return ret, nil
+}
+
+// readTags extracts and returns the tags in the file.
+func readTags(mkv matroska, cmd runner) ([]tagEntry, error) {
+	fname, err := extractTemp(mkv, "tags", cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(fname)
+
+	r, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return parseTags(r, mkv)
+}
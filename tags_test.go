@@ -0,0 +1,71 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	mkv := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video", "properties": {"uid": 100}},
+		{"id": 1, "type": "audio", "properties": {"uid": 200}}]}`)
+
+	input := `<?xml version="1.0"?>
+<!DOCTYPE Tags SYSTEM "matroskatags.dtd">
+<Tags>
+  <Tag>
+    <Targets>
+      <TargetTypeValue>50</TargetTypeValue>
+      <TargetType>MOVIE</TargetType>
+    </Targets>
+    <Simple>
+      <Name>TITLE</Name>
+      <String>Movie</String>
+      <Simple>
+        <Name>SORT_WITH</Name>
+        <String>Movie, The</String>
+      </Simple>
+    </Simple>
+    <Simple>
+      <Name>COVER</Name>
+      <Binary>AAEC</Binary>
+    </Simple>
+  </Tag>
+  <Tag>
+    <Targets>
+      <TrackUID>200</TrackUID>
+      <TrackUID>999</TrackUID>
+    </Targets>
+    <Simple>
+      <Name>BPS</Name>
+      <String>640000</String>
+    </Simple>
+  </Tag>
+  <Tag>
+    <Simple>
+      <Name>ENCODER</Name>
+      <String>x</String>
+    </Simple>
+  </Tag>
+</Tags>
+`
+	want := []tagEntry{
+		{target: "Global (MOVIE)", name: "TITLE", value: "Movie"},
+		{target: "Global (MOVIE)", name: "TITLE/SORT_WITH", value: "Movie, The"},
+		{target: "Global (MOVIE)", name: "COVER", value: "(binary)"},
+		{target: "Track 1, Track UID 999", name: "BPS", value: "640000"},
+		{target: "Global", name: "ENCODER", value: "x"},
+	}
+	got, err := parseTags(strings.NewReader(input), mkv)
+	if err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
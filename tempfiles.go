@@ -0,0 +1,82 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// tempRegistry keeps track of the temporary files and directories created by
+// the program, so they can be removed if the program is interrupted.
+var tempRegistry = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// createTemp creates and registers a new temporary file.
+func createTemp() (*os.File, error) {
+	f, err := ioutil.TempFile("", "mkvtool")
+	if err != nil {
+		return nil, err
+	}
+	registerTemp(f.Name())
+	return f, nil
+}
+
+// createTempDir creates and registers a new temporary directory.
+func createTempDir() (string, error) {
+	dir, err := ioutil.TempDir("", "mkvtool")
+	if err != nil {
+		return "", err
+	}
+	registerTemp(dir)
+	return dir, nil
+}
+
+func registerTemp(path string) {
+	tempRegistry.Lock()
+	defer tempRegistry.Unlock()
+	tempRegistry.paths[path] = true
+}
+
+// removeTemp removes a temporary file or directory (recursively) and removes
+// it from the registry.
+func removeTemp(path string) error {
+	tempRegistry.Lock()
+	defer tempRegistry.Unlock()
+	delete(tempRegistry.paths, path)
+	return os.RemoveAll(path)
+}
+
+// cleanupTemp removes all registered temporary files and directories.
+func cleanupTemp() {
+	tempRegistry.Lock()
+	defer tempRegistry.Unlock()
+	for path := range tempRegistry.paths {
+		os.RemoveAll(path)
+		delete(tempRegistry.paths, path)
+	}
+}
+
+// handleSignals removes all temporary files and exits when the program is
+// interrupted (SIGINT or SIGTERM).
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		cleanupTemp()
+		infof("Interrupted by %v. Temporary files removed.", sig)
+		code := 130
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
+		}
+		os.Exit(code)
+	}()
+}
@@ -0,0 +1,41 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCleanupTemp(t *testing.T) {
+	f, err := createTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	dir, err := createTempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := createTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed.Close()
+	if err := removeTemp(removed.Name()); err != nil {
+		t.Fatalf("Got error %q want no error", err)
+	}
+
+	cleanupTemp()
+
+	for _, path := range []string{f.Name(), dir, removed.Name()} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%q still exists after cleanup", path)
+		}
+	}
+	if n := len(tempRegistry.paths); n != 0 {
+		t.Errorf("Got %d registered paths after cleanup, want 0", n)
+	}
+}
@@ -0,0 +1,137 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jedib0t/go-pretty/table"
+)
+
+// timingStat holds the accumulated durations of a command.
+type timingStat struct {
+	calls int
+	total time.Duration
+	max   time.Duration
+}
+
+// timingRecorder records the durations of external commands and file parsing,
+// by command and by file. It is safe for concurrent use.
+type timingRecorder struct {
+	mu       sync.Mutex
+	start    time.Time
+	commands map[string]*timingStat
+	// Time spent on each file (parsing and commands using the file).
+	files map[string]time.Duration
+}
+
+// timings records durations when not nil (set by --timings).
+var timings *timingRecorder
+
+// newTimingRecorder returns a new timingRecorder.
+func newTimingRecorder() *timingRecorder {
+	return &timingRecorder{
+		start:    time.Now(),
+		commands: map[string]*timingStat{},
+		files:    map[string]time.Duration{},
+	}
+}
+
+// record adds the duration of a command. Parsing a file (command "parse")
+// registers the file, and the durations of other commands are added to all
+// registered files found in their arguments.
+func (t *timingRecorder) record(command string, args []string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stat, ok := t.commands[command]
+	if !ok {
+		stat = &timingStat{}
+		t.commands[command] = stat
+	}
+	stat.calls++
+	stat.total += d
+	if d > stat.max {
+		stat.max = d
+	}
+
+	for _, arg := range args {
+		if _, ok := t.files[arg]; ok || command == "parse" {
+			t.files[arg] += d
+		}
+	}
+}
+
+// print writes the timing summary to w: per command, per file (slowest
+// first), and the total elapsed time.
+func (t *timingRecorder) print(w io.Writer) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var commands []string
+	for c := range t.commands {
+		commands = append(commands, c)
+	}
+	sort.Strings(commands)
+
+	tab := table.NewWriter()
+	tab.SetOutputMirror(w)
+	tab.AppendHeader(table.Row{"Command", "Calls", "Total", "Average", "Max"})
+	for _, c := range commands {
+		s := t.commands[c]
+		tab.AppendRow(table.Row{c, s.calls, roundDuration(s.total), roundDuration(s.total / time.Duration(s.calls)), roundDuration(s.max)})
+	}
+	tab.Render()
+
+	var files []string
+	for f := range t.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if t.files[files[i]] != t.files[files[j]] {
+			return t.files[files[i]] > t.files[files[j]]
+		}
+		return files[i] < files[j]
+	})
+
+	if len(files) != 0 {
+		tab = table.NewWriter()
+		tab.SetOutputMirror(w)
+		tab.AppendHeader(table.Row{"File", "Total"})
+		for _, f := range files {
+			tab.AppendRow(table.Row{f, roundDuration(t.files[f])})
+		}
+		tab.Render()
+	}
+	fmt.Fprintf(w, "Total elapsed time: %v\n", roundDuration(time.Since(t.start)))
+}
+
+// roundDuration rounds durations to milliseconds, for display.
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
+
+// timedRunner is a runner that records the duration of each command.
+type timedRunner struct {
+	r runner
+}
+
+// run runs the command with the wrapped runner, recording its duration.
+func (x timedRunner) run(name string, args ...string) error {
+	start := time.Now()
+	err := x.r.run(name, args...)
+	timings.record(name, args, time.Since(start))
+	return err
+}
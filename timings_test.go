@@ -0,0 +1,46 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimingRecorder(t *testing.T) {
+	tr := newTimingRecorder()
+	tr.record("parse", []string{"a.mkv"}, 1*time.Second)
+	tr.record("parse", []string{"b.mkv"}, 3*time.Second)
+	tr.record("mkvmerge", []string{"-o", "out.mkv", "a.mkv"}, 5*time.Second)
+	tr.record("mkvpropedit", []string{"b.mkv", "--edit", "track:1"}, 2*time.Second)
+	tr.record("mkvpropedit", []string{"c.mkv"}, 4*time.Second)
+
+	wantCommands := map[string]timingStat{
+		"parse":       {calls: 2, total: 4 * time.Second, max: 3 * time.Second},
+		"mkvmerge":    {calls: 1, total: 5 * time.Second, max: 5 * time.Second},
+		"mkvpropedit": {calls: 2, total: 6 * time.Second, max: 4 * time.Second},
+	}
+	gotCommands := map[string]timingStat{}
+	for k, v := range tr.commands {
+		gotCommands[k] = *v
+	}
+	if !reflect.DeepEqual(gotCommands, wantCommands) {
+		t.Errorf("commands: got %+v, want %+v", gotCommands, wantCommands)
+	}
+
+	// Only parsed files are recorded.
+	wantFiles := map[string]time.Duration{
+		"a.mkv": 6 * time.Second,
+		"b.mkv": 5 * time.Second,
+	}
+	if !reflect.DeepEqual(tr.files, wantFiles) {
+		t.Errorf("files: got %v, want %v", tr.files, wantFiles)
+	}
+
+	// A nil recorder is a no-op.
+	var none *timingRecorder
+	none.record("parse", []string{"a.mkv"}, time.Second)
+}
@@ -0,0 +1,118 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// checkVerifiable returns an error if the streams in the file can't be
+// verified (only Matroska files are supported).
+func checkVerifiable(mkv matroska) error {
+	if mkv.Container.Type != "Matroska" {
+		return fmt.Errorf("%s: only Matroska files can be verified (container: %s)", mkv.FileName, mkv.Container.Type)
+	}
+	return nil
+}
+
+// trackHashes extracts all tracks in the file into a temporary directory and
+// returns the SHA-256 of the data of each track, by track ID (base 0). The
+// extracted files are removed after hashing.
+func trackHashes(mkv matroska, cmd runner) (map[int]string, error) {
+	if err := checkVerifiable(mkv); err != nil {
+		return nil, err
+	}
+	if len(mkv.Tracks) == 0 {
+		return map[int]string{}, nil
+	}
+
+	dir, err := createTempDir()
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(dir)
+
+	command := []string{"mkvextract", mkv.FileName, "tracks"}
+	for _, track := range mkv.Tracks {
+		command = append(command, fmt.Sprintf("%d:%s", track.ID, filepath.Join(dir, fmt.Sprintf("track%d", track.ID))))
+	}
+	if err := cmd.run(command[0], command[1:]...); err != nil {
+		return nil, err
+	}
+
+	ret := map[int]string{}
+	for _, track := range mkv.Tracks {
+		fname := filepath.Join(dir, fmt.Sprintf("track%d", track.ID))
+		f, err := os.Open(fname)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		ret[track.ID] = fmt.Sprintf("%x", h.Sum(nil))
+		// Free the disk space as soon as possible.
+		os.Remove(fname)
+	}
+	return ret, nil
+}
+
+// compareStreams matches each track in dst to a track of the same type with
+// the same data (hash) in src. Each source track is only matched once.
+// Returns a description of the dst tracks without a matching source track.
+func compareStreams(src, dst matroska, srcHashes, dstHashes map[int]string) []string {
+	used := map[int]bool{}
+	var ret []string
+
+	for _, d := range dst.Tracks {
+		found := false
+		for _, s := range src.Tracks {
+			if used[s.ID] || s.Type != d.Type || srcHashes[s.ID] != dstHashes[d.ID] {
+				continue
+			}
+			used[s.ID] = true
+			found = true
+			break
+		}
+		if !found {
+			ret = append(ret, fmt.Sprintf("track %d (%s, %s): data differs from all source tracks", d.ID, d.Type, d.Codec))
+		}
+	}
+	return ret
+}
+
+// verifyStreams checks that the data of all tracks in outfile is identical
+// to the data of the tracks in infile (E.g. after a lossless remux). Only the
+// elementary streams are compared, so changes to the container (title, tags,
+// flags) are ignored.
+func verifyStreams(infile, outfile string, cmd runner) error {
+	src, err := parseFile(infile)
+	if err != nil {
+		return err
+	}
+	dst, err := parseFile(outfile)
+	if err != nil {
+		return err
+	}
+	srcHashes, err := trackHashes(src, cmd)
+	if err != nil {
+		return err
+	}
+	dstHashes, err := trackHashes(dst, cmd)
+	if err != nil {
+		return err
+	}
+	if mismatches := compareStreams(src, dst, srcHashes, dstHashes); len(mismatches) != 0 {
+		return fmt.Errorf("stream verification failed for %s:\n%s", outfile, errorFromSlice(mismatches))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// This file is part of mkvtool (http://github.com/marcopaganini/mkvtool))
+// See instructions in the README.md file that accompanies this program.
+// (C) 2022-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareStreams(t *testing.T) {
+	src := mustUnmarshalMKV(t, `{"tracks": [
+		{"id": 0, "type": "video", "codec": "AVC"},
+		{"id": 1, "type": "audio", "codec": "AAC"},
+		{"id": 2, "type": "audio", "codec": "AAC"},
+		{"id": 3, "type": "subtitles", "codec": "SRT"}]}`)
+	srcHashes := map[int]string{0: "v", 1: "a1", 2: "a2", 3: "s"}
+
+	casetests := []struct {
+		dst       string
+		dstHashes map[int]string
+		want      []string
+	}{
+		// Identical.
+		{
+			dst: `{"tracks": [
+				{"id": 0, "type": "video", "codec": "AVC"},
+				{"id": 1, "type": "audio", "codec": "AAC"},
+				{"id": 2, "type": "audio", "codec": "AAC"},
+				{"id": 3, "type": "subtitles", "codec": "SRT"}]}`,
+			dstHashes: map[int]string{0: "v", 1: "a1", 2: "a2", 3: "s"},
+		},
+		// Dropped and reordered tracks.
+		{
+			dst: `{"tracks": [
+				{"id": 0, "type": "video", "codec": "AVC"},
+				{"id": 1, "type": "audio", "codec": "AAC"}]}`,
+			dstHashes: map[int]string{0: "v", 1: "a2"},
+		},
+		// Re-encoded audio.
+		{
+			dst: `{"tracks": [
+				{"id": 0, "type": "video", "codec": "AVC"},
+				{"id": 1, "type": "audio", "codec": "Opus"}]}`,
+			dstHashes: map[int]string{0: "v", 1: "x"},
+			want:      []string{"track 1 (audio, Opus): data differs from all source tracks"},
+		},
+		// Each source track can only be matched once.
+		{
+			dst: `{"tracks": [
+				{"id": 0, "type": "audio", "codec": "AAC"},
+				{"id": 1, "type": "audio", "codec": "AAC"}]}`,
+			dstHashes: map[int]string{0: "a1", 1: "a1"},
+			want:      []string{"track 1 (audio, AAC): data differs from all source tracks"},
+		},
+	}
+
+	for _, tt := range casetests {
+		dst := mustUnmarshalMKV(t, tt.dst)
+		if got := compareStreams(src, dst, srcHashes, tt.dstHashes); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Got %q, want %q", got, tt.want)
+		}
+	}
+}